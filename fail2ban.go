@@ -3,28 +3,92 @@ package fail2ban
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/tomMoulard/fail2ban/pkg/chain"
+	"github.com/tomMoulard/fail2ban/pkg/challenge"
+	"github.com/tomMoulard/fail2ban/pkg/events"
+	"github.com/tomMoulard/fail2ban/pkg/export"
 	"github.com/tomMoulard/fail2ban/pkg/fail2ban"
 	f2bHandler "github.com/tomMoulard/fail2ban/pkg/fail2ban/handler"
+	"github.com/tomMoulard/fail2ban/pkg/geoip"
 	"github.com/tomMoulard/fail2ban/pkg/ipchecking"
 	lAllow "github.com/tomMoulard/fail2ban/pkg/list/allow"
+	lCrowdSec "github.com/tomMoulard/fail2ban/pkg/list/crowdsec"
 	lDeny "github.com/tomMoulard/fail2ban/pkg/list/deny"
 	"github.com/tomMoulard/fail2ban/pkg/logger"
-	"github.com/tomMoulard/fail2ban/pkg/response/status"
 	"github.com/tomMoulard/fail2ban/pkg/rules"
 	uAllow "github.com/tomMoulard/fail2ban/pkg/url/allow"
+	uCount "github.com/tomMoulard/fail2ban/pkg/url/count"
 	uDeny "github.com/tomMoulard/fail2ban/pkg/url/deny"
+	uTrap "github.com/tomMoulard/fail2ban/pkg/url/trap"
+	utime "github.com/tomMoulard/fail2ban/pkg/utils/time"
+	"github.com/tomMoulard/fail2ban/pkg/webhook"
 )
 
 // List struct.
 type List struct {
-	IP    []string
-	Files []string
+	IP      []string
+	Files   []string
+	Entries []ListEntry
+	// ExpiryHorizon enables a periodic report of the entries expiring within
+	// this duration (e.g. "24h").
+	ExpiryHorizon string
+	// Action applied to the requests matching the list: block (default),
+	// observe, tighten or delay. Only supported on the denylist.
+	Action string
+	// Delay applied with the delay action (e.g. "2s").
+	Delay string
+	// Hostnames allows the clients whose IP is verified to belong to the
+	// hostnames. Only supported on the allowlist.
+	Hostnames Hostnames
+	// CrowdSec denies the IPs banned by a CrowdSec local API. Only supported
+	// on the denylist.
+	CrowdSec CrowdSec
+}
+
+// CrowdSec struct, polls the decisions stream of a CrowdSec local API (bouncer
+// mode), keeping the banned IPs and ranges next to the denylist entries.
+// Enabled when the URL is set.
+type CrowdSec struct {
+	// URL of the local API (e.g. "http://crowdsec:8080").
+	URL string `yaml:"url"`
+	// APIKey of the bouncer (cscli bouncers add).
+	APIKey string `yaml:"apiKey"`
+	// Interval between two polls, defaults to 10s.
+	Interval string `yaml:"interval"`
+	// Timeout of a poll, defaults to 5s.
+	Timeout string `yaml:"timeout"`
+}
+
+// Hostnames struct, the client IP is verified with a reverse DNS lookup
+// matching one of the suffixes, confirmed by a forward lookup.
+type Hostnames struct {
+	// Suffixes of the allowed hostnames (e.g. ".googlebot.com").
+	Suffixes []string `yaml:"suffixes"`
+	// TTL of the positive verifications, defaults to 1h.
+	TTL string `yaml:"ttl"`
+	// NegativeTTL of the negative verifications, defaults to 5m.
+	NegativeTTL string `yaml:"negativeTTL"`
+}
+
+// ListEntry is an annotated, optionally time-limited, list entry.
+type ListEntry struct {
+	IP string `yaml:"ip"`
+	// Expires is either a RFC3339 timestamp (e.g. "2024-06-01T00:00:00Z"), or
+	// a duration relative to the time the entry was first loaded (e.g. "72h").
+	Expires string `yaml:"expires"`
+	// Note is the reason, or ticket, of the entry.
+	Note string `yaml:"note"`
+	// Action overrides the list action.
+	Action string `yaml:"action"`
+	// Delay overrides the list delay.
+	Delay string `yaml:"delay"`
 }
 
 // SourceCriterion defines how to determine the client IP for fail2ban evaluation.
@@ -35,6 +99,85 @@ type SourceCriterion struct {
 	RequestHeaderName string `yaml:"requestHeaderName"`
 }
 
+// GeoIP struct, the MaxMind DB files used to resolve the "country:XX" and
+// "asn:AS12345" list entries.
+type GeoIP struct {
+	// Files are the .mmdb files (e.g. GeoLite2-Country and GeoLite2-ASN).
+	Files []string `yaml:"files"`
+	// ReloadInterval is the interval between two checks for file changes,
+	// defaults to 1m.
+	ReloadInterval string `yaml:"reloadInterval"`
+}
+
+// Challenge struct, the banned clients are served a proof-of-work page instead
+// of a 429: the ones solving it with JavaScript get their ban lifted, their
+// failures forgotten, and a signed cookie lifting their older bans.
+type Challenge struct {
+	Enabled bool `yaml:"enabled"`
+	// Secret signs the puzzles and cookies.
+	Secret string `yaml:"secret"`
+	// Difficulty is the number of leading zero bits of the solutions hash,
+	// defaults to 16 when unset, 0 accepting any solution.
+	Difficulty *int `yaml:"difficulty"`
+	// TTL is the validity of the cookies, defaults to 1h.
+	TTL string `yaml:"ttl"`
+	// CookieName defaults to "fail2ban_challenge".
+	CookieName string `yaml:"cookieName"`
+	// Path receives the solutions, defaults to "/.fail2ban/challenge".
+	Path string `yaml:"path"`
+}
+
+// Webhook struct, posts the ban events to a URL.
+type Webhook struct {
+	URL string `yaml:"url"`
+	// Template is the Go template of the JSON payload, the JSON of the event
+	// when empty.
+	Template string `yaml:"template"`
+	// Secret signs the requests when set.
+	Secret string `yaml:"secret"`
+	// Events are the types of events sent (ban, unban, expire, static_block
+	// or failure), all but failure when empty.
+	Events []string `yaml:"events"`
+	// Retries of a failed delivery, defaults to 3 when unset, 0 disabling
+	// them.
+	Retries *int `yaml:"retries"`
+	// Backoff is the delay before the first retry, doubled on each retry,
+	// defaults to 1s.
+	Backoff string `yaml:"backoff"`
+	// Timeout of a request, defaults to 5s.
+	Timeout string `yaml:"timeout"`
+	// QueueSize is the number of events waiting to be sent, defaults to 1000.
+	QueueSize int `yaml:"queueSize"`
+}
+
+// Export struct, writes the banned IPs to a file periodically, for the host
+// firewall to load them. Enabled when the path is set.
+type Export struct {
+	Path string `yaml:"path"`
+	// Format is nftables, ipset or cidr.
+	Format string `yaml:"format"`
+	// Interval between two exports, defaults to 10s.
+	Interval string `yaml:"interval"`
+	// Table is the nftables table, defaults to "fail2ban".
+	Table string `yaml:"table"`
+	// Set is the prefix of the sets, defaults to "fail2ban".
+	Set string `yaml:"set"`
+	// DangerouslyExportHeaderIPs allows the export when the client IP is read
+	// from a request header (see SourceCriterion): a forged header would get
+	// any IP blocked by the host firewall.
+	DangerouslyExportHeaderIPs bool `yaml:"dangerouslyExportHeaderIPs"`
+}
+
+// Fail2banLog struct, writes the failures and bans to a log file, for the host
+// fail2ban to read it. Enabled when the path is set.
+type Fail2banLog struct {
+	Path string `yaml:"path"`
+	// MaxSize is the size in megabytes rotating the file, defaults to 10.
+	MaxSize int `yaml:"maxSize"`
+	// MaxBackups is the number of rotated files kept, defaults to 3.
+	MaxBackups int `yaml:"maxBackups"`
+}
+
 // Config struct.
 type Config struct {
 	Denylist        List            `yaml:"denylist"`
@@ -42,6 +185,16 @@ type Config struct {
 	Rules           rules.Rules     `yaml:"port"`
 	SourceCriterion SourceCriterion `yaml:"sourceCriterion"`
 	EnableBlockLogs bool            `yaml:"enableBlockLogs"`
+	GeoIP           GeoIP           `yaml:"geoip"`
+	Challenge       Challenge       `yaml:"challenge"`
+	Webhooks        []Webhook       `yaml:"webhooks"`
+	Export          Export          `yaml:"export"`
+	Fail2banLog     Fail2banLog     `yaml:"fail2banLog"`
+	// Mode of every handler, enforce (default) or shadow. The rules mode
+	// overrides it for the jail.
+	Mode string `yaml:"mode"`
+	// Strict rejects suspicious but legal values (see Validate).
+	Strict bool `yaml:"strict"`
 
 	// deprecated
 	Blacklist List `yaml:"blacklist"`
@@ -82,15 +235,273 @@ func ImportIP(list List) ([]string, error) {
 	return rlist, nil
 }
 
+// ImportEntries extract all denylist entries from config sources.
+func ImportEntries(list List) ([]lDeny.Entry, error) {
+	ips, err := ImportIP(list)
+	if err != nil {
+		return nil, err
+	}
+
+	delay, err := parseDelay(list.Delay)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := lDeny.Entries(ips)
+	for i := range entries {
+		entries[i].Action = list.Action
+		entries[i].Delay = delay
+	}
+
+	for _, e := range list.Entries {
+		expires, ttl, err := lDeny.ParseExpires(e.Expires)
+		if err != nil {
+			return nil, fmt.Errorf("invalid entry %q: %w", e.IP, err)
+		}
+
+		entry := lDeny.Entry{IP: e.IP, Expires: expires, TTL: ttl, Note: e.Note, Action: list.Action, Delay: delay}
+
+		if e.Action != "" {
+			entry.Action = e.Action
+		}
+
+		if e.Delay != "" {
+			entry.Delay, err = parseDelay(e.Delay)
+			if err != nil {
+				return nil, fmt.Errorf("invalid entry %q: %w", e.IP, err)
+			}
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+func parseDelay(delay string) (time.Duration, error) {
+	if delay == "" {
+		return 0, nil
+	}
+
+	d, err := time.ParseDuration(delay)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse delay: %w", err)
+	}
+
+	return d, nil
+}
+
+func newHostnames(h Hostnames, resolver lAllow.Resolver) (*lAllow.Hostnames, error) {
+	ttl := time.Hour
+	negativeTTL := 5 * time.Minute
+
+	var err error
+
+	if h.TTL != "" {
+		ttl, err = time.ParseDuration(h.TTL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse ttl: %w", err)
+		}
+	}
+
+	if h.NegativeTTL != "" {
+		negativeTTL, err = time.ParseDuration(h.NegativeTTL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse negative ttl: %w", err)
+		}
+	}
+
+	return lAllow.NewHostnames(h.Suffixes, resolver, ttl, negativeTTL), nil
+}
+
+func openGeoIP(ctx context.Context, config GeoIP) (*geoip.DB, error) {
+	interval := time.Minute
+
+	if config.ReloadInterval != "" {
+		var err error
+
+		interval, err = time.ParseDuration(config.ReloadInterval)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse reload interval: %w", err)
+		}
+	}
+
+	db, err := geoip.Open(config.Files)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open files: %w", err)
+	}
+
+	go db.Watch(ctx, interval)
+
+	return db, nil
+}
+
+// requiresGeoIP returns whether any entry is a geoip selector.
+func requiresGeoIP(entries []lDeny.Entry) bool {
+	for _, e := range entries {
+		if _, ok, _ := geoip.ParseSelector(e.IP); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// requiresTighten returns whether any entry uses the tighten action.
+func requiresTighten(entries []lDeny.Entry) bool {
+	for _, e := range entries {
+		if e.Action == lDeny.ActionTighten {
+			return true
+		}
+	}
+
+	return false
+}
+
+// withMode returns the handler in shadow mode when shadow is set.
+func withMode(handler chain.ChainHandler, shadow bool) chain.ChainHandler {
+	if shadow {
+		return chain.Shadow(handler)
+	}
+
+	return handler
+}
+
+func newWebhook(config Webhook) (*webhook.Webhook, error) {
+	backoff, err := parseDelay(config.Backoff)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse backoff: %w", err)
+	}
+
+	timeout, err := parseDelay(config.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse timeout: %w", err)
+	}
+
+	types := make([]events.Type, 0, len(config.Events))
+	for _, t := range config.Events {
+		types = append(types, events.Type(t))
+	}
+
+	w, err := webhook.New(webhook.Config{
+		URL:       config.URL,
+		Template:  config.Template,
+		Secret:    []byte(config.Secret),
+		Events:    types,
+		Retries:   config.Retries,
+		Backoff:   backoff,
+		Timeout:   timeout,
+		QueueSize: config.QueueSize,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create webhook: %w", err)
+	}
+
+	return w, nil
+}
+
+func newExporter(config Export) (*export.Exporter, error) {
+	interval, err := parseDelay(config.Interval)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse interval: %w", err)
+	}
+
+	e, err := export.Open(export.Config{
+		Path:     config.Path,
+		Format:   config.Format,
+		Interval: interval,
+		Table:    config.Table,
+		Set:      config.Set,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create exporter: %w", err)
+	}
+
+	return e, nil
+}
+
+func newCrowdSec(config CrowdSec) (*lCrowdSec.Stream, error) {
+	interval, err := parseDelay(config.Interval)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse crowdsec interval: %w", err)
+	}
+
+	timeout, err := parseDelay(config.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse crowdsec timeout: %w", err)
+	}
+
+	stream, err := lCrowdSec.Open(lCrowdSec.Config{
+		URL:      config.URL,
+		APIKey:   config.APIKey,
+		Interval: interval,
+		Timeout:  timeout,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create crowdsec stream: %w", err)
+	}
+
+	return stream, nil
+}
+
+// Defaults of the fail2ban log.
+const (
+	defaultFail2banLogMaxSize    = 10
+	defaultFail2banLogMaxBackups = 3
+)
+
+func newFail2banLog(config Fail2banLog) (*logger.Fail2ban, error) {
+	maxSize := config.MaxSize
+	if maxSize == 0 {
+		maxSize = defaultFail2banLogMaxSize
+	}
+
+	maxBackups := config.MaxBackups
+	if maxBackups == 0 {
+		maxBackups = defaultFail2banLogMaxBackups
+	}
+
+	file, err := logger.OpenFile(config.Path, int64(maxSize)<<20, maxBackups)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create fail2ban log: %w", err)
+	}
+
+	return logger.NewFail2ban(file), nil
+}
+
+func newChallenge(config Challenge, f2b *fail2ban.Fail2Ban, enableBlockLogs bool) (*challenge.Challenge, error) {
+	ttl, err := parseDelay(config.TTL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse ttl: %w", err)
+	}
+
+	c, err := challenge.New(challenge.Config{
+		Secret:     []byte(config.Secret),
+		Difficulty: config.Difficulty,
+		TTL:        ttl,
+		CookieName: config.CookieName,
+		Path:       config.Path,
+	}, f2b, enableBlockLogs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create challenge: %w", err)
+	}
+
+	return c, nil
+}
+
 // New instantiates and returns the required components used to handle a HTTP
 // request.
-func New(_ context.Context, next http.Handler, config *Config, _ string) (http.Handler, error) {
+func New(ctx context.Context, next http.Handler, config *Config, name string) (http.Handler, error) {
 	if !config.Rules.Enabled {
 		logger.Info("Plugin: FailToBan is disabled")
 
 		return next, nil
 	}
 
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
 	allowIPs, err := ImportIP(config.Allowlist)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse allowlist IPs: %w", err)
@@ -107,7 +518,13 @@ func New(_ context.Context, next http.Handler, config *Config, _ string) (http.H
 		allowIPs = append(allowIPs, whiteips...)
 	}
 
-	allowNetIPs, err := ipchecking.ParseNetIPs(allowIPs)
+	// The geoip selectors are handled by the allowlist handler only.
+	allowOnlyIPs, allowSelectors, err := geoip.Split(allowIPs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse allowlist IPs: %w", err)
+	}
+
+	allowNetIPs, err := ipchecking.ParseNetIPs(allowOnlyIPs)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse allowlist IPs: %w", err)
 	}
@@ -117,7 +534,7 @@ func New(_ context.Context, next http.Handler, config *Config, _ string) (http.H
 		return nil, fmt.Errorf("failed to parse allowlist IPs: %w", err)
 	}
 
-	denyIPs, err := ImportIP(config.Denylist)
+	denyEntries, err := ImportEntries(config.Denylist)
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse denylist IPs: %w", err)
 	}
@@ -130,12 +547,36 @@ func New(_ context.Context, next http.Handler, config *Config, _ string) (http.H
 			return nil, fmt.Errorf("failed to parse blacklist IPs: %w", err)
 		}
 
-		denyIPs = append(denyIPs, blackips...)
+		denyEntries = append(denyEntries, lDeny.Entries(blackips)...)
 	}
 
-	denyHandler, err := lDeny.New(denyIPs, config.EnableBlockLogs)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse denylist IPs: %w", err)
+	// The entries expiring after a duration are anchored to the time the jail
+	// first loaded them.
+	loaded := jailLoaded(name)
+	denyEntries = loaded.Anchor(denyEntries, utime.Now())
+
+	shadow := config.Mode == rules.ModeShadow
+
+	jailShadow := shadow
+	if config.Rules.Mode != "" {
+		jailShadow = config.Rules.Mode == rules.ModeShadow
+	}
+
+	// The shadow mode always logs the requests it would block.
+	blockLogs := config.EnableBlockLogs || shadow
+	jailBlockLogs := config.EnableBlockLogs || jailShadow
+
+	var horizon time.Duration
+
+	if config.Denylist.ExpiryHorizon != "" {
+		horizon, err = time.ParseDuration(config.Denylist.ExpiryHorizon)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse denylist expiry horizon: %w", err)
+		}
+	}
+
+	if len(config.GeoIP.Files) == 0 && (len(allowSelectors) > 0 || requiresGeoIP(denyEntries)) {
+		return nil, errors.New("lists use country or asn entries, but no geoip files are configured")
 	}
 
 	rules, err := rules.TransformRule(config.Rules)
@@ -143,25 +584,84 @@ func New(_ context.Context, next http.Handler, config *Config, _ string) (http.H
 		return nil, fmt.Errorf("error when Transforming rules: %w", err)
 	}
 
-	f2b := fail2ban.New(rules, allowNetIPs)
+	if rules.Tightened == nil && requiresTighten(denyEntries) {
+		return nil, errors.New("denylist uses the tighten action, but no tighten rules are configured")
+	}
 
-	c := chain.New(
-		next,
-		config.SourceCriterion.RequestHeaderName,
-		denyHandler,
-		allowHandler,
-		uDeny.New(rules.URLRegexpBan, f2b, config.EnableBlockLogs),
-		uAllow.New(rules.URLRegexpAllow),
-		f2bHandler.New(f2b, config.EnableBlockLogs),
-	)
+	j, err := openJail(ctx, name, config, func(ctx context.Context) (*jail, error) {
+		j, err := newJail(ctx, name, config, rules, allowNetIPs, allowSelectors, jailShadow)
+		if err != nil {
+			return nil, err
+		}
 
-	if rules.StatusCode != "" {
-		statusCodeHandler, err := status.New(next, rules.StatusCode, f2b, config.EnableBlockLogs)
+		// The denylist is shared by the instances too, publishing the static
+		// blocks of an IP once per interval.
+		denyHandler, err := lDeny.New(denyEntries, blockLogs)
 		if err != nil {
-			return nil, fmt.Errorf("failed to create status handler: %w", err)
+			return nil, fmt.Errorf("failed to parse denylist IPs: %w", err)
 		}
 
-		c.WithStatus(statusCodeHandler)
+		denyHandler.WithEvents(j.bus)
+		j.deny = denyHandler
+		j.loaded = loaded
+
+		if config.Denylist.CrowdSec.URL != "" {
+			stream, err := newCrowdSec(config.Denylist.CrowdSec)
+			if err != nil {
+				return nil, err
+			}
+
+			denyHandler.WithSet(stream.Set())
+			stream.Start(ctx)
+		}
+
+		if horizon > 0 {
+			go denyHandler.ReportExpiring(ctx, horizon)
+		}
+
+		return j, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	f2b := j.f2b
+
+	if j.hostnames != nil {
+		// The hostnames are only verified for the IPs the jail counts against,
+		// sparing the DNS lookups to the other requests.
+		allowHandler.WithHostnames(j.hostnames, f2b.Suspected)
+	}
+
+	handlers := []chain.ChainHandler{withMode(j.deny, shadow), allowHandler}
+
+	if j.credential != nil {
+		handlers = append(handlers, withMode(j.credential, jailShadow))
+	}
+
+	handlers = append(handlers,
+		withMode(uTrap.New(rules.URLTraps, f2b, jailBlockLogs), jailShadow),
+		withMode(uDeny.New(rules.URLRegexpBan, f2b, jailBlockLogs), jailShadow),
+		uAllow.New(rules.URLRegexpAllow),
+		withMode(uCount.New(rules.URLRegexpCount, f2b, jailBlockLogs), jailShadow),
+	)
+
+	if j.challenge != nil {
+		handlers = append(handlers, withMode(j.challenge, jailShadow))
+	}
+
+	handlers = append(handlers, withMode(f2bHandler.New(f2b, jailBlockLogs), jailShadow))
+
+	c := chain.New(next, config.SourceCriterion.RequestHeaderName, handlers...)
+
+	if j.geoip != nil {
+		c.WithGeoIP(j.geoip)
+	}
+
+	c.WithDelayed(j.delayed)
+
+	if j.status != nil {
+		c.WithStatus(j.status.WithNext(next))
 	}
 
 	return c, nil
@@ -1,22 +1,41 @@
 package fail2ban
 
 import (
+	"crypto/sha256"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/tomMoulard/fail2ban/pkg/events"
 	"github.com/tomMoulard/fail2ban/pkg/rules"
+	"github.com/tomMoulard/fail2ban/pkg/webhook"
 	"golang.org/x/net/websocket"
 )
 
+// jails counts the jails created by the tests, the state of the jails being
+// kept by name.
+var testJails atomic.Int64
+
+// jailName returns a name unique to the test run.
+func jailName(t *testing.T) string {
+	t.Helper()
+
+	return fmt.Sprintf("%s#%d", t.Name(), testJails.Add(1))
+}
+
 func TestDummy(t *testing.T) {
 	t.Parallel()
 
@@ -214,8 +233,59 @@ func TestFail2Ban(t *testing.T) {
 					},
 				},
 			},
-			newError:     false,
-			expectStatus: http.StatusOK, // request not denylisted
+			newError: true,
+		},
+		{
+			name: "invalid count weight",
+			url:  "/test",
+			cfg: &Config{
+				Rules: rules.Rules{
+					Enabled:  true,
+					Bantime:  "300s",
+					Findtime: "300s",
+					Maxretry: 10,
+					Urlregexps: []rules.Urlregexp{
+						{
+							Regexp: "/test",
+							Mode:   "count",
+							Weight: -1,
+						},
+					},
+				},
+			},
+			newError: true,
+		},
+		{
+			name: "invalid status code weight",
+			cfg: &Config{
+				Rules: rules.Rules{
+					Enabled:    true,
+					Bantime:    "300s",
+					Findtime:   "300s",
+					Maxretry:   10,
+					StatusCode: "400-499",
+					StatusCodeWeights: []rules.StatusCodeWeight{
+						{Codes: "404", Weight: 0},
+					},
+				},
+			},
+			newError: true,
+		},
+		{
+			name: "invalid status code weight codes",
+			cfg: &Config{
+				Rules: rules.Rules{
+					Enabled:    true,
+					Bantime:    "300s",
+					Findtime:   "300s",
+					Maxretry:   10,
+					StatusCode: "400-499",
+					StatusCodeWeights: []rules.StatusCodeWeight{
+						{Codes: "4xx", Weight: 2},
+					},
+				},
+			},
+			newError: true,
 		},
 		{
 			name: "url allowlisted",
@@ -289,6 +359,69 @@ func TestFail2Ban(t *testing.T) {
 			newError:     false,
 			expectStatus: http.StatusTooManyRequests,
 		},
+		{
+			name: "denylist entry",
+			cfg: &Config{
+				Rules: rules.Rules{
+					Enabled:  true,
+					Bantime:  "300s",
+					Findtime: "300s",
+					Maxretry: 20,
+				},
+				Denylist: List{
+					Entries: []ListEntry{{IP: remoteAddr, Expires: "2999-01-01T00:00:00Z", Note: "INC-42"}},
+				},
+			},
+			newError:     false,
+			expectStatus: http.StatusTooManyRequests,
+		},
+		{
+			name: "expired denylist entry",
+			cfg: &Config{
+				Rules: rules.Rules{
+					Enabled:  true,
+					Bantime:  "300s",
+					Findtime: "300s",
+					Maxretry: 20,
+				},
+				Denylist: List{
+					Entries: []ListEntry{{IP: remoteAddr, Expires: "2021-01-01T00:00:00Z", Note: "INC-42"}},
+				},
+			},
+			newError:     false,
+			expectStatus: http.StatusOK,
+		},
+		{
+			name: "invalid denylist entry expiry",
+			cfg: &Config{
+				Rules: rules.Rules{
+					Enabled:  true,
+					Bantime:  "300s",
+					Findtime: "300s",
+					Maxretry: 20,
+				},
+				Denylist: List{
+					Entries: []ListEntry{{IP: remoteAddr, Expires: "tomorrow"}},
+				},
+			},
+			newError: true,
+		},
+		{
+			name: "duration denylist entry expiry",
+			cfg: &Config{
+				Rules: rules.Rules{
+					Enabled:  true,
+					Bantime:  "300s",
+					Findtime: "300s",
+					Maxretry: 20,
+				},
+				Denylist: List{
+					Entries: []ListEntry{{IP: remoteAddr, Expires: "72h"}},
+				},
+			},
+			newError:     false,
+			expectStatus: http.StatusTooManyRequests,
+		},
 	}
 
 	for _, test := range tests {
@@ -301,7 +434,7 @@ func TestFail2Ban(t *testing.T) {
 				nextCount.Add(1)
 			})
 
-			handler, err := New(t.Context(), next, test.cfg, "fail2ban_test")
+			handler, err := New(t.Context(), next, test.cfg, jailName(t))
 			if err != nil {
 				if test.newError != (err != nil) {
 					t.Errorf("newError: wanted '%t' got '%t'", test.newError, err != nil)
@@ -327,6 +460,940 @@ func TestFail2Ban(t *testing.T) {
 	}
 }
 
+func TestDenylistActions(t *testing.T) {
+	t.Parallel()
+
+	const remoteIP = "192.0.2.10"
+
+	tests := []struct {
+		name         string
+		denylist     List
+		tighten      *rules.Tighten
+		newError     bool
+		expectStatus []int
+	}{
+		{
+			name:         "observe",
+			denylist:     List{IP: []string{remoteIP}, Action: "observe"},
+			expectStatus: []int{http.StatusBadRequest, http.StatusBadRequest, http.StatusBadRequest},
+		},
+		{
+			name:         "tighten",
+			denylist:     List{IP: []string{remoteIP}, Action: "tighten"},
+			tighten:      &rules.Tighten{Maxretry: 2},
+			expectStatus: []int{http.StatusBadRequest, http.StatusTooManyRequests, http.StatusTooManyRequests},
+		},
+		{
+			name: "entry overrides list action",
+			denylist: List{
+				Action:  "observe",
+				Entries: []ListEntry{{IP: remoteIP, Action: "delay", Delay: "1ms"}},
+			},
+			expectStatus: []int{http.StatusBadRequest, http.StatusBadRequest, http.StatusBadRequest},
+		},
+		{
+			name:     "tighten without tighten rules",
+			denylist: List{IP: []string{remoteIP}, Action: "tighten"},
+			newError: true,
+		},
+		{
+			name:     "unknown action",
+			denylist: List{IP: []string{remoteIP}, Action: "tarpit"},
+			newError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			cfg := CreateConfig()
+			cfg.Rules.Maxretry = 20
+			cfg.Rules.StatusCode = "400-499"
+			cfg.Rules.Tighten = test.tighten
+			cfg.Denylist = test.denylist
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusBadRequest)
+			})
+
+			handler, err := New(t.Context(), next, cfg, jailName(t))
+			if test.newError {
+				require.Error(t, err)
+
+				return
+			}
+
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = remoteIP + ":1234"
+
+			for i, expected := range test.expectStatus {
+				rw := httptest.NewRecorder()
+				handler.ServeHTTP(rw, req)
+				assert.Equal(t, expected, rw.Code, "request [%d] code", i)
+			}
+		})
+	}
+}
+
+func TestGeoIP(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name          string
+		cfg           func(cfg *Config)
+		remoteIP      string
+		newError      bool
+		expectedCodes []int
+	}{
+		{
+			name: "denied country",
+			cfg: func(cfg *Config) {
+				cfg.GeoIP.Files = []string{"tests/test-geoip.mmdb"}
+				cfg.Denylist.IP = []string{"country:FR"}
+			},
+			remoteIP:      "192.0.2.1",
+			expectedCodes: []int{http.StatusTooManyRequests, http.StatusTooManyRequests, http.StatusTooManyRequests},
+		},
+		{
+			name: "other country",
+			cfg: func(cfg *Config) {
+				cfg.GeoIP.Files = []string{"tests/test-geoip.mmdb"}
+				cfg.Denylist.IP = []string{"country:FR"}
+			},
+			remoteIP:      "198.51.100.1",
+			expectedCodes: []int{http.StatusBadRequest, http.StatusTooManyRequests, http.StatusTooManyRequests},
+		},
+		{
+			name: "allowed asn is not banned",
+			cfg: func(cfg *Config) {
+				cfg.GeoIP.Files = []string{"tests/test-geoip.mmdb"}
+				cfg.Allowlist.IP = []string{"asn:AS64496"}
+			},
+			remoteIP:      "198.51.100.1",
+			expectedCodes: []int{http.StatusBadRequest, http.StatusBadRequest, http.StatusBadRequest},
+		},
+		{
+			name: "selector without geoip files",
+			cfg: func(cfg *Config) {
+				cfg.Denylist.IP = []string{"asn:AS64496"}
+			},
+			newError: true,
+		},
+		{
+			name: "missing geoip file",
+			cfg: func(cfg *Config) {
+				cfg.GeoIP.Files = []string{"tests/idontexist.mmdb"}
+			},
+			newError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			cfg := CreateConfig()
+			cfg.Rules.Bantime = "300s"
+			cfg.Rules.Findtime = "300s"
+			cfg.Rules.Maxretry = 2
+			cfg.Rules.StatusCode = "400-499"
+			test.cfg(cfg)
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusBadRequest)
+			})
+
+			handler, err := New(t.Context(), next, cfg, jailName(t))
+			if test.newError {
+				require.Error(t, err)
+
+				return
+			}
+
+			require.NoError(t, err)
+
+			for i, expectedCode := range test.expectedCodes {
+				req := httptest.NewRequest(http.MethodGet, "/", nil)
+				req.RemoteAddr = test.remoteIP + ":1234"
+
+				rw := httptest.NewRecorder()
+				handler.ServeHTTP(rw, req)
+
+				assert.Equal(t, expectedCode, rw.Code, "request [%d] code", i)
+			}
+		})
+	}
+}
+
+func TestTrap(t *testing.T) {
+	t.Parallel()
+
+	cfg := CreateConfig()
+	cfg.Rules.Maxretry = 10
+	cfg.Rules.Urlregexps = []rules.Urlregexp{
+		{
+			Path: `^/admin\.php$`,
+			Mode: "trap",
+			Trap: rules.Trap{
+				Bantime: "72h",
+				Body:    "<form>login</form>",
+			},
+		},
+	}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	handler, err := New(t.Context(), next, cfg, jailName(t))
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+
+	trapReq := httptest.NewRequest(http.MethodGet, "/admin.php", nil)
+	trapReq.RemoteAddr = "192.0.2.1:1234"
+
+	// The trap answers the decoy, even once banned.
+	for range 2 {
+		rw = httptest.NewRecorder()
+		handler.ServeHTTP(rw, trapReq)
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.Equal(t, "<form>login</form>", rw.Body.String())
+		assert.Equal(t, "text/html; charset=utf-8", rw.Header().Get("Content-Type"))
+	}
+
+	rw = httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+}
+
+func TestCredentialStuffing(t *testing.T) {
+	t.Parallel()
+
+	cfg := CreateConfig()
+	cfg.Rules.Maxretry = 10
+	cfg.Rules.CredentialStuffing = &rules.CredentialStuffing{
+		Routes:    []rules.Urlregexp{{Method: "^POST$", Path: "^/login$"}},
+		FormField: "username",
+		Threshold: 3,
+		Locktime:  "1h",
+	}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+
+		if r.PostForm.Get("password") != "right" {
+			w.WriteHeader(http.StatusUnauthorized)
+
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	})
+
+	handler, err := New(t.Context(), next, cfg, jailName(t))
+	require.NoError(t, err)
+
+	login := func(remoteIP, body string) int {
+		req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = remoteIP + ":1234"
+
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+
+		return rw.Code
+	}
+
+	// A botnet tries the same username from many IPs.
+	assert.Equal(t, http.StatusUnauthorized, login("192.0.2.1", "username=alice&password=a"))
+	assert.Equal(t, http.StatusUnauthorized, login("192.0.2.2", "username=alice&password=b"))
+	assert.Equal(t, http.StatusUnauthorized, login("192.0.2.3", "username=alice&password=c"))
+
+	// The username is locked, even with the right password.
+	assert.Equal(t, http.StatusTooManyRequests, login("192.0.2.4", "username=alice&password=right"))
+	assert.Equal(t, http.StatusOK, login("192.0.2.4", "username=bob&password=right"))
+}
+
+func TestSuccess(t *testing.T) {
+	t.Parallel()
+
+	cfg := CreateConfig()
+	cfg.Rules.Maxretry = 3
+	cfg.Rules.StatusCode = "401"
+	cfg.Rules.Success = &rules.Success{
+		Routes:     []rules.Urlregexp{{Path: "^/login$"}},
+		StatusCode: "200-299",
+	}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("password") != "right" {
+			w.WriteHeader(http.StatusUnauthorized)
+
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	})
+
+	handler, err := New(t.Context(), next, cfg, jailName(t))
+	require.NoError(t, err)
+
+	login := func(password string) int {
+		req := httptest.NewRequest(http.MethodGet, "/login?password="+password, nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+
+		return rw.Code
+	}
+
+	// Two typos, then a successful login.
+	assert.Equal(t, http.StatusUnauthorized, login("wrong"))
+	assert.Equal(t, http.StatusUnauthorized, login("wrong"))
+	assert.Equal(t, http.StatusOK, login("right"))
+
+	// The counter starts over.
+	assert.Equal(t, http.StatusUnauthorized, login("wrong"))
+	assert.Equal(t, http.StatusUnauthorized, login("wrong"))
+	assert.Equal(t, http.StatusTooManyRequests, login("wrong"))
+	assert.Equal(t, http.StatusTooManyRequests, login("right"))
+}
+
+func TestResponseFailures(t *testing.T) {
+	t.Parallel()
+
+	cfg := CreateConfig()
+	cfg.Rules.Maxretry = 2
+	cfg.Rules.ResponseFailures = &rules.ResponseFailures{
+		Matchers: []rules.ResponseMatcher{
+			{StatusCode: "200", Body: `"error":"invalid_credentials"`},
+			{Headers: []rules.HeaderRegexp{{Name: "X-Auth-Result", Regexp: "^fail$"}}, Weight: 2},
+		},
+	}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("password") {
+		case "right":
+			_, _ = w.Write([]byte(`{"token":"abc"}`))
+		case "locked":
+			w.Header().Set("X-Auth-Result", "fail")
+			w.WriteHeader(http.StatusOK)
+		default:
+			_, _ = w.Write([]byte(`{"error":"invalid_credentials"}`))
+		}
+	})
+
+	handler, err := New(t.Context(), next, cfg, jailName(t))
+	require.NoError(t, err)
+
+	login := func(remoteIP, password string) int {
+		req := httptest.NewRequest(http.MethodPost, "/login?password="+password, nil)
+		req.RemoteAddr = remoteIP + ":1234"
+
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+
+		return rw.Code
+	}
+
+	assert.Equal(t, http.StatusOK, login("192.0.2.1", "right"))
+	assert.Equal(t, http.StatusOK, login("192.0.2.1", "wrong"))
+	assert.Equal(t, http.StatusTooManyRequests, login("192.0.2.1", "wrong"))
+	assert.Equal(t, http.StatusTooManyRequests, login("192.0.2.1", "right"))
+
+	// The header failure weights 2.
+	assert.Equal(t, http.StatusOK, login("192.0.2.2", "right"))
+	assert.Equal(t, http.StatusTooManyRequests, login("192.0.2.2", "locked"))
+}
+
+func TestStatusCodeBuckets(t *testing.T) {
+	t.Parallel()
+
+	cfg := CreateConfig()
+	cfg.Rules.Maxretry = 100
+	cfg.Rules.StatusCodes = []rules.StatusCodeBucket{
+		{Codes: "401,403", MaxRetry: 2},
+		{Codes: "404", MaxRetry: 5},
+	}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/admin":
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	handler, err := New(t.Context(), next, cfg, jailName(t))
+	require.NoError(t, err)
+
+	for i, test := range []struct {
+		path         string
+		expectedCode int
+	}{
+		{path: "/missing", expectedCode: http.StatusNotFound},
+		{path: "/missing", expectedCode: http.StatusNotFound},
+		{path: "/missing", expectedCode: http.StatusNotFound},
+		{path: "/admin", expectedCode: http.StatusUnauthorized},
+		{path: "/admin", expectedCode: http.StatusTooManyRequests},
+		{path: "/missing", expectedCode: http.StatusTooManyRequests},
+	} {
+		req := httptest.NewRequest(http.MethodGet, test.path, nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+
+		assert.Equal(t, test.expectedCode, rw.Code, "request [%d]", i)
+	}
+}
+
+func TestEscalation(t *testing.T) {
+	t.Parallel()
+
+	cfg := CreateConfig()
+	cfg.Rules.Maxretry = 5
+	cfg.Rules.StatusCode = "401"
+	cfg.Rules.Escalation = &rules.Escalation{
+		DelayAfter:  2,
+		Delay:       "20ms",
+		RejectAfter: 4,
+	}
+
+	var backendCalls int
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backendCalls++
+
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+
+	handler, err := New(t.Context(), next, cfg, jailName(t))
+	require.NoError(t, err)
+
+	for i, test := range []struct {
+		expectedCode    int
+		expectedDelayed bool
+	}{
+		{expectedCode: http.StatusUnauthorized},
+		{expectedCode: http.StatusUnauthorized},
+		{expectedCode: http.StatusUnauthorized, expectedDelayed: true},
+		{expectedCode: http.StatusUnauthorized, expectedDelayed: true},
+		// Rejected, then banned.
+		{expectedCode: http.StatusTooManyRequests},
+		{expectedCode: http.StatusTooManyRequests},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/login", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+
+		rw := httptest.NewRecorder()
+		start := time.Now()
+		handler.ServeHTTP(rw, req)
+
+		assert.Equal(t, test.expectedCode, rw.Code, "request [%d]", i)
+
+		if test.expectedDelayed {
+			assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond, "request [%d]", i)
+		}
+	}
+
+	assert.Equal(t, 4, backendCalls)
+}
+
+func TestChallenge(t *testing.T) {
+	t.Parallel()
+
+	cfg := CreateConfig()
+	cfg.Rules.Maxretry = 2
+	cfg.Rules.StatusCode = "401"
+	difficulty := 4
+	cfg.Challenge = Challenge{Enabled: true, Secret: "0123456789abcdef", Difficulty: &difficulty}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	})
+
+	handler, err := New(t.Context(), next, cfg, jailName(t))
+	require.NoError(t, err)
+
+	serve := func(method, path string, body io.Reader, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, body)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+
+		return rw
+	}
+
+	serve(http.MethodGet, "/login", nil)
+	serve(http.MethodGet, "/login", nil)
+
+	rw := serve(http.MethodGet, "/", nil)
+	require.Equal(t, http.StatusTooManyRequests, rw.Code)
+
+	match := regexp.MustCompile(`"token":"([^"]+)"`).FindStringSubmatch(rw.Body.String())
+	require.Len(t, match, 2)
+
+	// Solving the challenge as the page does.
+	counter := 0
+	for ; ; counter++ {
+		hash := sha256.Sum256([]byte(match[1] + ":" + strconv.Itoa(counter)))
+		if hash[0]>>4 == 0 {
+			break
+		}
+	}
+
+	// A tampered token is rejected.
+	rw = serve(http.MethodPost, "/.fail2ban/challenge",
+		strings.NewReader("token=1"+match[1]+"&counter="+strconv.Itoa(counter)))
+	require.Equal(t, http.StatusForbidden, rw.Code)
+
+	rw = serve(http.MethodPost, "/.fail2ban/challenge",
+		strings.NewReader("token="+match[1]+"&counter="+strconv.Itoa(counter)))
+	require.Equal(t, http.StatusNoContent, rw.Code)
+
+	cookies := rw.Result().Cookies()
+	require.Len(t, cookies, 1)
+
+	assert.Equal(t, http.StatusOK, serve(http.MethodGet, "/", nil).Code)
+
+	assert.Equal(t, http.StatusOK, serve(http.MethodGet, "/", nil, cookies...).Code)
+
+	// The solution is only accepted once.
+	serve(http.MethodGet, "/login", nil)
+	serve(http.MethodGet, "/login", nil)
+
+	rw = serve(http.MethodPost, "/.fail2ban/challenge",
+		strings.NewReader("token="+match[1]+"&counter="+strconv.Itoa(counter)))
+	require.Equal(t, http.StatusForbidden, rw.Code)
+
+	// The clients banned again are challenged again, cookie or not.
+	assert.Equal(t, http.StatusTooManyRequests, serve(http.MethodGet, "/", nil).Code)
+
+	rw = serve(http.MethodGet, "/", nil, cookies...)
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	assert.Contains(t, rw.Body.String(), `"token":`)
+}
+
+func TestShadow(t *testing.T) {
+	t.Parallel()
+
+	newConfig := func(mode, jailMode string) *Config {
+		cfg := CreateConfig()
+		cfg.Mode = mode
+		cfg.Rules.Mode = jailMode
+		cfg.Rules.Maxretry = 2
+		cfg.Rules.StatusCode = "401"
+		cfg.Denylist.IP = []string{"192.0.2.2"}
+
+		return cfg
+	}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	})
+
+	serve := func(handler http.Handler, remoteIP, path string) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.RemoteAddr = remoteIP + ":1234"
+
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+
+		return rw.Code
+	}
+
+	t.Run("switch to enforce", func(t *testing.T) {
+		t.Parallel()
+
+		name := jailName(t)
+
+		handler, err := New(t.Context(), next, newConfig(rules.ModeShadow, ""), name)
+		require.NoError(t, err)
+
+		for range 4 {
+			assert.Equal(t, http.StatusUnauthorized, serve(handler, "192.0.2.1", "/login"))
+		}
+
+		assert.Equal(t, http.StatusOK, serve(handler, "192.0.2.1", "/"))
+		assert.Equal(t, http.StatusOK, serve(handler, "192.0.2.2", "/"))
+
+		// The reloaded jail keeps the ban.
+		handler, err = New(t.Context(), next, newConfig(rules.ModeEnforce, ""), name)
+		require.NoError(t, err)
+
+		assert.Equal(t, http.StatusTooManyRequests, serve(handler, "192.0.2.1", "/"))
+		assert.Equal(t, http.StatusTooManyRequests, serve(handler, "192.0.2.2", "/"))
+		assert.Equal(t, http.StatusOK, serve(handler, "192.0.2.3", "/"))
+	})
+
+	t.Run("jail enforced", func(t *testing.T) {
+		t.Parallel()
+
+		handler, err := New(t.Context(), next, newConfig(rules.ModeShadow, rules.ModeEnforce), jailName(t))
+		require.NoError(t, err)
+
+		assert.Equal(t, http.StatusOK, serve(handler, "192.0.2.2", "/"))
+
+		assert.Equal(t, http.StatusUnauthorized, serve(handler, "192.0.2.1", "/login"))
+		assert.Equal(t, http.StatusTooManyRequests, serve(handler, "192.0.2.1", "/login"))
+		assert.Equal(t, http.StatusTooManyRequests, serve(handler, "192.0.2.1", "/"))
+	})
+
+	t.Run("jail in shadow", func(t *testing.T) {
+		t.Parallel()
+
+		handler, err := New(t.Context(), next, newConfig(rules.ModeEnforce, rules.ModeShadow), jailName(t))
+		require.NoError(t, err)
+
+		assert.Equal(t, http.StatusTooManyRequests, serve(handler, "192.0.2.2", "/"))
+
+		for range 3 {
+			assert.Equal(t, http.StatusUnauthorized, serve(handler, "192.0.2.1", "/login"))
+		}
+
+		assert.Equal(t, http.StatusOK, serve(handler, "192.0.2.1", "/"))
+	})
+}
+
+func TestWebhook(t *testing.T) {
+	t.Parallel()
+
+	received := make(chan events.Event, 10)
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, "sha256="+webhook.Sign([]byte("secret"), r.Header.Get(webhook.HeaderTimestamp), body),
+			r.Header.Get(webhook.HeaderSignature))
+
+		var e events.Event
+		assert.NoError(t, json.Unmarshal(body, &e))
+
+		received <- e
+	}))
+	t.Cleanup(receiver.Close)
+
+	cfg := CreateConfig()
+	cfg.Rules.Maxretry = 2
+	cfg.Rules.StatusCode = "401"
+	cfg.Denylist.IP = []string{"192.0.2.2"}
+	cfg.Webhooks = []Webhook{{URL: receiver.URL, Secret: "secret"}}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+
+	name := jailName(t)
+
+	handler, err := New(t.Context(), next, cfg, name)
+	require.NoError(t, err)
+
+	for _, remoteIP := range []string{"192.0.2.1", "192.0.2.1", "192.0.2.2"} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteIP + ":1234"
+
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	for _, expected := range []struct {
+		eventType events.Type
+		ip        string
+	}{
+		{eventType: events.Ban, ip: "192.0.2.1"},
+		{eventType: events.StaticBlock, ip: "192.0.2.2"},
+	} {
+		select {
+		case e := <-received:
+			assert.Equal(t, expected.eventType, e.Type)
+			assert.Equal(t, expected.ip, e.IP)
+			assert.Equal(t, name, e.Jail)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %s event received", expected.eventType)
+		}
+	}
+}
+
+func TestExport(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "bans.txt")
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+
+	// The middlewares exporting to the same path share the file, but for the
+	// jails in shadow mode.
+	for _, test := range []struct {
+		remoteIP string
+		mode     string
+	}{
+		{remoteIP: "192.0.2.1"},
+		{remoteIP: "192.0.2.2"},
+		{remoteIP: "192.0.2.3", mode: rules.ModeShadow},
+	} {
+		cfg := CreateConfig()
+		cfg.Rules.Maxretry = 2
+		cfg.Rules.StatusCode = "401"
+		cfg.Rules.Mode = test.mode
+		cfg.Export = Export{Path: path, Format: "cidr", Interval: "10ms"}
+
+		handler, err := New(t.Context(), next, cfg, jailName(t))
+		require.NoError(t, err)
+
+		for range 2 {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = test.remoteIP + ":1234"
+
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+		}
+	}
+
+	assert.Eventually(t, func() bool {
+		content, err := os.ReadFile(path)
+
+		return err == nil && string(content) == "192.0.2.1/32\n192.0.2.2/32\n"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestExportAllowlisted(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "bans.txt")
+
+	cfg := CreateConfig()
+	cfg.Rules.Maxretry = 1
+	cfg.Allowlist.IP = []string{"192.0.2.2"}
+	cfg.Export = Export{Path: path, Format: "cidr", Interval: "10ms"}
+
+	name := jailName(t)
+
+	_, err := New(t.Context(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), cfg, name)
+	require.NoError(t, err)
+
+	jailsMu.Lock()
+	j := jails[name]
+	jailsMu.Unlock()
+
+	// The allowlisted IPs are not exported, even when banned (e.g. before the
+	// allowlist was reloaded).
+	j.f2b.Ban("192.0.2.1", 0)
+	j.f2b.Ban("192.0.2.2", 0)
+
+	assert.Eventually(t, func() bool {
+		content, err := os.ReadFile(path)
+
+		return err == nil && string(content) == "192.0.2.1/32\n"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestCountRequests(t *testing.T) {
+	t.Parallel()
+
+	cfg := CreateConfig()
+	cfg.Rules.Maxretry = 3
+	cfg.Rules.CountMode = rules.CountRequests
+	cfg.Rules.Costs = []rules.Urlregexp{{Method: "^POST$", Weight: 3}}
+	cfg.Rules.Urlregexps = []rules.Urlregexp{{Path: "^/health$", Mode: "allow"}}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	handler, err := New(t.Context(), next, cfg, jailName(t))
+	require.NoError(t, err)
+
+	for i, test := range []struct {
+		remoteIP     string
+		method       string
+		path         string
+		expectedCode int
+	}{
+		// The allowed URLs do not reach the fail2ban stage.
+		{remoteIP: "192.0.2.1", method: http.MethodGet, path: "/health", expectedCode: http.StatusOK},
+		{remoteIP: "192.0.2.1", method: http.MethodGet, path: "/health", expectedCode: http.StatusOK},
+		{remoteIP: "192.0.2.1", method: http.MethodGet, path: "/health", expectedCode: http.StatusOK},
+		{remoteIP: "192.0.2.1", method: http.MethodGet, path: "/", expectedCode: http.StatusOK},
+		{remoteIP: "192.0.2.1", method: http.MethodGet, path: "/", expectedCode: http.StatusOK},
+		// maxretry is full, the next requests are banned.
+		{remoteIP: "192.0.2.1", method: http.MethodGet, path: "/", expectedCode: http.StatusOK},
+		{remoteIP: "192.0.2.1", method: http.MethodGet, path: "/", expectedCode: http.StatusTooManyRequests},
+		{remoteIP: "192.0.2.1", method: http.MethodGet, path: "/health", expectedCode: http.StatusOK},
+		// A POST costs maxretry.
+		{remoteIP: "192.0.2.2", method: http.MethodPost, path: "/", expectedCode: http.StatusOK},
+		{remoteIP: "192.0.2.2", method: http.MethodGet, path: "/", expectedCode: http.StatusTooManyRequests},
+	} {
+		req := httptest.NewRequest(test.method, test.path, nil)
+		req.RemoteAddr = test.remoteIP + ":1234"
+
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+
+		assert.Equal(t, test.expectedCode, rw.Code, "request [%d] %s %s", i, test.method, test.path)
+	}
+}
+
+func TestCrowdSec(t *testing.T) {
+	t.Parallel()
+
+	var startups atomic.Int64
+
+	lapi := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Api-Key") != "bouncer-key" {
+			w.WriteHeader(http.StatusForbidden)
+
+			return
+		}
+
+		if r.URL.Query().Get("startup") != "true" {
+			_, _ = io.WriteString(w, `{"new": null, "deleted": null}`)
+
+			return
+		}
+
+		startups.Add(1)
+
+		_, _ = io.WriteString(w, `{"new": [{"duration": "4h", "origin": "crowdsec", "scenario": "crowdsecurity/http-probing", "scope": "Ip", "type": "ban", "value": "192.0.2.1"}], "deleted": []}`)
+	}))
+	t.Cleanup(lapi.Close)
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	// The middlewares using the same bouncer share the stream.
+	handlers := make([]http.Handler, 2)
+
+	for i, maxretry := range []int{4, 5} {
+		cfg := CreateConfig()
+		cfg.Rules.Maxretry = maxretry
+		cfg.Denylist.CrowdSec = CrowdSec{URL: lapi.URL, APIKey: "bouncer-key", Interval: "10ms"}
+
+		handler, err := New(t.Context(), next, cfg, jailName(t))
+		require.NoError(t, err)
+
+		handlers[i] = handler
+	}
+
+	serve := func(handler http.Handler, remoteIP string) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteIP + ":1234"
+
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+
+		return rw.Code
+	}
+
+	for _, handler := range handlers {
+		assert.Eventually(t, func() bool {
+			return serve(handler, "192.0.2.1") == http.StatusTooManyRequests
+		}, 5*time.Second, 10*time.Millisecond)
+		assert.Equal(t, http.StatusOK, serve(handler, "192.0.2.2"))
+	}
+
+	assert.Equal(t, int64(1), startups.Load())
+}
+
+func TestFail2banLog(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "fail2ban.log")
+
+	cfg := CreateConfig()
+	cfg.Rules.Maxretry = 2
+	cfg.Rules.StatusCode = "401"
+	cfg.Fail2banLog = Fail2banLog{Path: path}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+
+	name := jailName(t)
+
+	handler, err := New(t.Context(), next, cfg, name)
+	require.NoError(t, err)
+
+	for range 3 {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// The lines are written in the background.
+	var lines []string
+
+	require.Eventually(t, func() bool {
+		content, err := os.ReadFile(path)
+		lines = strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+
+		return err == nil && len(lines) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	assert.Regexp(t, `^\S+Z fail2ban-traefik\[`+regexp.QuoteMeta(name)+`\]: Found 192\.0\.2\.1 reason="failure" score=1$`, lines[0])
+	assert.Regexp(t, `^\S+Z fail2ban-traefik\[`+regexp.QuoteMeta(name)+`\]: Ban 192\.0\.2\.1 reason="threshold" score=2$`, lines[1])
+}
+
+func TestOutcomes(t *testing.T) {
+	t.Parallel()
+
+	cfg := CreateConfig()
+	cfg.Rules.Maxretry = 2
+	cfg.Rules.Outcomes = &rules.Outcomes{
+		ServerError: &rules.Outcome{Weight: 2},
+	}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/crash" {
+			w.WriteHeader(http.StatusInternalServerError)
+
+			return
+		}
+
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	handler, err := New(t.Context(), next, cfg, jailName(t))
+	require.NoError(t, err)
+
+	for i, test := range []struct {
+		path         string
+		expectedCode int
+	}{
+		{path: "/down", expectedCode: http.StatusServiceUnavailable},
+		{path: "/down", expectedCode: http.StatusServiceUnavailable},
+		{path: "/crash", expectedCode: http.StatusTooManyRequests},
+		{path: "/down", expectedCode: http.StatusTooManyRequests},
+	} {
+		req := httptest.NewRequest(http.MethodGet, test.path, nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+
+		assert.Equal(t, test.expectedCode, rw.Code, "request [%d]", i)
+	}
+}
+
 func TestAllowlistCIDRDoesNotBan(t *testing.T) {
 	t.Parallel()
 
@@ -345,7 +1412,7 @@ func TestAllowlistCIDRDoesNotBan(t *testing.T) {
 		w.WriteHeader(http.StatusBadRequest)
 	})
 
-	handler, err := New(t.Context(), next, cfg, "fail2ban_test")
+	handler, err := New(t.Context(), next, cfg, jailName(t))
 	require.NoError(t, err)
 
 	req := httptest.NewRequest(http.MethodGet, "/", nil)
@@ -383,7 +1450,7 @@ func TestDeadlockWebsocket(t *testing.T) {
 	cfg := CreateConfig()
 	cfg.Rules.Maxretry = 20
 
-	handler, err := New(t.Context(), next, cfg, "fail2ban_test")
+	handler, err := New(t.Context(), next, cfg, jailName(t))
 	require.NoError(t, err)
 
 	s := httptest.NewServer(handler)
@@ -450,7 +1517,7 @@ func TestSourceCriterion(t *testing.T) {
 			w.WriteHeader(http.StatusOK)
 		})
 
-		handler, err := New(t.Context(), next, cfg, "fail2ban_test")
+		handler, err := New(t.Context(), next, cfg, jailName(t))
 		require.NoError(t, err)
 
 		req := httptest.NewRequest(http.MethodGet, "/", nil)
@@ -474,7 +1541,7 @@ func TestSourceCriterion(t *testing.T) {
 			w.WriteHeader(http.StatusCreated)
 		})
 
-		handler, err := New(t.Context(), next, cfg, "fail2ban_test")
+		handler, err := New(t.Context(), next, cfg, jailName(t))
 		require.NoError(t, err)
 
 		req := httptest.NewRequest(http.MethodGet, "/", nil)
@@ -497,7 +1564,7 @@ func TestSourceCriterion(t *testing.T) {
 			w.WriteHeader(http.StatusOK)
 		})
 
-		handler, err := New(t.Context(), next, cfg, "fail2ban_test")
+		handler, err := New(t.Context(), next, cfg, jailName(t))
 		require.NoError(t, err)
 
 		req := httptest.NewRequest(http.MethodGet, "/", nil)
@@ -577,7 +1644,7 @@ func TestFail2Ban_SuccessiveRequests(t *testing.T) {
 				w.WriteHeader(testno)
 			})
 
-			handler, _ := New(t.Context(), next, test.cfg, "fail2ban_test")
+			handler, _ := New(t.Context(), next, test.cfg, jailName(t))
 
 			req := httptest.NewRequest(http.MethodGet, "/", nil)
 			req.RemoteAddr = remoteAddr + ":1234"
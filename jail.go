@@ -0,0 +1,353 @@
+package fail2ban
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/tomMoulard/fail2ban/pkg/chain"
+	"github.com/tomMoulard/fail2ban/pkg/challenge"
+	"github.com/tomMoulard/fail2ban/pkg/credential"
+	"github.com/tomMoulard/fail2ban/pkg/events"
+	"github.com/tomMoulard/fail2ban/pkg/fail2ban"
+	"github.com/tomMoulard/fail2ban/pkg/geoip"
+	"github.com/tomMoulard/fail2ban/pkg/ipchecking"
+	lAllow "github.com/tomMoulard/fail2ban/pkg/list/allow"
+	lDeny "github.com/tomMoulard/fail2ban/pkg/list/deny"
+	"github.com/tomMoulard/fail2ban/pkg/response/status"
+	"github.com/tomMoulard/fail2ban/pkg/response/success"
+	"github.com/tomMoulard/fail2ban/pkg/rules"
+	utime "github.com/tomMoulard/fail2ban/pkg/utils/time"
+)
+
+// jail is the state of a middleware: its bans and failures, and the state of
+// its handlers. Traefik creates the middleware once per router using it, and
+// again on every configuration reload: the instances with the same name and
+// configuration share the jail, and a jail reconfigured (e.g. from shadow to
+// enforce mode) takes over the state of the previous one.
+type jail struct {
+	// config is the configuration the jail was created with.
+	config string
+	// ctx is done when the jail is replaced, stopping its goroutines (e.g. the
+	// webhooks).
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	f2b *fail2ban.Fail2Ban
+	bus *events.Bus
+	// delayed caps the requests delayed at the same time by the instances.
+	delayed chain.Delayed
+	// geoip is read and watched once for the instances, nil when not
+	// configured.
+	geoip *geoip.DB
+	// The allowlist of the instances: its IPs, selectors and hostnames, the
+	// latter nil when not configured.
+	allowNetIPs    ipchecking.NetIPs
+	allowSelectors []geoip.Selector
+	hostnames      *lAllow.Hostnames
+	// deny is the denylist, remembering the IPs it published a block of.
+	deny chain.ChainHandler
+	// loaded are the times the denylist entries were first loaded, taken over
+	// by the next jails of the middleware.
+	loaded *lDeny.Loaded
+	// The handlers keeping a state, nil when not configured. The status
+	// handler answers with the next handler of the instances (see WithNext).
+	credential *credential.Detector
+	challenge  *challenge.Challenge
+	status     *status.Status
+}
+
+// jails are the jails by middleware name. They are package-level as Traefik
+// gives the middlewares nothing else to share between the instances. The files
+// and the CrowdSec streams outlive the jails the same way, in the registries of
+// their packages (see export.Open, logger.OpenFile and crowdsec.Open).
+var (
+	jailsMu sync.Mutex
+	jails   = make(map[string]*jail)
+)
+
+// openJail returns the jail of the middleware, created by create with a
+// context canceled when the jail is replaced, unless the middleware already
+// has a jail for the configuration.
+func openJail(ctx context.Context, name string, config *Config, create func(ctx context.Context) (*jail, error)) (*jail, error) {
+	b, err := json.Marshal(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode configuration: %w", err)
+	}
+
+	jailsMu.Lock()
+	defer jailsMu.Unlock()
+
+	prev, found := jails[name]
+	if found && prev.config == string(b) && prev.ctx.Err() == nil {
+		return prev, nil
+	}
+
+	jailCtx, cancel := context.WithCancel(ctx)
+
+	j, err := create(jailCtx)
+	if err != nil {
+		cancel()
+
+		return nil, err
+	}
+
+	j.config = string(b)
+	j.ctx, j.cancel = jailCtx, cancel
+
+	if found {
+		j.restore(prev)
+		prev.cancel()
+	}
+
+	jails[name] = j
+
+	return j, nil
+}
+
+// jailLoaded returns the times the denylist entries of the middleware were
+// first loaded, empty for a new middleware.
+func jailLoaded(name string) *lDeny.Loaded {
+	jailsMu.Lock()
+	defer jailsMu.Unlock()
+
+	if j, found := jails[name]; found && j.loaded != nil {
+		return j.loaded
+	}
+
+	return lDeny.NewLoaded()
+}
+
+// restore takes over the state of the previous jail.
+func (j *jail) restore(prev *jail) {
+	j.f2b.Restore(prev.f2b)
+
+	if j.credential != nil && prev.credential != nil {
+		j.credential.Restore(prev.credential)
+	}
+
+	if j.challenge != nil && prev.challenge != nil {
+		j.challenge.Restore(prev.challenge)
+	}
+
+	if j.status != nil && prev.status != nil {
+		j.status.Restore(prev.status)
+	}
+}
+
+// newJail creates the jail of the middleware, with its sinks and its stateful
+// handlers.
+func newJail(ctx context.Context, name string, config *Config, rules rules.RulesTransformed, allowNetIPs ipchecking.NetIPs, allowSelectors []geoip.Selector, shadow bool) (*jail, error) {
+	f2b := fail2ban.New(rules, allowNetIPs)
+
+	bus := events.New(name)
+	f2b.WithEvents(bus)
+
+	if shadow {
+		f2b.WithShadow()
+	}
+
+	for i, webhookConfig := range config.Webhooks {
+		w, err := newWebhook(webhookConfig)
+		if err != nil {
+			return nil, fmt.Errorf("webhooks[%d]: %w", i, err)
+		}
+
+		go w.Run(ctx)
+
+		bus.Subscribe(w)
+	}
+
+	if config.Fail2banLog.Path != "" {
+		f2bLog, err := newFail2banLog(config.Fail2banLog)
+		if err != nil {
+			return nil, err
+		}
+
+		go f2bLog.Run(ctx)
+
+		bus.Subscribe(f2bLog)
+	}
+
+	// The shadow mode always logs the requests it would block.
+	blockLogs := config.EnableBlockLogs || shadow
+
+	j := &jail{
+		f2b:            f2b,
+		bus:            bus,
+		delayed:        chain.NewDelayed(rules.MaxDelayed()),
+		allowNetIPs:    allowNetIPs,
+		allowSelectors: allowSelectors,
+	}
+
+	if len(config.GeoIP.Files) > 0 {
+		db, err := openGeoIP(ctx, config.GeoIP)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open geoip databases: %w", err)
+		}
+
+		j.geoip = db
+	}
+
+	if len(config.Allowlist.Hostnames.Suffixes) > 0 {
+		hostnames, err := newHostnames(config.Allowlist.Hostnames, net.DefaultResolver)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse allowlist hostnames: %w", err)
+		}
+
+		j.hostnames = hostnames
+	}
+
+	if config.Export.Path != "" {
+		exporter, err := newExporter(config.Export)
+		if err != nil {
+			return nil, err
+		}
+
+		// The bans of a jail in shadow mode are not enforced.
+		if !shadow {
+			exporter.Add(ctx, name, f2b, j.allowed)
+		}
+	}
+
+	if rules.CredentialStuffing != nil {
+		detector, err := credential.New(*rules.CredentialStuffing, f2b, blockLogs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create credential stuffing detector: %w", err)
+		}
+
+		j.credential = detector
+	}
+
+	if config.Challenge.Enabled {
+		challengeHandler, err := newChallenge(config.Challenge, f2b, blockLogs)
+		if err != nil {
+			return nil, err
+		}
+
+		j.challenge = challengeHandler
+	}
+
+	if rules.StatusCode != "" || len(rules.StatusCodes) > 0 || rules.PathDiversity != nil || j.credential != nil ||
+		rules.Success != nil || rules.ResponseFailures != nil || rules.Outcomes != nil {
+		statusCodeHandler, err := newStatus(rules, f2b, blockLogs, shadow)
+		if err != nil {
+			return nil, err
+		}
+
+		if j.credential != nil {
+			statusCodeHandler.WithObserver(j.credential)
+		}
+
+		if rules.Success != nil {
+			successObserver, err := success.New(*rules.Success, f2b)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create success observer: %w", err)
+			}
+
+			successObserver.WithBuckets(statusCodeHandler.Buckets())
+
+			statusCodeHandler.WithObserver(successObserver)
+		}
+
+		j.status = statusCodeHandler
+	}
+
+	go j.run(ctx)
+
+	return j, nil
+}
+
+// sweepInterval is the interval between two sweeps of the expired bans and
+// failures.
+const sweepInterval = 10 * time.Second
+
+// run sweeps the expired bans and failures of the jail periodically, the ones
+// of the status code buckets included, until the context is done.
+func (j *jail) run(ctx context.Context) {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			j.sweep(utime.Now())
+		}
+	}
+}
+
+func (j *jail) sweep(now time.Time) {
+	j.f2b.Sweep(now)
+
+	if j.status != nil {
+		j.status.Sweep(now)
+	}
+}
+
+// allowed returns whether the IP is allowlisted, its hostname verification
+// being taken from the cache only.
+func (j *jail) allowed(remoteIP string) bool {
+	if j.allowNetIPs.Contains(remoteIP) || (j.hostnames != nil && j.hostnames.Verified(remoteIP)) {
+		return true
+	}
+
+	if len(j.allowSelectors) == 0 || j.geoip == nil {
+		return false
+	}
+
+	info := j.geoip.Lookup(remoteIP)
+
+	for _, selector := range j.allowSelectors {
+		if selector.Matches(info) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// newStatus creates the status handler of the jail, without next handler (see
+// WithNext).
+func newStatus(rules rules.RulesTransformed, f2b *fail2ban.Fail2Ban, enableBlockLogs, shadow bool) (*status.Status, error) {
+	statusCodeHandler, err := status.New(nil, rules.StatusCode, f2b, enableBlockLogs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create status handler: %w", err)
+	}
+
+	if err := statusCodeHandler.WithWeights(rules.StatusCodeWeights); err != nil {
+		return nil, fmt.Errorf("failed to set status code weights: %w", err)
+	}
+
+	if err := statusCodeHandler.WithBuckets(rules.StatusCodes, rules.Findtime, rules.Bantime); err != nil {
+		return nil, fmt.Errorf("failed to set status code buckets: %w", err)
+	}
+
+	if rules.PathDiversity != nil {
+		if err := statusCodeHandler.WithPathDiversity(*rules.PathDiversity, rules.Findtime); err != nil {
+			return nil, fmt.Errorf("failed to set path diversity: %w", err)
+		}
+	}
+
+	if rules.ResponseFailures != nil {
+		if err := statusCodeHandler.WithResponseFailures(*rules.ResponseFailures); err != nil {
+			return nil, fmt.Errorf("failed to set response failures: %w", err)
+		}
+	}
+
+	if rules.Outcomes != nil {
+		if err := statusCodeHandler.WithOutcomes(*rules.Outcomes); err != nil {
+			return nil, fmt.Errorf("failed to set outcomes: %w", err)
+		}
+	}
+
+	if shadow {
+		statusCodeHandler.WithShadow()
+	}
+
+	return statusCodeHandler, nil
+}
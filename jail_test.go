@@ -0,0 +1,169 @@
+package fail2ban
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tomMoulard/fail2ban/pkg/rules"
+)
+
+func TestJailShared(t *testing.T) {
+	t.Parallel()
+
+	cfg := CreateConfig()
+	cfg.Rules.Maxretry = 2
+	cfg.Rules.StatusCode = "401"
+
+	name := jailName(t)
+
+	newRouter := func(body string) http.Handler {
+		t.Helper()
+
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(body))
+		})
+
+		handler, err := New(t.Context(), next, cfg, name)
+		require.NoError(t, err)
+
+		return handler
+	}
+
+	// Traefik creates the middleware once per router using it.
+	routerA := newRouter("a")
+	routerB := newRouter("b")
+
+	serve := func(handler http.Handler) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+
+		return rw
+	}
+
+	// Each router answers with its own service, counting in the same jail.
+	rw := serve(routerA)
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+	assert.Equal(t, "a", rw.Body.String())
+
+	rw = serve(routerB)
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+
+	assert.Equal(t, http.StatusTooManyRequests, serve(routerA).Code)
+}
+
+func TestJailRestore(t *testing.T) {
+	t.Parallel()
+
+	newConfig := func(bantime string) *Config {
+		cfg := CreateConfig()
+		cfg.Rules.Maxretry = 100
+		cfg.Rules.Bantime = bantime
+		cfg.Rules.StatusCodes = []rules.StatusCodeBucket{{Codes: "403", MaxRetry: 2}}
+		cfg.Rules.PathDiversity = &rules.PathDiversity{StatusCode: "404", Threshold: 3}
+		cfg.Rules.CredentialStuffing = &rules.CredentialStuffing{
+			Routes:    []rules.Urlregexp{{Method: "^POST$", Path: "^/login$"}},
+			FormField: "username",
+			Threshold: 2,
+			Locktime:  "1h",
+		}
+
+		return cfg
+	}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			w.WriteHeader(http.StatusUnauthorized)
+		case "/admin":
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+
+	serve := func(handler http.Handler, remoteIP, method, path, body string) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.RemoteAddr = remoteIP + ":1234"
+
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+
+		return rw.Code
+	}
+
+	name := jailName(t)
+
+	handler, err := New(t.Context(), next, newConfig("3h"), name)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusForbidden, serve(handler, "192.0.2.1", http.MethodGet, "/admin", ""))
+	assert.Equal(t, http.StatusNotFound, serve(handler, "192.0.2.2", http.MethodGet, "/.env", ""))
+	assert.Equal(t, http.StatusNotFound, serve(handler, "192.0.2.2", http.MethodGet, "/.git/config", ""))
+	assert.Equal(t, http.StatusUnauthorized, serve(handler, "192.0.2.3", http.MethodPost, "/login", "username=alice"))
+
+	// The reloaded jail keeps the bucket, path diversity and username counts.
+	handler, err = New(t.Context(), next, newConfig("4h"), name)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusTooManyRequests, serve(handler, "192.0.2.1", http.MethodGet, "/admin", ""))
+	assert.Equal(t, http.StatusTooManyRequests, serve(handler, "192.0.2.2", http.MethodGet, "/wp-admin", ""))
+	assert.Equal(t, http.StatusUnauthorized, serve(handler, "192.0.2.4", http.MethodPost, "/login", "username=alice"))
+	assert.Equal(t, http.StatusTooManyRequests, serve(handler, "192.0.2.5", http.MethodPost, "/login", "username=alice"))
+}
+
+func TestJailDenylistLoaded(t *testing.T) {
+	t.Parallel()
+
+	newConfig := func(bantime string) *Config {
+		cfg := CreateConfig()
+		cfg.Rules.Maxretry = 3
+		cfg.Rules.Bantime = bantime
+		cfg.Denylist.Entries = []ListEntry{{IP: "192.0.2.1", Expires: "72h"}}
+
+		return cfg
+	}
+
+	name := jailName(t)
+
+	_, err := New(t.Context(), http.NotFoundHandler(), newConfig("3h"), name)
+	require.NoError(t, err)
+
+	loaded := jailLoaded(name)
+
+	// The reloaded jail keeps the times the entries were first loaded.
+	_, err = New(t.Context(), http.NotFoundHandler(), newConfig("4h"), name)
+	require.NoError(t, err)
+
+	assert.Same(t, loaded, jailLoaded(name))
+}
+
+func TestJailGeoIP(t *testing.T) {
+	t.Parallel()
+
+	cfg := CreateConfig()
+	cfg.Rules.Maxretry = 3
+	cfg.GeoIP.Files = []string{"tests/test-geoip.mmdb"}
+
+	name := jailName(t)
+
+	// The routers using the middleware read the databases once.
+	for range 2 {
+		_, err := New(t.Context(), http.NotFoundHandler(), cfg, name)
+		require.NoError(t, err)
+	}
+
+	jailsMu.Lock()
+	db := jails[name].geoip
+	jailsMu.Unlock()
+
+	require.NotNil(t, db)
+}
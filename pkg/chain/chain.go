@@ -3,8 +3,10 @@ package chain
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/tomMoulard/fail2ban/pkg/data"
+	"github.com/tomMoulard/fail2ban/pkg/geoip"
 	"github.com/tomMoulard/fail2ban/pkg/logger"
 )
 
@@ -16,6 +18,15 @@ type Status struct {
 	// Break is a flag that tells the chain to break. If Break is true, the chain
 	// will stop (e.g., the ip is in the allowlist)
 	Break bool
+	// Delay is the duration the chain waits before calling the next handler
+	// (e.g., the ip is in a tarpitted network).
+	Delay time.Duration
+	// Tighten is a flag that tells the chain to evaluate the request against
+	// the stricter rules (e.g., the ip is in a suspicious network).
+	Tighten bool
+	// Response, when set with Return, writes the response instead of the 429
+	// (e.g., the decoy of a honeypot trap).
+	Response http.Handler
 }
 
 // ChainHandler is a handler that can be chained.
@@ -27,13 +38,31 @@ type ChainHandler interface {
 type Chain interface {
 	ServeHTTP(w http.ResponseWriter, r *http.Request)
 	WithStatus(status http.Handler)
+	WithGeoIP(db *geoip.DB)
+	WithDelayed(delayed Delayed)
+}
+
+// defaultMaxDelayed is the cap of the requests delayed at the same time by a
+// chain not given a shared one (see WithDelayed).
+const defaultMaxDelayed = 100
+
+// Delayed holds a token per request being delayed, capping the requests delayed
+// at the same time by the chains sharing it.
+type Delayed chan struct{}
+
+// NewDelayed returns a cap of n requests delayed at the same time.
+func NewDelayed(n int) Delayed {
+	return make(Delayed, n)
 }
 
 type chain struct {
 	handlers          []ChainHandler
 	final             http.Handler
 	status            *http.Handler
+	geoip             *geoip.DB
 	requestHeaderName string
+	// delayed caps the requests being delayed, possibly shared.
+	delayed Delayed
 }
 
 // New creates a new chain.
@@ -42,6 +71,7 @@ func New(final http.Handler, requestHeaderName string, handlers ...ChainHandler)
 		handlers:          handlers,
 		final:             final,
 		requestHeaderName: requestHeaderName,
+		delayed:           NewDelayed(defaultMaxDelayed),
 	}
 }
 
@@ -50,6 +80,18 @@ func (c *chain) WithStatus(status http.Handler) {
 	c.status = &status
 }
 
+// WithGeoIP sets the geoip database used to locate the clients.
+func (c *chain) WithGeoIP(db *geoip.DB) {
+	c.geoip = db
+}
+
+// WithDelayed sets the cap of the requests delayed at the same time, the
+// requests over the cap being answered with a 429 right away, so that the
+// delayed requests cannot exhaust the proxy.
+func (c *chain) WithDelayed(delayed Delayed) {
+	c.delayed = delayed
+}
+
 // ServeHTTP chains the handlers together, and calls the final handler at the end.
 func (c *chain) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	newReq, err := data.ServeHTTP(w, r, c.requestHeaderName)
@@ -67,6 +109,12 @@ func (c *chain) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	r = newReq
 
+	if c.geoip != nil {
+		d := data.GetData(r)
+		info := c.geoip.Lookup(d.RemoteIP)
+		d.Country, d.ASN = info.Country, info.ASN
+	}
+
 	for _, handler := range c.handlers {
 		s, err := handler.ServeHTTP(w, r)
 		if err != nil {
@@ -85,11 +133,37 @@ func (c *chain) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if s.Return {
+			if s.Response != nil {
+				s.Response.ServeHTTP(w, r)
+
+				return
+			}
+
 			w.WriteHeader(http.StatusTooManyRequests)
 
 			return
 		}
 
+		if s.Tighten {
+			data.GetData(r).Tightened = true
+		}
+
+		if s.Delay > 0 {
+			if !c.acquireDelay() {
+				w.WriteHeader(http.StatusTooManyRequests)
+
+				return
+			}
+
+			waited := wait(r, s.Delay)
+			c.releaseDelay()
+
+			if !waited {
+				// The client went away while being delayed.
+				return
+			}
+		}
+
 		if s.Break {
 			break
 		}
@@ -103,3 +177,32 @@ func (c *chain) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	c.final.ServeHTTP(w, r)
 }
+
+// acquireDelay returns whether the request can be delayed, without exceeding
+// the maximum number of delayed requests.
+func (c *chain) acquireDelay() bool {
+	select {
+	case c.delayed <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *chain) releaseDelay() {
+	<-c.delayed
+}
+
+// wait waits for the given duration, or until the request is canceled.
+// It returns false if the request was canceled.
+func wait(r *http.Request, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-r.Context().Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -1,10 +1,13 @@
 package chain
 
 import (
+	"context"
 	"errors"
 	"net/http"
 	"net/http/httptest"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -242,3 +245,152 @@ func TestChainWithStatus(t *testing.T) {
 	final.assert(t)
 	status.assert(t)
 }
+
+func TestChainTighten(t *testing.T) {
+	t.Parallel()
+
+	tighten := &mockChainHandler{
+		status:      &Status{Tighten: true},
+		mockHandler: mockHandler{expectedCalled: 1},
+	}
+	handler := &mockDataHandler{
+		t:          t,
+		ExpectData: &data.Data{RemoteIP: "192.0.2.1", Tightened: true},
+	}
+	final := &mockHandler{expectedCalled: 1}
+
+	ch := New(final, "", tighten, handler)
+	r := httptest.NewRequest(http.MethodGet, "https://example.com/foo", nil)
+	ch.ServeHTTP(nil, r)
+
+	tighten.assert(t)
+	final.assert(t)
+}
+
+func TestChainDelay(t *testing.T) {
+	t.Parallel()
+
+	t.Run("delayed", func(t *testing.T) {
+		t.Parallel()
+
+		handler := &mockChainHandler{
+			status:      &Status{Delay: 10 * time.Millisecond},
+			mockHandler: mockHandler{expectedCalled: 1},
+		}
+		final := &mockHandler{expectedCalled: 1}
+
+		ch := New(final, "", handler)
+		r := httptest.NewRequest(http.MethodGet, "https://example.com/foo", nil)
+
+		start := time.Now()
+
+		ch.ServeHTTP(nil, r)
+
+		assert.GreaterOrEqual(t, time.Since(start), 10*time.Millisecond)
+		handler.assert(t)
+		final.assert(t)
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		t.Parallel()
+
+		handler := &mockChainHandler{
+			status:      &Status{Delay: time.Hour},
+			mockHandler: mockHandler{expectedCalled: 1},
+		}
+		final := &mockHandler{expectedCalled: 0}
+
+		ctx, cancel := context.WithCancel(t.Context())
+		cancel()
+
+		ch := New(final, "", handler)
+		r := httptest.NewRequestWithContext(ctx, http.MethodGet, "https://example.com/foo", nil)
+		ch.ServeHTTP(nil, r)
+
+		handler.assert(t)
+		final.assert(t)
+	})
+}
+
+func TestChainMaxDelayed(t *testing.T) {
+	t.Parallel()
+
+	handler := &delayChainHandler{delay: time.Hour}
+	final := &mockHandler{expectedCalled: 0}
+
+	// The chains of the routers using a middleware share the cap.
+	delayedCap := NewDelayed(1)
+
+	ch := New(final, "", handler)
+	ch.WithDelayed(delayedCap)
+
+	other := New(final, "", handler)
+	other.WithDelayed(delayedCap)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	delayed := make(chan struct{})
+
+	go func() {
+		defer close(delayed)
+
+		r := httptest.NewRequestWithContext(ctx, http.MethodGet, "https://example.com/foo", nil)
+		ch.ServeHTTP(httptest.NewRecorder(), r)
+	}()
+
+	// The first request holds the only slot.
+	require.Eventually(t, func() bool {
+		return len(delayedCap) == 1
+	}, time.Second, time.Millisecond)
+
+	w := httptest.NewRecorder()
+	other.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "https://example.com/foo", nil))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+
+	cancel()
+	<-delayed
+
+	assert.Empty(t, delayedCap)
+	assert.Equal(t, int32(2), handler.called.Load())
+	final.assert(t)
+}
+
+func TestChainDefaultMaxDelayed(t *testing.T) {
+	t.Parallel()
+
+	ch := New(&mockHandler{}, "")
+
+	assert.Equal(t, defaultMaxDelayed, cap(ch.(*chain).delayed))
+}
+
+// delayChainHandler delays every request, and can be called concurrently.
+type delayChainHandler struct {
+	called atomic.Int32
+	delay  time.Duration
+}
+
+func (d *delayChainHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) (*Status, error) {
+	d.called.Add(1)
+
+	return &Status{Delay: d.delay}, nil
+}
+
+func TestChainResponse(t *testing.T) {
+	t.Parallel()
+
+	response := &mockHandler{expectedCalled: 1}
+	handler := &mockChainHandler{
+		status:      &Status{Return: true, Response: response},
+		mockHandler: mockHandler{expectedCalled: 1},
+	}
+	final := &mockHandler{expectedCalled: 0}
+
+	ch := New(final, "", handler)
+	r := httptest.NewRequest(http.MethodGet, "https://example.com/foo", nil)
+	w := httptest.NewRecorder()
+	ch.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	handler.assert(t)
+	response.assert(t)
+	final.assert(t)
+}
@@ -44,6 +44,6 @@ func Example() {
 	fmt.Println(rec.Body.String())
 
 	// Output:
-	// data: &{RemoteIP:192.0.2.1}
+	// data: &{RemoteIP:192.0.2.1 Tightened:false Allowlisted:false Country: ASN:0 Username: BanChecked:false Banned:false Shadow:false}
 	// pong
 }
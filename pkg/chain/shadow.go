@@ -0,0 +1,52 @@
+package chain
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/tomMoulard/fail2ban/pkg/data"
+	"github.com/tomMoulard/fail2ban/pkg/logger"
+)
+
+// shadow runs a handler in shadow mode: the handler computes its decision and
+// updates its state as usual, but the request is never blocked nor delayed.
+type shadow struct {
+	handler ChainHandler
+}
+
+// Shadow returns the handler in shadow mode. The handler logs the requests it
+// would block, the delays are logged here.
+func Shadow(handler ChainHandler) ChainHandler {
+	return &shadow{handler: handler}
+}
+
+func (s *shadow) ServeHTTP(w http.ResponseWriter, r *http.Request) (*Status, error) {
+	reqData := data.GetData(r)
+	if reqData == nil {
+		return nil, errors.New("failed to get data from request context")
+	}
+
+	reqData.Shadow = true
+	status, err := s.handler.ServeHTTP(w, r)
+	reqData.Shadow = false
+
+	if status == nil || err != nil {
+		return status, err
+	}
+
+	if status.Delay > 0 {
+		logger.Info("Plugin: FailToBan: would delay IP",
+			logger.WithIP(reqData.RemoteIP),
+			logger.WithCountry(reqData.Country),
+			logger.WithASN(reqData.ASN),
+			logger.WithReason("delay "+status.Delay.String()),
+			logger.WithMethod(r.Method),
+			logger.WithPath(r.URL.Path),
+			logger.WithUA(r.UserAgent()),
+		)
+	}
+
+	// The request goes on to the next handlers, which may still enforce their
+	// decisions.
+	return &Status{Break: status.Break, Tighten: status.Tighten}, nil
+}
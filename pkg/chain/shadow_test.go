@@ -0,0 +1,90 @@
+package chain
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/tomMoulard/fail2ban/pkg/data"
+)
+
+type shadowDataHandler struct {
+	status   *Status
+	shadowed bool
+}
+
+func (m *shadowDataHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) (*Status, error) {
+	m.shadowed = data.GetData(r).Shadow
+
+	return m.status, nil
+}
+
+func TestShadow(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name          string
+		status        *Status
+		expectedFinal int
+		expectedData  *data.Data
+	}{
+		{
+			name:          "return",
+			status:        &Status{Return: true},
+			expectedFinal: 1,
+			expectedData:  &data.Data{RemoteIP: "192.0.2.1"},
+		},
+		{
+			name: "response",
+			status: &Status{Return: true, Response: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusTeapot)
+			})},
+			expectedFinal: 1,
+			expectedData:  &data.Data{RemoteIP: "192.0.2.1"},
+		},
+		{
+			name:          "delay",
+			status:        &Status{Delay: time.Hour},
+			expectedFinal: 1,
+			expectedData:  &data.Data{RemoteIP: "192.0.2.1"},
+		},
+		{
+			name:          "tighten",
+			status:        &Status{Tighten: true},
+			expectedFinal: 1,
+			expectedData:  &data.Data{RemoteIP: "192.0.2.1", Tightened: true},
+		},
+		{
+			name:          "break",
+			status:        &Status{Break: true},
+			expectedFinal: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			shadowed := &shadowDataHandler{status: test.status}
+			enforced := &shadowDataHandler{}
+			final := &mockHandler{expectedCalled: test.expectedFinal}
+
+			handlers := []ChainHandler{Shadow(shadowed), enforced}
+			if test.expectedData != nil {
+				handlers = append(handlers, &mockDataHandler{t: t, ExpectData: test.expectedData})
+			}
+
+			ch := New(final, "", handlers...)
+			r := httptest.NewRequest(http.MethodGet, "https://example.com/foo", nil)
+			recorder := httptest.NewRecorder()
+			ch.ServeHTTP(recorder, r)
+
+			assert.True(t, shadowed.shadowed)
+			assert.False(t, enforced.shadowed)
+			assert.Equal(t, http.StatusOK, recorder.Code)
+			final.assert(t)
+		})
+	}
+}
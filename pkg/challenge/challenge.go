@@ -0,0 +1,424 @@
+// Package challenge serves a proof-of-work page to the banned clients instead
+// of a 429: the clients solving it with JavaScript get their ban lifted, and a
+// signed, time-limited cookie lifting the bans older than it (e.g. on another
+// instance).
+package challenge
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/bits"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tomMoulard/fail2ban/pkg/chain"
+	"github.com/tomMoulard/fail2ban/pkg/data"
+	"github.com/tomMoulard/fail2ban/pkg/fail2ban"
+	"github.com/tomMoulard/fail2ban/pkg/logger"
+	utime "github.com/tomMoulard/fail2ban/pkg/utils/time"
+)
+
+const (
+	defaultDifficulty = 16
+	defaultTTL        = time.Hour
+	defaultCookieName = "fail2ban_challenge"
+	defaultPath       = "/.fail2ban/challenge"
+
+	// tokenTTL is how long a puzzle can be solved.
+	tokenTTL = 10 * time.Minute
+	// maxUsedTokens bounds the solved puzzles remembered, until they expire.
+	maxUsedTokens = 10000
+	// maxSolutionSize bounds the size of the solutions read.
+	maxSolutionSize = 1024
+)
+
+// Config of the challenge.
+type Config struct {
+	// Secret is the HMAC key of the puzzles and cookies.
+	Secret []byte
+	// Difficulty is the number of leading zero bits of the solutions hash,
+	// defaults to 16 when nil, 0 accepting any solution.
+	Difficulty *int
+	// TTL is the validity of the cookies, defaults to 1h.
+	TTL time.Duration
+	// CookieName defaults to "fail2ban_challenge".
+	CookieName string
+	// Path receives the solutions, defaults to "/.fail2ban/challenge".
+	Path string
+}
+
+// Challenge challenges the banned clients.
+type Challenge struct {
+	config          Config
+	difficulty      int
+	f2b             *fail2ban.Fail2Ban
+	enableBlockLogs bool
+
+	mu sync.Mutex
+	// used are the solved puzzles, with their expiry, each puzzle being only
+	// accepted once.
+	used map[string]time.Time
+}
+
+// New creates a Challenge.
+func New(config Config, f2b *fail2ban.Fail2Ban, enableBlockLogs bool) (*Challenge, error) {
+	if len(config.Secret) == 0 {
+		return nil, errors.New("secret is required")
+	}
+
+	difficulty := defaultDifficulty
+	if config.Difficulty != nil {
+		difficulty = *config.Difficulty
+	}
+
+	if difficulty < 0 || difficulty > 32 {
+		return nil, fmt.Errorf("invalid difficulty %d: must be between 0 and 32", difficulty)
+	}
+
+	if config.TTL == 0 {
+		config.TTL = defaultTTL
+	}
+
+	if config.CookieName == "" {
+		config.CookieName = defaultCookieName
+	}
+
+	if config.Path == "" {
+		config.Path = defaultPath
+	}
+
+	return &Challenge{
+		config:          config,
+		difficulty:      difficulty,
+		f2b:             f2b,
+		enableBlockLogs: enableBlockLogs,
+		used:            make(map[string]time.Time),
+	}, nil
+}
+
+// Restore takes over the solved puzzles of the previous Challenge of the jail,
+// for them not to be replayed.
+func (c *Challenge) Restore(prev *Challenge) {
+	prev.mu.Lock()
+	used := make(map[string]time.Time, len(prev.used))
+
+	for token, expires := range prev.used {
+		used[token] = expires
+	}
+	prev.mu.Unlock()
+
+	c.mu.Lock()
+	c.used = used
+	c.mu.Unlock()
+}
+
+// ServeHTTP verifies the solutions, and challenges the banned clients, but the
+// ones with a cookie issued after their ban.
+func (c *Challenge) ServeHTTP(w http.ResponseWriter, r *http.Request) (*chain.Status, error) {
+	reqData := data.GetData(r)
+	if reqData == nil {
+		return nil, errors.New("failed to get data from request context")
+	}
+
+	if r.Method == http.MethodPost && r.URL.Path == c.config.Path {
+		return &chain.Status{
+			Return: true,
+			Response: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				c.verify(w, r, reqData)
+			}),
+		}, nil
+	}
+
+	// The fail2ban handler reuses the check, IsNotBanned counting the request.
+	f2b := c.f2b.For(reqData)
+	reqData.BanChecked = true
+	reqData.Banned = !f2b.IsNotBanned(reqData.RemoteIP)
+
+	if !reqData.Banned {
+		return nil, nil
+	}
+
+	// The cookie lifts the bans it was issued after (e.g. by another instance),
+	// the newer ones being challenged again. The next handlers still run.
+	if since, banned := f2b.BannedSince(reqData.RemoteIP); banned && c.cookieIssuedAfter(r, reqData.RemoteIP, since) {
+		f2b.Unban(reqData.RemoteIP)
+		reqData.Banned = false
+
+		return nil, nil
+	}
+
+	c.log(r, reqData, "challenged", http.StatusTooManyRequests)
+
+	token := c.token(reqData.RemoteIP)
+
+	return &chain.Status{
+		Return: true,
+		Response: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			c.page(w, token)
+		}),
+	}, nil
+}
+
+// verify checks the solution of the puzzle, and sets the cookie when solved.
+func (c *Challenge) verify(w http.ResponseWriter, r *http.Request, reqData *data.Data) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxSolutionSize)
+
+	if err := r.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+
+		return
+	}
+
+	token, counter := r.PostForm.Get("token"), r.PostForm.Get("counter")
+	if !c.validToken(token, reqData.RemoteIP) || !c.solved(token, counter) || !c.use(token) {
+		c.log(r, reqData, "challenge failed", http.StatusForbidden)
+		w.WriteHeader(http.StatusForbidden)
+
+		return
+	}
+
+	expires := utime.Now().Add(c.config.TTL)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     c.config.CookieName,
+		Value:    c.cookieValue(reqData.RemoteIP, expires),
+		Path:     "/",
+		Expires:  expires,
+		MaxAge:   int(c.config.TTL.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	c.f2b.For(reqData).Unban(reqData.RemoteIP)
+
+	c.log(r, reqData, "challenge solved", http.StatusNoContent)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// token returns a new puzzle for the IP: "issuedAt.random.signature".
+func (c *Challenge) token(ip string) string {
+	random := make([]byte, 12)
+	_, _ = rand.Read(random)
+
+	payload := strconv.FormatInt(utime.Now().Unix(), 10) + "." + base64.RawURLEncoding.EncodeToString(random)
+
+	return payload + "." + c.sign("token", ip, payload)
+}
+
+// validToken returns whether the puzzle was issued to the IP, less than
+// tokenTTL ago.
+func (c *Challenge) validToken(token, ip string) bool {
+	i := strings.LastIndexByte(token, '.')
+	if i < 0 || !hmac.Equal([]byte(token[i+1:]), []byte(c.sign("token", ip, token[:i]))) {
+		return false
+	}
+
+	issuedAt, _, _ := strings.Cut(token, ".")
+
+	issued, err := strconv.ParseInt(issuedAt, 10, 64)
+	if err != nil {
+		return false
+	}
+
+	return utime.Now().Sub(time.Unix(issued, 0)) <= tokenTTL
+}
+
+// use marks the solved token as used, and returns whether it was not already.
+// When too many tokens are in use, the solutions are rejected until some
+// expire.
+func (c *Challenge) use(token string) bool {
+	now := utime.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if expires, found := c.used[token]; found && now.Before(expires) {
+		return false
+	}
+
+	if len(c.used) >= maxUsedTokens {
+		for t, expires := range c.used {
+			if !now.Before(expires) {
+				delete(c.used, t)
+			}
+		}
+
+		if len(c.used) >= maxUsedTokens {
+			return false
+		}
+	}
+
+	// The token is valid for tokenTTL from its issuance, at most.
+	c.used[token] = now.Add(tokenTTL)
+
+	return true
+}
+
+// solved returns whether the hash of the token and counter has the number of
+// leading zero bits required.
+func (c *Challenge) solved(token, counter string) bool {
+	if counter == "" {
+		return false
+	}
+
+	return leadingZeroBits(sha256.Sum256([]byte(token+":"+counter))) >= c.difficulty
+}
+
+func leadingZeroBits(hash [sha256.Size]byte) int {
+	n := 0
+
+	for _, b := range hash {
+		n += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+
+	return n
+}
+
+// cookieValue returns the cookie letting the IP through until expires:
+// "expires.signature".
+func (c *Challenge) cookieValue(ip string, expires time.Time) string {
+	payload := strconv.FormatInt(expires.Unix(), 10)
+
+	return payload + "." + c.sign("cookie", ip, payload)
+}
+
+// cookieIssuedAfter returns whether the request has a cookie, not expired,
+// issued to the IP after since.
+func (c *Challenge) cookieIssuedAfter(r *http.Request, ip string, since time.Time) bool {
+	cookie, err := r.Cookie(c.config.CookieName)
+	if err != nil {
+		return false
+	}
+
+	payload, signature, found := strings.Cut(cookie.Value, ".")
+	if !found || !hmac.Equal([]byte(signature), []byte(c.sign("cookie", ip, payload))) {
+		return false
+	}
+
+	unix, err := strconv.ParseInt(payload, 10, 64)
+	if err != nil {
+		return false
+	}
+
+	expires := time.Unix(unix, 0)
+
+	return utime.Now().Before(expires) && since.Before(expires.Add(-c.config.TTL))
+}
+
+// sign returns the signature of the payload for the IP, the kind preventing a
+// token from being used as a cookie.
+func (c *Challenge) sign(kind, ip, payload string) string {
+	mac := hmac.New(sha256.New, c.config.Secret)
+	_, _ = mac.Write([]byte(kind + "|" + ip + "|" + payload))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// page writes the puzzle page, solved by the browser.
+func (c *Challenge) page(w http.ResponseWriter, token string) {
+	params, err := json.Marshal(map[string]any{
+		"token":      token,
+		"difficulty": c.difficulty,
+		"path":       c.config.Path,
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusTooManyRequests)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusTooManyRequests)
+
+	if _, err := fmt.Fprintf(w, page, params); err != nil {
+		logger.Error("Plugin: FailToBan: failed to write challenge",
+			logger.WithErr(err.Error()),
+		)
+	}
+}
+
+func (c *Challenge) log(r *http.Request, reqData *data.Data, reason string, code int) {
+	if !c.enableBlockLogs {
+		return
+	}
+
+	msg := "Plugin: FailToBan: IP challenged"
+	if reqData.Shadow {
+		msg = logger.Blocked(true)
+	}
+
+	logger.Info(msg,
+		logger.WithIP(reqData.RemoteIP),
+		logger.WithCountry(reqData.Country),
+		logger.WithASN(reqData.ASN),
+		logger.WithReason(reason),
+		logger.WithStatusCode(code),
+		logger.WithMethod(r.Method),
+		logger.WithPath(r.URL.Path),
+		logger.WithUA(r.UserAgent()),
+	)
+}
+
+// page solves the puzzle: it looks for the counter whose SHA-256 hash, with
+// the token, has difficulty leading zero bits, then posts it and reloads.
+const page = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Checking your browser</title>
+</head>
+<body>
+<p id="status">Checking your browser...</p>
+<noscript><p>JavaScript is required to access this site.</p></noscript>
+<script>
+(async function (params) {
+  const encoder = new TextEncoder();
+
+  function zeroBits(hash) {
+    let n = 0;
+    for (const b of hash) {
+      n += Math.clz32(b) - 24;
+      if (b !== 0) {
+        break;
+      }
+    }
+    return n;
+  }
+
+  for (let counter = 0; ; counter++) {
+    const data = encoder.encode(params.token + ":" + counter);
+    const hash = new Uint8Array(await crypto.subtle.digest("SHA-256", data));
+    if (zeroBits(hash) < params.difficulty) {
+      continue;
+    }
+
+    const resp = await fetch(params.path, {
+      method: "POST",
+      credentials: "same-origin",
+      body: new URLSearchParams({token: params.token, counter: String(counter)}),
+    });
+    if (resp.ok) {
+      location.reload();
+    } else {
+      document.getElementById("status").textContent = "Verification failed.";
+    }
+    return;
+  }
+})(%s);
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,298 @@
+package challenge
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tomMoulard/fail2ban/pkg/chain"
+	"github.com/tomMoulard/fail2ban/pkg/data"
+	"github.com/tomMoulard/fail2ban/pkg/fail2ban"
+	"github.com/tomMoulard/fail2ban/pkg/rules"
+	utime "github.com/tomMoulard/fail2ban/pkg/utils/time"
+)
+
+func newChallenge(t *testing.T) (*Challenge, *fail2ban.Fail2Ban) {
+	t.Helper()
+
+	f2b := fail2ban.New(rules.RulesTransformed{MaxRetry: 3, Bantime: time.Hour, Findtime: time.Hour}, nil)
+
+	difficulty := 8
+
+	c, err := New(Config{Secret: []byte("0123456789abcdef"), Difficulty: &difficulty}, f2b, true)
+	require.NoError(t, err)
+
+	return c, f2b
+}
+
+func newRequest(t *testing.T, method, remoteIP, path string, body io.Reader) *http.Request {
+	t.Helper()
+
+	req := httptest.NewRequest(method, "https://example.com"+path, body)
+	req.RemoteAddr = remoteIP + ":1234"
+
+	req, err := data.ServeHTTP(nil, req, "")
+	require.NoError(t, err)
+
+	return req
+}
+
+// serve runs the challenge handler, and its response if any.
+func serve(t *testing.T, c *Challenge, req *http.Request) (*chain.Status, *httptest.ResponseRecorder) {
+	t.Helper()
+
+	got, err := c.ServeHTTP(nil, req)
+	require.NoError(t, err)
+
+	recorder := httptest.NewRecorder()
+	if got != nil && got.Response != nil {
+		got.Response.ServeHTTP(recorder, req)
+	}
+
+	return got, recorder
+}
+
+// solve finds the counter solving the token, as the page does.
+func solve(t *testing.T, c *Challenge, token string) string {
+	t.Helper()
+
+	for counter := 0; ; counter++ {
+		if c.solved(token, strconv.Itoa(counter)) {
+			return strconv.Itoa(counter)
+		}
+	}
+}
+
+var tokenRegexp = regexp.MustCompile(`"token":"([^"]+)"`)
+
+func TestNew(t *testing.T) {
+	t.Parallel()
+
+	_, err := New(Config{}, nil, false)
+	require.EqualError(t, err, "secret is required")
+
+	difficulty := 33
+
+	_, err = New(Config{Secret: []byte("secret"), Difficulty: &difficulty}, nil, false)
+	require.EqualError(t, err, "invalid difficulty 33: must be between 0 and 32")
+
+	c, err := New(Config{Secret: []byte("secret")}, nil, false)
+	require.NoError(t, err)
+	assert.Equal(t, Config{
+		Secret:     []byte("secret"),
+		TTL:        defaultTTL,
+		CookieName: defaultCookieName,
+		Path:       defaultPath,
+	}, c.config)
+	assert.Equal(t, defaultDifficulty, c.difficulty)
+
+	// A difficulty of 0 is kept, any solution being accepted.
+	difficulty = 0
+
+	c, err = New(Config{Secret: []byte("secret"), Difficulty: &difficulty}, nil, false)
+	require.NoError(t, err)
+	assert.Equal(t, 0, c.difficulty)
+	assert.True(t, c.solved("token", "0"))
+}
+
+func TestChallenge(t *testing.T) {
+	t.Parallel()
+
+	c, f2b := newChallenge(t)
+
+	// Not banned: the request goes on, the fail2ban handler reusing the check.
+	req := newRequest(t, http.MethodGet, "192.0.2.1", "/", nil)
+	got, _ := serve(t, c, req)
+	assert.Nil(t, got)
+	assert.True(t, data.GetData(req).BanChecked)
+	assert.False(t, data.GetData(req).Banned)
+
+	f2b.Ban("192.0.2.1", 0)
+
+	// Banned: the page is served.
+	req = newRequest(t, http.MethodGet, "192.0.2.1", "/", nil)
+	got, recorder := serve(t, c, req)
+	require.NotNil(t, got)
+	assert.True(t, data.GetData(req).Banned)
+	assert.True(t, got.Return)
+	assert.Equal(t, http.StatusTooManyRequests, recorder.Code)
+	assert.Equal(t, "text/html; charset=utf-8", recorder.Header().Get("Content-Type"))
+	assert.Contains(t, recorder.Body.String(), "<noscript>")
+
+	match := tokenRegexp.FindStringSubmatch(recorder.Body.String())
+	require.Len(t, match, 2)
+
+	token := match[1]
+	solution := url.Values{"token": {token}, "counter": {solve(t, c, token)}}.Encode()
+
+	// The solution is bound to the IP.
+	req = newRequest(t, http.MethodPost, "192.0.2.2", defaultPath, strings.NewReader(solution))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	_, recorder = serve(t, c, req)
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	assert.Empty(t, recorder.Result().Cookies())
+
+	req = newRequest(t, http.MethodPost, "192.0.2.1", defaultPath, strings.NewReader(solution))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	_, recorder = serve(t, c, req)
+	assert.Equal(t, http.StatusNoContent, recorder.Code)
+	assert.True(t, f2b.IsNotBanned("192.0.2.1"))
+
+	cookies := recorder.Result().Cookies()
+	require.Len(t, cookies, 1)
+	assert.Equal(t, defaultCookieName, cookies[0].Name)
+	assert.True(t, cookies[0].HttpOnly)
+	assert.Equal(t, http.SameSiteLaxMode, cookies[0].SameSite)
+
+	// The solution is only accepted once.
+	f2b.Ban("192.0.2.1", 0)
+
+	req = newRequest(t, http.MethodPost, "192.0.2.1", defaultPath, strings.NewReader(solution))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	_, recorder = serve(t, c, req)
+	assert.Equal(t, http.StatusForbidden, recorder.Code)
+	assert.False(t, f2b.IsNotBanned("192.0.2.1"))
+
+	// A ban newer than the cookie is challenged again.
+	req = newRequest(t, http.MethodGet, "192.0.2.1", "/", nil)
+	req.AddCookie(cookies[0])
+	got, recorder = serve(t, c, req)
+	require.NotNil(t, got)
+	assert.True(t, got.Return)
+	assert.Equal(t, http.StatusTooManyRequests, recorder.Code)
+
+	// A ban older than the cookie (e.g. on another instance) is lifted, the
+	// next handlers still running.
+	f2b.MuIP.Lock()
+	ip := f2b.IPs["192.0.2.1"]
+	ip.Viewed = ip.Viewed.Add(-10 * time.Minute)
+	f2b.IPs["192.0.2.1"] = ip
+	f2b.MuIP.Unlock()
+
+	req = newRequest(t, http.MethodGet, "192.0.2.1", "/", nil)
+	req.AddCookie(cookies[0])
+	got, _ = serve(t, c, req)
+	assert.Nil(t, got)
+	assert.True(t, f2b.IsNotBanned("192.0.2.1"))
+
+	// Without a ban, the next handlers run.
+	got, _ = serve(t, c, req)
+	assert.Nil(t, got)
+
+	// The cookie is bound to the IP.
+	f2b.Ban("192.0.2.2", 0)
+	f2b.MuIP.Lock()
+	ip = f2b.IPs["192.0.2.2"]
+	ip.Viewed = ip.Viewed.Add(-10 * time.Minute)
+	f2b.IPs["192.0.2.2"] = ip
+	f2b.MuIP.Unlock()
+
+	req = newRequest(t, http.MethodGet, "192.0.2.2", "/", nil)
+	req.AddCookie(cookies[0])
+	got, recorder = serve(t, c, req)
+	require.NotNil(t, got)
+	assert.True(t, got.Return)
+	assert.Equal(t, http.StatusTooManyRequests, recorder.Code)
+}
+
+func TestValidToken(t *testing.T) {
+	t.Parallel()
+
+	c, _ := newChallenge(t)
+	token := c.token("192.0.2.1")
+
+	issuedAt, rest, _ := strings.Cut(token, ".")
+	issued, err := strconv.ParseInt(issuedAt, 10, 64)
+	require.NoError(t, err)
+
+	expired := strconv.FormatInt(issued-int64(2*tokenTTL/time.Second), 10)
+	random, _, _ := strings.Cut(rest, ".")
+	expiredPayload := expired + "." + random
+
+	tests := []struct {
+		name     string
+		token    string
+		expected bool
+	}{
+		{name: "valid", token: token, expected: true},
+		{name: "empty"},
+		{name: "tampered", token: "1" + token},
+		{name: "expired", token: expiredPayload + "." + c.sign("token", "192.0.2.1", expiredPayload)},
+		{name: "cookie", token: c.cookieValue("192.0.2.1", time.Now().Add(time.Hour))},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, test.expected, c.validToken(test.token, "192.0.2.1"))
+		})
+	}
+}
+
+func TestUse(t *testing.T) {
+	t.Parallel()
+
+	c, _ := newChallenge(t)
+
+	assert.True(t, c.use("a"))
+	assert.False(t, c.use("a"))
+	assert.True(t, c.use("b"))
+
+	// Full: the expired tokens are forgotten, else the solutions rejected.
+	for i := range maxUsedTokens - 2 {
+		c.used[strconv.Itoa(i)] = utime.Now().Add(time.Minute)
+	}
+
+	assert.False(t, c.use("c"))
+
+	c.used["0"] = utime.Now().Add(-time.Minute)
+	assert.True(t, c.use("c"))
+	assert.False(t, c.use("c"))
+}
+
+func TestRestore(t *testing.T) {
+	t.Parallel()
+
+	prev, _ := newChallenge(t)
+	assert.True(t, prev.use("a"))
+
+	c, _ := newChallenge(t)
+	c.Restore(prev)
+
+	// The solutions used before the reload are not replayed.
+	assert.False(t, c.use("a"))
+	assert.True(t, c.use("b"))
+	assert.True(t, prev.use("b"))
+}
+
+func TestLeadingZeroBits(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		hash     [32]byte
+		expected int
+	}{
+		{name: "none", hash: [32]byte{0x80}, expected: 0},
+		{name: "within the first byte", hash: [32]byte{0x10}, expected: 3},
+		{name: "across bytes", hash: [32]byte{0, 0, 0x01}, expected: 23},
+		{name: "all", expected: 256},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			assert.Equal(t, test.expected, leadingZeroBits(test.hash))
+		})
+	}
+}
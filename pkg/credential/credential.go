@@ -0,0 +1,324 @@
+// Package credential detects credential stuffing: failed login attempts are
+// counted per username, whatever the IPs they come from, and the usernames
+// with too many failures are locked.
+package credential
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tomMoulard/fail2ban/pkg/chain"
+	"github.com/tomMoulard/fail2ban/pkg/data"
+	"github.com/tomMoulard/fail2ban/pkg/fail2ban"
+	"github.com/tomMoulard/fail2ban/pkg/logger"
+	"github.com/tomMoulard/fail2ban/pkg/response/status"
+	"github.com/tomMoulard/fail2ban/pkg/rules"
+	utime "github.com/tomMoulard/fail2ban/pkg/utils/time"
+)
+
+// maxTrackedUsernames bounds the number of usernames tracked.
+const maxTrackedUsernames = 10000
+
+// Detector detects credential stuffing on the login routes.
+type Detector struct {
+	rule            rules.CredentialStuffingRule
+	codeRanges      status.HTTPCodeRanges
+	f2b             *fail2ban.Fail2Ban
+	enableBlockLogs bool
+
+	mu        sync.Mutex
+	usernames map[string]*attempts
+}
+
+// attempts are the failed attempts of a username.
+type attempts struct {
+	start       time.Time
+	count       int
+	ips         map[string]struct{}
+	lockedUntil time.Time
+}
+
+// New creates a Detector.
+func New(rule rules.CredentialStuffingRule, f2b *fail2ban.Fail2Ban, enableBlockLogs bool) (*Detector, error) {
+	codeRanges, err := status.NewHTTPCodeRanges(strings.Split(rule.StatusCode, ","))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP code ranges: %w", err)
+	}
+
+	return &Detector{
+		rule:            rule,
+		codeRanges:      codeRanges,
+		f2b:             f2b,
+		enableBlockLogs: enableBlockLogs,
+		usernames:       make(map[string]*attempts),
+	}, nil
+}
+
+// Restore takes over the failed attempts and locks of the previous Detector of
+// the jail.
+func (d *Detector) Restore(prev *Detector) {
+	prev.mu.Lock()
+	usernames := make(map[string]*attempts, len(prev.usernames))
+
+	for username, a := range prev.usernames {
+		ips := make(map[string]struct{}, len(a.ips))
+		for ip := range a.ips {
+			ips[ip] = struct{}{}
+		}
+
+		usernames[username] = &attempts{start: a.start, count: a.count, ips: ips, lockedUntil: a.lockedUntil}
+	}
+	prev.mu.Unlock()
+
+	d.mu.Lock()
+	d.usernames = usernames
+	d.mu.Unlock()
+}
+
+// ServeHTTP finds the username of the login attempts, and blocks the attempts
+// on locked usernames.
+func (d *Detector) ServeHTTP(w http.ResponseWriter, r *http.Request) (*chain.Status, error) {
+	reqData := data.GetData(r)
+	if reqData == nil {
+		return nil, errors.New("failed to get data from request context")
+	}
+
+	if !d.isLoginRoute(r) {
+		return nil, nil
+	}
+
+	username, err := d.username(r)
+	if err != nil {
+		// The next handlers still run: failing the chain would let a banned
+		// IP through with a malformed body.
+		logger.Warn("Plugin: FailToBan: failed to read username",
+			logger.WithIP(reqData.RemoteIP),
+			logger.WithErr(err.Error()),
+		)
+
+		return nil, nil
+	}
+
+	if username == "" {
+		return nil, nil
+	}
+
+	reqData.Username = username
+
+	if !d.locked(username) {
+		return nil, nil
+	}
+
+	d.f2b.For(reqData).AddFailure(reqData.RemoteIP, d.rule.Penalty)
+
+	if d.enableBlockLogs {
+		logger.Info(logger.Blocked(reqData.Shadow),
+			logger.WithIP(reqData.RemoteIP),
+			logger.WithCountry(reqData.Country),
+			logger.WithASN(reqData.ASN),
+			logger.WithUser(username),
+			logger.WithReason("username locked"),
+			logger.WithStatusCode(http.StatusTooManyRequests),
+			logger.WithMethod(r.Method),
+			logger.WithPath(r.URL.Path),
+			logger.WithUA(r.UserAgent()),
+		)
+	}
+
+	return &chain.Status{Return: true}, nil
+}
+
+// Observe counts the failed login attempts from the status code of the
+// response, but the allowlisted ones.
+func (d *Detector) Observe(r *http.Request, code int) {
+	reqData := data.GetData(r)
+	if reqData == nil || reqData.Allowlisted || reqData.Username == "" || !d.codeRanges.Contains(code) {
+		return
+	}
+
+	ips := d.fail(reqData.Username, reqData.RemoteIP)
+	if ips == nil {
+		return
+	}
+
+	if d.enableBlockLogs {
+		logger.Info("Plugin: FailToBan: username locked",
+			logger.WithUser(reqData.Username),
+			logger.WithReason("credential stuffing"),
+			logger.WithExpires(utime.Now().Add(d.rule.Locktime)),
+		)
+	}
+
+	// Every IP involved gets a penalty.
+	f2b := d.f2b.For(reqData)
+	for _, ip := range ips {
+		f2b.AddFailure(ip, d.rule.Penalty)
+	}
+}
+
+func (d *Detector) isLoginRoute(r *http.Request) bool {
+	for _, route := range d.rule.Routes {
+		if route.Match(r) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// locked returns whether the username is locked.
+func (d *Detector) locked(username string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	a, found := d.usernames[username]
+
+	return found && utime.Now().Before(a.lockedUntil)
+}
+
+// fail records a failed attempt, and returns the IPs involved when the
+// username gets locked, nil otherwise.
+func (d *Detector) fail(username, ip string) []string {
+	now := utime.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	a, found := d.usernames[username]
+	if found && now.Before(a.lockedUntil) {
+		return nil
+	}
+
+	if !found || now.After(a.start.Add(d.rule.Findtime)) {
+		if !found && len(d.usernames) >= maxTrackedUsernames {
+			d.prune(now)
+
+			if len(d.usernames) >= maxTrackedUsernames {
+				return nil
+			}
+		}
+
+		a = &attempts{start: now, ips: make(map[string]struct{})}
+		d.usernames[username] = a
+	}
+
+	a.count++
+	a.ips[ip] = struct{}{}
+
+	if a.count < d.rule.Threshold {
+		return nil
+	}
+
+	ips := make([]string, 0, len(a.ips))
+	for ip := range a.ips {
+		ips = append(ips, ip)
+	}
+
+	d.usernames[username] = &attempts{
+		start:       now,
+		ips:         make(map[string]struct{}),
+		lockedUntil: now.Add(d.rule.Locktime),
+	}
+
+	return ips
+}
+
+// prune forgets the usernames neither locked nor failing within findtime.
+func (d *Detector) prune(now time.Time) {
+	for username, a := range d.usernames {
+		if now.After(a.start.Add(d.rule.Findtime)) && now.After(a.lockedUntil) {
+			delete(d.usernames, username)
+		}
+	}
+}
+
+// username returns the username of the login attempt, empty if not found. The
+// request body is restored after being read.
+func (d *Detector) username(r *http.Request) (string, error) {
+	if d.rule.BasicAuth {
+		if username, _, ok := r.BasicAuth(); ok {
+			return normalize(username), nil
+		}
+	}
+
+	if r.Body == nil || (d.rule.FormField == "" && d.rule.JSONField == "") {
+		return "", nil
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	var field func(body []byte) string
+
+	switch {
+	case mediaType == "application/x-www-form-urlencoded" && d.rule.FormField != "":
+		field = func(body []byte) string {
+			values, err := url.ParseQuery(string(body))
+			if err != nil {
+				return ""
+			}
+
+			return values.Get(d.rule.FormField)
+		}
+	case (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")) && d.rule.JSONField != "":
+		field = func(body []byte) string {
+			return jsonField(body, d.rule.JSONField)
+		}
+	default:
+		return "", nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, d.rule.MaxBodySize+1))
+
+	// The backend reads the body as if it was never read.
+	r.Body = readCloser{Reader: io.MultiReader(bytes.NewReader(body), r.Body), Closer: r.Body}
+
+	if err != nil {
+		return "", fmt.Errorf("failed to read body: %w", err)
+	}
+
+	if int64(len(body)) > d.rule.MaxBodySize {
+		return "", nil
+	}
+
+	return normalize(field(body)), nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// jsonField returns the string value of the dotted path (e.g. "user.email") in
+// the JSON body, empty if not found.
+func jsonField(body []byte, path string) string {
+	var v any
+	if err := json.Unmarshal(body, &v); err != nil {
+		return ""
+	}
+
+	for _, key := range strings.Split(path, ".") {
+		m, ok := v.(map[string]any)
+		if !ok {
+			return ""
+		}
+
+		v = m[key]
+	}
+
+	s, _ := v.(string)
+
+	return s
+}
+
+func normalize(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
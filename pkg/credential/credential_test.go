@@ -0,0 +1,288 @@
+package credential
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tomMoulard/fail2ban/pkg/chain"
+	"github.com/tomMoulard/fail2ban/pkg/data"
+	"github.com/tomMoulard/fail2ban/pkg/fail2ban"
+	"github.com/tomMoulard/fail2ban/pkg/rules"
+)
+
+func newDetector(t *testing.T, f2b *fail2ban.Fail2Ban) *Detector {
+	t.Helper()
+
+	route, err := rules.CompileMatcher(rules.Urlregexp{Method: "^POST$", Path: "^/login$"})
+	require.NoError(t, err)
+
+	d, err := New(rules.CredentialStuffingRule{
+		Routes:      []*rules.Matcher{route},
+		FormField:   "username",
+		JSONField:   "user.email",
+		BasicAuth:   true,
+		StatusCode:  "401",
+		Threshold:   3,
+		Findtime:    time.Minute,
+		Locktime:    time.Hour,
+		Penalty:     2,
+		MaxBodySize: 64,
+	}, f2b, true)
+	require.NoError(t, err)
+
+	return d
+}
+
+func newRequest(t *testing.T, remoteIP, path, contentType, body string) *http.Request {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, "https://example.com"+path, strings.NewReader(body))
+	req.RemoteAddr = remoteIP + ":1234"
+	req.Header.Set("Content-Type", contentType)
+
+	req, err := data.ServeHTTP(nil, req, "")
+	require.NoError(t, err)
+
+	return req
+}
+
+func TestUsername(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		path        string
+		contentType string
+		body        string
+		basicAuth   string
+		expected    string
+	}{
+		{
+			name:        "form",
+			path:        "/login",
+			contentType: "application/x-www-form-urlencoded",
+			body:        "username=Alice&password=secret",
+			expected:    "alice",
+		},
+		{
+			name:        "json",
+			path:        "/login",
+			contentType: "application/json; charset=utf-8",
+			body:        `{"user":{"email":"bob@example.com"},"password":"secret"}`,
+			expected:    "bob@example.com",
+		},
+		{
+			name:      "basic auth",
+			path:      "/login",
+			basicAuth: "carol",
+			expected:  "carol",
+		},
+		{
+			name:        "body too large",
+			path:        "/login",
+			contentType: "application/x-www-form-urlencoded",
+			body:        "username=alice&password=" + strings.Repeat("a", 64),
+		},
+		{
+			name:        "not a login route",
+			path:        "/register",
+			contentType: "application/x-www-form-urlencoded",
+			body:        "username=alice",
+		},
+		{
+			name:        "unsupported content type",
+			path:        "/login",
+			contentType: "text/plain",
+			body:        "username=alice",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			d := newDetector(t, fail2ban.New(rules.RulesTransformed{MaxRetry: 10}, nil))
+
+			req := newRequest(t, "192.0.2.1", test.path, test.contentType, test.body)
+			if test.basicAuth != "" {
+				req.SetBasicAuth(test.basicAuth, "secret")
+			}
+
+			got, err := d.ServeHTTP(nil, req)
+			require.NoError(t, err)
+			assert.Nil(t, got)
+			assert.Equal(t, test.expected, data.GetData(req).Username)
+
+			// The body is restored for the backend.
+			body, err := io.ReadAll(req.Body)
+			require.NoError(t, err)
+			assert.Equal(t, test.body, string(body))
+		})
+	}
+}
+
+func TestLock(t *testing.T) {
+	t.Parallel()
+
+	f2b := fail2ban.New(rules.RulesTransformed{
+		MaxRetry: 100,
+		Findtime: time.Minute,
+		Bantime:  time.Hour,
+	}, nil)
+	d := newDetector(t, f2b)
+
+	attempt := func(remoteIP, username string, code int) *chain.Status {
+		t.Helper()
+
+		req := newRequest(t, remoteIP, "/login", "application/x-www-form-urlencoded", "username="+username)
+
+		got, err := d.ServeHTTP(nil, req)
+		require.NoError(t, err)
+
+		if got == nil {
+			d.Observe(req, code)
+		}
+
+		return got
+	}
+
+	// Successful attempts are not counted.
+	assert.Nil(t, attempt("192.0.2.1", "alice", http.StatusOK))
+	assert.Nil(t, attempt("192.0.2.1", "alice", http.StatusUnauthorized))
+	assert.Nil(t, attempt("192.0.2.2", "alice", http.StatusUnauthorized))
+	assert.Nil(t, attempt("192.0.2.3", "bob", http.StatusUnauthorized))
+	assert.Nil(t, attempt("192.0.2.3", "ALICE", http.StatusUnauthorized))
+
+	// Every IP involved gets a penalty.
+	assert.InDelta(t, 2, f2b.Score("192.0.2.1"), 0)
+	assert.InDelta(t, 2, f2b.Score("192.0.2.2"), 0)
+	assert.InDelta(t, 2, f2b.Score("192.0.2.3"), 0)
+
+	// The username is locked from every IP, the others are not.
+	assert.Equal(t, &chain.Status{Return: true}, attempt("198.51.100.1", "alice", http.StatusOK))
+	assert.InDelta(t, 2, f2b.Score("198.51.100.1"), 0)
+	assert.Nil(t, attempt("198.51.100.1", "bob", http.StatusOK))
+}
+
+func TestLockAllowlisted(t *testing.T) {
+	t.Parallel()
+
+	f2b := fail2ban.New(rules.RulesTransformed{
+		MaxRetry: 100,
+		Findtime: time.Minute,
+		Bantime:  time.Hour,
+	}, nil)
+	d := newDetector(t, f2b)
+
+	// The failed attempts of the allowlisted clients are not counted.
+	for range 3 {
+		req := newRequest(t, "192.0.2.1", "/login", "application/x-www-form-urlencoded", "username=alice")
+		data.GetData(req).Allowlisted = true
+
+		got, err := d.ServeHTTP(nil, req)
+		require.NoError(t, err)
+		require.Nil(t, got)
+
+		d.Observe(req, http.StatusUnauthorized)
+	}
+
+	assert.Zero(t, f2b.Score("192.0.2.1"))
+	assert.False(t, d.locked("alice"))
+}
+
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) {
+	return 0, errors.New("malformed chunked encoding")
+}
+
+func TestBodyReadError(t *testing.T) {
+	t.Parallel()
+
+	d := newDetector(t, fail2ban.New(rules.RulesTransformed{MaxRetry: 1}, nil))
+
+	req := httptest.NewRequest(http.MethodPost, "https://example.com/login", errReader{})
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	req, err := data.ServeHTTP(nil, req, "")
+	require.NoError(t, err)
+
+	// The next handlers (e.g. the ban check) still run.
+	got, err := d.ServeHTTP(nil, req)
+	require.NoError(t, err)
+	assert.Nil(t, got)
+	assert.Empty(t, data.GetData(req).Username)
+}
+
+func TestLockTightened(t *testing.T) {
+	t.Parallel()
+
+	tightened := rules.RulesTransformed{MaxRetry: 100, Findtime: time.Minute, Bantime: time.Hour}
+	f2b := fail2ban.New(rules.RulesTransformed{
+		MaxRetry:  100,
+		Findtime:  time.Minute,
+		Bantime:   time.Hour,
+		Tightened: &tightened,
+	}, nil)
+	d := newDetector(t, f2b)
+
+	for range 3 {
+		req := newRequest(t, "192.0.2.1", "/login", "application/x-www-form-urlencoded", "username=alice")
+		data.GetData(req).Tightened = true
+
+		got, err := d.ServeHTTP(nil, req)
+		require.NoError(t, err)
+		require.Nil(t, got)
+
+		d.Observe(req, http.StatusUnauthorized)
+	}
+
+	// The penalty goes to the jail of the request.
+	assert.Zero(t, f2b.Score("192.0.2.1"))
+	assert.InDelta(t, 2, f2b.For(&data.Data{Tightened: true}).Score("192.0.2.1"), 0)
+}
+
+func TestRestore(t *testing.T) {
+	t.Parallel()
+
+	f2b := fail2ban.New(rules.RulesTransformed{
+		MaxRetry: 100,
+		Findtime: time.Minute,
+		Bantime:  time.Hour,
+	}, nil)
+
+	fail := func(d *Detector, remoteIP string) *chain.Status {
+		t.Helper()
+
+		req := newRequest(t, remoteIP, "/login", "application/x-www-form-urlencoded", "username=alice")
+
+		got, err := d.ServeHTTP(nil, req)
+		require.NoError(t, err)
+
+		if got == nil {
+			d.Observe(req, http.StatusUnauthorized)
+		}
+
+		return got
+	}
+
+	prev := newDetector(t, f2b)
+	assert.Nil(t, fail(prev, "192.0.2.1"))
+	assert.Nil(t, fail(prev, "192.0.2.2"))
+
+	// The attempts before the reload count towards the lock.
+	d := newDetector(t, f2b)
+	d.Restore(prev)
+	assert.Nil(t, fail(d, "192.0.2.3"))
+	assert.Equal(t, &chain.Status{Return: true}, fail(d, "192.0.2.4"))
+
+	// The previous detector is left untouched.
+	assert.Nil(t, fail(prev, "192.0.2.4"))
+}
@@ -19,6 +19,27 @@ const headerSplitLimit = 2
 
 type Data struct {
 	RemoteIP string
+	// Tightened is set when the request must be evaluated against the
+	// stricter rules.
+	Tightened bool
+	// Allowlisted is set when the request comes from an allowlisted client,
+	// whose failures must not be counted.
+	Allowlisted bool
+	// Country is the ISO code of the client country, when geoip is enabled.
+	Country string
+	// ASN is the client autonomous system number, when geoip is enabled.
+	ASN uint32
+	// Username is the username of a login attempt, when credential stuffing
+	// detection is enabled.
+	Username string
+	// BanChecked is set once a handler checked whether the client is banned,
+	// Banned holding the result, for the next handlers not to count the
+	// request again.
+	BanChecked bool
+	Banned     bool
+	// Shadow is set while the request is evaluated by a handler in shadow
+	// mode, whose decisions are logged but not enforced.
+	Shadow bool
 }
 
 // ServeHTTP sets data in the request context, to be extracted with GetData.
@@ -0,0 +1,96 @@
+// Package events is the bus of the ban decisions, notifying the sinks (e.g.
+// webhooks) of the failures, bans, unbans and static blocks.
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// Type is the type of an event.
+type Type string
+
+// Types of the events.
+const (
+	// Ban is emitted when an IP gets banned.
+	Ban Type = "ban"
+	// Unban is emitted when the ban of an IP is lifted (e.g. a solved
+	// challenge).
+	Unban Type = "unban"
+	// Expire is emitted when the ban of an IP is found expired, on its next
+	// request.
+	Expire Type = "expire"
+	// StaticBlock is emitted when a request is blocked by the denylist.
+	StaticBlock Type = "static_block"
+	// Failure is emitted when a failure of an IP is counted, without banning
+	// it.
+	Failure Type = "failure"
+)
+
+// Types are all the types of events.
+var Types = []Type{Ban, Unban, Expire, StaticBlock, Failure}
+
+// Decisions are the types of events changing whether an IP is blocked.
+var Decisions = []Type{Ban, Unban, Expire, StaticBlock}
+
+// Event is a ban decision.
+type Event struct {
+	Type Type `json:"type"`
+	// Jail is the name of the middleware.
+	Jail string `json:"jail"`
+	IP   string `json:"ip"`
+	// Reason is the note of the denylist entry for static blocks, and
+	// threshold or rule for bans.
+	Reason string `json:"reason,omitempty"`
+	// Score is the score of the IP on failures and bans.
+	Score float64 `json:"score,omitempty"`
+	// Expires is when the ban ends, RFC3339 formatted.
+	Expires string `json:"expires,omitempty"`
+	// Shadow is set on the events of a jail in shadow mode, the IP not being
+	// blocked.
+	Shadow bool      `json:"shadow,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// Sink receives the events. Send must not block, nor call back the emitter.
+type Sink interface {
+	Send(e Event)
+}
+
+// Bus dispatches the events of a jail to its sinks. A nil Bus drops the
+// events.
+type Bus struct {
+	jail string
+
+	mu    sync.RWMutex
+	sinks []Sink
+}
+
+// New creates the Bus of the jail.
+func New(jail string) *Bus {
+	return &Bus{jail: jail}
+}
+
+// Subscribe sends the next events to the sink.
+func (b *Bus) Subscribe(s Sink) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.sinks = append(b.sinks, s)
+}
+
+// Publish sends the event to every sink.
+func (b *Bus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+
+	e.Jail = b.jail
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, s := range b.sinks {
+		s.Send(e)
+	}
+}
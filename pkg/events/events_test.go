@@ -0,0 +1,48 @@
+package events
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recorder struct {
+	events []Event
+}
+
+func (r *recorder) Send(e Event) {
+	r.events = append(r.events, e)
+}
+
+func TestBus(t *testing.T) {
+	t.Parallel()
+
+	bus := New("jail")
+
+	// No sink yet.
+	bus.Publish(Event{Type: Ban, IP: "192.0.2.1"})
+
+	a, b := &recorder{}, &recorder{}
+	bus.Subscribe(a)
+	bus.Subscribe(b)
+
+	bus.Publish(Event{Type: Ban, IP: "192.0.2.2"})
+	bus.Publish(Event{Type: Unban, IP: "192.0.2.2"})
+
+	expected := []Event{
+		{Type: Ban, Jail: "jail", IP: "192.0.2.2"},
+		{Type: Unban, Jail: "jail", IP: "192.0.2.2"},
+	}
+	assert.Equal(t, expected, a.events)
+	assert.Equal(t, expected, b.events)
+}
+
+func TestNilBus(t *testing.T) {
+	t.Parallel()
+
+	var bus *Bus
+
+	assert.NotPanics(t, func() {
+		bus.Publish(Event{Type: Ban, IP: "192.0.2.1"})
+	})
+}
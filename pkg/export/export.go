@@ -0,0 +1,346 @@
+// Package export writes the banned IPs to a file, periodically, for the host
+// firewall to block them before they reach the proxy.
+package export
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tomMoulard/fail2ban/pkg/fail2ban"
+	"github.com/tomMoulard/fail2ban/pkg/logger"
+	utime "github.com/tomMoulard/fail2ban/pkg/utils/time"
+)
+
+// Formats of the exported file.
+const (
+	// FormatNftables is a nftables script (nft -f), filling a set per family
+	// with timeouts.
+	FormatNftables = "nftables"
+	// FormatIpset is an ipset restore script (ipset restore -f), filling a set
+	// per family with timeouts.
+	FormatIpset = "ipset"
+	// FormatCIDR is a plain list of CIDRs, one per line.
+	FormatCIDR = "cidr"
+)
+
+const (
+	defaultInterval = 10 * time.Second
+	defaultTable    = "fail2ban"
+	defaultSet      = "fail2ban"
+)
+
+// Config of the exporter.
+type Config struct {
+	Path   string
+	Format string
+	// Interval between two exports, defaults to 10s.
+	Interval time.Duration
+	// Table is the nftables table, defaults to "fail2ban".
+	Table string
+	// Set is the prefix of the sets, suffixed with the family (e.g.
+	// "fail2ban_v4"), defaults to "fail2ban".
+	Set string
+}
+
+// Exporter writes the bans of the jails exporting to a path to the file.
+type Exporter struct {
+	mu     sync.Mutex
+	config Config
+	// jails are the bans of the jails by name.
+	jails map[string]source
+	// cancel stops Run, nil while the exporter has no jails.
+	cancel context.CancelFunc
+}
+
+// source is the bans of a jail, with the IPs it never exports.
+type source struct {
+	f2b *fail2ban.Fail2Ban
+	// exempt returns whether the IP is allowed, nil when none is.
+	exempt func(remoteIP string) bool
+}
+
+var (
+	exportersMu sync.Mutex
+	// exporters are the exporters by path.
+	exporters = make(map[string]*Exporter)
+)
+
+// Open returns the Exporter of the path. The jails exporting to the same path
+// share the Exporter, using the last configuration given.
+func Open(config Config) (*Exporter, error) {
+	e, err := New(config)
+	if err != nil {
+		return nil, err
+	}
+
+	exportersMu.Lock()
+	defer exportersMu.Unlock()
+
+	if prev, ok := exporters[config.Path]; ok {
+		prev.mu.Lock()
+		prev.config = e.config
+		prev.mu.Unlock()
+
+		return prev, nil
+	}
+
+	exporters[config.Path] = e
+
+	return e, nil
+}
+
+// New creates an Exporter, without jails.
+func New(config Config) (*Exporter, error) {
+	if config.Path == "" {
+		return nil, errors.New("path is required")
+	}
+
+	switch config.Format {
+	case FormatNftables, FormatIpset, FormatCIDR:
+	default:
+		return nil, fmt.Errorf("unknown format %q", config.Format)
+	}
+
+	if config.Interval == 0 {
+		config.Interval = defaultInterval
+	}
+
+	if config.Table == "" {
+		config.Table = defaultTable
+	}
+
+	if config.Set == "" {
+		config.Set = defaultSet
+	}
+
+	return &Exporter{config: config, jails: make(map[string]source)}, nil
+}
+
+// Add exports the bans of the jail until the context is done, replacing the
+// previous Fail2Ban of the jail. The bans of the IPs exempt returns true for
+// (e.g. allowlisted) are not exported, exempt being optional. The exporter
+// runs while it has jails.
+func (e *Exporter) Add(ctx context.Context, jail string, f2b *fail2ban.Fail2Ban, exempt func(remoteIP string) bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.jails[jail] = source{f2b: f2b, exempt: exempt}
+
+	if e.cancel == nil {
+		runCtx, cancel := context.WithCancel(context.Background())
+		e.cancel = cancel
+
+		go e.Run(runCtx)
+	}
+
+	go func() {
+		<-ctx.Done()
+		e.remove(jail, f2b)
+	}()
+}
+
+// remove stops exporting the bans of the jail, unless it was replaced.
+func (e *Exporter) remove(jail string, f2b *fail2ban.Fail2Ban) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.jails[jail].f2b != f2b {
+		return
+	}
+
+	delete(e.jails, jail)
+
+	if len(e.jails) == 0 && e.cancel != nil {
+		e.cancel()
+		e.cancel = nil
+	}
+}
+
+// Run exports the bans every interval, until the context is done.
+func (e *Exporter) Run(ctx context.Context) {
+	e.mu.Lock()
+	interval := e.config.Interval
+	e.mu.Unlock()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := e.Export(); err != nil {
+			logger.Error("Plugin: FailToBan: failed to export bans",
+				logger.WithErr(err.Error()),
+			)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Export writes the bans of every jail to the file, atomically: the file is
+// written next to it, then renamed.
+func (e *Exporter) Export() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	content := e.render(e.bans(), utime.Now())
+
+	tmp, err := os.CreateTemp(filepath.Dir(e.config.Path), "."+filepath.Base(e.config.Path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+
+	if _, err := tmp.Write(content); err != nil {
+		_ = tmp.Close()
+
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close file: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), e.config.Path); err != nil {
+		return fmt.Errorf("failed to rename file: %w", err)
+	}
+
+	return nil
+}
+
+// bans returns the bans of every jail, sorted by IP, the latest expiry of an IP
+// banned by several jails being kept. The IPs exempt by a jail are skipped.
+func (e *Exporter) bans() []fail2ban.Ban {
+	expires := make(map[string]time.Time)
+
+	for _, s := range e.jails {
+		for _, b := range s.f2b.Bans() {
+			if s.exempt != nil && s.exempt(b.IP) {
+				continue
+			}
+
+			if b.Expires.After(expires[b.IP]) {
+				expires[b.IP] = b.Expires
+			}
+		}
+	}
+
+	result := make([]fail2ban.Ban, 0, len(expires))
+	for ip, end := range expires {
+		result = append(result, fail2ban.Ban{IP: ip, Expires: end})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].IP < result[j].IP
+	})
+
+	return result
+}
+
+// ban is an active ban, ready to be exported.
+type ban struct {
+	cidr    string
+	ipv6    bool
+	timeout int64 // seconds
+}
+
+// bans returns the bans with their remaining bantime, in seconds rounded up.
+// The IPs that cannot be parsed are skipped.
+func bans(f2bBans []fail2ban.Ban, now time.Time) []ban {
+	result := make([]ban, 0, len(f2bBans))
+
+	for _, b := range f2bBans {
+		ip := net.ParseIP(b.IP)
+		if ip == nil {
+			continue
+		}
+
+		timeout := int64(math.Ceil(b.Expires.Sub(now).Seconds()))
+		if timeout < 1 {
+			timeout = 1
+		}
+
+		if ip4 := ip.To4(); ip4 != nil {
+			result = append(result, ban{cidr: ip4.String() + "/32", timeout: timeout})
+		} else {
+			result = append(result, ban{cidr: ip.String() + "/128", ipv6: true, timeout: timeout})
+		}
+	}
+
+	return result
+}
+
+// render returns the content of the file.
+func (e *Exporter) render(f2bBans []fail2ban.Ban, now time.Time) []byte {
+	var buf bytes.Buffer
+
+	switch e.config.Format {
+	case FormatNftables:
+		e.nftables(&buf, bans(f2bBans, now))
+	case FormatIpset:
+		e.ipset(&buf, bans(f2bBans, now))
+	default:
+		for _, b := range bans(f2bBans, now) {
+			fmt.Fprintln(&buf, b.cidr)
+		}
+	}
+
+	return buf.Bytes()
+}
+
+// nftables writes a script creating the table and sets when missing, then
+// replacing the elements of the sets.
+func (e *Exporter) nftables(buf *bytes.Buffer, bans []ban) {
+	table, v4, v6 := e.config.Table, e.config.Set+"_v4", e.config.Set+"_v6"
+
+	fmt.Fprintf(buf, "table inet %s {\n", table)
+	fmt.Fprintf(buf, "\tset %s {\n\t\ttype ipv4_addr\n\t\tflags interval, timeout\n\t}\n", v4)
+	fmt.Fprintf(buf, "\tset %s {\n\t\ttype ipv6_addr\n\t\tflags interval, timeout\n\t}\n", v6)
+	fmt.Fprintf(buf, "}\n")
+	fmt.Fprintf(buf, "flush set inet %s %s\n", table, v4)
+	fmt.Fprintf(buf, "flush set inet %s %s\n", table, v6)
+
+	for _, b := range bans {
+		set := v4
+		if b.ipv6 {
+			set = v6
+		}
+
+		fmt.Fprintf(buf, "add element inet %s %s { %s timeout %ds }\n", table, set, b.cidr, b.timeout)
+	}
+}
+
+// ipset writes a script creating the sets when missing, then replacing their
+// entries.
+func (e *Exporter) ipset(buf *bytes.Buffer, bans []ban) {
+	v4, v6 := e.config.Set+"_v4", e.config.Set+"_v6"
+
+	fmt.Fprintf(buf, "create %s hash:net family inet timeout 0 -exist\n", v4)
+	fmt.Fprintf(buf, "create %s hash:net family inet6 timeout 0 -exist\n", v6)
+	fmt.Fprintf(buf, "flush %s\n", v4)
+	fmt.Fprintf(buf, "flush %s\n", v6)
+
+	for _, b := range bans {
+		set := v4
+		if b.ipv6 {
+			set = v6
+		}
+
+		fmt.Fprintf(buf, "add %s %s timeout %d -exist\n", set, b.cidr, b.timeout)
+	}
+}
@@ -0,0 +1,236 @@
+package export
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tomMoulard/fail2ban/pkg/fail2ban"
+	"github.com/tomMoulard/fail2ban/pkg/rules"
+)
+
+var (
+	now      = time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	testBans = []fail2ban.Ban{
+		{IP: "192.0.2.1", Expires: now.Add(300 * time.Second)},
+		{IP: "2001:db8::1", Expires: now.Add(time.Hour)},
+		{IP: "198.51.100.1", Expires: now.Add(1500 * time.Millisecond)},
+		{IP: "not-an-ip", Expires: now.Add(time.Hour)},
+	}
+)
+
+func TestNew(t *testing.T) {
+	t.Parallel()
+
+	_, err := New(Config{Format: FormatCIDR})
+	require.EqualError(t, err, "path is required")
+
+	_, err = New(Config{Path: "bans", Format: "iptables"})
+	require.EqualError(t, err, `unknown format "iptables"`)
+
+	e, err := New(Config{Path: "bans", Format: FormatCIDR})
+	require.NoError(t, err)
+	assert.Equal(t, Config{
+		Path:     "bans",
+		Format:   FormatCIDR,
+		Interval: defaultInterval,
+		Table:    defaultTable,
+		Set:      defaultSet,
+	}, e.config)
+}
+
+func TestRender(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		format   string
+		bans     []fail2ban.Ban
+		expected string
+	}{
+		{
+			format: FormatNftables,
+			bans:   testBans,
+			expected: `table inet fail2ban {
+	set fail2ban_v4 {
+		type ipv4_addr
+		flags interval, timeout
+	}
+	set fail2ban_v6 {
+		type ipv6_addr
+		flags interval, timeout
+	}
+}
+flush set inet fail2ban fail2ban_v4
+flush set inet fail2ban fail2ban_v6
+add element inet fail2ban fail2ban_v4 { 192.0.2.1/32 timeout 300s }
+add element inet fail2ban fail2ban_v6 { 2001:db8::1/128 timeout 3600s }
+add element inet fail2ban fail2ban_v4 { 198.51.100.1/32 timeout 2s }
+`,
+		},
+		{
+			format: FormatNftables,
+			expected: `table inet fail2ban {
+	set fail2ban_v4 {
+		type ipv4_addr
+		flags interval, timeout
+	}
+	set fail2ban_v6 {
+		type ipv6_addr
+		flags interval, timeout
+	}
+}
+flush set inet fail2ban fail2ban_v4
+flush set inet fail2ban fail2ban_v6
+`,
+		},
+		{
+			format: FormatIpset,
+			bans:   testBans,
+			expected: `create fail2ban_v4 hash:net family inet timeout 0 -exist
+create fail2ban_v6 hash:net family inet6 timeout 0 -exist
+flush fail2ban_v4
+flush fail2ban_v6
+add fail2ban_v4 192.0.2.1/32 timeout 300 -exist
+add fail2ban_v6 2001:db8::1/128 timeout 3600 -exist
+add fail2ban_v4 198.51.100.1/32 timeout 2 -exist
+`,
+		},
+		{
+			format: FormatCIDR,
+			bans:   testBans,
+			expected: `192.0.2.1/32
+2001:db8::1/128
+198.51.100.1/32
+`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.format, func(t *testing.T) {
+			t.Parallel()
+
+			e, err := New(Config{Path: "bans", Format: test.format})
+			require.NoError(t, err)
+
+			assert.Equal(t, test.expected, string(e.render(test.bans, now)))
+		})
+	}
+}
+
+func TestExport(t *testing.T) {
+	t.Parallel()
+
+	f2b := fail2ban.New(rules.RulesTransformed{MaxRetry: 1, Findtime: time.Hour, Bantime: time.Hour}, nil)
+	f2b.Ban("192.0.2.1", 0)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "bans.txt")
+
+	e, err := New(Config{Path: path, Format: FormatCIDR})
+	require.NoError(t, err)
+
+	e.jails["jail"] = source{f2b: f2b}
+	require.NoError(t, e.Export())
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "192.0.2.1/32\n", string(content))
+
+	f2b.Unban("192.0.2.1")
+	require.NoError(t, e.Export())
+
+	content, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Empty(t, content)
+
+	// No temporary file is left behind.
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestExportJails(t *testing.T) {
+	t.Parallel()
+
+	newF2B := func(bantime time.Duration) *fail2ban.Fail2Ban {
+		return fail2ban.New(rules.RulesTransformed{MaxRetry: 1, Findtime: time.Hour, Bantime: bantime}, nil)
+	}
+
+	a, b := newF2B(time.Hour), newF2B(2*time.Hour)
+	a.Ban("192.0.2.1", 0)
+	a.Ban("192.0.2.2", 0)
+	b.Ban("192.0.2.2", 0)
+
+	e, err := New(Config{Path: "bans", Format: FormatCIDR})
+	require.NoError(t, err)
+
+	e.jails["a"] = source{f2b: a}
+	e.jails["b"] = source{f2b: b}
+
+	// The IPs banned by both jails are exported once, with the latest expiry.
+	assert.Equal(t, []fail2ban.Ban{
+		{IP: "192.0.2.1", Expires: a.Bans()[0].Expires},
+		{IP: "192.0.2.2", Expires: b.Bans()[0].Expires},
+	}, e.bans())
+}
+
+func TestExportExempt(t *testing.T) {
+	t.Parallel()
+
+	f2b := fail2ban.New(rules.RulesTransformed{MaxRetry: 1, Findtime: time.Hour, Bantime: time.Hour}, nil)
+	f2b.Ban("192.0.2.1", 0)
+	f2b.Ban("192.0.2.2", 0)
+
+	e, err := New(Config{Path: "bans", Format: FormatCIDR})
+	require.NoError(t, err)
+
+	// The exempt IPs (e.g. verified hostnames) are not exported.
+	e.jails["jail"] = source{f2b: f2b, exempt: func(remoteIP string) bool {
+		return remoteIP == "192.0.2.2"
+	}}
+
+	assert.Equal(t, []fail2ban.Ban{{IP: "192.0.2.1", Expires: f2b.Bans()[0].Expires}}, e.bans())
+}
+
+func TestOpen(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "bans.txt")
+
+	e, err := Open(Config{Path: path, Format: FormatCIDR})
+	require.NoError(t, err)
+
+	// The exporters of a path are shared, with the last configuration.
+	shared, err := Open(Config{Path: path, Format: FormatIpset})
+	require.NoError(t, err)
+	assert.Same(t, e, shared)
+	assert.Equal(t, FormatIpset, e.config.Format)
+
+	_, err = Open(Config{Path: path, Format: "iptables"})
+	require.EqualError(t, err, `unknown format "iptables"`)
+
+	f2b := fail2ban.New(rules.RulesTransformed{MaxRetry: 1, Findtime: time.Hour, Bantime: time.Hour}, nil)
+	reloaded := fail2ban.New(rules.RulesTransformed{MaxRetry: 1, Findtime: time.Hour, Bantime: time.Hour}, nil)
+
+	e.Add(t.Context(), "jail", f2b, nil)
+	e.Add(t.Context(), "jail", reloaded, nil)
+
+	// The reloaded jail stays exported once the previous one is gone.
+	e.remove("jail", f2b)
+
+	e.mu.Lock()
+	assert.Same(t, reloaded, e.jails["jail"].f2b)
+	assert.NotNil(t, e.cancel)
+	e.mu.Unlock()
+
+	e.remove("jail", reloaded)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	assert.Empty(t, e.jails)
+	assert.Nil(t, e.cancel)
+}
@@ -2,8 +2,13 @@
 package fail2ban
 
 import (
+	"net/http"
+	"sort"
 	"sync"
+	"time"
 
+	"github.com/tomMoulard/fail2ban/pkg/data"
+	"github.com/tomMoulard/fail2ban/pkg/events"
 	"github.com/tomMoulard/fail2ban/pkg/ipchecking"
 	"github.com/tomMoulard/fail2ban/pkg/rules"
 	utime "github.com/tomMoulard/fail2ban/pkg/utils/time"
@@ -16,20 +21,119 @@ type Fail2Ban struct {
 	MuIP      sync.Mutex
 	IPs       map[string]ipchecking.IPViewed
 	allowList ipchecking.NetIPs
+
+	// tightened is the Fail2Ban used for tightened requests, with its own
+	// state, nil when no stricter rules are configured.
+	tightened *Fail2Ban
+
+	// events is notified of the failures, bans, unbans and expiries, nil when
+	// unused.
+	events *events.Bus
+	// shadow tags the events, the bans of the jail not being enforced.
+	shadow bool
 }
 
 // New creates a new Fail2Ban.
 func New(rules rules.RulesTransformed, allowList ipchecking.NetIPs) *Fail2Ban {
-	return &Fail2Ban{
+	f2b := &Fail2Ban{
 		rules:     rules,
 		IPs:       make(map[string]ipchecking.IPViewed),
 		allowList: allowList,
 	}
+
+	if rules.Tightened != nil {
+		f2b.tightened = New(*rules.Tightened, allowList)
+	}
+
+	return f2b
+}
+
+// WithEvents publishes the failures, bans, unbans and expiries on the bus.
+func (u *Fail2Ban) WithEvents(bus *events.Bus) {
+	u.events = bus
+
+	if u.tightened != nil {
+		u.tightened.WithEvents(bus)
+	}
+}
+
+// WithShadow tags the events as shadow ones, the bans not being enforced.
+func (u *Fail2Ban) WithShadow() {
+	u.shadow = true
+
+	if u.tightened != nil {
+		u.tightened.WithShadow()
+	}
+}
+
+// Reasons of the bans.
+const (
+	// reasonThreshold is for the bans of the IPs reaching the threshold.
+	reasonThreshold = "threshold"
+	// reasonRule is for the bans given by a rule (e.g. a trap).
+	reasonRule = "rule"
+)
+
+// publish publishes the event of the IP. It is called with MuIP held, the sinks
+// not blocking.
+func (u *Fail2Ban) publish(t events.Type, reason, remoteIP string, ip ipchecking.IPViewed) {
+	e := events.Event{
+		Type:   t,
+		IP:     remoteIP,
+		Reason: reason,
+		Shadow: u.shadow,
+		Time:   utime.Now(),
+	}
+
+	switch t {
+	case events.Failure:
+		e.Score = ip.Score
+	case events.Ban:
+		e.Score = ip.Score
+		e.Expires = ip.Viewed.Add(u.bantime(ip)).UTC().Format(time.RFC3339)
+	}
+
+	u.events.Publish(e)
+}
+
+// Restore takes over the bans and failures of the previous Fail2Ban of the
+// jail.
+func (u *Fail2Ban) Restore(prev *Fail2Ban) {
+	prev.MuIP.Lock()
+	ips := make(map[string]ipchecking.IPViewed, len(prev.IPs))
+
+	for ip, viewed := range prev.IPs {
+		ips[ip] = viewed
+	}
+	prev.MuIP.Unlock()
+
+	u.MuIP.Lock()
+	u.IPs = ips
+	u.MuIP.Unlock()
+
+	if u.tightened != nil && prev.tightened != nil {
+		u.tightened.Restore(prev.tightened)
+	}
+}
+
+// For returns the Fail2Ban the request must be evaluated against.
+func (u *Fail2Ban) For(reqData *data.Data) *Fail2Ban {
+	if reqData != nil && reqData.Tightened && u.tightened != nil {
+		return u.tightened
+	}
+
+	return u
 }
 
 // ShouldAllow check if the request should be allowed.
 // Called when a request was DENIED - increments the denied counter.
 func (u *Fail2Ban) ShouldAllow(remoteIP string) bool {
+	return u.AddFailure(remoteIP, 1)
+}
+
+// AddFailure increments the failure counter of the IP, adds weight to its
+// score, and returns whether the request should be allowed.
+func (u *Fail2Ban) AddFailure(remoteIP string, weight float64) bool {
 	if u.allowList != nil && u.allowList.Contains(remoteIP) {
 		return true
 	}
@@ -40,42 +144,38 @@ func (u *Fail2Ban) ShouldAllow(remoteIP string) bool {
 	ip, foundIP := u.IPs[remoteIP]
 
 	if !foundIP {
-		u.IPs[remoteIP] = ipchecking.IPViewed{
-			Viewed: utime.Now(),
-			Count:  1,
-		}
-
-		return true
+		return u.firstFailure(remoteIP, weight)
 	}
 
 	if ip.Denied {
-		if utime.Now().Before(ip.Viewed.Add(u.rules.Bantime)) {
+		if utime.Now().Before(ip.Viewed.Add(u.bantime(ip))) {
 			u.IPs[remoteIP] = ipchecking.IPViewed{
-				Viewed: ip.Viewed,
-				Count:  ip.Count + 1,
-				Denied: true,
+				Viewed:  ip.Viewed,
+				Count:   ip.Count + 1,
+				Denied:  true,
+				Score:   ip.Score + weight,
+				Bantime: ip.Bantime,
 			}
 
 			return false
 		}
 
-		u.IPs[remoteIP] = ipchecking.IPViewed{
-			Viewed: utime.Now(),
-			Count:  1,
-			Denied: false,
-		}
+		u.publish(events.Expire, "", remoteIP, ip)
 
-		return true
+		return u.firstFailure(remoteIP, weight)
 	}
 
 	if utime.Now().Before(ip.Viewed.Add(u.rules.Findtime)) {
-		if ip.Count+1 >= u.rules.MaxRetry {
+		if ip.Score+weight >= u.threshold() {
 			u.IPs[remoteIP] = ipchecking.IPViewed{
 				Viewed: utime.Now(),
 				Count:  ip.Count + 1,
 				Denied: true,
+				Score:  ip.Score + weight,
 			}
 
+			u.publish(events.Ban, reasonThreshold, remoteIP, u.IPs[remoteIP])
+
 			return false
 		}
 
@@ -83,20 +183,292 @@ func (u *Fail2Ban) ShouldAllow(remoteIP string) bool {
 			Viewed: ip.Viewed,
 			Count:  ip.Count + 1,
 			Denied: false,
+			Score:  ip.Score + weight,
 		}
+		u.publish(events.Failure, "", remoteIP, u.IPs[remoteIP])
 
 		return true
 	}
 
-	u.IPs[remoteIP] = ipchecking.IPViewed{
+	return u.firstFailure(remoteIP, weight)
+}
+
+// firstFailure starts a findtime window with the failure, banning the IP right
+// away when the failure alone, heavier than a plain one, reaches the threshold:
+// a plain first failure never bans, as with maxretry 1. It is called with MuIP
+// held.
+func (u *Fail2Ban) firstFailure(remoteIP string, weight float64) bool {
+	ip := ipchecking.IPViewed{
 		Viewed: utime.Now(),
 		Count:  1,
-		Denied: false,
+		Denied: weight > 1 && weight >= u.threshold(),
+		Score:  weight,
+	}
+	u.IPs[remoteIP] = ip
+
+	if ip.Denied {
+		u.publish(events.Ban, reasonThreshold, remoteIP, ip)
+
+		return false
 	}
 
+	u.publish(events.Failure, "", remoteIP, ip)
+
 	return true
 }
 
+// CountsRequests returns whether every request is counted (see AddRequest),
+// not only the failures.
+func (u *Fail2Ban) CountsRequests() bool {
+	return u.rules.CountRequests
+}
+
+// AddRequest counts the request in the requests count mode, adding its cost to
+// the score of the IP. The request reaching the threshold bans the IP from the
+// next one.
+func (u *Fail2Ban) AddRequest(remoteIP string, r *http.Request) {
+	u.AddFailure(remoteIP, u.Cost(r))
+}
+
+// Cost returns the cost of the request: the weight of the first matching cost
+// rule, 1 when none matches.
+func (u *Fail2Ban) Cost(r *http.Request) float64 {
+	for _, m := range u.rules.Costs {
+		if m.Match(r) {
+			return m.Weight()
+		}
+	}
+
+	return 1
+}
+
+// Ban bans the IP for bantime (the rules bantime when 0), regardless of its
+// failures. A banned IP keeps the later of its current and new ban ends, the
+// ban being only published once.
+func (u *Fail2Ban) Ban(remoteIP string, bantime time.Duration) {
+	u.MuIP.Lock()
+	defer u.MuIP.Unlock()
+
+	now := utime.Now()
+	ip := u.IPs[remoteIP]
+	banned := ip.Denied && now.Before(ip.Viewed.Add(u.bantime(ip)))
+
+	next := ipchecking.IPViewed{
+		Viewed:  now,
+		Count:   ip.Count + 1,
+		Denied:  true,
+		Score:   ip.Score,
+		Bantime: bantime,
+	}
+
+	if banned && !now.Add(u.bantime(next)).After(ip.Viewed.Add(u.bantime(ip))) {
+		return
+	}
+
+	u.IPs[remoteIP] = next
+
+	if !banned {
+		u.publish(events.Ban, reasonRule, remoteIP, next)
+	}
+}
+
+// Sweep forgets the IPs whose ban expired, publishing the expiry of the ones
+// not coming back, and the failures older than findtime, the tightened ones
+// included.
+func (u *Fail2Ban) Sweep(now time.Time) {
+	for f2b := u; f2b != nil; f2b = f2b.tightened {
+		f2b.sweep(now)
+	}
+}
+
+func (u *Fail2Ban) sweep(now time.Time) {
+	u.MuIP.Lock()
+	defer u.MuIP.Unlock()
+
+	for remoteIP, ip := range u.IPs {
+		if ip.Denied {
+			if now.Before(ip.Viewed.Add(u.bantime(ip))) {
+				continue
+			}
+
+			u.publish(events.Expire, "", remoteIP, ip)
+		} else if now.Before(ip.Viewed.Add(u.rules.Findtime)) {
+			continue
+		}
+
+		delete(u.IPs, remoteIP)
+	}
+}
+
+// Reset forgets the failures of the IP, unless it is banned.
+func (u *Fail2Ban) Reset(remoteIP string) {
+	u.MuIP.Lock()
+	defer u.MuIP.Unlock()
+
+	if ip, foundIP := u.IPs[remoteIP]; foundIP && !ip.Denied {
+		delete(u.IPs, remoteIP)
+	}
+}
+
+// Unban lifts the ban of the IP, and forgets its failures.
+func (u *Fail2Ban) Unban(remoteIP string) {
+	u.MuIP.Lock()
+	defer u.MuIP.Unlock()
+
+	if ip, foundIP := u.IPs[remoteIP]; foundIP && ip.Denied {
+		u.publish(events.Unban, "", remoteIP, ip)
+	}
+
+	delete(u.IPs, remoteIP)
+}
+
+// Decrement removes one failure and weight from the score of the IP, unless it
+// is banned.
+func (u *Fail2Ban) Decrement(remoteIP string, weight float64) {
+	u.MuIP.Lock()
+	defer u.MuIP.Unlock()
+
+	ip, foundIP := u.IPs[remoteIP]
+	if !foundIP || ip.Denied {
+		return
+	}
+
+	if ip.Count > 0 {
+		ip.Count--
+	}
+
+	ip.Score -= weight
+	if ip.Score < 0 {
+		ip.Score = 0
+	}
+
+	u.IPs[remoteIP] = ip
+}
+
+// Escalation returns how the requests of the IP, not banned, are slowed down
+// (delay) or rejected from its score, as configured by the escalation rules.
+func (u *Fail2Ban) Escalation(remoteIP string) (time.Duration, bool) {
+	e := u.rules.Escalation
+	if e == nil || (u.allowList != nil && u.allowList.Contains(remoteIP)) {
+		return 0, false
+	}
+
+	u.MuIP.Lock()
+	ip, foundIP := u.IPs[remoteIP]
+	u.MuIP.Unlock()
+
+	// The failures older than findtime are forgotten.
+	if !foundIP || ip.Denied || !utime.Now().Before(ip.Viewed.Add(u.rules.Findtime)) {
+		return 0, false
+	}
+
+	if e.RejectAfter > 0 && ip.Score >= e.RejectAfter {
+		return 0, true
+	}
+
+	if e.DelayAfter > 0 && ip.Score >= e.DelayAfter {
+		return e.Delay, false
+	}
+
+	return 0, false
+}
+
+// bantime returns the ban duration of the IP.
+func (u *Fail2Ban) bantime(ip ipchecking.IPViewed) time.Duration {
+	if ip.Bantime > 0 {
+		return ip.Bantime
+	}
+
+	return u.rules.Bantime
+}
+
+// threshold returns the score banning an IP, maxretry by default.
+func (u *Fail2Ban) threshold() float64 {
+	if u.rules.Threshold > 0 {
+		return u.rules.Threshold
+	}
+
+	return float64(u.rules.MaxRetry)
+}
+
+// Ban is an active ban.
+type Ban struct {
+	IP      string
+	Expires time.Time
+}
+
+// Bans returns the active bans, the tightened ones included, sorted by IP.
+func (u *Fail2Ban) Bans() []Ban {
+	now := utime.Now()
+	expires := make(map[string]time.Time)
+
+	for f2b := u; f2b != nil; f2b = f2b.tightened {
+		f2b.MuIP.Lock()
+
+		for remoteIP, ip := range f2b.IPs {
+			end := ip.Viewed.Add(f2b.bantime(ip))
+			if ip.Denied && now.Before(end) && end.After(expires[remoteIP]) {
+				expires[remoteIP] = end
+			}
+		}
+
+		f2b.MuIP.Unlock()
+	}
+
+	bans := make([]Ban, 0, len(expires))
+	for ip, end := range expires {
+		bans = append(bans, Ban{IP: ip, Expires: end})
+	}
+
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].IP < bans[j].IP
+	})
+
+	return bans
+}
+
+// Score returns the current score of the IP.
+func (u *Fail2Ban) Score(remoteIP string) float64 {
+	u.MuIP.Lock()
+	defer u.MuIP.Unlock()
+
+	return u.IPs[remoteIP].Score
+}
+
+// BannedSince returns when the active ban of the IP started, and whether it is
+// banned.
+func (u *Fail2Ban) BannedSince(remoteIP string) (time.Time, bool) {
+	u.MuIP.Lock()
+	defer u.MuIP.Unlock()
+
+	ip, found := u.IPs[remoteIP]
+	if !found || !ip.Denied || !utime.Now().Before(ip.Viewed.Add(u.bantime(ip))) {
+		return time.Time{}, false
+	}
+
+	return ip.Viewed, true
+}
+
+// Suspected returns whether the IP is counted against: every IP in the
+// requests count mode, else the IPs with failures or banned, in either jail.
+func (u *Fail2Ban) Suspected(remoteIP string) bool {
+	if u.CountsRequests() {
+		return true
+	}
+
+	for f2b := u; f2b != nil; f2b = f2b.tightened {
+		f2b.MuIP.Lock()
+		ip := f2b.IPs[remoteIP]
+		f2b.MuIP.Unlock()
+
+		if ip.Score > 0 || ip.Denied {
+			return true
+		}
+	}
+
+	return false
+}
+
 // IsNotBanned Non-incrementing check to see if an IP is already banned.
 func (u *Fail2Ban) IsNotBanned(remoteIP string) bool {
 	if u.allowList != nil && u.allowList.Contains(remoteIP) {
@@ -118,20 +490,32 @@ func (u *Fail2Ban) IsNotBanned(remoteIP string) bool {
 	}
 
 	if ip.Denied {
-		if utime.Now().Before(ip.Viewed.Add(u.rules.Bantime)) {
+		if utime.Now().Before(ip.Viewed.Add(u.bantime(ip))) {
 			u.IPs[remoteIP] = ipchecking.IPViewed{
-				Viewed: ip.Viewed,
-				Count:  ip.Count + 1,
-				Denied: true,
+				Viewed:  ip.Viewed,
+				Count:   ip.Count + 1,
+				Denied:  true,
+				Score:   ip.Score,
+				Bantime: ip.Bantime,
 			}
 
 			return false
 		}
 
+		u.publish(events.Expire, "", remoteIP, ip)
+
+		// In the requests count mode, the request is counted by AddRequest.
+		if u.rules.CountRequests {
+			u.IPs[remoteIP] = ipchecking.IPViewed{Viewed: utime.Now()}
+
+			return true
+		}
+
 		u.IPs[remoteIP] = ipchecking.IPViewed{
 			Viewed: utime.Now(),
 			Count:  1,
 			Denied: false,
+			Score:  1,
 		}
 
 		return true
@@ -1,10 +1,15 @@
 package fail2ban
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tomMoulard/fail2ban/pkg/data"
+	"github.com/tomMoulard/fail2ban/pkg/events"
 	"github.com/tomMoulard/fail2ban/pkg/ipchecking"
 	"github.com/tomMoulard/fail2ban/pkg/rules"
 	utime "github.com/tomMoulard/fail2ban/pkg/utils/time"
@@ -118,3 +123,587 @@ func TestShouldAllow(t *testing.T) {
 		})
 	}
 }
+
+func TestAddFailure(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		rules     rules.RulesTransformed
+		weights   []float64
+		expect    []bool
+		wantScore float64
+	}{
+		{
+			name:      "maxretry is the threshold",
+			rules:     rules.RulesTransformed{MaxRetry: 3, Findtime: 300 * time.Second, Bantime: 300 * time.Second},
+			weights:   []float64{1, 1, 1},
+			expect:    []bool{true, true, false},
+			wantScore: 3,
+		},
+		{
+			name:      "fractional weights",
+			rules:     rules.RulesTransformed{MaxRetry: 3, Findtime: 300 * time.Second, Bantime: 300 * time.Second},
+			weights:   []float64{0.5, 0.5, 0.5, 0.5},
+			expect:    []bool{true, true, true, true},
+			wantScore: 2,
+		},
+		{
+			name:      "heavy failure",
+			rules:     rules.RulesTransformed{MaxRetry: 3, Findtime: 300 * time.Second, Bantime: 300 * time.Second},
+			weights:   []float64{0.5, 5},
+			expect:    []bool{true, false},
+			wantScore: 5.5,
+		},
+		{
+			name:      "heavy first failure",
+			rules:     rules.RulesTransformed{MaxRetry: 3, Findtime: 300 * time.Second, Bantime: 300 * time.Second},
+			weights:   []float64{10, 1},
+			expect:    []bool{false, false},
+			wantScore: 11,
+		},
+		{
+			name:      "first failure at the threshold",
+			rules:     rules.RulesTransformed{MaxRetry: 3, Findtime: 300 * time.Second, Bantime: 300 * time.Second},
+			weights:   []float64{3},
+			expect:    []bool{false},
+			wantScore: 3,
+		},
+		{
+			name:      "threshold",
+			rules:     rules.RulesTransformed{MaxRetry: 3, Threshold: 1.5, Findtime: 300 * time.Second, Bantime: 300 * time.Second},
+			weights:   []float64{1, 0.5},
+			expect:    []bool{true, false},
+			wantScore: 1.5,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			f2b := New(test.rules, nil)
+
+			for i, weight := range test.weights {
+				assert.Equal(t, test.expect[i], f2b.AddFailure("10.0.0.0", weight), "failure [%d]", i)
+			}
+
+			assert.InDelta(t, test.wantScore, f2b.Score("10.0.0.0"), 0)
+		})
+	}
+}
+
+// TestAddRequest reproduces the schema of the README, in the requests count
+// mode.
+func TestAddRequest(t *testing.T) {
+	t.Parallel()
+
+	f2b := New(rules.RulesTransformed{
+		MaxRetry:      3,
+		Findtime:      10 * time.Minute,
+		Bantime:       3 * time.Hour,
+		CountRequests: true,
+	}, nil)
+
+	const remoteIP = "10.0.0.0"
+
+	// request mimics the fail2ban handler.
+	request := func() bool {
+		if !f2b.IsNotBanned(remoteIP) {
+			return false
+		}
+
+		f2b.AddRequest(remoteIP, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		return true
+	}
+
+	// rewind moves the IP back in time.
+	rewind := func(d time.Duration) {
+		f2b.MuIP.Lock()
+		defer f2b.MuIP.Unlock()
+
+		ip := f2b.IPs[remoteIP]
+		ip.Viewed = ip.Viewed.Add(-d)
+		f2b.IPs[remoteIP] = ip
+	}
+
+	// First request, the findtime starts.
+	assert.True(t, request())
+	// Second request, within findtime.
+	assert.True(t, request())
+	// Third request, maxretry is full: the request goes through, not the
+	// next ones.
+	assert.True(t, request())
+	assert.False(t, f2b.IsNotBanned(remoteIP))
+
+	// Fourth and fifth requests, the IP is banned.
+	assert.False(t, request())
+	rewind(time.Hour)
+	assert.False(t, request())
+
+	// Last request, the bantime is over, another findtime starts.
+	rewind(2 * time.Hour)
+	assert.True(t, request())
+	assert.InDelta(t, 1, f2b.Score(remoteIP), 0)
+
+	// The requests out of findtime start another findtime.
+	assert.True(t, request())
+	rewind(10 * time.Minute)
+	assert.True(t, request())
+	assert.True(t, request())
+	assert.InDelta(t, 2, f2b.Score(remoteIP), 0)
+}
+
+func TestCost(t *testing.T) {
+	t.Parallel()
+
+	costs := []rules.Urlregexp{
+		{Method: "^POST$", Path: "^/login$", Weight: 5},
+		{Method: "^(POST|PUT|DELETE)$", Weight: 2},
+		{Path: "^/static/", Weight: 0.1},
+	}
+
+	matchers := make([]*rules.Matcher, 0, len(costs))
+
+	for _, c := range costs {
+		m, err := rules.CompileMatcher(c)
+		require.NoError(t, err)
+
+		matchers = append(matchers, m)
+	}
+
+	f2b := New(rules.RulesTransformed{CountRequests: true, Costs: matchers}, nil)
+
+	tests := []struct {
+		method   string
+		path     string
+		expected float64
+	}{
+		{method: http.MethodPost, path: "/login", expected: 5},
+		{method: http.MethodPost, path: "/api/users", expected: 2},
+		{method: http.MethodDelete, path: "/static/app.js", expected: 2},
+		{method: http.MethodGet, path: "/static/app.js", expected: 0.1},
+		{method: http.MethodGet, path: "/", expected: 1},
+	}
+
+	for _, test := range tests {
+		got := f2b.Cost(httptest.NewRequest(test.method, test.path, nil))
+		assert.InDelta(t, test.expected, got, 0, "%s %s", test.method, test.path)
+	}
+}
+
+func TestBan(t *testing.T) {
+	t.Parallel()
+
+	f2b := New(rules.RulesTransformed{
+		MaxRetry: 3,
+		Findtime: 300 * time.Second,
+		Bantime:  300 * time.Second,
+	}, nil)
+
+	f2b.Ban("10.0.0.0", 72*time.Hour)
+	assert.False(t, f2b.IsNotBanned("10.0.0.0"))
+	assert.False(t, f2b.ShouldAllow("10.0.0.0"))
+	assert.Equal(t, 72*time.Hour, f2b.IPs["10.0.0.0"].Bantime)
+
+	// A shorter ban keeps the current one, a longer one replaces it.
+	f2b.Ban("10.0.0.1", 72*time.Hour)
+	viewed := f2b.IPs["10.0.0.1"].Viewed
+	f2b.Ban("10.0.0.1", 0)
+	assert.Equal(t, 72*time.Hour, f2b.IPs["10.0.0.1"].Bantime)
+	assert.Equal(t, viewed, f2b.IPs["10.0.0.1"].Viewed)
+	f2b.Ban("10.0.0.1", 96*time.Hour)
+	assert.Equal(t, 96*time.Hour, f2b.IPs["10.0.0.1"].Bantime)
+
+	// The ban outlasts the rules bantime.
+	ip := f2b.IPs["10.0.0.0"]
+	ip.Viewed = utime.Now().Add(-time.Hour)
+	f2b.IPs["10.0.0.0"] = ip
+	assert.False(t, f2b.IsNotBanned("10.0.0.0"))
+
+	ip = f2b.IPs["10.0.0.0"]
+	ip.Viewed = utime.Now().Add(-73 * time.Hour)
+	f2b.IPs["10.0.0.0"] = ip
+	assert.True(t, f2b.IsNotBanned("10.0.0.0"))
+	assert.Zero(t, f2b.IPs["10.0.0.0"].Bantime)
+}
+
+func TestReset(t *testing.T) {
+	t.Parallel()
+
+	f2b := New(rules.RulesTransformed{
+		MaxRetry: 3,
+		Findtime: 300 * time.Second,
+		Bantime:  300 * time.Second,
+	}, nil)
+
+	// Two failures, then a success.
+	assert.True(t, f2b.ShouldAllow("10.0.0.0"))
+	assert.True(t, f2b.ShouldAllow("10.0.0.0"))
+	f2b.Reset("10.0.0.0")
+	assert.NotContains(t, f2b.IPs, "10.0.0.0")
+
+	assert.True(t, f2b.ShouldAllow("10.0.0.0"))
+	assert.True(t, f2b.ShouldAllow("10.0.0.0"))
+	assert.False(t, f2b.ShouldAllow("10.0.0.0"))
+
+	// A success does not lift a ban.
+	f2b.Reset("10.0.0.0")
+	assert.False(t, f2b.IsNotBanned("10.0.0.0"))
+}
+
+func TestUnban(t *testing.T) {
+	t.Parallel()
+
+	f2b := New(rules.RulesTransformed{
+		MaxRetry: 1,
+		Findtime: 300 * time.Second,
+		Bantime:  300 * time.Second,
+	}, nil)
+
+	f2b.Ban("10.0.0.0", time.Hour)
+	assert.False(t, f2b.IsNotBanned("10.0.0.0"))
+
+	f2b.Unban("10.0.0.0")
+	assert.True(t, f2b.IsNotBanned("10.0.0.0"))
+	assert.Zero(t, f2b.Score("10.0.0.0"))
+}
+
+func TestRestore(t *testing.T) {
+	t.Parallel()
+
+	r := rules.RulesTransformed{
+		MaxRetry: 2,
+		Findtime: 300 * time.Second,
+		Bantime:  300 * time.Second,
+		Tightened: &rules.RulesTransformed{
+			MaxRetry: 1,
+			Findtime: 300 * time.Second,
+			Bantime:  300 * time.Second,
+		},
+	}
+
+	prev := New(r, nil)
+	prev.Ban("10.0.0.0", time.Hour)
+	prev.AddFailure("10.0.0.1", 1)
+	prev.For(&data.Data{Tightened: true}).Ban("10.0.0.2", 0)
+
+	f2b := New(r, nil)
+	f2b.Restore(prev)
+
+	assert.False(t, f2b.IsNotBanned("10.0.0.0"))
+	assert.InDelta(t, 1, f2b.Score("10.0.0.1"), 0)
+	assert.False(t, f2b.For(&data.Data{Tightened: true}).IsNotBanned("10.0.0.2"))
+
+	// The states are not shared.
+	f2b.Unban("10.0.0.0")
+	assert.False(t, prev.IsNotBanned("10.0.0.0"))
+}
+
+type eventRecorder struct {
+	events []events.Event
+}
+
+func (r *eventRecorder) Send(e events.Event) {
+	r.events = append(r.events, e)
+}
+
+func TestEvents(t *testing.T) {
+	t.Parallel()
+
+	f2b := New(rules.RulesTransformed{
+		MaxRetry: 2,
+		Findtime: 300 * time.Second,
+		Bantime:  300 * time.Second,
+	}, nil)
+
+	recorder := &eventRecorder{}
+	bus := events.New("jail")
+	bus.Subscribe(recorder)
+	f2b.WithEvents(bus)
+
+	f2b.AddFailure("10.0.0.0", 1)
+	f2b.AddFailure("10.0.0.0", 1)
+	f2b.AddFailure("10.0.0.0", 1)
+	f2b.Ban("10.0.0.1", time.Hour)
+	// Already banned.
+	f2b.Ban("10.0.0.1", 0)
+	f2b.Ban("10.0.0.1", 2*time.Hour)
+	f2b.Unban("10.0.0.1")
+	// Not banned.
+	f2b.Unban("10.0.0.2")
+
+	f2b.MuIP.Lock()
+	f2b.IPs["10.0.0.3"] = ipchecking.IPViewed{Viewed: utime.Now().Add(-time.Hour), Denied: true}
+	f2b.MuIP.Unlock()
+	f2b.IsNotBanned("10.0.0.3")
+
+	now := utime.Now()
+	for i := range recorder.events {
+		recorder.events[i].Time = now
+	}
+
+	assert.Equal(t, []events.Event{
+		{Type: events.Failure, Jail: "jail", IP: "10.0.0.0", Score: 1, Time: now},
+		{Type: events.Ban, Jail: "jail", IP: "10.0.0.0", Reason: "threshold", Score: 2, Expires: now.Add(300 * time.Second).UTC().Format(time.RFC3339), Time: now},
+		{Type: events.Ban, Jail: "jail", IP: "10.0.0.1", Reason: "rule", Expires: now.Add(time.Hour).UTC().Format(time.RFC3339), Time: now},
+		{Type: events.Unban, Jail: "jail", IP: "10.0.0.1", Time: now},
+		{Type: events.Expire, Jail: "jail", IP: "10.0.0.3", Time: now},
+	}, recorder.events)
+}
+
+func TestEventsShadow(t *testing.T) {
+	t.Parallel()
+
+	f2b := New(rules.RulesTransformed{
+		MaxRetry: 2,
+		Findtime: 300 * time.Second,
+		Bantime:  300 * time.Second,
+	}, nil)
+
+	recorder := &eventRecorder{}
+	bus := events.New("jail")
+	bus.Subscribe(recorder)
+	f2b.WithEvents(bus)
+	f2b.WithShadow()
+
+	f2b.AddFailure("10.0.0.0", 1)
+	f2b.Ban("10.0.0.1", time.Hour)
+
+	require.Len(t, recorder.events, 2)
+
+	for _, e := range recorder.events {
+		assert.True(t, e.Shadow, e.Type)
+	}
+}
+
+func TestSweep(t *testing.T) {
+	t.Parallel()
+
+	f2b := New(rules.RulesTransformed{
+		MaxRetry: 2,
+		Findtime: 300 * time.Second,
+		Bantime:  300 * time.Second,
+	}, nil)
+
+	recorder := &eventRecorder{}
+	bus := events.New("jail")
+	bus.Subscribe(recorder)
+	f2b.WithEvents(bus)
+
+	now := utime.Now()
+
+	f2b.MuIP.Lock()
+	f2b.IPs["10.0.0.0"] = ipchecking.IPViewed{Viewed: now.Add(-time.Hour), Denied: true}
+	f2b.IPs["10.0.0.1"] = ipchecking.IPViewed{Viewed: now.Add(-time.Hour), Denied: true, Bantime: 2 * time.Hour}
+	f2b.IPs["10.0.0.2"] = ipchecking.IPViewed{Viewed: now.Add(-time.Hour), Count: 1, Score: 1}
+	f2b.IPs["10.0.0.3"] = ipchecking.IPViewed{Viewed: now, Count: 1, Score: 1}
+	f2b.MuIP.Unlock()
+
+	f2b.Sweep(now)
+
+	// The expiry of a ban is published without the IP coming back, once.
+	f2b.Sweep(now)
+
+	for i := range recorder.events {
+		recorder.events[i].Time = now
+	}
+
+	assert.Equal(t, []events.Event{
+		{Type: events.Expire, Jail: "jail", IP: "10.0.0.0", Time: now},
+	}, recorder.events)
+	assert.Equal(t, map[string]ipchecking.IPViewed{
+		"10.0.0.1": {Viewed: now.Add(-time.Hour), Denied: true, Bantime: 2 * time.Hour},
+		"10.0.0.3": {Viewed: now, Count: 1, Score: 1},
+	}, f2b.IPs)
+}
+
+func TestBans(t *testing.T) {
+	t.Parallel()
+
+	f2b := New(rules.RulesTransformed{
+		MaxRetry: 2,
+		Findtime: 300 * time.Second,
+		Bantime:  300 * time.Second,
+		Tightened: &rules.RulesTransformed{
+			MaxRetry: 1,
+			Findtime: 300 * time.Second,
+			Bantime:  time.Hour,
+		},
+	}, nil)
+
+	now := utime.Now()
+
+	f2b.Ban("10.0.0.2", 0)
+	f2b.Ban("10.0.0.1", 2*time.Hour)
+	f2b.AddFailure("10.0.0.3", 1)
+	f2b.MuIP.Lock()
+	f2b.IPs["10.0.0.4"] = ipchecking.IPViewed{Viewed: now.Add(-time.Hour), Denied: true}
+	f2b.MuIP.Unlock()
+
+	// The longest ban wins.
+	tightened := f2b.For(&data.Data{Tightened: true})
+	tightened.Ban("10.0.0.2", 0)
+	tightened.Ban("10.0.0.5", 0)
+
+	bans := f2b.Bans()
+	require.Len(t, bans, 3)
+
+	for i, expected := range []struct {
+		ip       string
+		duration time.Duration
+	}{
+		{ip: "10.0.0.1", duration: 2 * time.Hour},
+		{ip: "10.0.0.2", duration: time.Hour},
+		{ip: "10.0.0.5", duration: time.Hour},
+	} {
+		assert.Equal(t, expected.ip, bans[i].IP)
+		assert.WithinDuration(t, now.Add(expected.duration), bans[i].Expires, time.Second)
+	}
+}
+
+func TestDecrement(t *testing.T) {
+	t.Parallel()
+
+	f2b := New(rules.RulesTransformed{
+		MaxRetry: 3,
+		Findtime: 300 * time.Second,
+		Bantime:  300 * time.Second,
+	}, nil)
+
+	f2b.Decrement("10.0.0.0", 1)
+	assert.NotContains(t, f2b.IPs, "10.0.0.0")
+
+	assert.True(t, f2b.AddFailure("10.0.0.0", 1))
+	assert.True(t, f2b.AddFailure("10.0.0.0", 1))
+	f2b.Decrement("10.0.0.0", 1)
+	assert.Equal(t, 1, f2b.IPs["10.0.0.0"].Count)
+	assert.InDelta(t, 1, f2b.Score("10.0.0.0"), 0)
+
+	// The score never goes below 0.
+	f2b.Decrement("10.0.0.0", 5)
+	assert.Equal(t, 0, f2b.IPs["10.0.0.0"].Count)
+	assert.InDelta(t, 0, f2b.Score("10.0.0.0"), 0)
+
+	assert.True(t, f2b.AddFailure("10.0.0.0", 1))
+	assert.True(t, f2b.AddFailure("10.0.0.0", 1))
+	assert.False(t, f2b.AddFailure("10.0.0.0", 1))
+
+	// A success does not lift a ban.
+	f2b.Decrement("10.0.0.0", 5)
+	assert.False(t, f2b.IsNotBanned("10.0.0.0"))
+	assert.InDelta(t, 3, f2b.Score("10.0.0.0"), 0)
+}
+
+func TestEscalation(t *testing.T) {
+	t.Parallel()
+
+	f2b := New(rules.RulesTransformed{
+		MaxRetry: 5,
+		Findtime: 300 * time.Second,
+		Bantime:  300 * time.Second,
+		Escalation: &rules.EscalationRule{
+			DelayAfter:  2,
+			Delay:       time.Second,
+			RejectAfter: 4,
+		},
+	}, nil)
+
+	for i, test := range []struct {
+		expectedDelay  time.Duration
+		expectedReject bool
+	}{
+		{},
+		{},
+		{expectedDelay: time.Second},
+		{expectedDelay: time.Second},
+		{expectedReject: true},
+		// Banned.
+		{},
+	} {
+		delay, reject := f2b.Escalation("10.0.0.0")
+		assert.Equal(t, test.expectedDelay, delay, "request [%d]", i)
+		assert.Equal(t, test.expectedReject, reject, "request [%d]", i)
+
+		f2b.IsNotBanned("10.0.0.0")
+		f2b.AddFailure("10.0.0.0", 1)
+	}
+
+	assert.False(t, f2b.IsNotBanned("10.0.0.0"))
+
+	// The failures older than findtime are forgotten.
+	assert.True(t, f2b.ShouldAllow("10.0.0.1"))
+	assert.True(t, f2b.ShouldAllow("10.0.0.1"))
+
+	ip := f2b.IPs["10.0.0.1"]
+	ip.Viewed = utime.Now().Add(-time.Hour)
+	f2b.IPs["10.0.0.1"] = ip
+
+	delay, reject := f2b.Escalation("10.0.0.1")
+	assert.Zero(t, delay)
+	assert.False(t, reject)
+}
+
+func TestFor(t *testing.T) {
+	t.Parallel()
+
+	tightened := rules.RulesTransformed{MaxRetry: 1}
+
+	f2b := New(rules.RulesTransformed{MaxRetry: 10}, nil)
+	assert.Same(t, f2b, f2b.For(&data.Data{Tightened: true}))
+
+	f2b = New(rules.RulesTransformed{MaxRetry: 10, Tightened: &tightened}, nil)
+	assert.Same(t, f2b, f2b.For(nil))
+	assert.Same(t, f2b, f2b.For(&data.Data{}))
+	assert.NotSame(t, f2b, f2b.For(&data.Data{Tightened: true}))
+	assert.Equal(t, 1, f2b.For(&data.Data{Tightened: true}).rules.MaxRetry)
+}
+
+func TestSuspected(t *testing.T) {
+	t.Parallel()
+
+	tightened := rules.RulesTransformed{MaxRetry: 1, Bantime: time.Hour}
+
+	f2b := New(rules.RulesTransformed{MaxRetry: 10, Bantime: time.Hour, Tightened: &tightened}, nil)
+	assert.False(t, f2b.Suspected("10.0.0.0"))
+
+	assert.True(t, f2b.IsNotBanned("10.0.0.0"))
+	assert.False(t, f2b.Suspected("10.0.0.0"))
+
+	f2b.AddFailure("10.0.0.0", 1)
+	assert.True(t, f2b.Suspected("10.0.0.0"))
+
+	f2b.For(&data.Data{Tightened: true}).Ban("10.0.0.1", 0)
+	assert.True(t, f2b.Suspected("10.0.0.1"))
+
+	f2b = New(rules.RulesTransformed{MaxRetry: 10, CountRequests: true}, nil)
+	assert.True(t, f2b.Suspected("10.0.0.0"))
+}
+
+func TestBannedSince(t *testing.T) {
+	t.Parallel()
+
+	f2b := New(rules.RulesTransformed{MaxRetry: 10, Bantime: time.Hour}, nil)
+
+	_, banned := f2b.BannedSince("10.0.0.0")
+	assert.False(t, banned)
+
+	f2b.AddFailure("10.0.0.0", 1)
+	_, banned = f2b.BannedSince("10.0.0.0")
+	assert.False(t, banned)
+
+	f2b.Ban("10.0.0.0", 0)
+	since, banned := f2b.BannedSince("10.0.0.0")
+	assert.True(t, banned)
+	assert.Equal(t, f2b.IPs["10.0.0.0"].Viewed, since)
+
+	f2b.MuIP.Lock()
+	ip := f2b.IPs["10.0.0.0"]
+	ip.Viewed = utime.Now().Add(-2 * time.Hour)
+	f2b.IPs["10.0.0.0"] = ip
+	f2b.MuIP.Unlock()
+
+	_, banned = f2b.BannedSince("10.0.0.0")
+	assert.False(t, banned)
+}
@@ -28,20 +28,60 @@ func (h *handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) (*chain.S
 		return nil, errors.New("failed to get data from request context")
 	}
 
-	if !h.f2b.IsNotBanned(reqData.RemoteIP) {
-		if h.enableBlockLogs {
-			logger.Info("Plugin: FailToBan: IP blocked",
-				logger.WithIP(reqData.RemoteIP),
-				logger.WithReason("banned"),
-				logger.WithStatusCode(http.StatusTooManyRequests),
-				logger.WithMethod(req.Method),
-				logger.WithPath(req.URL.Path),
-				logger.WithUA(req.UserAgent()),
-			)
+	f2b := h.f2b.For(reqData)
+
+	banned := reqData.Banned
+	if !reqData.BanChecked {
+		banned = !f2b.IsNotBanned(reqData.RemoteIP)
+	}
+
+	if banned {
+		h.logBlocked(req, reqData, f2b, "banned")
+
+		return &chain.Status{Return: true}, nil
+	}
+
+	delay, reject := f2b.Escalation(reqData.RemoteIP)
+	if reject {
+		// The rejected requests count as failures, for the clients insisting
+		// to get banned.
+		reason := "rejected"
+		if !f2b.AddFailure(reqData.RemoteIP, 1) {
+			reason = "banned"
 		}
 
+		h.logBlocked(req, reqData, f2b, reason)
+
 		return &chain.Status{Return: true}, nil
 	}
 
+	// In the requests count mode, the request reaching the threshold still
+	// goes through, the IP being banned from the next one.
+	if f2b.CountsRequests() {
+		f2b.AddRequest(reqData.RemoteIP, req)
+	}
+
+	if delay > 0 {
+		return &chain.Status{Delay: delay}, nil
+	}
+
 	return nil, nil
 }
+
+func (h *handler) logBlocked(req *http.Request, reqData *data.Data, f2b *fail2ban.Fail2Ban, reason string) {
+	if !h.enableBlockLogs {
+		return
+	}
+
+	logger.Info(logger.Blocked(reqData.Shadow),
+		logger.WithIP(reqData.RemoteIP),
+		logger.WithCountry(reqData.Country),
+		logger.WithASN(reqData.ASN),
+		logger.WithReason(reason),
+		logger.WithScore(f2b.Score(reqData.RemoteIP)),
+		logger.WithStatusCode(http.StatusTooManyRequests),
+		logger.WithMethod(req.Method),
+		logger.WithPath(req.URL.Path),
+		logger.WithUA(req.UserAgent()),
+	)
+}
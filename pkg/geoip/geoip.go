@@ -0,0 +1,258 @@
+// Package geoip resolves the country and the ASN of an IP from local MaxMind
+// DB files, and matches them against list selectors (e.g. "country:RU").
+package geoip
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tomMoulard/fail2ban/pkg/logger"
+)
+
+const (
+	countryPrefix = "country:"
+	asnPrefix     = "asn:"
+)
+
+// Info is the geolocation of an IP.
+type Info struct {
+	// Country is the ISO 3166-1 alpha-2 country code.
+	Country string
+	// ASN is the autonomous system number.
+	ASN uint32
+}
+
+// Selector matches IPs by country or ASN.
+type Selector struct {
+	Country string
+	ASN     uint32
+}
+
+// ParseSelector parses a "country:XX" or "asn:AS12345" list entry. It returns
+// false if the entry is not a selector (e.g. an IP).
+func ParseSelector(entry string) (Selector, bool, error) {
+	lower := strings.ToLower(strings.TrimSpace(entry))
+
+	switch {
+	case strings.HasPrefix(lower, countryPrefix):
+		country := strings.ToUpper(strings.TrimPrefix(lower, countryPrefix))
+		if len(country) != 2 {
+			return Selector{}, true, fmt.Errorf("invalid country %q: expecting an ISO 3166-1 alpha-2 code", entry)
+		}
+
+		return Selector{Country: country}, true, nil
+	case strings.HasPrefix(lower, asnPrefix):
+		asn, err := strconv.ParseUint(strings.TrimPrefix(strings.TrimPrefix(lower, asnPrefix), "as"), 10, 32)
+		if err != nil || asn == 0 {
+			return Selector{}, true, fmt.Errorf("invalid ASN %q: expecting e.g. asn:AS12345", entry)
+		}
+
+		return Selector{ASN: uint32(asn)}, true, nil
+	}
+
+	return Selector{}, false, nil
+}
+
+// Split splits a list into IPs and selectors.
+func Split(list []string) ([]string, []Selector, error) {
+	var (
+		ips       []string
+		selectors []Selector
+	)
+
+	for _, entry := range list {
+		selector, ok, err := ParseSelector(entry)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if !ok {
+			ips = append(ips, entry)
+
+			continue
+		}
+
+		selectors = append(selectors, selector)
+	}
+
+	return ips, selectors, nil
+}
+
+// Matches returns whether the geolocation matches the selector.
+func (s Selector) Matches(info Info) bool {
+	if s.Country != "" {
+		return s.Country == info.Country
+	}
+
+	return s.ASN != 0 && s.ASN == info.ASN
+}
+
+// String returns the selector as written in a list.
+func (s Selector) String() string {
+	if s.Country != "" {
+		return countryPrefix + s.Country
+	}
+
+	return asnPrefix + "AS" + strconv.FormatUint(uint64(s.ASN), 10)
+}
+
+type database struct {
+	path    string
+	reader  *Reader
+	modTime time.Time
+	size    int64
+}
+
+// DB resolves IPs from a set of MaxMind DB files (e.g. GeoLite2-Country and
+// GeoLite2-ASN), reloaded when they change.
+type DB struct {
+	mu        sync.RWMutex
+	databases []*database
+}
+
+// Open opens the MaxMind DB files.
+func Open(paths []string) (*DB, error) {
+	db := &DB{}
+
+	for _, path := range paths {
+		d := &database{path: path}
+		if err := d.load(); err != nil {
+			return nil, err
+		}
+
+		db.databases = append(db.databases, d)
+	}
+
+	return db, nil
+}
+
+func (d *database) load() error {
+	stat, err := os.Stat(d.path)
+	if err != nil {
+		return fmt.Errorf("failed to stat %q: %w", d.path, err)
+	}
+
+	buf, err := os.ReadFile(d.path)
+	if err != nil {
+		return fmt.Errorf("failed to read %q: %w", d.path, err)
+	}
+
+	reader, err := NewReader(buf)
+	if err != nil {
+		return fmt.Errorf("failed to parse %q: %w", d.path, err)
+	}
+
+	d.reader = reader
+	d.modTime = stat.ModTime()
+	d.size = stat.Size()
+
+	return nil
+}
+
+// changed returns whether the file changed since it was loaded.
+func (d *database) changed() bool {
+	stat, err := os.Stat(d.path)
+	if err != nil {
+		return false
+	}
+
+	return !stat.ModTime().Equal(d.modTime) || stat.Size() != d.size
+}
+
+// Reload reloads the files that changed. On failure, the previous version of
+// the file is kept.
+func (db *DB) Reload() {
+	db.mu.RLock()
+	databases := append([]*database(nil), db.databases...)
+	db.mu.RUnlock()
+
+	for i, d := range databases {
+		if !d.changed() {
+			continue
+		}
+
+		reloaded := &database{path: d.path}
+		if err := reloaded.load(); err != nil {
+			logger.Error("Plugin: FailToBan: failed to reload geoip database",
+				logger.WithErr(err.Error()),
+			)
+
+			continue
+		}
+
+		db.mu.Lock()
+		db.databases[i] = reloaded
+		db.mu.Unlock()
+
+		logger.Info("Plugin: FailToBan: geoip database reloaded",
+			logger.WithPath(d.path),
+		)
+	}
+}
+
+// Watch reloads the files that changed every interval, until the context is
+// done.
+func (db *DB) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			db.Reload()
+		}
+	}
+}
+
+// infoPaths are the paths of the record fields decoded by Lookup, the country
+// falling back to the registered country.
+var infoPaths = [][]string{
+	{"country", "iso_code"},
+	{"registered_country", "iso_code"},
+	{"autonomous_system_number"},
+}
+
+// Lookup returns the geolocation of the IP. Unknown fields are left empty.
+func (db *DB) Lookup(remoteIP string) Info {
+	var info Info
+
+	ip, err := netip.ParseAddr(remoteIP)
+	if err != nil {
+		return info
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	for _, d := range db.databases {
+		values, err := d.reader.LookupPaths(ip, infoPaths...)
+		if err != nil {
+			logger.Error("Plugin: FailToBan: geoip lookup failed",
+				logger.WithIP(remoteIP),
+				logger.WithErr(err.Error()),
+			)
+
+			continue
+		}
+
+		for _, v := range values[:2] {
+			if code, ok := v.(string); ok && info.Country == "" {
+				info.Country = code
+			}
+		}
+
+		if asn, ok := values[2].(uint64); ok && info.ASN == 0 {
+			info.ASN = uint32(asn)
+		}
+	}
+
+	return info
+}
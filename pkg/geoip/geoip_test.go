@@ -0,0 +1,132 @@
+package geoip
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSelector(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		entry       string
+		expected    Selector
+		expectedOK  bool
+		expectError bool
+	}{
+		{
+			name:  "ip",
+			entry: "192.0.2.1",
+		},
+		{
+			name:       "country",
+			entry:      "country:ru",
+			expected:   Selector{Country: "RU"},
+			expectedOK: true,
+		},
+		{
+			name:       "asn",
+			entry:      "asn:AS12345",
+			expected:   Selector{ASN: 12345},
+			expectedOK: true,
+		},
+		{
+			name:       "asn without prefix",
+			entry:      "ASN:12345",
+			expected:   Selector{ASN: 12345},
+			expectedOK: true,
+		},
+		{
+			name:        "invalid country",
+			entry:       "country:russia",
+			expectedOK:  true,
+			expectError: true,
+		},
+		{
+			name:        "invalid asn",
+			entry:       "asn:ASX",
+			expectedOK:  true,
+			expectError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, ok, err := ParseSelector(test.entry)
+			assert.Equal(t, test.expectedOK, ok)
+
+			if test.expectError {
+				require.Error(t, err)
+
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, test.expected, got)
+		})
+	}
+}
+
+func TestSplit(t *testing.T) {
+	t.Parallel()
+
+	ips, selectors, err := Split([]string{"192.0.2.1", "country:FR", "10.0.0.0/8", "asn:AS64496"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"192.0.2.1", "10.0.0.0/8"}, ips)
+	assert.Equal(t, []Selector{{Country: "FR"}, {ASN: 64496}}, selectors)
+	assert.Equal(t, "country:FR", selectors[0].String())
+	assert.Equal(t, "asn:AS64496", selectors[1].String())
+}
+
+func TestDB(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	country := filepath.Join(dir, "country.mmdb")
+	asn := filepath.Join(dir, "asn.mmdb")
+
+	require.NoError(t, os.WriteFile(country, buildMMDB(t, 6, 24, []testNetwork{
+		{prefix: "192.0.2.0/24", record: map[string]any{"country": map[string]any{"iso_code": "FR"}}},
+	}), 0o600))
+	require.NoError(t, os.WriteFile(asn, buildMMDB(t, 4, 24, []testNetwork{
+		{prefix: "192.0.2.0/25", record: map[string]any{"autonomous_system_number": uint32(64496)}},
+	}), 0o600))
+
+	db, err := Open([]string{country, asn})
+	require.NoError(t, err)
+
+	assert.Equal(t, Info{Country: "FR", ASN: 64496}, db.Lookup("192.0.2.1"))
+	assert.Equal(t, Info{Country: "FR"}, db.Lookup("192.0.2.200"))
+	assert.Equal(t, Info{}, db.Lookup("198.51.100.1"))
+	assert.Equal(t, Info{}, db.Lookup("not-an-ip"))
+
+	// Nothing changed.
+	db.Reload()
+	assert.Equal(t, Info{Country: "FR", ASN: 64496}, db.Lookup("192.0.2.1"))
+
+	require.NoError(t, os.WriteFile(country, buildMMDB(t, 6, 24, []testNetwork{
+		{prefix: "192.0.2.0/24", record: map[string]any{"country": map[string]any{"iso_code": "DE"}}},
+		{prefix: "198.51.100.0/24", record: map[string]any{"country": map[string]any{"iso_code": "RU"}}},
+	}), 0o600))
+	require.NoError(t, os.Chtimes(country, time.Now(), time.Now().Add(time.Minute)))
+
+	db.Reload()
+	assert.Equal(t, Info{Country: "DE", ASN: 64496}, db.Lookup("192.0.2.1"))
+	assert.Equal(t, Info{Country: "RU"}, db.Lookup("198.51.100.1"))
+
+	// A corrupted file is not loaded.
+	require.NoError(t, os.WriteFile(country, []byte("corrupted"), 0o600))
+	db.Reload()
+	assert.Equal(t, Info{Country: "DE", ASN: 64496}, db.Lookup("192.0.2.1"))
+
+	_, err = Open([]string{filepath.Join(dir, "missing.mmdb")})
+	require.Error(t, err)
+}
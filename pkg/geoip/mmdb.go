@@ -0,0 +1,585 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+)
+
+// Source: https://maxmind.github.io/MaxMind-DB/
+
+// metadataMarker is the marker preceding the metadata section.
+var metadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+// metadataMaxSize is the maximum size of the metadata section.
+const metadataMaxSize = 128 * 1024
+
+// dataSectionSeparatorSize is the size of the separator between the search
+// tree and the data section.
+const dataSectionSeparatorSize = 16
+
+// maxPointerDepth protects the decoder against pointer loops.
+const maxPointerDepth = 32
+
+// maxNestingDepth protects the skipping of the values against deeply nested
+// maps and arrays.
+const maxNestingDepth = 32
+
+// maxPrealloc caps the preallocation of the maps and arrays, their size being
+// read from the file.
+const maxPrealloc = 64
+
+const (
+	typeExtended  = 0
+	typePointer   = 1
+	typeString    = 2
+	typeDouble    = 3
+	typeBytes     = 4
+	typeUint16    = 5
+	typeUint32    = 6
+	typeMap       = 7
+	typeInt32     = 8
+	typeUint64    = 9
+	typeUint128   = 10
+	typeArray     = 11
+	typeContainer = 12
+	typeEnd       = 13
+	typeBool      = 14
+	typeFloat     = 15
+)
+
+var errCorrupted = errors.New("corrupted database")
+
+// Reader reads a MaxMind DB (.mmdb) file, loaded in memory.
+type Reader struct {
+	buf        []byte
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	ipv4Start  uint
+}
+
+// NewReader parses a MaxMind DB.
+func NewReader(buf []byte) (*Reader, error) {
+	start := len(buf) - metadataMaxSize
+	if start < 0 {
+		start = 0
+	}
+
+	i := bytes.LastIndex(buf[start:], metadataMarker)
+	if i < 0 {
+		return nil, errors.New("invalid database: metadata not found")
+	}
+
+	metaStart := start + i + len(metadataMarker)
+
+	metaDecoder := decoder{buf: buf[metaStart:]}
+
+	v, _, err := metaDecoder.decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode metadata: %w", err)
+	}
+
+	meta, ok := v.(map[string]any)
+	if !ok {
+		return nil, errors.New("invalid database: metadata is not a map")
+	}
+
+	r := &Reader{
+		buf:        buf,
+		nodeCount:  toUint(meta["node_count"]),
+		recordSize: toUint(meta["record_size"]),
+		ipVersion:  toUint(meta["ip_version"]),
+	}
+
+	switch r.recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("invalid database: unsupported record size %d", r.recordSize)
+	}
+
+	treeSize := r.nodeCount * r.recordSize / 4
+	if treeSize+dataSectionSeparatorSize > uint(start+i) {
+		return nil, errors.New("invalid database: search tree larger than the file")
+	}
+
+	r.data = buf[treeSize+dataSectionSeparatorSize : start+i]
+
+	if r.ipVersion == 6 {
+		node := uint(0)
+		for bit := 0; bit < 96 && node < r.nodeCount; bit++ {
+			node, err = r.readNode(node, 0)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		r.ipv4Start = node
+	}
+
+	return r, nil
+}
+
+// Lookup returns the record of the IP, nil if not found.
+func (r *Reader) Lookup(ip netip.Addr) (any, error) {
+	offset, found, err := r.locate(ip)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	d := decoder{buf: r.data}
+
+	v, _, err := d.decode(offset, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode record: %w", err)
+	}
+
+	return v, nil
+}
+
+// LookupPaths returns the values at the paths (e.g. country, iso_code) of the
+// record of the IP, nil when not found, decoding only them.
+func (r *Reader) LookupPaths(ip netip.Addr, paths ...[]string) ([]any, error) {
+	values := make([]any, len(paths))
+
+	offset, found, err := r.locate(ip)
+	if err != nil || !found {
+		return values, err
+	}
+
+	d := decoder{buf: r.data}
+
+	for i, path := range paths {
+		values[i], err = d.decodePath(offset, path)
+		if err != nil {
+			return values, fmt.Errorf("failed to decode record: %w", err)
+		}
+	}
+
+	return values, nil
+}
+
+// locate returns the offset of the record of the IP in the data section, and
+// whether it is found.
+func (r *Reader) locate(ip netip.Addr) (uint, bool, error) {
+	ip = ip.Unmap()
+
+	node := uint(0)
+	bitCount := 128
+
+	if ip.Is4() {
+		if r.ipVersion == 6 {
+			node = r.ipv4Start
+		}
+
+		bitCount = 32
+	} else if r.ipVersion == 4 {
+		return 0, false, nil
+	}
+
+	addr := ip.AsSlice()
+
+	for i := 0; i < bitCount && node < r.nodeCount; i++ {
+		bit := uint(addr[i/8]>>(7-uint(i%8))) & 1
+
+		var err error
+
+		node, err = r.readNode(node, bit)
+		if err != nil {
+			return 0, false, err
+		}
+	}
+
+	if node == r.nodeCount {
+		return 0, false, nil
+	}
+
+	if node < r.nodeCount || node-r.nodeCount < dataSectionSeparatorSize {
+		return 0, false, errCorrupted
+	}
+
+	return node - r.nodeCount - dataSectionSeparatorSize, true, nil
+}
+
+func (r *Reader) readNode(node, bit uint) (uint, error) {
+	nodeSize := r.recordSize / 4
+	offset := node * nodeSize
+
+	if offset+nodeSize > uint(len(r.buf)) {
+		return 0, errCorrupted
+	}
+
+	b := r.buf[offset : offset+nodeSize]
+
+	switch r.recordSize {
+	case 24:
+		if bit == 0 {
+			return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]), nil
+		}
+
+		return uint(b[3])<<16 | uint(b[4])<<8 | uint(b[5]), nil
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]), nil
+		}
+
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6]), nil
+	default:
+		if bit == 0 {
+			return uint(binary.BigEndian.Uint32(b[:4])), nil
+		}
+
+		return uint(binary.BigEndian.Uint32(b[4:])), nil
+	}
+}
+
+// decoder decodes the MaxMind DB data section format.
+type decoder struct {
+	buf []byte
+}
+
+// decode decodes the value at offset, and returns the offset of the next
+// value.
+func (d decoder) decode(offset uint, depth int) (any, uint, error) {
+	typeNum, size, offset, err := d.decodeCtrl(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if typeNum == typePointer {
+		if depth >= maxPointerDepth {
+			return nil, 0, errCorrupted
+		}
+
+		pointer, next, err := d.decodePointer(size, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		v, _, err := d.decode(pointer, depth+1)
+
+		return v, next, err
+	}
+
+	if offset+size > uint(len(d.buf)) && typeNum != typeMap && typeNum != typeArray && typeNum != typeBool {
+		return nil, 0, errCorrupted
+	}
+
+	switch typeNum {
+	case typeString:
+		return string(d.buf[offset : offset+size]), offset + size, nil
+	case typeBytes:
+		return append([]byte(nil), d.buf[offset:offset+size]...), offset + size, nil
+	case typeDouble:
+		if size != 8 {
+			return nil, 0, errCorrupted
+		}
+
+		return math.Float64frombits(binary.BigEndian.Uint64(d.buf[offset:])), offset + size, nil
+	case typeFloat:
+		if size != 4 {
+			return nil, 0, errCorrupted
+		}
+
+		return math.Float32frombits(binary.BigEndian.Uint32(d.buf[offset:])), offset + size, nil
+	case typeUint16, typeUint32, typeUint64:
+		if size > 8 {
+			return nil, 0, errCorrupted
+		}
+
+		return d.decodeUint(offset, size), offset + size, nil
+	case typeUint128:
+		if size > 16 {
+			return nil, 0, errCorrupted
+		}
+
+		return append([]byte(nil), d.buf[offset:offset+size]...), offset + size, nil
+	case typeInt32:
+		if size > 4 {
+			return nil, 0, errCorrupted
+		}
+
+		v := uint32(d.decodeUint(offset, size))
+
+		return int32(v), offset + size, nil
+	case typeBool:
+		return size != 0, offset, nil
+	case typeMap:
+		return d.decodeMap(size, offset, depth)
+	case typeArray:
+		return d.decodeArray(size, offset, depth)
+	default:
+		return nil, 0, fmt.Errorf("unsupported data type %d: %w", typeNum, errCorrupted)
+	}
+}
+
+// decodePath decodes the value at the path of the map at offset, skipping the
+// other values. It returns nil when the path is not found.
+func (d decoder) decodePath(offset uint, path []string) (any, error) {
+	if len(path) == 0 {
+		v, _, err := d.decode(offset, 0)
+
+		return v, err
+	}
+
+	typeNum, size, offset, err := d.resolve(offset)
+	if err != nil {
+		return nil, err
+	}
+
+	if typeNum != typeMap {
+		return nil, nil
+	}
+
+	for range size {
+		key, next, err := d.decodeKey(offset)
+		if err != nil {
+			return nil, err
+		}
+
+		if string(key) == path[0] {
+			return d.decodePath(next, path[1:])
+		}
+
+		offset, err = d.skip(next, 0)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return nil, nil
+}
+
+// resolve decodes the control byte at offset, following the pointers, and
+// returns the type and size of the value, and the offset of its payload.
+func (d decoder) resolve(offset uint) (uint, uint, uint, error) {
+	for range maxPointerDepth {
+		typeNum, size, next, err := d.decodeCtrl(offset)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+
+		if typeNum != typePointer {
+			return typeNum, size, next, nil
+		}
+
+		offset, _, err = d.decodePointer(size, next)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+	}
+
+	return 0, 0, 0, errCorrupted
+}
+
+// decodeKey returns the map key at offset without copying it, and the offset
+// of its value.
+func (d decoder) decodeKey(offset uint) ([]byte, uint, error) {
+	typeNum, size, next, err := d.decodeCtrl(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	end := next + size
+
+	if typeNum == typePointer {
+		var pointer uint
+
+		pointer, end, err = d.decodePointer(size, next)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		typeNum, size, next, err = d.resolve(pointer)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	if typeNum != typeString || next+size > uint(len(d.buf)) {
+		return nil, 0, errCorrupted
+	}
+
+	return d.buf[next : next+size], end, nil
+}
+
+// skip returns the offset of the value following the one at offset.
+func (d decoder) skip(offset uint, depth int) (uint, error) {
+	typeNum, size, offset, err := d.decodeCtrl(offset)
+	if err != nil {
+		return 0, err
+	}
+
+	switch typeNum {
+	case typePointer:
+		_, next, err := d.decodePointer(size, offset)
+
+		return next, err
+	case typeBool:
+		return offset, nil
+	case typeMap, typeArray:
+		if depth >= maxNestingDepth {
+			return 0, errCorrupted
+		}
+
+		count := size
+		if typeNum == typeMap {
+			count *= 2
+		}
+
+		for range count {
+			offset, err = d.skip(offset, depth+1)
+			if err != nil {
+				return 0, err
+			}
+		}
+
+		return offset, nil
+	}
+
+	if offset+size > uint(len(d.buf)) {
+		return 0, errCorrupted
+	}
+
+	return offset + size, nil
+}
+
+func (d decoder) decodeCtrl(offset uint) (uint, uint, uint, error) {
+	if offset >= uint(len(d.buf)) {
+		return 0, 0, 0, errCorrupted
+	}
+
+	ctrl := d.buf[offset]
+	offset++
+
+	typeNum := uint(ctrl >> 5)
+	if typeNum == typeExtended {
+		if offset >= uint(len(d.buf)) {
+			return 0, 0, 0, errCorrupted
+		}
+
+		typeNum = 7 + uint(d.buf[offset])
+		offset++
+	}
+
+	size := uint(ctrl & 0x1F)
+	if typeNum == typePointer || size < 29 {
+		return typeNum, size, offset, nil
+	}
+
+	extra := size - 28
+	if offset+extra > uint(len(d.buf)) {
+		return 0, 0, 0, errCorrupted
+	}
+
+	switch size {
+	case 29:
+		size = 29 + uint(d.buf[offset])
+	case 30:
+		size = 285 + (uint(d.buf[offset])<<8 | uint(d.buf[offset+1]))
+	default:
+		size = 65821 + (uint(d.buf[offset])<<16 | uint(d.buf[offset+1])<<8 | uint(d.buf[offset+2]))
+	}
+
+	return typeNum, size, offset + extra, nil
+}
+
+func (d decoder) decodePointer(size, offset uint) (uint, uint, error) {
+	pointerSize := ((size >> 3) & 0x3) + 1
+	if offset+pointerSize > uint(len(d.buf)) {
+		return 0, 0, errCorrupted
+	}
+
+	var prefix uint
+	if pointerSize != 4 {
+		prefix = size & 0x7
+	}
+
+	pointer := prefix
+
+	for _, b := range d.buf[offset : offset+pointerSize] {
+		pointer = pointer<<8 | uint(b)
+	}
+
+	switch pointerSize {
+	case 2:
+		pointer += 2048
+	case 3:
+		pointer += 526336
+	}
+
+	return pointer, offset + pointerSize, nil
+}
+
+func (d decoder) decodeUint(offset, size uint) uint64 {
+	var v uint64
+	for _, b := range d.buf[offset : offset+size] {
+		v = v<<8 | uint64(b)
+	}
+
+	return v
+}
+
+func (d decoder) decodeMap(size, offset uint, depth int) (any, uint, error) {
+	m := make(map[string]any, prealloc(size))
+
+	for range size {
+		k, next, err := d.decode(offset, depth)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		key, ok := k.(string)
+		if !ok {
+			return nil, 0, errCorrupted
+		}
+
+		v, next, err := d.decode(next, depth)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		m[key] = v
+		offset = next
+	}
+
+	return m, offset, nil
+}
+
+func (d decoder) decodeArray(size, offset uint, depth int) (any, uint, error) {
+	a := make([]any, 0, prealloc(size))
+
+	for range size {
+		v, next, err := d.decode(offset, depth)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		a = append(a, v)
+		offset = next
+	}
+
+	return a, offset, nil
+}
+
+// prealloc returns the capacity to preallocate for size elements.
+func prealloc(size uint) uint {
+	if size > maxPrealloc {
+		return maxPrealloc
+	}
+
+	return size
+}
+
+// toUint converts a decoded unsigned integer to uint, 0 otherwise.
+func toUint(v any) uint {
+	if u, ok := v.(uint64); ok {
+		return uint(u)
+	}
+
+	return 0
+}
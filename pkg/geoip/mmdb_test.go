@@ -0,0 +1,335 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testNetwork struct {
+	prefix string
+	record map[string]any
+}
+
+// buildMMDB writes a minimal MaxMind DB holding the networks.
+func buildMMDB(t *testing.T, ipVersion, recordSize int, networks []testNetwork) []byte {
+	t.Helper()
+
+	// records values: >= 0 is a node, -1 is empty, <= -2 is the data -(v+2).
+	records := [][2]int{{-1, -1}}
+
+	var (
+		dataSection []byte
+		dataOffsets []int
+		encoded     [][]byte
+	)
+
+	for i, network := range networks {
+		prefix := netip.MustParsePrefix(network.prefix)
+
+		bits := prefixBits(prefix)
+		if ipVersion == 6 && prefix.Addr().Is4() {
+			bits = append(make([]int, 96), bits...)
+		}
+
+		node := 0
+
+		for j, bit := range bits {
+			if j == len(bits)-1 {
+				records[node][bit] = -(i + 2)
+
+				break
+			}
+
+			if records[node][bit] < 0 {
+				records = append(records, [2]int{-1, -1})
+				records[node][bit] = len(records) - 1
+			}
+
+			node = records[node][bit]
+		}
+
+		record := encode(t, network.record)
+
+		// Deduplicate identical records with a pointer, as real databases do.
+		if k := slices.IndexFunc(encoded, func(b []byte) bool { return bytes.Equal(b, record) }); k >= 0 {
+			require.Less(t, dataOffsets[k], 2048)
+			record = []byte{typePointer<<5 | byte(dataOffsets[k]>>8), byte(dataOffsets[k])}
+		}
+
+		encoded = append(encoded, record)
+		dataOffsets = append(dataOffsets, len(dataSection))
+		dataSection = append(dataSection, record...)
+	}
+
+	nodeCount := len(records)
+	value := func(v int) uint32 {
+		switch {
+		case v >= 0:
+			return uint32(v)
+		case v == -1:
+			return uint32(nodeCount)
+		default:
+			return uint32(nodeCount + dataSectionSeparatorSize + dataOffsets[-(v+2)])
+		}
+	}
+
+	var buf []byte
+
+	for _, record := range records {
+		left, right := value(record[0]), value(record[1])
+
+		switch recordSize {
+		case 24:
+			buf = append(buf, byte(left>>16), byte(left>>8), byte(left), byte(right>>16), byte(right>>8), byte(right))
+		case 28:
+			buf = append(buf, byte(left>>16), byte(left>>8), byte(left),
+				byte((left>>24)&0x0F)<<4|byte((right>>24)&0x0F),
+				byte(right>>16), byte(right>>8), byte(right))
+		default:
+			buf = binary.BigEndian.AppendUint32(buf, left)
+			buf = binary.BigEndian.AppendUint32(buf, right)
+		}
+	}
+
+	buf = append(buf, make([]byte, dataSectionSeparatorSize)...)
+	buf = append(buf, dataSection...)
+	buf = append(buf, metadataMarker...)
+	buf = append(buf, encode(t, map[string]any{
+		"node_count":                  uint32(nodeCount),
+		"record_size":                 uint16(recordSize),
+		"ip_version":                  uint16(ipVersion),
+		"database_type":               "Test",
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+	})...)
+
+	return buf
+}
+
+func prefixBits(prefix netip.Prefix) []int {
+	addr := prefix.Addr().AsSlice()
+	bits := make([]int, 0, prefix.Bits())
+
+	for i := range prefix.Bits() {
+		bits = append(bits, int(addr[i/8]>>(7-i%8))&1)
+	}
+
+	return bits
+}
+
+func encodeCtrl(typeNum, size int) []byte {
+	var extra []byte
+	if size >= 29 {
+		extra = []byte{byte(size - 29)}
+		size = 29
+	}
+
+	if typeNum <= typeMap {
+		return append([]byte{byte(typeNum<<5 | size)}, extra...)
+	}
+
+	return append([]byte{byte(size), byte(typeNum - typeMap)}, extra...)
+}
+
+func encodeUint(typeNum int, v uint64) []byte {
+	var b []byte
+	for ; v > 0; v >>= 8 {
+		b = append([]byte{byte(v)}, b...)
+	}
+
+	return append(encodeCtrl(typeNum, len(b)), b...)
+}
+
+func encode(t *testing.T, v any) []byte {
+	t.Helper()
+
+	switch v := v.(type) {
+	case string:
+		require.Less(t, len(v), 285)
+
+		return append(encodeCtrl(typeString, len(v)), v...)
+	case uint16:
+		return encodeUint(typeUint16, uint64(v))
+	case uint32:
+		return encodeUint(typeUint32, uint64(v))
+	case uint64:
+		return encodeUint(typeUint64, v)
+	case bool:
+		if v {
+			return encodeCtrl(typeBool, 1)
+		}
+
+		return encodeCtrl(typeBool, 0)
+	case []any:
+		b := encodeCtrl(typeArray, len(v))
+		for _, e := range v {
+			b = append(b, encode(t, e)...)
+		}
+
+		return b
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+
+		slices.Sort(keys)
+
+		b := encodeCtrl(typeMap, len(v))
+		for _, k := range keys {
+			b = append(b, encode(t, k)...)
+			b = append(b, encode(t, v[k])...)
+		}
+
+		return b
+	default:
+		require.Failf(t, "unsupported type", "%T", v)
+
+		return nil
+	}
+}
+
+func TestReaderLookup(t *testing.T) {
+	t.Parallel()
+
+	networks := []testNetwork{
+		{prefix: "192.0.2.0/24", record: map[string]any{"country": map[string]any{"iso_code": "FR"}}},
+		{prefix: "198.51.100.0/25", record: map[string]any{
+			"autonomous_system_number":       uint32(64496),
+			"autonomous_system_organization": "Example",
+		}},
+		{prefix: "203.0.113.0/24", record: map[string]any{"country": map[string]any{"iso_code": "FR"}}},
+		{prefix: "2001:db8::/32", record: map[string]any{
+			"registered_country": map[string]any{"iso_code": "DE"},
+			"is_anycast":         true,
+			"tags":               []any{"a", uint64(1)},
+		}},
+	}
+
+	tests := []struct {
+		name     string
+		ip       string
+		expected any
+	}{
+		{
+			name:     "ipv4",
+			ip:       "192.0.2.42",
+			expected: map[string]any{"country": map[string]any{"iso_code": "FR"}},
+		},
+		{
+			name: "ipv4 asn",
+			ip:   "198.51.100.1",
+			expected: map[string]any{
+				"autonomous_system_number":       uint64(64496),
+				"autonomous_system_organization": "Example",
+			},
+		},
+		{
+			name:     "ipv4 deduplicated record",
+			ip:       "203.0.113.1",
+			expected: map[string]any{"country": map[string]any{"iso_code": "FR"}},
+		},
+		{
+			name: "not found",
+			ip:   "198.51.100.200",
+		},
+		{
+			name:     "ipv4 mapped ipv6",
+			ip:       "::ffff:192.0.2.1",
+			expected: map[string]any{"country": map[string]any{"iso_code": "FR"}},
+		},
+	}
+
+	for _, ipVersion := range []int{4, 6} {
+		for _, recordSize := range []int{24, 28, 32} {
+			r, err := NewReader(buildMMDB(t, ipVersion, recordSize, networks[:3]))
+			require.NoError(t, err)
+
+			for _, test := range tests {
+				got, err := r.Lookup(netip.MustParseAddr(test.ip))
+				require.NoError(t, err)
+				assert.Equal(t, test.expected, got, "ipv%d/%d: %s", ipVersion, recordSize, test.name)
+			}
+		}
+	}
+
+	r, err := NewReader(buildMMDB(t, 6, 28, networks))
+	require.NoError(t, err)
+
+	got, err := r.Lookup(netip.MustParseAddr("2001:db8::1"))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{
+		"registered_country": map[string]any{"iso_code": "DE"},
+		"is_anycast":         true,
+		"tags":               []any{"a", uint64(1)},
+	}, got)
+
+	got, err = r.Lookup(netip.MustParseAddr("2001:db9::1"))
+	require.NoError(t, err)
+	assert.Nil(t, got)
+}
+
+func TestNewReaderInvalid(t *testing.T) {
+	t.Parallel()
+
+	_, err := NewReader([]byte("not a database"))
+	require.Error(t, err)
+
+	valid := buildMMDB(t, 4, 24, []testNetwork{{prefix: "192.0.2.0/24", record: map[string]any{"a": "b"}}})
+
+	// Only keep the metadata.
+	_, err = NewReader(valid[bytes.LastIndex(valid, metadataMarker):])
+	require.Error(t, err)
+}
+
+func TestReaderLookupPaths(t *testing.T) {
+	t.Parallel()
+
+	r, err := NewReader(buildMMDB(t, 6, 28, []testNetwork{
+		{prefix: "2001:db8::/32", record: map[string]any{
+			"autonomous_system_number": uint32(64496),
+			"is_anycast":               true,
+			"registered_country":       map[string]any{"iso_code": "DE", "names": map[string]any{"en": "Germany"}},
+			"tags":                     []any{"a", uint64(1)},
+		}},
+	}))
+	require.NoError(t, err)
+
+	got, err := r.LookupPaths(netip.MustParseAddr("2001:db8::1"),
+		[]string{"country", "iso_code"},
+		[]string{"registered_country", "iso_code"},
+		[]string{"tags", "a"},
+		[]string{"autonomous_system_number"},
+		[]string{"registered_country", "names"},
+	)
+	require.NoError(t, err)
+	assert.Equal(t, []any{nil, "DE", nil, uint64(64496), map[string]any{"en": "Germany"}}, got)
+
+	got, err = r.LookupPaths(netip.MustParseAddr("2001:db9::1"), []string{"country", "iso_code"})
+	require.NoError(t, err)
+	assert.Equal(t, []any{nil}, got)
+}
+
+func TestDecodeOversized(t *testing.T) {
+	t.Parallel()
+
+	// A map and an array claiming 16M entries, in a few bytes.
+	for _, buf := range [][]byte{
+		{typeMap<<5 | 31, 0xFF, 0xFF, 0xFF},
+		{31, typeArray - typeMap, 0xFF, 0xFF, 0xFF},
+	} {
+		d := decoder{buf: buf}
+
+		_, _, err := d.decode(0, 0)
+		require.ErrorIs(t, err, errCorrupted)
+
+		_, err = d.skip(0, 0)
+		require.ErrorIs(t, err, errCorrupted)
+	}
+}
@@ -14,6 +14,10 @@ type IPViewed struct {
 	Viewed time.Time
 	Count  int
 	Denied bool
+	// Score is the sum of the weights of the failures.
+	Score float64
+	// Bantime overrides the rules bantime when set (e.g. trapped IPs).
+	Bantime time.Duration
 }
 
 // NetIP struct that holds an NetIP IP address, and a IP network.
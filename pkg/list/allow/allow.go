@@ -8,20 +8,39 @@ import (
 
 	"github.com/tomMoulard/fail2ban/pkg/chain"
 	"github.com/tomMoulard/fail2ban/pkg/data"
+	"github.com/tomMoulard/fail2ban/pkg/geoip"
 	"github.com/tomMoulard/fail2ban/pkg/ipchecking"
 )
 
 type allow struct {
-	list ipchecking.NetIPs
+	list      ipchecking.NetIPs
+	selectors []geoip.Selector
+	hostnames *Hostnames
+	// suspected tells the IPs worth a hostname verification, nil to verify
+	// every IP.
+	suspected func(remoteIP string) bool
 }
 
 func New(ipList []string) (*allow, error) {
-	list, err := ipchecking.ParseNetIPs(ipList)
+	ips, selectors, err := geoip.Split(ipList)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse selectors: %w", err)
+	}
+
+	list, err := ipchecking.ParseNetIPs(ips)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create new net ips: %w", err)
 	}
 
-	return &allow{list: list}, nil
+	return &allow{list: list, selectors: selectors}, nil
+}
+
+// WithHostnames also allows the requests from IPs verified by the hostnames.
+// Only the suspected IPs (e.g. with failures) are verified, when set, sparing
+// the DNS lookups to the others.
+func (a *allow) WithHostnames(hostnames *Hostnames, suspected func(remoteIP string) bool) {
+	a.hostnames = hostnames
+	a.suspected = suspected
 }
 
 func (a *allow) ServeHTTP(w http.ResponseWriter, r *http.Request) (*chain.Status, error) {
@@ -30,9 +49,34 @@ func (a *allow) ServeHTTP(w http.ResponseWriter, r *http.Request) (*chain.Status
 		return nil, errors.New("failed to get data from request context")
 	}
 
-	if a.list.Contains(data.RemoteIP) {
+	if a.list.Contains(data.RemoteIP) ||
+		a.matchesSelector(data) ||
+		a.verified(r, data.RemoteIP) {
+		data.Allowlisted = true
+
 		return &chain.Status{Break: true}, nil
 	}
 
 	return nil, nil
 }
+
+// verified returns whether the IP is verified by the hostnames.
+func (a *allow) verified(r *http.Request, remoteIP string) bool {
+	if a.hostnames == nil || (a.suspected != nil && !a.suspected(remoteIP)) {
+		return false
+	}
+
+	return a.hostnames.Verify(r.Context(), remoteIP)
+}
+
+func (a *allow) matchesSelector(d *data.Data) bool {
+	info := geoip.Info{Country: d.Country, ASN: d.ASN}
+
+	for _, selector := range a.selectors {
+		if selector.Matches(info) {
+			return true
+		}
+	}
+
+	return false
+}
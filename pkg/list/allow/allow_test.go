@@ -1,9 +1,11 @@
 package allow
 
 import (
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -26,6 +28,13 @@ func TestAllow(t *testing.T) {
 				Break: true,
 			},
 		},
+		{
+			name:   "allowed by country",
+			ipList: []string{"country:FR"},
+			expectedStatus: &chain.Status{
+				Break: true,
+			},
+		},
 		{
 			name: "denied",
 		},
@@ -43,9 +52,61 @@ func TestAllow(t *testing.T) {
 			req, err = data.ServeHTTP(recorder, req, "")
 			require.NoError(t, err)
 
+			data.GetData(req).Country = "FR"
+
 			got, err := a.ServeHTTP(recorder, req)
 			require.NoError(t, err)
 			assert.Equal(t, test.expectedStatus, got)
+			assert.Equal(t, test.expectedStatus != nil, data.GetData(req).Allowlisted)
 		})
 	}
 }
+
+func TestAllowHostnames(t *testing.T) {
+	t.Parallel()
+
+	a, err := New(nil)
+	require.NoError(t, err)
+
+	a.WithHostnames(NewHostnames([]string{".googlebot.com"}, newMockResolver(), time.Hour, time.Minute), nil)
+
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/foo", nil)
+	req.RemoteAddr = "66.249.66.1:1234"
+	req, err = data.ServeHTTP(nil, req, "")
+	require.NoError(t, err)
+
+	got, err := a.ServeHTTP(nil, req)
+	require.NoError(t, err)
+	assert.Equal(t, &chain.Status{Break: true}, got)
+	assert.True(t, data.GetData(req).Allowlisted)
+}
+
+func TestAllowHostnamesSuspected(t *testing.T) {
+	t.Parallel()
+
+	resolver := newMockResolver()
+
+	a, err := New(nil)
+	require.NoError(t, err)
+
+	suspected := map[string]bool{"66.249.66.1": true}
+	a.WithHostnames(NewHostnames([]string{".googlebot.com"}, resolver, time.Hour, time.Minute), func(remoteIP string) bool {
+		return suspected[remoteIP]
+	})
+
+	for remoteIP, expectedStatus := range map[string]*chain.Status{
+		"66.249.66.1": {Break: true},
+		"2001:db8::1": nil,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "https://example.com/foo", nil)
+		req.RemoteAddr = net.JoinHostPort(remoteIP, "1234")
+		req, err = data.ServeHTTP(nil, req, "")
+		require.NoError(t, err)
+
+		got, err := a.ServeHTTP(nil, req)
+		require.NoError(t, err)
+		assert.Equal(t, expectedStatus, got, remoteIP)
+	}
+
+	assert.Equal(t, 1, resolver.lookups)
+}
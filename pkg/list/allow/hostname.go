@@ -0,0 +1,227 @@
+package allow
+
+import (
+	"context"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tomMoulard/fail2ban/pkg/logger"
+	utime "github.com/tomMoulard/fail2ban/pkg/utils/time"
+)
+
+// lookupTimeout is the maximum duration of the reverse and forward lookups of
+// a single verification.
+const lookupTimeout = 2 * time.Second
+
+// maxCacheSize is the maximum number of IPs kept in the verification cache.
+const maxCacheSize = 10000
+
+// Resolver resolves IPs to hostnames, and hostnames to IPs.
+// *net.Resolver implements it.
+type Resolver interface {
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+type verification struct {
+	allowed bool
+	expires time.Time
+}
+
+// lookup is an ongoing verification, shared by the requests of the IP.
+type lookup struct {
+	done    chan struct{}
+	allowed bool
+}
+
+// Hostnames verifies that an IP belongs to a set of hostname suffixes (e.g.
+// ".googlebot.com"), with a reverse lookup confirmed by a forward lookup.
+type Hostnames struct {
+	suffixes    []string
+	resolver    Resolver
+	ttl         time.Duration
+	negativeTTL time.Duration
+
+	mu       sync.Mutex
+	cache    map[string]verification
+	inflight map[string]*lookup
+}
+
+// NewHostnames creates a new Hostnames. Positive results are cached for ttl,
+// and negative results for negativeTTL.
+func NewHostnames(suffixes []string, resolver Resolver, ttl, negativeTTL time.Duration) *Hostnames {
+	normalized := make([]string, 0, len(suffixes))
+	for _, suffix := range suffixes {
+		normalized = append(normalized, strings.ToLower(strings.TrimSuffix(suffix, ".")))
+	}
+
+	return &Hostnames{
+		suffixes:    normalized,
+		resolver:    resolver,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		cache:       make(map[string]verification),
+		inflight:    make(map[string]*lookup),
+	}
+}
+
+// Verify returns whether the IP is verified to belong to one of the suffixes.
+// The concurrent verifications of an IP share the same lookups.
+func (h *Hostnames) Verify(ctx context.Context, remoteIP string) bool {
+	now := utime.Now()
+
+	h.mu.Lock()
+
+	if v, found := h.cache[remoteIP]; found && now.Before(v.expires) {
+		h.mu.Unlock()
+
+		return v.allowed
+	}
+
+	if l, found := h.inflight[remoteIP]; found {
+		h.mu.Unlock()
+
+		select {
+		case <-l.done:
+			return l.allowed
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	l := &lookup{done: make(chan struct{})}
+	h.inflight[remoteIP] = l
+	h.mu.Unlock()
+
+	// The lookups outlive the request starting them, as their result is
+	// shared and cached; lookupTimeout bounds them.
+	allowed := h.verify(context.WithoutCancel(ctx), remoteIP)
+
+	ttl := h.negativeTTL
+	if allowed {
+		ttl = h.ttl
+	}
+
+	h.mu.Lock()
+	h.store(remoteIP, verification{allowed: allowed, expires: now.Add(ttl)}, now)
+	delete(h.inflight, remoteIP)
+	h.mu.Unlock()
+
+	l.allowed = allowed
+	close(l.done)
+
+	return allowed
+}
+
+// Verified returns whether the IP was verified to belong to one of the
+// suffixes, from the cache only: no lookup is made.
+func (h *Hostnames) Verified(remoteIP string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	v, found := h.cache[remoteIP]
+
+	return found && v.allowed && utime.Now().Before(v.expires)
+}
+
+// store caches the verification, evicting the expired ones when the cache is
+// full, then the ones expiring first. It is called with mu held.
+func (h *Hostnames) store(remoteIP string, v verification, now time.Time) {
+	if _, found := h.cache[remoteIP]; !found && len(h.cache) >= maxCacheSize {
+		for ip, cached := range h.cache {
+			if !now.Before(cached.expires) {
+				delete(h.cache, ip)
+			}
+		}
+
+		for len(h.cache) >= maxCacheSize {
+			h.evictOldest()
+		}
+	}
+
+	h.cache[remoteIP] = v
+}
+
+// evictOldest removes the verification expiring first.
+func (h *Hostnames) evictOldest() {
+	var (
+		oldestIP string
+		oldest   time.Time
+	)
+
+	for ip, cached := range h.cache {
+		if oldestIP == "" || cached.expires.Before(oldest) {
+			oldestIP, oldest = ip, cached.expires
+		}
+	}
+
+	delete(h.cache, oldestIP)
+}
+
+func (h *Hostnames) verify(ctx context.Context, remoteIP string) bool {
+	ip, err := netip.ParseAddr(remoteIP)
+	if err != nil {
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, lookupTimeout)
+	defer cancel()
+
+	names, err := h.resolver.LookupAddr(ctx, remoteIP)
+	if err != nil {
+		logger.Warn("Plugin: FailToBan: reverse lookup failed",
+			logger.WithIP(remoteIP),
+			logger.WithErr(err.Error()),
+		)
+
+		return false
+	}
+
+	for _, name := range names {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		if !h.matches(name) {
+			continue
+		}
+
+		addrs, err := h.resolver.LookupHost(ctx, name)
+		if err != nil {
+			logger.Warn("Plugin: FailToBan: forward lookup failed",
+				logger.WithIP(remoteIP),
+				logger.WithErr(err.Error()),
+			)
+
+			continue
+		}
+
+		for _, addr := range addrs {
+			resolved, err := netip.ParseAddr(addr)
+			if err == nil && resolved.Unmap() == ip.Unmap() {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// matches returns whether the hostname is one of the suffixes, or a subdomain
+// of one of them.
+func (h *Hostnames) matches(name string) bool {
+	for _, suffix := range h.suffixes {
+		if strings.HasPrefix(suffix, ".") {
+			if strings.HasSuffix(name, suffix) {
+				return true
+			}
+
+			continue
+		}
+
+		if name == suffix || strings.HasSuffix(name, "."+suffix) {
+			return true
+		}
+	}
+
+	return false
+}
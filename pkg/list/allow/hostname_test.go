@@ -0,0 +1,238 @@
+package allow
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	utime "github.com/tomMoulard/fail2ban/pkg/utils/time"
+)
+
+type mockResolver struct {
+	mu      sync.Mutex
+	addrs   map[string][]string
+	hosts   map[string][]string
+	lookups int
+	// release, when set, holds the reverse lookups until closed.
+	release chan struct{}
+}
+
+func (m *mockResolver) LookupAddr(_ context.Context, addr string) ([]string, error) {
+	if m.release != nil {
+		<-m.release
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lookups++
+
+	names, ok := m.addrs[addr]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+
+	return names, nil
+}
+
+func (m *mockResolver) LookupHost(_ context.Context, host string) ([]string, error) {
+	addrs, ok := m.hosts[host]
+	if !ok {
+		return nil, errors.New("no such host")
+	}
+
+	return addrs, nil
+}
+
+func newMockResolver() *mockResolver {
+	return &mockResolver{
+		addrs: map[string][]string{
+			"66.249.66.1":  {"crawl-66-249-66-1.googlebot.com."},
+			"66.249.66.2":  {"crawl-66-249-66-2.googlebot.com."},
+			"198.51.100.1": {"fake.googlebot.com.evil.example."},
+			"2001:db8::1":  {"msnbot-2001-db8--1.search.msn.com."},
+		},
+		hosts: map[string][]string{
+			"crawl-66-249-66-1.googlebot.com":   {"66.249.66.1"},
+			"crawl-66-249-66-2.googlebot.com":   {"66.249.66.42"}, // spoofed PTR record
+			"fake.googlebot.com.evil.example":   {"198.51.100.1"},
+			"msnbot-2001-db8--1.search.msn.com": {"2001:db8::1"},
+		},
+	}
+}
+
+func TestHostnamesVerify(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		remoteIP string
+		expect   assert.BoolAssertionFunc
+	}{
+		{
+			name:     "verified",
+			remoteIP: "66.249.66.1",
+			expect:   assert.True,
+		},
+		{
+			name:     "verified ipv6",
+			remoteIP: "2001:db8::1",
+			expect:   assert.True,
+		},
+		{
+			name:     "forward lookup mismatch",
+			remoteIP: "66.249.66.2",
+			expect:   assert.False,
+		},
+		{
+			name:     "suffix mismatch",
+			remoteIP: "198.51.100.1",
+			expect:   assert.False,
+		},
+		{
+			name:     "no reverse record",
+			remoteIP: "192.0.2.1",
+			expect:   assert.False,
+		},
+		{
+			name:     "invalid IP",
+			remoteIP: "not-an-ip",
+			expect:   assert.False,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			h := NewHostnames([]string{".googlebot.com", "search.msn.com."}, newMockResolver(), time.Hour, time.Minute)
+			test.expect(t, h.Verify(t.Context(), test.remoteIP))
+		})
+	}
+}
+
+func TestHostnamesCache(t *testing.T) {
+	t.Parallel()
+
+	resolver := newMockResolver()
+	h := NewHostnames([]string{".googlebot.com"}, resolver, time.Hour, time.Hour)
+
+	for range 3 {
+		assert.True(t, h.Verify(t.Context(), "66.249.66.1"))
+		assert.False(t, h.Verify(t.Context(), "192.0.2.1"))
+	}
+
+	assert.Equal(t, 2, resolver.lookups)
+}
+
+func TestHostnamesVerified(t *testing.T) {
+	t.Parallel()
+
+	resolver := newMockResolver()
+	h := NewHostnames([]string{".googlebot.com"}, resolver, time.Hour, time.Hour)
+
+	// Only the cached verifications count, without lookups.
+	assert.False(t, h.Verified("66.249.66.1"))
+	assert.Zero(t, resolver.lookups)
+
+	h.Verify(t.Context(), "66.249.66.1")
+	h.Verify(t.Context(), "192.0.2.1")
+
+	assert.True(t, h.Verified("66.249.66.1"))
+	assert.False(t, h.Verified("192.0.2.1"))
+	assert.Equal(t, 2, resolver.lookups)
+}
+
+func TestHostnamesConcurrentLookups(t *testing.T) {
+	t.Parallel()
+
+	resolver := newMockResolver()
+	resolver.release = make(chan struct{})
+	h := NewHostnames([]string{".googlebot.com"}, resolver, time.Hour, time.Hour)
+
+	var wg sync.WaitGroup
+
+	results := make([]bool, 10)
+
+	for i := range results {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			results[i] = h.Verify(t.Context(), "66.249.66.1")
+		}()
+	}
+
+	// Wait for the first lookup to start, the others waiting on it.
+	require.Eventually(t, func() bool {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		return len(h.inflight) == 1
+	}, time.Second, time.Millisecond)
+
+	close(resolver.release)
+	wg.Wait()
+
+	for _, allowed := range results {
+		assert.True(t, allowed)
+	}
+
+	assert.Equal(t, 1, resolver.lookups)
+	assert.Empty(t, h.inflight)
+}
+
+func TestHostnamesCanceledWait(t *testing.T) {
+	t.Parallel()
+
+	resolver := newMockResolver()
+	resolver.release = make(chan struct{})
+	h := NewHostnames([]string{".googlebot.com"}, resolver, time.Hour, time.Hour)
+
+	done := make(chan bool)
+
+	go func() { done <- h.Verify(context.Background(), "66.249.66.1") }()
+
+	require.Eventually(t, func() bool {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+
+		return len(h.inflight) == 1
+	}, time.Second, time.Millisecond)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+
+	assert.False(t, h.Verify(ctx, "66.249.66.1"))
+
+	close(resolver.release)
+	assert.True(t, <-done)
+	assert.True(t, h.Verify(ctx, "66.249.66.1"))
+}
+
+func TestHostnamesEviction(t *testing.T) {
+	t.Parallel()
+
+	resolver := newMockResolver()
+	h := NewHostnames([]string{".googlebot.com"}, resolver, time.Hour, time.Hour)
+
+	now := utime.Now()
+	for i := range maxCacheSize {
+		h.cache["10.0."+strconv.Itoa(i/256)+"."+strconv.Itoa(i%256)] = verification{
+			expires: now.Add(time.Minute + time.Duration(i)*time.Second),
+		}
+	}
+
+	assert.True(t, h.Verify(t.Context(), "66.249.66.1"))
+
+	assert.Len(t, h.cache, maxCacheSize)
+	assert.Contains(t, h.cache, "66.249.66.1")
+	assert.NotContains(t, h.cache, "10.0.0.0")
+	assert.Contains(t, h.cache, "10.0.0.1")
+}
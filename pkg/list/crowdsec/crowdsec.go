@@ -0,0 +1,320 @@
+// Package crowdsec is a list source polling the decisions stream of a CrowdSec
+// local API (bouncer mode), keeping the banned IPs and ranges in a deny.Set.
+package crowdsec
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tomMoulard/fail2ban/pkg/list/deny"
+	"github.com/tomMoulard/fail2ban/pkg/logger"
+	utime "github.com/tomMoulard/fail2ban/pkg/utils/time"
+)
+
+// HeaderAPIKey is the header of the bouncer API key.
+const HeaderAPIKey = "X-Api-Key"
+
+// streamPath is the path of the decisions stream, under the local API URL.
+const streamPath = "/v1/decisions/stream"
+
+const (
+	defaultInterval = 10 * time.Second
+	defaultTimeout  = 5 * time.Second
+)
+
+// Config of the stream.
+type Config struct {
+	// URL of the local API, e.g. http://crowdsec:8080.
+	URL string
+	// APIKey of the bouncer (cscli bouncers add).
+	APIKey string
+	// Interval between two polls, defaults to 10s.
+	Interval time.Duration
+	// Timeout of a poll, defaults to 5s.
+	Timeout time.Duration
+}
+
+// decision is a decision of the stream.
+type decision struct {
+	ID       int64  `json:"id"`
+	Duration string `json:"duration"`
+	Origin   string `json:"origin"`
+	Scenario string `json:"scenario"`
+	Scope    string `json:"scope"`
+	Type     string `json:"type"`
+	Value    string `json:"value"`
+}
+
+// streamResponse is the response of the stream: the decisions since the last
+// poll, or all the active ones on startup.
+type streamResponse struct {
+	New     []decision `json:"new"`
+	Deleted []decision `json:"deleted"`
+}
+
+// Stream polls the decisions stream, adding the bans to the set and removing
+// the deleted ones.
+type Stream struct {
+	config Config
+	url    string
+	client *http.Client
+	set    *deny.Set
+	// started is set once the active decisions are pulled, the next polls
+	// only pulling the changes. It is atomic, a poll of a stopped Run possibly
+	// ending after the next Run started.
+	started atomic.Bool
+
+	mu sync.Mutex
+	// users are the number of contexts given to Start not done yet.
+	users int
+	// cancel stops Run, nil while the stream has no users.
+	cancel context.CancelFunc
+}
+
+// streamKey identifies the bouncer of a stream.
+type streamKey struct {
+	url    string
+	apiKey string
+}
+
+var (
+	streamsMu sync.Mutex
+	// streams are the streams by bouncer: the local API tracks the decisions
+	// pulled by bouncer, two streams would steal each other's changes.
+	streams = make(map[streamKey]*Stream)
+)
+
+// Open returns the Stream of the local API and API key, filling its own set.
+// The middlewares opening the same bouncer share the Stream, using the
+// interval and timeout of the first one.
+func Open(config Config) (*Stream, error) {
+	key := streamKey{url: strings.TrimSuffix(config.URL, "/"), apiKey: config.APIKey}
+
+	streamsMu.Lock()
+	defer streamsMu.Unlock()
+
+	if s, ok := streams[key]; ok {
+		return s, nil
+	}
+
+	s, err := New(config, deny.NewSet())
+	if err != nil {
+		return nil, err
+	}
+
+	streams[key] = s
+
+	return s, nil
+}
+
+// New creates a Stream filling the set. Run polls the decisions.
+func New(config Config, set *deny.Set) (*Stream, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse url: %w", err)
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid url %q: scheme must be http or https", config.URL)
+	}
+
+	if config.APIKey == "" {
+		return nil, errors.New("api key is required")
+	}
+
+	if config.Interval == 0 {
+		config.Interval = defaultInterval
+	}
+
+	if config.Timeout == 0 {
+		config.Timeout = defaultTimeout
+	}
+
+	return &Stream{
+		config: config,
+		url:    strings.TrimSuffix(config.URL, "/") + streamPath,
+		client: &http.Client{Timeout: config.Timeout},
+		set:    set,
+	}, nil
+}
+
+// Set returns the set filled by the stream.
+func (s *Stream) Set() *deny.Set {
+	return s.set
+}
+
+// Start polls the decisions until the context is done, the stream running
+// while a context given to Start is not done.
+func (s *Stream) Start(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.users++
+
+	if s.cancel == nil {
+		runCtx, cancel := context.WithCancel(context.Background())
+		s.cancel = cancel
+
+		go s.Run(runCtx)
+	}
+
+	go func() {
+		<-ctx.Done()
+		s.stop()
+	}()
+}
+
+// stop stops running the stream once it has no users.
+func (s *Stream) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.users--
+
+	if s.users == 0 && s.cancel != nil {
+		s.cancel()
+		s.cancel = nil
+	}
+}
+
+// Run polls the decisions every interval, until the context is done.
+func (s *Stream) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.Poll(ctx); err != nil {
+			logger.Error("Plugin: FailToBan: failed to pull crowdsec decisions",
+				logger.WithErr(err.Error()),
+			)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Poll pulls the decisions, all the active ones until a poll succeeds, then
+// the changes, and applies them to the set.
+func (s *Stream) Poll(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+
+	query := url.Values{}
+	query.Set("startup", strconv.FormatBool(!s.started.Load()))
+	query.Set("scopes", "ip,range")
+	req.URL.RawQuery = query.Encode()
+
+	req.Header.Set(HeaderAPIKey, s.config.APIKey)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		// The body is drained for the connection to be reused.
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	var stream streamResponse
+	if err := json.NewDecoder(resp.Body).Decode(&stream); err != nil {
+		return fmt.Errorf("failed to decode decisions: %w", err)
+	}
+
+	s.apply(stream, utime.Now())
+	s.started.Store(true)
+
+	return nil
+}
+
+// apply removes the deleted decisions, then adds the new ones, and forgets the
+// expired ones. A value denied by several decisions (e.g. a local scenario and
+// a community list) stays denied until the last one is deleted.
+func (s *Stream) apply(stream streamResponse, now time.Time) {
+	for _, d := range stream.Deleted {
+		if !supported(d) {
+			continue
+		}
+
+		if err := s.set.Remove(d.Value, d.key()); err != nil {
+			logger.Warn("Plugin: FailToBan: invalid crowdsec decision",
+				logger.WithIP(d.Value),
+				logger.WithErr(err.Error()),
+			)
+		}
+	}
+
+	for _, d := range stream.New {
+		if !supported(d) {
+			continue
+		}
+
+		duration, err := time.ParseDuration(d.Duration)
+		if err != nil {
+			logger.Warn("Plugin: FailToBan: invalid crowdsec decision",
+				logger.WithIP(d.Value),
+				logger.WithErr(fmt.Sprintf("failed to parse duration %q: %v", d.Duration, err)),
+			)
+
+			continue
+		}
+
+		if err := s.set.Add(d.Value, d.key(), now.Add(duration), d.reason()); err != nil {
+			logger.Warn("Plugin: FailToBan: invalid crowdsec decision",
+				logger.WithIP(d.Value),
+				logger.WithErr(err.Error()),
+			)
+		}
+	}
+
+	s.set.Purge(now)
+}
+
+// supported returns whether the decision is a ban of an IP or a range, the
+// other remediations (e.g. captcha) and scopes (e.g. country) being ignored.
+func supported(d decision) bool {
+	if !strings.EqualFold(d.Type, "ban") {
+		return false
+	}
+
+	return strings.EqualFold(d.Scope, "ip") || strings.EqualFold(d.Scope, "range")
+}
+
+// reason returns the block reason of the decision: its scenario, or its origin
+// for the decisions without scenario.
+func (d decision) reason() string {
+	if d.Scenario != "" {
+		return d.Scenario
+	}
+
+	if d.Origin != "" {
+		return "crowdsec:" + d.Origin
+	}
+
+	return "crowdsec"
+}
+
+// key identifies the decision among the ones of its value.
+func (d decision) key() string {
+	return strconv.FormatInt(d.ID, 10)
+}
@@ -0,0 +1,242 @@
+package crowdsec
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tomMoulard/fail2ban/pkg/list/deny"
+	utime "github.com/tomMoulard/fail2ban/pkg/utils/time"
+)
+
+const apiKey = "bouncer-key"
+
+// lapi is a stand-in of the CrowdSec local API, answering the polls with the
+// queued responses.
+type lapi struct {
+	mu        sync.Mutex
+	responses []streamResponse
+	startups  []string
+}
+
+func newLAPI(t *testing.T, responses ...streamResponse) (*lapi, string) {
+	t.Helper()
+
+	l := &lapi{responses: responses}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != streamPath {
+			http.NotFound(w, r)
+
+			return
+		}
+
+		if r.Header.Get(HeaderAPIKey) != apiKey {
+			w.WriteHeader(http.StatusForbidden)
+
+			return
+		}
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+
+		l.startups = append(l.startups, r.URL.Query().Get("startup"))
+
+		var resp streamResponse
+		if len(l.responses) > 0 {
+			resp, l.responses = l.responses[0], l.responses[1:]
+		}
+
+		_ = json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(srv.Close)
+
+	return l, srv.URL
+}
+
+func TestNew(t *testing.T) {
+	t.Parallel()
+
+	_, err := New(Config{URL: "crowdsec:8080", APIKey: apiKey}, deny.NewSet())
+	require.EqualError(t, err, `invalid url "crowdsec:8080": scheme must be http or https`)
+
+	_, err = New(Config{URL: "http://crowdsec:8080"}, deny.NewSet())
+	require.EqualError(t, err, "api key is required")
+
+	s, err := New(Config{URL: "http://crowdsec:8080/", APIKey: apiKey}, deny.NewSet())
+	require.NoError(t, err)
+	assert.Equal(t, "http://crowdsec:8080/v1/decisions/stream", s.url)
+	assert.Equal(t, defaultInterval, s.config.Interval)
+	assert.Equal(t, defaultTimeout, s.config.Timeout)
+}
+
+func TestPoll(t *testing.T) {
+	t.Parallel()
+
+	l, url := newLAPI(t,
+		streamResponse{
+			New: []decision{
+				{ID: 1, Duration: "4h", Origin: "crowdsec", Scenario: "crowdsecurity/http-probing", Scope: "Ip", Type: "ban", Value: "192.0.2.1"},
+				{ID: 2, Duration: "24h", Origin: "lists", Scenario: "firehol_level1", Scope: "Range", Type: "ban", Value: "198.51.100.0/24"},
+				{ID: 3, Duration: "1h", Origin: "cscli", Scope: "Ip", Type: "ban", Value: "192.0.2.2"},
+				{ID: 4, Duration: "4h", Origin: "crowdsec", Scenario: "crowdsecurity/http-probing", Scope: "Ip", Type: "ban", Value: "192.0.2.6"},
+				{ID: 5, Duration: "24h", Origin: "crowdsec", Scenario: "crowdsecurity/http-probing", Scope: "Ip", Type: "ban", Value: "192.0.2.6"},
+				// Ignored.
+				{ID: 6, Duration: "4h", Scenario: "crowdsecurity/http-probing", Scope: "Ip", Type: "captcha", Value: "192.0.2.3"},
+				{ID: 7, Duration: "4h", Scenario: "manual", Scope: "Country", Type: "ban", Value: "RU"},
+				{ID: 8, Duration: "forever", Scenario: "crowdsecurity/ssh-bf", Scope: "Ip", Type: "ban", Value: "192.0.2.4"},
+				{ID: 9, Duration: "4h", Scenario: "crowdsecurity/ssh-bf", Scope: "Ip", Type: "ban", Value: "not-an-ip"},
+			},
+		},
+		streamResponse{
+			New: []decision{
+				{ID: 10, Duration: "2h", Origin: "crowdsec", Scenario: "crowdsecurity/ssh-bf", Scope: "Ip", Type: "ban", Value: "192.0.2.5"},
+			},
+			Deleted: []decision{
+				{ID: 1, Duration: "-1s", Origin: "crowdsec", Scenario: "crowdsecurity/http-probing", Scope: "Ip", Type: "ban", Value: "192.0.2.1"},
+				// A captcha removal keeps the ban.
+				{ID: 11, Duration: "-1s", Origin: "cscli", Scope: "Ip", Type: "captcha", Value: "192.0.2.2"},
+				// The IP stays banned by its other decision, of the same scenario.
+				{ID: 4, Duration: "-1s", Origin: "crowdsec", Scenario: "crowdsecurity/http-probing", Scope: "Ip", Type: "ban", Value: "192.0.2.6"},
+			},
+		},
+	)
+
+	set := deny.NewSet()
+	s, err := New(Config{URL: url, APIKey: apiKey}, set)
+	require.NoError(t, err)
+
+	require.NoError(t, s.Poll(t.Context()))
+
+	now := utime.Now()
+
+	for _, test := range []struct {
+		remoteIP       string
+		expectedFound  bool
+		expectedReason string
+	}{
+		{remoteIP: "192.0.2.1", expectedFound: true, expectedReason: "crowdsecurity/http-probing"},
+		{remoteIP: "198.51.100.42", expectedFound: true, expectedReason: "firehol_level1"},
+		{remoteIP: "192.0.2.2", expectedFound: true, expectedReason: "crowdsec:cscli"},
+		{remoteIP: "192.0.2.3"},
+		{remoteIP: "192.0.2.4"},
+	} {
+		reason, found := set.Reason(test.remoteIP, now)
+		assert.Equal(t, test.expectedFound, found, test.remoteIP)
+		assert.Equal(t, test.expectedReason, reason, test.remoteIP)
+	}
+
+	// The durations come from the decisions.
+	_, found := set.Reason("192.0.2.2", now.Add(59*time.Minute))
+	assert.True(t, found)
+	_, found = set.Reason("192.0.2.2", now.Add(time.Hour))
+	assert.False(t, found)
+
+	require.NoError(t, s.Poll(t.Context()))
+
+	_, found = set.Reason("192.0.2.1", now)
+	assert.False(t, found)
+
+	for _, remoteIP := range []string{"192.0.2.2", "192.0.2.5", "192.0.2.6", "198.51.100.42"} {
+		_, found = set.Reason(remoteIP, now)
+		assert.True(t, found, remoteIP)
+	}
+
+	assert.Equal(t, []string{"true", "false"}, l.startups)
+}
+
+func TestPollErrors(t *testing.T) {
+	t.Parallel()
+
+	l, url := newLAPI(t)
+
+	s, err := New(Config{URL: url, APIKey: "wrong"}, deny.NewSet())
+	require.NoError(t, err)
+	require.EqualError(t, s.Poll(t.Context()), "unexpected status code 403")
+
+	// The active decisions are pulled until a poll succeeds.
+	s.config.APIKey = apiKey
+	require.NoError(t, s.Poll(t.Context()))
+	require.NoError(t, s.Poll(t.Context()))
+	assert.Equal(t, []string{"true", "false"}, l.startups)
+
+	s, err = New(Config{URL: url + "/nowhere", APIKey: apiKey}, deny.NewSet())
+	require.NoError(t, err)
+	require.EqualError(t, s.Poll(t.Context()), "unexpected status code 404")
+}
+
+func TestRun(t *testing.T) {
+	t.Parallel()
+
+	_, url := newLAPI(t, streamResponse{
+		New: []decision{{ID: 1, Duration: "4h", Scenario: "crowdsecurity/http-probing", Scope: "Ip", Type: "ban", Value: "192.0.2.1"}},
+	})
+
+	set := deny.NewSet()
+	s, err := New(Config{URL: url, APIKey: apiKey, Interval: time.Millisecond}, set)
+	require.NoError(t, err)
+
+	go s.Run(t.Context())
+
+	assert.Eventually(t, func() bool { return set.Len() == 1 }, time.Second, time.Millisecond)
+}
+
+func TestOpen(t *testing.T) {
+	t.Parallel()
+
+	_, url := newLAPI(t)
+
+	s, err := Open(Config{URL: url, APIKey: apiKey})
+	require.NoError(t, err)
+
+	// The bouncers are shared by local API and API key.
+	shared, err := Open(Config{URL: url + "/", APIKey: apiKey, Interval: time.Minute})
+	require.NoError(t, err)
+	assert.Same(t, s, shared)
+
+	other, err := Open(Config{URL: url, APIKey: "other-key"})
+	require.NoError(t, err)
+	assert.NotSame(t, s, other)
+
+	_, err = Open(Config{URL: url})
+	require.EqualError(t, err, "api key is required")
+}
+
+func TestStart(t *testing.T) {
+	t.Parallel()
+
+	_, url := newLAPI(t, streamResponse{
+		New: []decision{{ID: 1, Duration: "4h", Scenario: "crowdsecurity/http-probing", Scope: "Ip", Type: "ban", Value: "192.0.2.1"}},
+	})
+
+	s, err := New(Config{URL: url, APIKey: apiKey, Interval: time.Millisecond}, deny.NewSet())
+	require.NoError(t, err)
+
+	running := func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		return s.cancel != nil
+	}
+
+	first, cancelFirst := context.WithCancel(t.Context())
+	second, cancelSecond := context.WithCancel(t.Context())
+
+	s.Start(first)
+	s.Start(second)
+
+	assert.Eventually(t, func() bool { return s.Set().Len() == 1 }, time.Second, time.Millisecond)
+
+	// The stream runs until every user is done.
+	cancelFirst()
+	assert.Never(t, func() bool { return !running() }, 50*time.Millisecond, time.Millisecond)
+
+	cancelSecond()
+	assert.Eventually(t, func() bool { return !running() }, time.Second, time.Millisecond)
+}
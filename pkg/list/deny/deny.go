@@ -2,28 +2,250 @@
 package deny
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/tomMoulard/fail2ban/pkg/chain"
 	"github.com/tomMoulard/fail2ban/pkg/data"
+	"github.com/tomMoulard/fail2ban/pkg/events"
+	"github.com/tomMoulard/fail2ban/pkg/geoip"
 	"github.com/tomMoulard/fail2ban/pkg/ipchecking"
 	"github.com/tomMoulard/fail2ban/pkg/logger"
+	utime "github.com/tomMoulard/fail2ban/pkg/utils/time"
 )
 
+// defaultReason is the block reason used for entries without a note.
+const defaultReason = "static denylist"
+
+// expiryReportInterval is the interval between two reports of the entries
+// about to expire.
+const expiryReportInterval = time.Hour
+
+// blockEventInterval is the interval between two static block events of an IP,
+// for a client hammering the proxy not to flood the sinks.
+const blockEventInterval = 5 * time.Minute
+
+// maxBlockEvents bounds the IPs remembered for blockEventInterval. When full,
+// the events of the other IPs are dropped.
+const maxBlockEvents = 10000
+
+// Actions applied to the requests matching a denylist entry.
+const (
+	// ActionBlock blocks the request.
+	ActionBlock = "block"
+	// ActionObserve only logs the request.
+	ActionObserve = "observe"
+	// ActionTighten evaluates the request against the stricter rules.
+	ActionTighten = "tighten"
+	// ActionDelay delays the request before evaluating it.
+	ActionDelay = "delay"
+)
+
+// Entry is a denylist entry.
+type Entry struct {
+	// IP is the IP, CIDR, or geoip selector (e.g. "country:RU",
+	// "asn:AS12345") to deny.
+	IP string
+	// Expires is the time after which the entry is ignored. A zero value
+	// means the entry never expires.
+	Expires time.Time
+	// TTL is the expiry relative to the time the entry was first loaded,
+	// setting Expires (see Loaded.Anchor).
+	TTL time.Duration
+	// Note is the reason (or ticket reference) of the entry, logged as the
+	// block reason.
+	Note string
+	// Action is the action applied to matching requests, defaults to
+	// ActionBlock.
+	Action string
+	// Delay is the delay applied with ActionDelay.
+	Delay time.Duration
+}
+
+// Entries converts a list of IPs into never expiring entries.
+func Entries(ipList []string) []Entry {
+	entries := make([]Entry, 0, len(ipList))
+	for _, ip := range ipList {
+		entries = append(entries, Entry{IP: ip})
+	}
+
+	return entries
+}
+
+// ParseExpires parses an expiry, either as a RFC3339 timestamp, or as a
+// duration relative to the time the entry is first loaded (see Loaded). An
+// empty value means the entry never expires.
+func ParseExpires(value string) (time.Time, time.Duration, error) {
+	if value == "" {
+		return time.Time{}, 0, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, 0, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return time.Time{}, 0, fmt.Errorf("failed to parse expiry %q: not a RFC3339 timestamp nor a positive duration", value)
+	}
+
+	return time.Time{}, d, nil
+}
+
+// Loaded are the times the entries with a TTL were first loaded, anchoring
+// their expiry for a reload not to renew it.
+type Loaded struct {
+	mu    sync.Mutex
+	times map[string]time.Time
+}
+
+// NewLoaded returns empty load times.
+func NewLoaded() *Loaded {
+	return &Loaded{times: make(map[string]time.Time)}
+}
+
+// Anchor sets the expiry of the entries with a TTL from the time they were
+// first loaded, now for the new ones. The entries no longer loaded are
+// forgotten.
+func (l *Loaded) Anchor(entries []Entry, now time.Time) []Entry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	times := make(map[string]time.Time, len(l.times))
+
+	for i, e := range entries {
+		if e.TTL <= 0 {
+			continue
+		}
+
+		key := e.IP + " " + e.TTL.String()
+
+		loaded, found := l.times[key]
+		if !found {
+			loaded = now
+		}
+
+		times[key] = loaded
+		entries[i].Expires = loaded.Add(e.TTL)
+	}
+
+	l.times = times
+
+	return entries
+}
+
+type entry struct {
+	ip       ipchecking.NetIP
+	selector *geoip.Selector
+	expires  time.Time
+	note     string
+	action   string
+	delay    time.Duration
+}
+
+func (e entry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+func (e entry) contains(reqData *data.Data) bool {
+	if e.selector != nil {
+		return e.selector.Matches(geoip.Info{Country: reqData.Country, ASN: reqData.ASN})
+	}
+
+	return e.ip.Contains(reqData.RemoteIP)
+}
+
+func (e entry) String() string {
+	if e.selector != nil {
+		return e.selector.String()
+	}
+
+	return e.ip.String()
+}
+
 type deny struct {
-	list            ipchecking.NetIPs
+	entries         []entry
 	enableBlockLogs bool
+	// events is notified of the blocked requests, nil when unused.
+	events *events.Bus
+	// published are the IPs by time of their last static block event.
+	mu        sync.Mutex
+	published map[string]time.Time
+	// set is checked after the entries, nil when unused.
+	set *Set
 }
 
-func New(ipList []string, enableBlockLogs bool) (*deny, error) {
-	list, err := ipchecking.ParseNetIPs(ipList)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create new net ips: %w", err)
+func New(entries []Entry, enableBlockLogs bool) (*deny, error) {
+	list := make([]entry, 0, len(entries))
+
+	for _, e := range entries {
+		var (
+			ip       ipchecking.NetIP
+			selector *geoip.Selector
+		)
+
+		sel, isSelector, err := geoip.ParseSelector(e.IP)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse selector: %w", err)
+		}
+
+		if isSelector {
+			selector = &sel
+		} else {
+			ip, err = ipchecking.ParseNetIP(e.IP)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create new net ips: %w", err)
+			}
+		}
+
+		action := e.Action
+		switch action {
+		case "":
+			action = ActionBlock
+		case ActionBlock, ActionObserve, ActionTighten:
+		case ActionDelay:
+			if e.Delay <= 0 {
+				return nil, fmt.Errorf("entry %q: action %q requires a positive delay", e.IP, action)
+			}
+		default:
+			return nil, fmt.Errorf("entry %q: unknown action %q", e.IP, action)
+		}
+
+		// The entries not anchored (see Loaded) expire from now.
+		expires := e.Expires
+		if e.TTL > 0 && expires.IsZero() {
+			expires = utime.Now().Add(e.TTL)
+		}
+
+		list = append(list, entry{
+			ip:       ip,
+			selector: selector,
+			expires:  expires,
+			note:     e.Note,
+			action:   action,
+			delay:    e.Delay,
+		})
 	}
 
-	return &deny{list: list, enableBlockLogs: enableBlockLogs}, nil
+	return &deny{
+		entries:         list,
+		enableBlockLogs: enableBlockLogs,
+		published:       make(map[string]time.Time),
+	}, nil
+}
+
+// WithSet blocks the requests from the IPs of the set too.
+func (d *deny) WithSet(set *Set) {
+	d.set = set
+}
+
+// WithEvents publishes the blocked requests on the bus.
+func (d *deny) WithEvents(bus *events.Bus) {
+	d.events = bus
 }
 
 func (d *deny) ServeHTTP(w http.ResponseWriter, r *http.Request) (*chain.Status, error) {
@@ -32,20 +254,149 @@ func (d *deny) ServeHTTP(w http.ResponseWriter, r *http.Request) (*chain.Status,
 		return nil, errors.New("failed to get data from request context")
 	}
 
-	if d.list.Contains(reqData.RemoteIP) {
-		if d.enableBlockLogs {
-			logger.Info("Plugin: FailToBan: IP blocked",
-				logger.WithIP(reqData.RemoteIP),
-				logger.WithReason("static denylist"),
-				logger.WithStatusCode(http.StatusTooManyRequests),
-				logger.WithMethod(r.Method),
-				logger.WithPath(r.URL.Path),
-				logger.WithUA(r.UserAgent()),
-			)
+	e, found := d.lookup(reqData, utime.Now())
+	if !found {
+		return nil, nil
+	}
+
+	reason := defaultReason
+	if e.note != "" {
+		reason = e.note
+	}
+
+	switch e.action {
+	case ActionObserve:
+		logger.Info("Plugin: FailToBan: IP observed",
+			logger.WithIP(reqData.RemoteIP),
+			logger.WithReason(reason),
+			logger.WithCountry(reqData.Country),
+			logger.WithASN(reqData.ASN),
+			logger.WithMethod(r.Method),
+			logger.WithPath(r.URL.Path),
+			logger.WithUA(r.UserAgent()),
+		)
+
+		return nil, nil
+	case ActionTighten:
+		return &chain.Status{Tighten: true}, nil
+	case ActionDelay:
+		return &chain.Status{Delay: e.delay}, nil
+	}
+
+	if d.enableBlockLogs {
+		logger.Info(logger.Blocked(reqData.Shadow),
+			logger.WithIP(reqData.RemoteIP),
+			logger.WithReason(reason),
+			logger.WithCountry(reqData.Country),
+			logger.WithASN(reqData.ASN),
+			logger.WithStatusCode(http.StatusTooManyRequests),
+			logger.WithMethod(r.Method),
+			logger.WithPath(r.URL.Path),
+			logger.WithUA(r.UserAgent()),
+		)
+	}
+
+	// The requests let through in shadow mode are not blocked.
+	if now := utime.Now(); !reqData.Shadow && d.publish(reqData.RemoteIP, now) {
+		d.events.Publish(events.Event{
+			Type:   events.StaticBlock,
+			IP:     reqData.RemoteIP,
+			Reason: reason,
+			Time:   now,
+		})
+	}
+
+	return &chain.Status{Return: true}, nil
+}
+
+// publish returns whether the static block of the IP is published, once per
+// blockEventInterval.
+func (d *deny) publish(remoteIP string, now time.Time) bool {
+	if d.events == nil {
+		return false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if last, found := d.published[remoteIP]; found && now.Before(last.Add(blockEventInterval)) {
+		return false
+	}
+
+	if len(d.published) >= maxBlockEvents {
+		for ip, last := range d.published {
+			if !now.Before(last.Add(blockEventInterval)) {
+				delete(d.published, ip)
+			}
 		}
 
-		return &chain.Status{Return: true}, nil
+		if len(d.published) >= maxBlockEvents {
+			return false
+		}
+	}
+
+	d.published[remoteIP] = now
+
+	return true
+}
+
+// lookup returns the first non expired entry containing the client, the
+// entries coming before the set.
+func (d *deny) lookup(reqData *data.Data, now time.Time) (entry, bool) {
+	for _, e := range d.entries {
+		if e.expired(now) {
+			continue
+		}
+
+		if e.contains(reqData) {
+			return e, true
+		}
+	}
+
+	if d.set != nil {
+		return d.set.lookup(reqData.RemoteIP, now)
 	}
 
-	return nil, nil
+	return entry{}, false
+}
+
+// expiring returns the entries that are still active, but will expire within
+// the horizon.
+func (d *deny) expiring(now time.Time, horizon time.Duration) []entry {
+	var list []entry
+
+	for _, e := range d.entries {
+		if e.expires.IsZero() || e.expired(now) {
+			continue
+		}
+
+		if e.expires.Before(now.Add(horizon)) {
+			list = append(list, e)
+		}
+	}
+
+	return list
+}
+
+// ReportExpiring periodically logs the entries that will expire within the
+// horizon, until the context is done.
+func (d *deny) ReportExpiring(ctx context.Context, horizon time.Duration) {
+	ticker := time.NewTicker(expiryReportInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, e := range d.expiring(utime.Now(), horizon) {
+			logger.Warn("Plugin: FailToBan: denylist entry about to expire",
+				logger.WithIP(e.String()),
+				logger.WithReason(e.note),
+				logger.WithExpires(e.expires),
+			)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
 }
@@ -3,12 +3,16 @@ package deny
 import (
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/tomMoulard/fail2ban/pkg/chain"
 	"github.com/tomMoulard/fail2ban/pkg/data"
+	"github.com/tomMoulard/fail2ban/pkg/events"
+	utime "github.com/tomMoulard/fail2ban/pkg/utils/time"
 )
 
 func TestDeny(t *testing.T) {
@@ -16,12 +20,14 @@ func TestDeny(t *testing.T) {
 
 	tests := []struct {
 		name           string
-		ipList         []string
+		entries        []Entry
+		country        string
+		asn            uint32
 		expectedStatus *chain.Status
 	}{
 		{
-			name:   "denied",
-			ipList: []string{"192.0.2.1"},
+			name:    "denied",
+			entries: Entries([]string{"192.0.2.1"}),
 			expectedStatus: &chain.Status{
 				Return: true,
 			},
@@ -29,13 +35,71 @@ func TestDeny(t *testing.T) {
 		{
 			name: "not denied",
 		},
+		{
+			name: "denied with note before expiry",
+			entries: []Entry{{
+				IP:      "192.0.2.0/24",
+				Expires: utime.Now().Add(time.Hour),
+				Note:    "INC-42",
+			}},
+			expectedStatus: &chain.Status{
+				Return: true,
+			},
+		},
+		{
+			name: "expired",
+			entries: []Entry{{
+				IP:      "192.0.2.1",
+				Expires: utime.Now().Add(-time.Hour),
+				Note:    "INC-42",
+			}},
+		},
+		{
+			name:    "denied by country",
+			entries: Entries([]string{"country:RU"}),
+			country: "RU",
+			expectedStatus: &chain.Status{
+				Return: true,
+			},
+		},
+		{
+			name:    "denied by asn",
+			entries: Entries([]string{"asn:AS64496"}),
+			asn:     64496,
+			expectedStatus: &chain.Status{
+				Return: true,
+			},
+		},
+		{
+			name:    "other country",
+			entries: Entries([]string{"country:RU"}),
+			country: "FR",
+		},
+		{
+			name:    "observed",
+			entries: []Entry{{IP: "192.0.2.1", Action: ActionObserve}},
+		},
+		{
+			name:    "tightened",
+			entries: []Entry{{IP: "192.0.2.1", Action: ActionTighten}},
+			expectedStatus: &chain.Status{
+				Tighten: true,
+			},
+		},
+		{
+			name:    "delayed",
+			entries: []Entry{{IP: "192.0.2.1", Action: ActionDelay, Delay: time.Second}},
+			expectedStatus: &chain.Status{
+				Delay: time.Second,
+			},
+		},
 	}
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
 			t.Parallel()
 
-			d, err := New(test.ipList, true)
+			d, err := New(test.entries, true)
 			require.NoError(t, err)
 
 			recorder := &httptest.ResponseRecorder{}
@@ -43,9 +107,206 @@ func TestDeny(t *testing.T) {
 			req, err = data.ServeHTTP(recorder, req, "")
 			require.NoError(t, err)
 
+			data.GetData(req).Country = test.country
+			data.GetData(req).ASN = test.asn
+
 			got, err := d.ServeHTTP(recorder, req)
 			require.NoError(t, err)
 			assert.Equal(t, test.expectedStatus, got)
 		})
 	}
 }
+
+type eventRecorder struct {
+	events []events.Event
+}
+
+func (r *eventRecorder) Send(e events.Event) {
+	r.events = append(r.events, e)
+}
+
+func TestDenyEvents(t *testing.T) {
+	t.Parallel()
+
+	d, err := New([]Entry{
+		{IP: "192.0.2.1", Note: "TICKET-42"},
+		{IP: "192.0.2.2", Action: ActionObserve},
+	}, true)
+	require.NoError(t, err)
+
+	recorder := &eventRecorder{}
+	bus := events.New("jail")
+	bus.Subscribe(recorder)
+	d.WithEvents(bus)
+
+	for _, test := range []struct {
+		remoteIP string
+		shadow   bool
+	}{
+		{remoteIP: "192.0.2.1"},
+		{remoteIP: "192.0.2.1", shadow: true},
+		// Published once per interval.
+		{remoteIP: "192.0.2.1"},
+		{remoteIP: "192.0.2.2"},
+		{remoteIP: "192.0.2.3"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "https://example.com/foo", nil)
+		req.RemoteAddr = test.remoteIP + ":1234"
+		req, err = data.ServeHTTP(nil, req, "")
+		require.NoError(t, err)
+
+		data.GetData(req).Shadow = test.shadow
+
+		_, err = d.ServeHTTP(nil, req)
+		require.NoError(t, err)
+	}
+
+	require.Len(t, recorder.events, 1)
+	assert.WithinDuration(t, utime.Now(), recorder.events[0].Time, time.Minute)
+
+	recorder.events[0].Time = time.Time{}
+	assert.Equal(t, events.Event{Type: events.StaticBlock, Jail: "jail", IP: "192.0.2.1", Reason: "TICKET-42"}, recorder.events[0])
+}
+
+func TestDenyPublish(t *testing.T) {
+	t.Parallel()
+
+	d, err := New(nil, true)
+	require.NoError(t, err)
+
+	// Nothing is published without bus.
+	assert.False(t, d.publish("192.0.2.1", utime.Now()))
+
+	d.WithEvents(events.New("jail"))
+
+	now := utime.Now()
+	assert.True(t, d.publish("192.0.2.1", now))
+	assert.False(t, d.publish("192.0.2.1", now.Add(blockEventInterval-time.Second)))
+	assert.True(t, d.publish("192.0.2.2", now))
+	assert.True(t, d.publish("192.0.2.1", now.Add(blockEventInterval)))
+
+	// Full: the IPs published before the interval are forgotten, else the
+	// events dropped.
+	d.published = make(map[string]time.Time)
+	for i := range maxBlockEvents {
+		d.published[strconv.Itoa(i)] = now
+	}
+
+	assert.False(t, d.publish("192.0.2.3", now.Add(blockEventInterval-time.Second)))
+	assert.True(t, d.publish("192.0.2.3", now.Add(blockEventInterval)))
+	assert.Len(t, d.published, 1)
+}
+
+func TestNewInvalidAction(t *testing.T) {
+	t.Parallel()
+
+	_, err := New([]Entry{{IP: "192.0.2.1", Action: "tarpit"}}, true)
+	require.Error(t, err)
+
+	_, err = New([]Entry{{IP: "192.0.2.1", Action: ActionDelay}}, true)
+	require.Error(t, err)
+
+	_, err = New([]Entry{{IP: "country:russia"}}, true)
+	require.Error(t, err)
+}
+
+func TestParseExpires(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		value       string
+		expected    time.Time
+		expectedTTL time.Duration
+		expectError bool
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:     "timestamp",
+			value:    "2022-01-02T03:04:05Z",
+			expected: time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC),
+		},
+		{
+			name:        "duration",
+			value:       "72h",
+			expectedTTL: 72 * time.Hour,
+		},
+		{
+			name:        "negative duration",
+			value:       "-1h",
+			expectError: true,
+		},
+		{
+			name:        "invalid",
+			value:       "tomorrow",
+			expectError: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			got, ttl, err := ParseExpires(test.value)
+			if test.expectError {
+				require.Error(t, err)
+
+				return
+			}
+
+			require.NoError(t, err)
+			assert.True(t, test.expected.Equal(got), "wanted %s got %s", test.expected, got)
+			assert.Equal(t, test.expectedTTL, ttl)
+		})
+	}
+}
+
+func TestLoadedAnchor(t *testing.T) {
+	t.Parallel()
+
+	first := time.Date(2021, 10, 21, 14, 44, 38, 0, time.UTC)
+	reload := first.Add(time.Hour)
+	timestamp := first.Add(time.Minute)
+
+	loaded := NewLoaded()
+
+	got := loaded.Anchor([]Entry{
+		{IP: "192.0.2.1", TTL: 72 * time.Hour},
+		{IP: "192.0.2.2", Expires: timestamp},
+	}, first)
+	assert.Equal(t, first.Add(72*time.Hour), got[0].Expires)
+	assert.Equal(t, timestamp, got[1].Expires)
+
+	// A reload keeps the expiry of the loaded entries, the new ones expiring
+	// from the reload.
+	got = loaded.Anchor([]Entry{
+		{IP: "192.0.2.1", TTL: 72 * time.Hour},
+		{IP: "192.0.2.3", TTL: time.Hour},
+	}, reload)
+	assert.Equal(t, first.Add(72*time.Hour), got[0].Expires)
+	assert.Equal(t, reload.Add(time.Hour), got[1].Expires)
+
+	// A changed TTL expires from its own load.
+	got = loaded.Anchor([]Entry{{IP: "192.0.2.1", TTL: 24 * time.Hour}}, reload)
+	assert.Equal(t, reload.Add(24*time.Hour), got[0].Expires)
+}
+
+func TestExpiring(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2021, 10, 21, 14, 44, 38, 0, time.UTC)
+
+	d, err := New([]Entry{
+		{IP: "192.0.2.1"},
+		{IP: "192.0.2.2", Expires: now.Add(-time.Hour), Note: "expired"},
+		{IP: "192.0.2.3", Expires: now.Add(time.Hour), Note: "soon"},
+		{IP: "192.0.2.4", Expires: now.Add(48 * time.Hour), Note: "later"},
+	}, true)
+	require.NoError(t, err)
+
+	got := d.expiring(now, 24*time.Hour)
+	require.Len(t, got, 1)
+	assert.Equal(t, "soon", got[0].note)
+}
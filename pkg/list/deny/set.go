@@ -0,0 +1,241 @@
+package deny
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/tomMoulard/fail2ban/pkg/ipchecking"
+)
+
+// Set is an in-memory set of denied IPs and ranges, next to the static
+// entries, updated at runtime by a list source (e.g. the CrowdSec decisions).
+// A value stays denied while one of its decisions is active.
+type Set struct {
+	mu  sync.RWMutex
+	ips map[netip.Addr]decisions
+	// ranges are the ranges by prefix length, an IP being looked up once per
+	// length rather than against every range.
+	ranges map[int]map[netip.Prefix]decisions
+}
+
+// decisions are the decisions denying a value, by key.
+type decisions map[string]setEntry
+
+type setEntry struct {
+	expires time.Time
+	reason  string
+}
+
+// active returns the active decision expiring last.
+func (d decisions) active(now time.Time) (setEntry, bool) {
+	var (
+		last  setEntry
+		found bool
+	)
+
+	for _, e := range d {
+		if now.Before(e.expires) && (!found || last.expires.Before(e.expires)) {
+			last, found = e, true
+		}
+	}
+
+	return last, found
+}
+
+// NewSet creates an empty Set.
+func NewSet() *Set {
+	return &Set{
+		ips:    make(map[netip.Addr]decisions),
+		ranges: make(map[int]map[netip.Prefix]decisions),
+	}
+}
+
+// Add denies the IP or CIDR until expires by the decision identified by key,
+// with the reason logged on the blocks. When the decision already denies the
+// value, the latest expiry is kept.
+func (s *Set) Add(value, key string, expires time.Time, reason string) error {
+	ip, err := ipchecking.ParseNetIP(value)
+	if err != nil {
+		return fmt.Errorf("failed to parse %q: %w", value, err)
+	}
+
+	e := setEntry{expires: expires, reason: reason}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ip.Net == nil {
+		addr := ip.Addr.Unmap()
+		if _, ok := s.ips[addr]; !ok {
+			s.ips[addr] = make(decisions)
+		}
+
+		s.ips[addr].add(key, e)
+
+		return nil
+	}
+
+	prefix := ip.Net.Masked()
+
+	ranges, ok := s.ranges[prefix.Bits()]
+	if !ok {
+		ranges = make(map[netip.Prefix]decisions)
+		s.ranges[prefix.Bits()] = ranges
+	}
+
+	if _, ok := ranges[prefix]; !ok {
+		ranges[prefix] = make(decisions)
+	}
+
+	ranges[prefix].add(key, e)
+
+	return nil
+}
+
+func (d decisions) add(key string, e setEntry) {
+	if prev, ok := d[key]; !ok || prev.expires.Before(e.expires) {
+		d[key] = e
+	}
+}
+
+// Remove deletes the decision identified by key, lifting the denial of the IP
+// or CIDR once it has no decisions left.
+func (s *Set) Remove(value, key string) error {
+	ip, err := ipchecking.ParseNetIP(value)
+	if err != nil {
+		return fmt.Errorf("failed to parse %q: %w", value, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ip.Net == nil {
+		addr := ip.Addr.Unmap()
+
+		delete(s.ips[addr], key)
+
+		if len(s.ips[addr]) == 0 {
+			delete(s.ips, addr)
+		}
+
+		return nil
+	}
+
+	prefix := ip.Net.Masked()
+	ranges := s.ranges[prefix.Bits()]
+
+	delete(ranges[prefix], key)
+
+	if len(ranges[prefix]) == 0 {
+		delete(ranges, prefix)
+	}
+
+	if len(ranges) == 0 {
+		delete(s.ranges, prefix.Bits())
+	}
+
+	return nil
+}
+
+// Purge forgets the expired decisions, and the values left without any.
+func (s *Set) Purge(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for addr, d := range s.ips {
+		if d.purge(now) {
+			delete(s.ips, addr)
+		}
+	}
+
+	for bits, ranges := range s.ranges {
+		for prefix, d := range ranges {
+			if d.purge(now) {
+				delete(ranges, prefix)
+			}
+		}
+
+		if len(ranges) == 0 {
+			delete(s.ranges, bits)
+		}
+	}
+}
+
+// purge forgets the expired decisions, and returns whether none is left.
+func (d decisions) purge(now time.Time) bool {
+	for key, e := range d {
+		if !now.Before(e.expires) {
+			delete(d, key)
+		}
+	}
+
+	return len(d) == 0
+}
+
+// Len returns the number of IPs and ranges, expired ones included.
+func (s *Set) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	n := len(s.ips)
+	for _, ranges := range s.ranges {
+		n += len(ranges)
+	}
+
+	return n
+}
+
+// Reason returns the block reason of the IP, and whether it is denied.
+func (s *Set) Reason(remoteIP string, now time.Time) (string, bool) {
+	e, found := s.lookup(remoteIP, now)
+
+	return e.note, found
+}
+
+// lookup returns the non expired entry containing the IP.
+func (s *Set) lookup(remoteIP string, now time.Time) (entry, bool) {
+	addr, err := netip.ParseAddr(remoteIP)
+	if err != nil {
+		return entry{}, false
+	}
+
+	addr = addr.Unmap()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if e, ok := s.ips[addr].active(now); ok {
+		return entry{
+			ip:      ipchecking.NetIP{Addr: addr},
+			expires: e.expires,
+			note:    e.reason,
+			action:  ActionBlock,
+		}, true
+	}
+
+	// The most specific range first.
+	for bits := addr.BitLen(); bits >= 0; bits-- {
+		ranges, ok := s.ranges[bits]
+		if !ok {
+			continue
+		}
+
+		prefix, err := addr.Prefix(bits)
+		if err != nil {
+			continue
+		}
+
+		if e, ok := ranges[prefix].active(now); ok {
+			return entry{
+				ip:      ipchecking.NetIP{Net: &prefix},
+				expires: e.expires,
+				note:    e.reason,
+				action:  ActionBlock,
+			}, true
+		}
+	}
+
+	return entry{}, false
+}
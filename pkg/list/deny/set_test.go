@@ -0,0 +1,122 @@
+package deny
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tomMoulard/fail2ban/pkg/chain"
+	"github.com/tomMoulard/fail2ban/pkg/data"
+	"github.com/tomMoulard/fail2ban/pkg/events"
+)
+
+func TestSet(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	s := NewSet()
+	require.NoError(t, s.Add("192.0.2.1", "crowdsec/http-probing", now.Add(time.Hour), "crowdsecurity/http-probing"))
+	// The latest expiry of a decision is kept.
+	require.NoError(t, s.Add("192.0.2.1", "crowdsec/http-probing", now.Add(time.Minute), "crowdsecurity/http-probing"))
+	// The decision expiring last gives the reason.
+	require.NoError(t, s.Add("192.0.2.1", "crowdsec/ssh-bf", now.Add(time.Minute), "crowdsecurity/ssh-bf"))
+	require.NoError(t, s.Add("198.51.100.7/24", "lists/firehol", now.Add(time.Hour), "lists:firehol"))
+	require.NoError(t, s.Add("2001:db8::1", "expired", now.Add(-time.Hour), "expired"))
+	require.NoError(t, s.Add("10.0.0.0/8", "wide", now.Add(time.Hour), "wide"))
+	require.NoError(t, s.Add("10.1.0.0/16", "narrow", now.Add(time.Hour), "narrow"))
+	require.NoError(t, s.Add("10.2.0.0/16", "expired", now.Add(-time.Hour), "expired"))
+	require.NoError(t, s.Add("2001:db8:1::/48", "ipv6", now.Add(time.Hour), "ipv6"))
+	require.Error(t, s.Add("not-an-ip", "", now.Add(time.Hour), ""))
+	assert.Equal(t, 7, s.Len())
+
+	tests := []struct {
+		remoteIP       string
+		expectedFound  bool
+		expectedReason string
+	}{
+		{remoteIP: "192.0.2.1", expectedFound: true, expectedReason: "crowdsecurity/http-probing"},
+		{remoteIP: "::ffff:192.0.2.1", expectedFound: true, expectedReason: "crowdsecurity/http-probing"},
+		{remoteIP: "198.51.100.200", expectedFound: true, expectedReason: "lists:firehol"},
+		// The most specific range wins, unless expired.
+		{remoteIP: "10.1.2.3", expectedFound: true, expectedReason: "narrow"},
+		{remoteIP: "10.2.2.3", expectedFound: true, expectedReason: "wide"},
+		{remoteIP: "2001:db8:1::42", expectedFound: true, expectedReason: "ipv6"},
+		{remoteIP: "2001:db8::1"},
+		{remoteIP: "192.0.2.2"},
+		{remoteIP: "not-an-ip"},
+	}
+
+	for _, test := range tests {
+		reason, found := s.Reason(test.remoteIP, now)
+		assert.Equal(t, test.expectedFound, found, test.remoteIP)
+		assert.Equal(t, test.expectedReason, reason, test.remoteIP)
+	}
+
+	// The value stays denied until its last decision is removed.
+	require.NoError(t, s.Remove("192.0.2.1", "crowdsec/http-probing"))
+
+	reason, found := s.Reason("192.0.2.1", now)
+	assert.True(t, found)
+	assert.Equal(t, "crowdsecurity/ssh-bf", reason)
+
+	require.NoError(t, s.Remove("192.0.2.1", "crowdsec/ssh-bf"))
+	require.NoError(t, s.Remove("198.51.100.0/24", "lists/firehol"))
+	require.NoError(t, s.Remove("10.1.0.0/16", "narrow"))
+	require.NoError(t, s.Remove("10.0.0.0/8", "unknown"))
+	require.Error(t, s.Remove("not-an-ip", ""))
+
+	_, found = s.Reason("192.0.2.1", now)
+	assert.False(t, found)
+	_, found = s.Reason("198.51.100.200", now)
+	assert.False(t, found)
+
+	reason, found = s.Reason("10.1.2.3", now)
+	assert.True(t, found)
+	assert.Equal(t, "wide", reason)
+	assert.Equal(t, 4, s.Len())
+
+	s.Purge(now)
+	assert.Equal(t, 2, s.Len())
+
+	require.NoError(t, s.Remove("10.0.0.0/8", "wide"))
+	require.NoError(t, s.Remove("2001:db8:1::/48", "ipv6"))
+
+	s.Purge(now)
+	assert.Equal(t, 0, s.Len())
+}
+
+func TestDenySet(t *testing.T) {
+	t.Parallel()
+
+	d, err := New([]Entry{{IP: "192.0.2.1", Note: "TICKET-42"}}, true)
+	require.NoError(t, err)
+
+	set := NewSet()
+	require.NoError(t, set.Add("192.0.2.0/24", "crowdsec/http-probing", time.Now().Add(time.Hour), "crowdsecurity/http-probing"))
+	d.WithSet(set)
+
+	recorder := &eventRecorder{}
+	bus := events.New("jail")
+	bus.Subscribe(recorder)
+	d.WithEvents(bus)
+
+	for _, remoteIP := range []string{"192.0.2.1", "192.0.2.2"} {
+		req := httptest.NewRequest(http.MethodGet, "https://example.com/foo", nil)
+		req.RemoteAddr = remoteIP + ":1234"
+		req, err = data.ServeHTTP(nil, req, "")
+		require.NoError(t, err)
+
+		got, err := d.ServeHTTP(nil, req)
+		require.NoError(t, err)
+		assert.Equal(t, &chain.Status{Return: true}, got)
+	}
+
+	require.Len(t, recorder.events, 2)
+	// The static entries come first.
+	assert.Equal(t, "TICKET-42", recorder.events[0].Reason)
+	assert.Equal(t, "crowdsecurity/http-probing", recorder.events[1].Reason)
+}
@@ -0,0 +1,102 @@
+package logger
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/tomMoulard/fail2ban/pkg/events"
+)
+
+// Fail2ban is an events sink writing the failures and bans in a format the
+// host fail2ban reads, one line per event:
+//
+//	2026-01-01T00:00:00Z fail2ban-traefik[<jail>]: Found 192.0.2.1 reason="failure" score=1
+//	2026-01-01T00:00:05Z fail2ban-traefik[<jail>]: Ban 192.0.2.1 reason="threshold" score=4
+//
+// The time is UTC, RFC3339 formatted. The format is stable: the filter in
+// contrib/fail2ban depends on it.
+//
+// The lines are written in the background by Run, so that the requests are
+// never slowed down by the disk (or a rotation).
+type Fail2ban struct {
+	w     io.Writer
+	queue chan events.Event
+	// dropped counts the events dropped since the last report, for a full
+	// queue not to log once per event.
+	dropped atomic.Int64
+}
+
+const (
+	// fail2banQueueSize is the number of events waiting to be written, the
+	// next ones being dropped.
+	fail2banQueueSize = 1000
+	// fail2banDroppedInterval is how often the dropped events are reported.
+	fail2banDroppedInterval = 10 * time.Second
+)
+
+// NewFail2ban creates the sink writing to w. Run writes the queued events.
+func NewFail2ban(w io.Writer) *Fail2ban {
+	return &Fail2ban{w: w, queue: make(chan events.Event, fail2banQueueSize)}
+}
+
+// Send queues the failures and bans, ignoring the other events and the shadow
+// ones, for the host not to enforce them. The events are dropped when the queue
+// is full.
+func (f *Fail2ban) Send(e events.Event) {
+	if e.Shadow || (e.Type != events.Failure && e.Type != events.Ban) {
+		return
+	}
+
+	select {
+	case f.queue <- e:
+	default:
+		f.dropped.Add(1)
+	}
+}
+
+// Run writes the queued events, and reports the dropped ones every
+// fail2banDroppedInterval, until the context is done.
+func (f *Fail2ban) Run(ctx context.Context) {
+	ticker := time.NewTicker(fail2banDroppedInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-f.queue:
+			f.write(e)
+		case <-ticker.C:
+			f.reportDropped()
+		}
+	}
+}
+
+// reportDropped logs the events dropped since the last report, if any.
+func (f *Fail2ban) reportDropped() {
+	if n := f.dropped.Swap(0); n > 0 {
+		Warn("Plugin: FailToBan: fail2ban log queue full, events dropped",
+			WithDropped(n),
+		)
+	}
+}
+
+// write writes the line of the event.
+func (f *Fail2ban) write(e events.Event) {
+	action, reason := "Found", "failure"
+	if e.Type == events.Ban {
+		action, reason = "Ban", e.Reason
+	}
+
+	_, err := fmt.Fprintf(f.w, "%s fail2ban-traefik[%s]: %s %s reason=%q score=%g\n",
+		e.Time.UTC().Format(time.RFC3339), e.Jail, action, e.IP, reason, e.Score)
+	if err != nil {
+		Error("Plugin: FailToBan: failed to write fail2ban log",
+			WithIP(e.IP),
+			WithErr(err.Error()),
+		)
+	}
+}
@@ -0,0 +1,97 @@
+package logger
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tomMoulard/fail2ban/pkg/events"
+)
+
+func TestFail2ban(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.FixedZone("CET", 3600))
+
+	var buf bytes.Buffer
+
+	f := NewFail2ban(&buf)
+	for _, e := range []events.Event{
+		{Type: events.Failure, Jail: "f2b@file", IP: "192.0.2.1", Score: 1, Time: now},
+		{Type: events.Failure, Jail: "f2b@file", IP: "2001:db8::1", Score: 0.5, Time: now},
+		{Type: events.Ban, Jail: "f2b@file", IP: "192.0.2.1", Reason: "threshold", Score: 4, Time: now},
+		{Type: events.Ban, Jail: "f2b@file", IP: "192.0.2.2", Reason: "rule", Time: now},
+		// Ignored.
+		{Type: events.Unban, Jail: "f2b@file", IP: "192.0.2.1", Time: now},
+		{Type: events.Expire, Jail: "f2b@file", IP: "192.0.2.1", Time: now},
+		{Type: events.StaticBlock, Jail: "f2b@file", IP: "192.0.2.3", Reason: "abuse", Time: now},
+		{Type: events.Ban, Jail: "f2b@file", IP: "192.0.2.4", Reason: "threshold", Score: 4, Shadow: true, Time: now},
+	} {
+		f.Send(e)
+	}
+
+	require.Len(t, f.queue, 4)
+
+	for len(f.queue) > 0 {
+		f.write(<-f.queue)
+	}
+
+	assert.Equal(t, `2025-12-31T23:00:00Z fail2ban-traefik[f2b@file]: Found 192.0.2.1 reason="failure" score=1
+2025-12-31T23:00:00Z fail2ban-traefik[f2b@file]: Found 2001:db8::1 reason="failure" score=0.5
+2025-12-31T23:00:00Z fail2ban-traefik[f2b@file]: Ban 192.0.2.1 reason="threshold" score=4
+2025-12-31T23:00:00Z fail2ban-traefik[f2b@file]: Ban 192.0.2.2 reason="rule" score=0
+`, buf.String())
+}
+
+// syncBuffer is a bytes.Buffer safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.buf.String()
+}
+
+func TestFail2banRun(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	var buf syncBuffer
+
+	f := NewFail2ban(&buf)
+
+	// The queue full, the next events are dropped.
+	for range fail2banQueueSize + 1 {
+		f.Send(events.Event{Type: events.Failure, Jail: "f2b@file", IP: "192.0.2.1", Score: 1, Time: now})
+	}
+
+	assert.Len(t, f.queue, fail2banQueueSize)
+	assert.Equal(t, int64(1), f.dropped.Load())
+
+	f.reportDropped()
+	assert.Zero(t, f.dropped.Load())
+
+	go f.Run(t.Context())
+
+	line := "2026-01-01T00:00:00Z fail2ban-traefik[f2b@file]: Found 192.0.2.1 reason=\"failure\" score=1\n"
+
+	assert.Eventually(t, func() bool {
+		return buf.String() == strings.Repeat(line, fail2banQueueSize)
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,131 @@
+package logger
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// File is a log file rotated by size: when a write would make it larger than
+// the max size, it is renamed <path>.1, the previous <path>.1 being renamed
+// <path>.2, and so on up to the max backups.
+type File struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+var (
+	filesMu sync.Mutex
+	// files are the open log files by path.
+	files = make(map[string]*File)
+)
+
+// OpenFile opens the log file, appending to it. The middlewares opening the
+// same path share the File, using the last limits given.
+func OpenFile(path string, maxSize int64, maxBackups int) (*File, error) {
+	filesMu.Lock()
+	defer filesMu.Unlock()
+
+	if f, ok := files[path]; ok {
+		f.mu.Lock()
+		f.maxSize = maxSize
+		f.maxBackups = maxBackups
+		f.mu.Unlock()
+
+		return f, nil
+	}
+
+	f := &File{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+
+	files[path] = f
+
+	return f, nil
+}
+
+func (f *File) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+
+		return fmt.Errorf("failed to stat log file: %w", err)
+	}
+
+	f.file = file
+	f.size = info.Size()
+
+	return nil
+}
+
+// Write writes p to the file, rotating it first when it would get larger than
+// the max size.
+func (f *File) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+
+	if err != nil {
+		return n, fmt.Errorf("failed to write log file: %w", err)
+	}
+
+	return n, nil
+}
+
+func (f *File) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return fmt.Errorf("failed to close log file: %w", err)
+	}
+
+	if f.maxBackups == 0 {
+		if err := os.Remove(f.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to remove log file: %w", err)
+		}
+
+		return f.open()
+	}
+
+	for i := f.maxBackups - 1; i > 0; i-- {
+		err := os.Rename(f.backup(i), f.backup(i+1))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to rotate log file: %w", err)
+		}
+	}
+
+	if err := os.Rename(f.path, f.backup(1)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to rotate log file: %w", err)
+	}
+
+	return f.open()
+}
+
+// backup returns the path of the i-th backup.
+func (f *File) backup(i int) string {
+	return f.path + "." + strconv.Itoa(i)
+}
@@ -0,0 +1,88 @@
+package logger
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFile(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		maxBackups int
+		expected   map[string]string
+	}{
+		{
+			name:       "backups",
+			maxBackups: 2,
+			expected: map[string]string{
+				"f2b.log":   "line 4\n",
+				"f2b.log.1": "line 3\n",
+				"f2b.log.2": "line 2\n",
+			},
+		},
+		{
+			name: "no backup",
+			expected: map[string]string{
+				"f2b.log": "line 4\n",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			dir := t.TempDir()
+			path := filepath.Join(dir, "f2b.log")
+			require.NoError(t, os.WriteFile(path, []byte("line 1\n"), 0o600))
+
+			f, err := OpenFile(path, 10, test.maxBackups)
+			require.NoError(t, err)
+
+			for _, line := range []string{"line 2\n", "line 3\n", "line 4\n"} {
+				n, err := f.Write([]byte(line))
+				require.NoError(t, err)
+				assert.Equal(t, len(line), n)
+			}
+
+			entries, err := os.ReadDir(dir)
+			require.NoError(t, err)
+
+			got := make(map[string]string, len(entries))
+
+			for _, entry := range entries {
+				content, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+				require.NoError(t, err)
+
+				got[entry.Name()] = string(content)
+			}
+
+			assert.Equal(t, test.expected, got)
+		})
+	}
+}
+
+func TestOpenFile(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "f2b.log")
+
+	f, err := OpenFile(path, 10, 1)
+	require.NoError(t, err)
+
+	// Shared, with the last limits.
+	other, err := OpenFile(path, 20, 2)
+	require.NoError(t, err)
+	assert.Same(t, f, other)
+	assert.Equal(t, int64(20), f.maxSize)
+	assert.Equal(t, 2, f.maxBackups)
+
+	_, err = OpenFile(filepath.Join(t.TempDir(), "missing", "f2b.log"), 10, 1)
+	require.Error(t, err)
+}
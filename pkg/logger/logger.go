@@ -1,4 +1,6 @@
-// Package logger provides structured JSON logging for the fail2ban plugin.
+// Package logger provides structured JSON logging for the fail2ban plugin, on
+// stdout, and the log of the failures and bans for the host fail2ban, in a
+// rotated file.
 package logger
 
 import (
@@ -10,18 +12,34 @@ import (
 
 // Event represents a structured log entry.
 type Event struct {
-	Time       string `json:"time"`
-	Level      string `json:"level"`
-	Msg        string `json:"msg"`
-	IP         string `json:"ip,omitempty"`
-	Reason     string `json:"reason,omitempty"`
-	StatusCode int    `json:"statusCode,omitempty"`
-	Method     string `json:"method,omitempty"`
-	Path       string `json:"path,omitempty"`
-	UA         string `json:"ua,omitempty"`
-	Header     string `json:"header,omitempty"`
-	FallbackIP string `json:"fallbackIp,omitempty"`
-	Err        string `json:"error,omitempty"`
+	Time       string  `json:"time"`
+	Level      string  `json:"level"`
+	Msg        string  `json:"msg"`
+	IP         string  `json:"ip,omitempty"`
+	Reason     string  `json:"reason,omitempty"`
+	StatusCode int     `json:"statusCode,omitempty"`
+	Method     string  `json:"method,omitempty"`
+	Path       string  `json:"path,omitempty"`
+	UA         string  `json:"ua,omitempty"`
+	Header     string  `json:"header,omitempty"`
+	FallbackIP string  `json:"fallbackIp,omitempty"`
+	Err        string  `json:"error,omitempty"`
+	Expires    string  `json:"expires,omitempty"`
+	Country    string  `json:"country,omitempty"`
+	ASN        uint32  `json:"asn,omitempty"`
+	Score      float64 `json:"score,omitempty"`
+	User       string  `json:"user,omitempty"`
+	Dropped    int64   `json:"dropped,omitempty"`
+}
+
+// Blocked returns the message of the block logs, telling apart the requests
+// let through in shadow mode.
+func Blocked(shadow bool) string {
+	if shadow {
+		return "Plugin: FailToBan: would block IP"
+	}
+
+	return "Plugin: FailToBan: IP blocked"
 }
 
 // Info writes an info-level JSON log entry to stdout.
@@ -104,3 +122,33 @@ func WithFallbackIP(ip string) func(*Event) {
 func WithErr(err string) func(*Event) {
 	return func(e *Event) { e.Err = err }
 }
+
+// WithExpires sets the Expires field.
+func WithExpires(t time.Time) func(*Event) {
+	return func(e *Event) { e.Expires = t.UTC().Format(time.RFC3339) }
+}
+
+// WithCountry sets the Country field.
+func WithCountry(country string) func(*Event) {
+	return func(e *Event) { e.Country = country }
+}
+
+// WithASN sets the ASN field.
+func WithASN(asn uint32) func(*Event) {
+	return func(e *Event) { e.ASN = asn }
+}
+
+// WithScore sets the Score field.
+func WithScore(score float64) func(*Event) {
+	return func(e *Event) { e.Score = score }
+}
+
+// WithUser sets the User field.
+func WithUser(user string) func(*Event) {
+	return func(e *Event) { e.User = user }
+}
+
+// WithDropped sets the Dropped field.
+func WithDropped(n int64) func(*Event) {
+	return func(e *Event) { e.Dropped = n }
+}
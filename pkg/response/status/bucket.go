@@ -0,0 +1,52 @@
+package status
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/tomMoulard/fail2ban/pkg/fail2ban"
+	"github.com/tomMoulard/fail2ban/pkg/rules"
+)
+
+// bucket counts the failures with its status codes apart from the others.
+type bucket struct {
+	codes      string
+	codeRanges HTTPCodeRanges
+	// f2b counts the failures of the bucket only, the IPs being banned by the
+	// jail.
+	f2b *fail2ban.Fail2Ban
+}
+
+func newBuckets(buckets []rules.StatusCodeBucket, findtime, bantime time.Duration) ([]bucket, error) {
+	bs := make([]bucket, 0, len(buckets))
+
+	for _, b := range buckets {
+		codeRanges, err := NewHTTPCodeRanges(strings.Split(b.Codes, ","))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create HTTP code ranges: %w", err)
+		}
+
+		bs = append(bs, bucket{
+			codes:      b.Codes,
+			codeRanges: codeRanges,
+			f2b: fail2ban.New(rules.RulesTransformed{
+				Findtime: findtime,
+				Bantime:  bantime,
+				MaxRetry: b.MaxRetry,
+			}, nil),
+		})
+	}
+
+	return bs, nil
+}
+
+// addFailure counts the failure in the bucket, and returns whether the IP
+// should be allowed.
+func (b bucket) addFailure(remoteIP string, weight float64) bool {
+	// Like the jail, the IP is seen before its first failure, for maxretry to
+	// be reached on the maxretry-th failure.
+	b.f2b.IsNotBanned(remoteIP)
+
+	return b.f2b.AddFailure(remoteIP, weight)
+}
@@ -3,44 +3,84 @@ package status
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"sync"
+	"time"
+
+	"github.com/tomMoulard/fail2ban/pkg/logger"
 )
 
+// maxInspectionDelay bounds the time the body of a response is held to be
+// inspected: the body of a backend streaming without flushing (e.g. long
+// polling) is matched as written so far, and forwarded.
+const maxInspectionDelay = 200 * time.Millisecond
+
 // Source: https://github.com/traefik/traefik/blob/05d2c86074a21d482945b9994d85e3b66de0480d/pkg/middlewares/customerrors/custom_errors.go
 
 // codeCatcher is a response writer that detects as soon as possible whether
 // the response is a code within the ranges of codes it watches for.
-// If it is, it simply drops the data from the response.
+// If it is, the ban decision is made as soon as the headers are written,
+// before any body: a banned response is replaced by a 429 and its body
+// dropped.
 // Otherwise, it forwards the data directly to the original client.
 // If the backend does not call WriteHeader, we consider it's a 200.
 type codeCatcher struct {
-	headerMap          http.Header
-	code               int
-	httpCodeRanges     HTTPCodeRanges
-	caughtFilteredCode bool
-	responseWriter     http.ResponseWriter
-	headersSent        bool
-
-	// bytes is used to store the response body in case of a filtered code that
-	// is allowed.
+	// mu guards the state shared with the inspection timer.
+	mu sync.Mutex
+
+	headerMap      http.Header
+	code           int
+	httpCodeRanges HTTPCodeRanges
+	responseWriter http.ResponseWriter
+	headersSent    bool
+	hijacked       bool
+	// headersAt is when the backend wrote the headers.
+	headersAt time.Time
+
+	// allow counts the failure of a filtered code, and returns whether the
+	// response is allowed.
+	allow func(code int) bool
+
+	// inspection, when set, matches the responses not filtered by their code
+	// against the response failures.
+	inspection *inspection
+	// inspecting is set while the first bytes of the body are buffered to be
+	// matched.
+	inspecting bool
+	// bytes are the first bytes of the body being inspected.
 	bytes []byte
-	// allowedRequest is there in case of flush when the caughtFilteredCode is
-	// set, but the request should be forwarded.
-	allowedRequest bool
+	// timer ends the inspection after maxInspectionDelay.
+	timer *time.Timer
+	// dropped is set when the response was replaced by a 429.
+	dropped bool
 }
 
-func newCodeCatcher(rw http.ResponseWriter, httpCodeRanges HTTPCodeRanges) *codeCatcher {
+func newCodeCatcher(rw http.ResponseWriter, httpCodeRanges HTTPCodeRanges, allow func(code int) bool) *codeCatcher {
 	return &codeCatcher{
-		headerMap:      make(http.Header),
+		// The headers set by the previous handlers are seen, and can be
+		// removed, by the backend.
+		headerMap:      rw.Header().Clone(),
 		code:           http.StatusOK,
 		responseWriter: rw,
 		httpCodeRanges: httpCodeRanges,
+		allow:          allow,
 	}
 }
 
+// Header returns the headers of the response. Once sent, these are the headers
+// of the wrapped ResponseWriter, so that trailers can be set.
 func (cc *codeCatcher) Header() http.Header {
-	if cc.headersSent {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	return cc.header()
+}
+
+// header is Header, with mu held.
+func (cc *codeCatcher) header() http.Header {
+	if cc.headersSent && !cc.dropped {
 		return cc.responseWriter.Header()
 	}
 
@@ -51,28 +91,32 @@ func (cc *codeCatcher) Header() http.Header {
 	return cc.headerMap
 }
 
+// getCode returns the status code, once the backend is done or with mu held.
 func (cc *codeCatcher) getCode() int {
 	return cc.code
 }
 
-// isFilteredCode returns whether the codeCatcher received a response code
-// among the ones it is watching, and for which the response should be deferred
-// to the fail2ban handler.
-func (cc *codeCatcher) isFilteredCode() bool {
-	return cc.caughtFilteredCode
-}
-
 func (cc *codeCatcher) Write(buf []byte) (int, error) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
 	// If WriteHeader was already called from the caller, this is a NOOP.
 	// Otherwise, cc.code is actually a 200 here.
-	cc.WriteHeader(cc.code)
+	cc.writeHeader(cc.code)
+
+	if cc.dropped {
+		return len(buf), nil
+	}
 
-	if cc.caughtFilteredCode {
-		// We don't care about the contents of the response,
-		// since we want to serve the forbidden page,
-		// so we just save them for later if needed.
+	if cc.inspecting {
 		cc.bytes = append(cc.bytes, buf...)
 
+		if int64(len(cc.bytes)) >= cc.inspection.maxBodySize {
+			if err := cc.endInspection(); err != nil {
+				return 0, err
+			}
+		}
+
 		return len(buf), nil
 	}
 
@@ -88,7 +132,15 @@ func (cc *codeCatcher) Write(buf []byte) (int, error) {
 // the wrapped ResponseWriter, without marking headers as sent, allowing so
 // further calls.
 func (cc *codeCatcher) WriteHeader(code int) {
-	if cc.headersSent || cc.caughtFilteredCode {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	cc.writeHeader(code)
+}
+
+// writeHeader is WriteHeader, with mu held.
+func (cc *codeCatcher) writeHeader(code int) {
+	if cc.headersSent || cc.inspecting || cc.hijacked {
 		return
 	}
 
@@ -96,7 +148,7 @@ func (cc *codeCatcher) WriteHeader(code int) {
 	if code >= 100 && code <= 199 {
 		// Multiple informational status codes can be used,
 		// so here the copy is not appending the values to not repeat them.
-		for k, v := range cc.Header() {
+		for k, v := range cc.header() {
 			cc.responseWriter.Header()[k] = v
 		}
 
@@ -106,25 +158,121 @@ func (cc *codeCatcher) WriteHeader(code int) {
 	}
 
 	cc.code = code
-	for _, block := range cc.httpCodeRanges {
-		if cc.code >= block[0] && cc.code <= block[1] {
-			cc.caughtFilteredCode = true
-			// it will be up to the caller to send the headers,
-			// so it is out of our hands now.
+	cc.headersAt = time.Now()
+
+	if cc.httpCodeRanges.Contains(cc.code) {
+		if !cc.allow(cc.code) {
+			cc.drop()
+
+			return
+		}
+
+		cc.sendHeaders()
+
+		return
+	}
+
+	if cc.inspection != nil {
+		if m := cc.inspection.matchHeader(cc.code, cc.header()); m != nil {
+			if !cc.inspection.fail(m) {
+				cc.drop()
+
+				return
+			}
+		} else if cc.inspection.needsBody() {
+			cc.inspecting = true
+			cc.timer = time.AfterFunc(maxInspectionDelay, cc.inspectionTimeout)
+
 			return
 		}
 	}
 
+	cc.sendHeaders()
+}
+
+// sendHeaders replaces the headers of the wrapped ResponseWriter by the
+// backend ones, as is, and writes them.
+func (cc *codeCatcher) sendHeaders() {
+	header := cc.responseWriter.Header()
+
+	for k := range header {
+		if _, found := cc.headerMap[k]; !found {
+			delete(header, k)
+		}
+	}
+
 	// The copy is not appending the values,
 	// to not repeat them in case any informational status code has been written.
-	for k, v := range cc.Header() {
-		cc.responseWriter.Header()[k] = v
+	for k, v := range cc.headerMap {
+		header[k] = v
 	}
 
 	cc.responseWriter.WriteHeader(cc.code)
 	cc.headersSent = true
 }
 
+// drop replaces the response by a 429, the headers and body of the backend
+// being discarded.
+func (cc *codeCatcher) drop() {
+	cc.dropped = true
+	cc.headersSent = true
+	cc.responseWriter.WriteHeader(http.StatusTooManyRequests)
+}
+
+// endInspection matches the buffered body against the response failures, and
+// either drops the response or sends it, the rest of the body being forwarded
+// directly. It is called with mu held.
+func (cc *codeCatcher) endInspection() error {
+	cc.inspecting = false
+	cc.timer.Stop()
+
+	body := cc.bytes
+	cc.bytes = nil
+
+	if m := cc.inspection.matchBody(body); m != nil && !cc.inspection.fail(m) {
+		cc.drop()
+
+		return nil
+	}
+
+	cc.sendHeaders()
+
+	if _, err := cc.responseWriter.Write(body); err != nil {
+		return fmt.Errorf("failed to write to response: %w", err)
+	}
+
+	return nil
+}
+
+// inspectionTimeout ends the inspection of a body still incomplete after
+// maxInspectionDelay, flushing what was written so far.
+func (cc *codeCatcher) inspectionTimeout() {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if !cc.inspecting || cc.hijacked {
+		return
+	}
+
+	if err := cc.flush(); err != nil {
+		logger.Error("Plugin: FailToBan: failed to write response",
+			logger.WithErr(err.Error()),
+		)
+	}
+}
+
+// finish ends the inspection of the body, if any, once the backend is done.
+func (cc *codeCatcher) finish() error {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if !cc.inspecting {
+		return nil
+	}
+
+	return cc.endInspection()
+}
+
 // Hijack hijacks the connection.
 func (cc *codeCatcher) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	if hj, ok := cc.responseWriter.(http.Hijacker); ok {
@@ -133,6 +281,10 @@ func (cc *codeCatcher) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 			return nil, nil, fmt.Errorf("failed to hijack connection: %w", err)
 		}
 
+		cc.mu.Lock()
+		cc.hijacked = true
+		cc.mu.Unlock()
+
 		return conn, rw, nil
 	}
 
@@ -141,20 +293,98 @@ func (cc *codeCatcher) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 
 // Flush sends any buffered data to the client.
 func (cc *codeCatcher) Flush() {
+	_ = cc.FlushError()
+}
+
+// FlushError sends any buffered data to the client, and returns the error of
+// the wrapped ResponseWriter, used by http.ResponseController.
+func (cc *codeCatcher) FlushError() error {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
 	// If WriteHeader was already called from the caller, this is a NOOP.
 	// Otherwise, cc.code is actually a 200 here.
-	cc.WriteHeader(cc.code)
-
-	// We don't care about the contents of the response,
-	// since we want to serve the forbidden page,
-	// so we just don't flush.
-	// (e.g., To prevent superfluous WriteHeader on request with a
-	// `Transfert-Encoding: chunked` header).
-	if cc.caughtFilteredCode && !cc.allowedRequest {
-		return
+	cc.writeHeader(cc.code)
+
+	return cc.flush()
+}
+
+// flush ends the inspection, if any, and flushes the response. It is called
+// with mu held.
+func (cc *codeCatcher) flush() error {
+	// A streamed response is matched against what has been written so far.
+	if cc.inspecting {
+		if err := cc.endInspection(); err != nil {
+			return err
+		}
+	}
+
+	// The body of a dropped response is never sent.
+	if cc.dropped {
+		return nil
 	}
 
-	if flusher, ok := cc.responseWriter.(http.Flusher); ok {
-		flusher.Flush()
+	if err := http.NewResponseController(cc.responseWriter).Flush(); err != nil {
+		return fmt.Errorf("failed to flush response: %w", err)
 	}
+
+	return nil
+}
+
+// ReadFrom copies the body from src, using the io.ReaderFrom of the wrapped
+// ResponseWriter once the response is forwarded (e.g. sendfile).
+func (cc *codeCatcher) ReadFrom(src io.Reader) (int64, error) {
+	cc.mu.Lock()
+
+	// If WriteHeader was already called from the caller, this is a NOOP.
+	// Otherwise, cc.code is actually a 200 here.
+	cc.writeHeader(cc.code)
+
+	var dst io.Writer
+
+	switch {
+	case cc.dropped:
+		dst = io.Discard
+	case cc.inspecting:
+		dst = writerOnly{cc}
+	default:
+		dst = cc.responseWriter
+	}
+
+	// Once forwarded, the response is not touched by the inspection timer
+	// anymore.
+	cc.mu.Unlock()
+
+	n, err := io.Copy(dst, src)
+	if err != nil {
+		return n, fmt.Errorf("failed to copy to response: %w", err)
+	}
+
+	return n, nil
+}
+
+// writerOnly hides the io.ReaderFrom of the codeCatcher, for io.Copy not to
+// call it back.
+type writerOnly struct {
+	io.Writer
+}
+
+// Push initiates an HTTP/2 server push.
+func (cc *codeCatcher) Push(target string, opts *http.PushOptions) error {
+	pusher, ok := cc.responseWriter.(http.Pusher)
+	if !ok {
+		return http.ErrNotSupported
+	}
+
+	if err := pusher.Push(target, opts); err != nil {
+		return fmt.Errorf("failed to push %q: %w", target, err)
+	}
+
+	return nil
+}
+
+// Unwrap returns the wrapped ResponseWriter, used by http.ResponseController
+// (e.g. deadlines, full duplex).
+func (cc *codeCatcher) Unwrap() http.ResponseWriter {
+	return cc.responseWriter
 }
@@ -0,0 +1,262 @@
+package status
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tomMoulard/fail2ban/pkg/data"
+	"github.com/tomMoulard/fail2ban/pkg/fail2ban"
+	"github.com/tomMoulard/fail2ban/pkg/rules"
+	"golang.org/x/net/websocket"
+)
+
+// newConformanceServer serves next through the status handler, with the
+// statusCode filtered and the response failures matched.
+func newConformanceServer(t *testing.T, next http.Handler, statusCode string) *httptest.Server {
+	t.Helper()
+
+	f2b := fail2ban.New(rules.RulesTransformed{
+		MaxRetry: 100,
+		Findtime: 300 * time.Second,
+		Bantime:  300 * time.Second,
+	}, nil)
+
+	s, err := New(next, statusCode, f2b, true)
+	require.NoError(t, err)
+
+	matcher, err := rules.CompileResponseMatcher(rules.ResponseMatcher{Body: "invalid_credentials"})
+	require.NoError(t, err)
+	require.NoError(t, s.WithResponseFailures(rules.ResponseFailuresRule{
+		MaxBodySize: 64,
+		Matchers:    []*rules.ResponseMatcherRule{matcher},
+	}))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, err := data.ServeHTTP(w, r, "")
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		s.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func get(t *testing.T, server *httptest.Server, path string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, server.URL+path, nil)
+	require.NoError(t, err)
+
+	resp, err := server.Client().Do(req)
+	require.NoError(t, err)
+
+	t.Cleanup(func() { _ = resp.Body.Close() })
+
+	return resp
+}
+
+func TestConformanceHeaders(t *testing.T) {
+	t.Parallel()
+
+	for _, code := range []int{http.StatusOK, http.StatusNotFound} {
+		t.Run(http.StatusText(code), func(t *testing.T) {
+			t.Parallel()
+
+			server := newConformanceServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Add("Set-Cookie", "a=1; Path=/")
+				w.Header().Add("Set-Cookie", "b=2; Expires=Wed, 21 Oct 2026 07:28:00 GMT")
+				w.Header().Del("X-Upstream")
+				w.WriteHeader(code)
+			}), "404")
+
+			// A header set by a previous handler, removed by the backend.
+			upstream := server.Config.Handler
+			server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-Upstream", "1")
+				upstream.ServeHTTP(w, r)
+			})
+
+			resp := get(t, server, "/")
+
+			assert.Equal(t, code, resp.StatusCode)
+			assert.Equal(t, []string{"a=1; Path=/", "b=2; Expires=Wed, 21 Oct 2026 07:28:00 GMT"}, resp.Header.Values("Set-Cookie"))
+			assert.Len(t, resp.Cookies(), 2)
+			assert.Empty(t, resp.Header.Values("X-Upstream"))
+		})
+	}
+}
+
+func TestConformanceTrailers(t *testing.T) {
+	t.Parallel()
+
+	for _, code := range []int{http.StatusOK, http.StatusNotFound} {
+		t.Run(http.StatusText(code), func(t *testing.T) {
+			t.Parallel()
+
+			server := newConformanceServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Trailer", "X-Checksum")
+				w.WriteHeader(code)
+				_, _ = w.Write([]byte("body"))
+				w.Header().Set("X-Checksum", "42")
+				w.Header().Set(http.TrailerPrefix+"X-Undeclared", "43")
+			}), "404")
+
+			resp := get(t, server, "/")
+
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+
+			assert.Equal(t, code, resp.StatusCode)
+			assert.Equal(t, "body", string(body))
+			assert.Equal(t, "42", resp.Trailer.Get("X-Checksum"))
+			assert.Equal(t, "43", resp.Trailer.Get("X-Undeclared"))
+		})
+	}
+}
+
+func TestConformanceChunked(t *testing.T) {
+	t.Parallel()
+
+	for _, code := range []int{http.StatusOK, http.StatusNotFound} {
+		t.Run(http.StatusText(code), func(t *testing.T) {
+			t.Parallel()
+
+			server := newConformanceServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(code)
+
+				for i := range 3 {
+					_, _ = w.Write([]byte(strings.Repeat(string(rune('a'+i)), 100)))
+					w.(http.Flusher).Flush()
+				}
+			}), "404")
+
+			resp := get(t, server, "/")
+
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+
+			assert.Equal(t, code, resp.StatusCode)
+			assert.Equal(t, []string{"chunked"}, resp.TransferEncoding)
+			assert.Equal(t, strings.Repeat("a", 100)+strings.Repeat("b", 100)+strings.Repeat("c", 100), string(body))
+		})
+	}
+}
+
+func TestConformanceReaderFrom(t *testing.T) {
+	t.Parallel()
+
+	body := strings.Repeat("x", 1024)
+
+	server := newConformanceServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, ok := w.(io.ReaderFrom)
+		assert.True(t, ok)
+
+		_, err := io.Copy(w, strings.NewReader(body))
+		assert.NoError(t, err)
+	}), "404")
+
+	resp := get(t, server, "/")
+
+	got, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, body, string(got))
+}
+
+func TestConformanceResponseController(t *testing.T) {
+	t.Parallel()
+
+	server := newConformanceServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+
+		assert.NoError(t, rc.SetReadDeadline(time.Now().Add(time.Minute)))
+		assert.NoError(t, rc.SetWriteDeadline(time.Now().Add(time.Minute)))
+		assert.NoError(t, rc.EnableFullDuplex())
+
+		_, _ = w.Write([]byte("ok"))
+		assert.NoError(t, rc.Flush())
+
+		pusher, ok := w.(http.Pusher)
+		if assert.True(t, ok) {
+			assert.ErrorIs(t, pusher.Push("/style.css", nil), http.ErrNotSupported)
+		}
+	}), "404")
+
+	resp := get(t, server, "/")
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	assert.Equal(t, "ok", string(body))
+}
+
+func TestConformanceSSE(t *testing.T) {
+	t.Parallel()
+
+	firstEventRead := make(chan struct{})
+
+	server := newConformanceServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+
+		_, _ = w.Write([]byte("data: first\n\n"))
+		w.(http.Flusher).Flush()
+
+		// The client reads the first event before the stream ends, even though
+		// the response failures match bodies.
+		select {
+		case <-firstEventRead:
+		case <-r.Context().Done():
+			return
+		}
+
+		_, _ = w.Write([]byte("data: invalid_credentials\n\n"))
+	}), "404")
+
+	resp := get(t, server, "/")
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	events := bufio.NewReader(resp.Body)
+
+	line, err := events.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "data: first\n", line)
+	close(firstEventRead)
+
+	rest, err := io.ReadAll(events)
+	require.NoError(t, err)
+	assert.Equal(t, "\ndata: invalid_credentials\n\n", string(rest))
+}
+
+func TestConformanceWebSocket(t *testing.T) {
+	t.Parallel()
+
+	server := newConformanceServer(t, websocket.Handler(func(ws *websocket.Conn) {
+		// Echoes the client messages.
+		_, _ = io.Copy(ws, ws)
+	}), "400-499")
+
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http"), "", "http://localhost")
+	require.NoError(t, err)
+
+	defer func() { _ = ws.Close() }()
+
+	for _, message := range []string{"hello", "invalid_credentials"} {
+		require.NoError(t, websocket.Message.Send(ws, message))
+
+		var echo string
+		require.NoError(t, websocket.Message.Receive(ws, &echo))
+		assert.Equal(t, message, echo)
+	}
+}
@@ -0,0 +1,105 @@
+package status
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+
+	utime "github.com/tomMoulard/fail2ban/pkg/utils/time"
+)
+
+// maxTrackedIPs bounds the number of IPs tracked by the path diversity
+// detector.
+const maxTrackedIPs = 10000
+
+// pathDiversity counts the distinct paths requested by each IP within
+// findtime. The set of paths of an IP is bounded by the threshold, as the IP is
+// forgotten once it reaches it.
+type pathDiversity struct {
+	codeRanges HTTPCodeRanges
+	threshold  int
+	findtime   time.Duration
+
+	mu  sync.Mutex
+	ips map[string]*paths
+}
+
+type paths struct {
+	start  time.Time
+	hashes map[uint64]struct{}
+}
+
+func newPathDiversity(codeRanges HTTPCodeRanges, threshold int, findtime time.Duration) *pathDiversity {
+	return &pathDiversity{
+		codeRanges: codeRanges,
+		threshold:  threshold,
+		findtime:   findtime,
+		ips:        make(map[string]*paths),
+	}
+}
+
+// add records the path requested by the IP, and returns whether the IP
+// requested threshold distinct paths within findtime.
+func (pd *pathDiversity) add(ip, path string) bool {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(path))
+	hash := h.Sum64()
+
+	now := utime.Now()
+
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+
+	p, found := pd.ips[ip]
+	if !found || now.After(p.start.Add(pd.findtime)) {
+		if !found && len(pd.ips) >= maxTrackedIPs {
+			pd.prune(now)
+
+			if len(pd.ips) >= maxTrackedIPs {
+				return false
+			}
+		}
+
+		p = &paths{start: now, hashes: make(map[uint64]struct{})}
+		pd.ips[ip] = p
+	}
+
+	p.hashes[hash] = struct{}{}
+
+	if len(p.hashes) < pd.threshold {
+		return false
+	}
+
+	delete(pd.ips, ip)
+
+	return true
+}
+
+// prune forgets the IPs whose findtime is over.
+func (pd *pathDiversity) prune(now time.Time) {
+	for ip, p := range pd.ips {
+		if now.After(p.start.Add(pd.findtime)) {
+			delete(pd.ips, ip)
+		}
+	}
+}
+
+// restore takes over the paths of the previous detector.
+func (pd *pathDiversity) restore(prev *pathDiversity) {
+	prev.mu.Lock()
+	ips := make(map[string]*paths, len(prev.ips))
+
+	for ip, p := range prev.ips {
+		hashes := make(map[uint64]struct{}, len(p.hashes))
+		for hash := range p.hashes {
+			hashes[hash] = struct{}{}
+		}
+
+		ips[ip] = &paths{start: p.start, hashes: hashes}
+	}
+	prev.mu.Unlock()
+
+	pd.mu.Lock()
+	pd.ips = ips
+	pd.mu.Unlock()
+}
@@ -0,0 +1,36 @@
+package status
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	utime "github.com/tomMoulard/fail2ban/pkg/utils/time"
+)
+
+func TestPathDiversity(t *testing.T) {
+	t.Parallel()
+
+	pd := newPathDiversity(HTTPCodeRanges{{404, 404}}, 3, time.Minute)
+
+	// The same broken link does not count.
+	for range 10 {
+		assert.False(t, pd.add("192.0.2.1", "/broken.png"))
+	}
+
+	assert.False(t, pd.add("192.0.2.1", "/.env"))
+	assert.False(t, pd.add("192.0.2.2", "/wp-admin"))
+	assert.True(t, pd.add("192.0.2.1", "/.git/config"))
+
+	// The IP is forgotten once detected.
+	assert.NotContains(t, pd.ips, "192.0.2.1")
+	assert.Len(t, pd.ips["192.0.2.2"].hashes, 1)
+
+	// Paths older than findtime are forgotten.
+	pd.ips["192.0.2.2"].start = utime.Now().Add(-2 * time.Minute)
+	assert.False(t, pd.add("192.0.2.2", "/admin"))
+	assert.Len(t, pd.ips["192.0.2.2"].hashes, 1)
+
+	pd.prune(utime.Now().Add(2 * time.Minute))
+	assert.Empty(t, pd.ips)
+}
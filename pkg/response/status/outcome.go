@@ -0,0 +1,159 @@
+package status
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tomMoulard/fail2ban/pkg/data"
+	"github.com/tomMoulard/fail2ban/pkg/rules"
+	utime "github.com/tomMoulard/fail2ban/pkg/utils/time"
+)
+
+// outageWindow is the window over which the backend failures are measured.
+const outageWindow = time.Minute
+
+// outcomes counts the request outcomes a status code does not show as
+// failures.
+type outcomes struct {
+	latency           time.Duration
+	slowWeight        float64
+	canceledWeight    float64
+	serverErrors      HTTPCodeRanges
+	serverErrorWeight float64
+	outage            *outage
+}
+
+func newOutcomes(o rules.OutcomesRule) (*outcomes, error) {
+	out := &outcomes{
+		latency:           o.Latency,
+		slowWeight:        o.SlowWeight,
+		canceledWeight:    o.CanceledWeight,
+		serverErrorWeight: o.ServerErrorWeight,
+		outage:            newOutage(o.OutageRatio, o.OutageClients),
+	}
+
+	if o.ServerErrorCodes != "" {
+		var err error
+
+		out.serverErrors, err = NewHTTPCodeRanges(strings.Split(o.ServerErrorCodes, ","))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create HTTP code ranges: %w", err)
+		}
+	}
+
+	return out, nil
+}
+
+// ended counts the slow and canceled outcomes of the request, once its
+// response is over. The ban applies to the next requests.
+func (s *Status) ended(r *http.Request, reqData *data.Data, cc *codeCatcher, start time.Time) {
+	if s.outcomes == nil || reqData.Allowlisted {
+		return
+	}
+
+	f2b := s.f2b.For(reqData)
+
+	slow := s.outcomes.slowWeight > 0 && !cc.headersAt.IsZero() && cc.headersAt.Sub(start) > s.outcomes.latency
+	failing := s.outcomes.outage.add(reqData.RemoteIP, slow || s.outcomes.serverErrors.Contains(cc.getCode()), utime.Now())
+
+	if slow && !failing &&
+		!f2b.AddFailure(reqData.RemoteIP, s.outcomes.slowWeight) {
+		s.logBlocked(r, reqData, f2b, "slow request ban", cc.getCode())
+	}
+
+	if s.outcomes.canceledWeight > 0 && errors.Is(r.Context().Err(), context.Canceled) &&
+		!f2b.AddFailure(reqData.RemoteIP, s.outcomes.canceledWeight) {
+		s.logBlocked(r, reqData, f2b, "canceled request ban", cc.getCode())
+	}
+}
+
+// outage tells whether the backend fails for every client (e.g. it is down or
+// overloaded), from the slow and server error outcomes of the requests over
+// the current and previous windows.
+type outage struct {
+	ratio   float64
+	clients int
+
+	mu       sync.Mutex
+	current  outageCount
+	previous outageCount
+}
+
+// outageCount counts the requests of a window.
+type outageCount struct {
+	start    time.Time
+	requests int
+	failures int
+	// clients are the failing clients, up to the clients needed.
+	clients map[string]struct{}
+}
+
+func newOutage(ratio float64, clients int) *outage {
+	return &outage{ratio: ratio, clients: clients}
+}
+
+// add counts the request, and returns whether the backend is failing.
+func (o *outage) add(remoteIP string, failed bool, now time.Time) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.rotate(now)
+
+	o.current.requests++
+
+	if failed {
+		o.current.failures++
+
+		if len(o.current.clients) < o.clients {
+			o.current.clients[remoteIP] = struct{}{}
+		}
+	}
+
+	return o.failingLocked()
+}
+
+// failing returns whether the backend is failing.
+func (o *outage) failing(now time.Time) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.rotate(now)
+
+	return o.failingLocked()
+}
+
+func (o *outage) rotate(now time.Time) {
+	if o.current.clients != nil && now.Before(o.current.start.Add(outageWindow)) {
+		return
+	}
+
+	if o.current.clients != nil && now.Before(o.current.start.Add(2*outageWindow)) {
+		o.previous = o.current
+	} else {
+		o.previous = outageCount{}
+	}
+
+	o.current = outageCount{start: now, clients: make(map[string]struct{}, o.clients)}
+}
+
+func (o *outage) failingLocked() bool {
+	requests := o.current.requests + o.previous.requests
+	if requests == 0 || float64(o.current.failures+o.previous.failures) < o.ratio*float64(requests) {
+		return false
+	}
+
+	clients := len(o.current.clients)
+
+	for ip := range o.previous.clients {
+		if _, found := o.current.clients[ip]; !found {
+			clients++
+		}
+	}
+
+	return clients >= o.clients
+}
@@ -0,0 +1,114 @@
+package status
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/tomMoulard/fail2ban/pkg/rules"
+)
+
+// responseMatcher is a response failure matcher, with its status codes.
+type responseMatcher struct {
+	rule *rules.ResponseMatcherRule
+	// codeRanges is nil when every status code is matched.
+	codeRanges HTTPCodeRanges
+}
+
+func newResponseMatchers(rf rules.ResponseFailuresRule) ([]responseMatcher, error) {
+	matchers := make([]responseMatcher, 0, len(rf.Matchers))
+
+	for _, m := range rf.Matchers {
+		matcher := responseMatcher{rule: m}
+
+		if m.StatusCode != "" {
+			var err error
+
+			matcher.codeRanges, err = NewHTTPCodeRanges(strings.Split(m.StatusCode, ","))
+			if err != nil {
+				return nil, fmt.Errorf("failed to create HTTP code ranges: %w", err)
+			}
+		}
+
+		matchers = append(matchers, matcher)
+	}
+
+	return matchers, nil
+}
+
+// inspection decides whether a response, not filtered by its status code, is
+// a failure from its headers and the first bytes of its body.
+type inspection struct {
+	matchers    []responseMatcher
+	maxBodySize int64
+	// fail counts the failure matched, and returns whether the response is
+	// allowed.
+	fail func(m *rules.ResponseMatcherRule) bool
+
+	// candidates are the matchers left to match against the body.
+	candidates []*rules.ResponseMatcherRule
+	header     http.Header
+}
+
+// matchHeader returns the first matcher without body regexp matching the
+// response, nil if none does. The matchers with a body regexp are kept as
+// candidates, unless the body cannot be matched.
+func (in *inspection) matchHeader(code int, header http.Header) *rules.ResponseMatcherRule {
+	inspectable := inspectableBody(header)
+
+	for _, m := range in.matchers {
+		if m.codeRanges != nil && !m.codeRanges.Contains(code) {
+			continue
+		}
+
+		if !m.rule.MatchBody() {
+			if m.rule.Match(header, nil) {
+				return m.rule
+			}
+
+			continue
+		}
+
+		if inspectable {
+			in.candidates = append(in.candidates, m.rule)
+		}
+	}
+
+	in.header = header
+
+	return nil
+}
+
+// needsBody returns whether matchers are left to match against the body.
+func (in *inspection) needsBody() bool {
+	return len(in.candidates) > 0
+}
+
+// matchBody returns the first candidate matching the first maxBodySize bytes
+// of the body, nil if none does.
+func (in *inspection) matchBody(body []byte) *rules.ResponseMatcherRule {
+	if int64(len(body)) > in.maxBodySize {
+		body = body[:in.maxBodySize]
+	}
+
+	for _, m := range in.candidates {
+		if m.Match(in.header, body) {
+			return m
+		}
+	}
+
+	return nil
+}
+
+// inspectableBody returns whether the body can be matched, i.e. it is neither
+// compressed nor an event stream.
+func inspectableBody(header http.Header) bool {
+	if encoding := header.Get("Content-Encoding"); encoding != "" && !strings.EqualFold(encoding, "identity") {
+		return false
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+
+	return mediaType != "text/event-stream"
+}
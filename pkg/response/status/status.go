@@ -5,79 +5,331 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/tomMoulard/fail2ban/pkg/data"
 	"github.com/tomMoulard/fail2ban/pkg/fail2ban"
 	"github.com/tomMoulard/fail2ban/pkg/logger"
+	"github.com/tomMoulard/fail2ban/pkg/rules"
+	utime "github.com/tomMoulard/fail2ban/pkg/utils/time"
 )
 
-type status struct {
-	next            http.Handler
-	codeRanges      HTTPCodeRanges
+// Status is the handler counting the failures from the responses.
+type Status struct {
+	next       http.Handler
+	codeRanges HTTPCodeRanges
+	weights    []weight
+	buckets    []bucket
+	// caughtRanges are the codes caught for the fail2ban handler, codeRanges
+	// and the buckets, path diversity and server error ones.
+	caughtRanges    HTTPCodeRanges
+	diversity       *pathDiversity
+	observers       []Observer
+	responses       []responseMatcher
+	maxBodySize     int64
+	outcomes        *outcomes
 	f2b             *fail2ban.Fail2Ban
 	enableBlockLogs bool
+	// shadow logs the responses that would be blocked, and lets them through.
+	shadow bool
 }
 
-func New(next http.Handler, statusCode string, f2b *fail2ban.Fail2Ban, enableBlockLogs bool) (*status, error) {
-	codeRanges, err := NewHTTPCodeRanges(strings.Split(statusCode, ","))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create HTTP code ranges: %w", err)
+type weight struct {
+	codeRanges HTTPCodeRanges
+	weight     float64
+}
+
+// Observer is notified of the status code of every response.
+type Observer interface {
+	Observe(r *http.Request, code int)
+}
+
+// New creates the status handler. The statusCode may be empty when only the
+// path diversity detection or the observers are used.
+func New(next http.Handler, statusCode string, f2b *fail2ban.Fail2Ban, enableBlockLogs bool) (*Status, error) {
+	var codeRanges HTTPCodeRanges
+
+	if statusCode != "" {
+		var err error
+
+		codeRanges, err = NewHTTPCodeRanges(strings.Split(statusCode, ","))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create HTTP code ranges: %w", err)
+		}
 	}
 
-	return &status{
+	return &Status{
 		next:            next,
 		codeRanges:      codeRanges,
+		caughtRanges:    codeRanges,
 		f2b:             f2b,
 		enableBlockLogs: enableBlockLogs,
 	}, nil
 }
 
-func (s *status) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	data := data.GetData(r)
-	if data == nil {
-		return
-	}
+// WithShadow counts the failures and bans as usual, but lets the responses
+// through, only logging the ones that would be blocked.
+func (s *Status) WithShadow() {
+	s.shadow = true
+}
 
-	catcher := newCodeCatcher(w, s.codeRanges)
-	s.next.ServeHTTP(catcher, r)
+// WithNext returns a status handler answering with next, sharing the state
+// (e.g. the buckets) of s.
+func (s *Status) WithNext(next http.Handler) *Status {
+	shared := *s
+	shared.next = next
 
-	if !catcher.isFilteredCode() {
-		for k, vv := range catcher.Header() {
-			w.Header().Set(k, strings.Join(vv, ", "))
+	return &shared
+}
+
+// Restore takes over the bucket and path diversity state of the previous
+// status handler of the jail.
+func (s *Status) Restore(prev *Status) {
+	for _, b := range s.buckets {
+		for _, pb := range prev.buckets {
+			if pb.codes == b.codes {
+				b.f2b.Restore(pb.f2b)
+			}
 		}
+	}
 
-		w.WriteHeader(catcher.getCode())
+	if s.diversity != nil && prev.diversity != nil {
+		s.diversity.restore(prev.diversity)
+	}
+}
 
-		return
+// Buckets returns the Fail2Ban of the status code buckets.
+func (s *Status) Buckets() []*fail2ban.Fail2Ban {
+	f2bs := make([]*fail2ban.Fail2Ban, 0, len(s.buckets))
+	for _, b := range s.buckets {
+		f2bs = append(f2bs, b.f2b)
+	}
+
+	return f2bs
+}
+
+// Sweep forgets the expired failures and bans of the status code buckets.
+func (s *Status) Sweep(now time.Time) {
+	for _, b := range s.buckets {
+		b.f2b.Sweep(now)
+	}
+}
+
+// WithObserver notifies the observer of the status code of every response.
+func (s *Status) WithObserver(o Observer) {
+	s.observers = append(s.observers, o)
+}
+
+// WithPathDiversity bans the IPs requesting threshold distinct paths answered
+// with the path diversity status codes within findtime.
+func (s *Status) WithPathDiversity(pd rules.PathDiversity, findtime time.Duration) error {
+	codeRanges, err := NewHTTPCodeRanges(strings.Split(pd.StatusCode, ","))
+	if err != nil {
+		return fmt.Errorf("failed to create HTTP code ranges: %w", err)
+	}
+
+	s.diversity = newPathDiversity(codeRanges, pd.Threshold, findtime)
+	s.caughtRanges = append(append(HTTPCodeRanges{}, s.caughtRanges...), codeRanges...)
+
+	return nil
+}
+
+// WithResponseFailures counts the responses matching the response failures,
+// from their headers and the first bytes of their body, as failures.
+func (s *Status) WithResponseFailures(rf rules.ResponseFailuresRule) error {
+	responses, err := newResponseMatchers(rf)
+	if err != nil {
+		return err
 	}
 
-	catcher.allowedRequest = s.f2b.ShouldAllow(data.RemoteIP)
-	if !catcher.allowedRequest {
-		if s.enableBlockLogs {
-			logger.Info("Plugin: FailToBan: IP blocked",
-				logger.WithIP(data.RemoteIP),
-				logger.WithReason("status code ban"),
-				logger.WithStatusCode(catcher.getCode()),
-				logger.WithMethod(r.Method),
-				logger.WithPath(r.URL.Path),
-				logger.WithUA(r.UserAgent()),
-			)
+	s.responses = responses
+	s.maxBodySize = rf.MaxBodySize
+
+	return nil
+}
+
+// WithOutcomes counts the slow, canceled and server error outcomes of the
+// requests as failures.
+func (s *Status) WithOutcomes(o rules.OutcomesRule) error {
+	outcomes, err := newOutcomes(o)
+	if err != nil {
+		return err
+	}
+
+	s.outcomes = outcomes
+	s.caughtRanges = append(append(HTTPCodeRanges{}, s.caughtRanges...), outcomes.serverErrors...)
+
+	return nil
+}
+
+// WithBuckets counts the failures of each bucket apart, banning the IPs
+// reaching the maxretry of a bucket.
+func (s *Status) WithBuckets(buckets []rules.StatusCodeBucket, findtime, bantime time.Duration) error {
+	bs, err := newBuckets(buckets, findtime, bantime)
+	if err != nil {
+		return err
+	}
+
+	s.buckets = bs
+
+	for _, b := range bs {
+		s.caughtRanges = append(append(HTTPCodeRanges{}, s.caughtRanges...), b.codeRanges...)
+	}
+
+	return nil
+}
+
+// WithWeights sets the score of the failures by status code, 1 by default.
+func (s *Status) WithWeights(weights []rules.StatusCodeWeight) error {
+	for _, w := range weights {
+		codeRanges, err := NewHTTPCodeRanges(strings.Split(w.Codes, ","))
+		if err != nil {
+			return fmt.Errorf("failed to create HTTP code ranges: %w", err)
 		}
 
-		w.WriteHeader(http.StatusTooManyRequests)
+		s.weights = append(s.weights, weight{codeRanges: codeRanges, weight: w.Weight})
+	}
 
+	return nil
+}
+
+// weight returns the score of a failure with the status code.
+func (s *Status) weight(code int) float64 {
+	for _, w := range s.weights {
+		if w.codeRanges.Contains(code) {
+			return w.weight
+		}
+	}
+
+	return 1
+}
+
+func (s *Status) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	data := data.GetData(r)
+	if data == nil {
 		return
 	}
 
-	for k, vv := range catcher.Header() {
-		w.Header().Set(k, strings.Join(vv, ", "))
+	catcher := newCodeCatcher(w, s.caughtRanges, func(code int) bool {
+		return s.allow(r, data, code)
+	})
+
+	if len(s.responses) > 0 {
+		catcher.inspection = &inspection{
+			matchers:    s.responses,
+			maxBodySize: s.maxBodySize,
+			fail: func(m *rules.ResponseMatcherRule) bool {
+				return s.fail(r, data, m, catcher.getCode())
+			},
+		}
 	}
 
-	w.WriteHeader(catcher.getCode())
+	start := time.Now()
 
-	if _, err := w.Write(catcher.bytes); err != nil {
+	s.next.ServeHTTP(catcher, r)
+
+	if err := catcher.finish(); err != nil {
 		logger.Error("Plugin: FailToBan: failed to write response",
 			logger.WithErr(err.Error()),
 		)
 	}
+
+	// Sends the headers of the responses without body.
+	catcher.WriteHeader(catcher.getCode())
+
+	s.ended(r, data, catcher, start)
+
+	for _, o := range s.observers {
+		o.Observe(r, catcher.getCode())
+	}
+}
+
+// allow counts the failure of a filtered status code, and returns whether the
+// response is allowed.
+func (s *Status) allow(r *http.Request, reqData *data.Data, code int) bool {
+	if reqData.Allowlisted {
+		return true
+	}
+
+	f2b := s.f2b.For(reqData)
+
+	reason := s.check(f2b, reqData.RemoteIP, r.URL.Path, code)
+	if reason == "" {
+		return true
+	}
+
+	s.logBlocked(r, reqData, f2b, reason, code)
+
+	return s.shadow
+}
+
+// check counts the failure, and returns why the IP is banned, empty if the
+// request is allowed.
+func (s *Status) check(f2b *fail2ban.Fail2Ban, remoteIP, path string, code int) string {
+	if s.codeRanges.Contains(code) && !f2b.AddFailure(remoteIP, s.weight(code)) {
+		return "status code ban"
+	}
+
+	for _, b := range s.buckets {
+		if !b.codeRanges.Contains(code) {
+			continue
+		}
+
+		if !b.addFailure(remoteIP, s.weight(code)) {
+			f2b.Ban(remoteIP, 0)
+
+			return "status code ban: bucket " + b.codes
+		}
+
+		break
+	}
+
+	if s.outcomes != nil && !s.codeRanges.Contains(code) && s.outcomes.serverErrors.Contains(code) &&
+		!s.outcomes.outage.failing(utime.Now()) && !f2b.AddFailure(remoteIP, s.outcomes.serverErrorWeight) {
+		return "server error ban"
+	}
+
+	if s.diversity != nil && s.diversity.codeRanges.Contains(code) && s.diversity.add(remoteIP, path) {
+		f2b.Ban(remoteIP, 0)
+
+		return "path diversity ban"
+	}
+
+	return ""
+}
+
+// fail counts the response failure matched, and returns whether the response
+// is allowed.
+func (s *Status) fail(r *http.Request, reqData *data.Data, m *rules.ResponseMatcherRule, code int) bool {
+	if reqData.Allowlisted {
+		return true
+	}
+
+	f2b := s.f2b.For(reqData)
+	if f2b.AddFailure(reqData.RemoteIP, m.Weight()) {
+		return true
+	}
+
+	s.logBlocked(r, reqData, f2b, "response failure ban: "+m.String(), code)
+
+	return s.shadow
+}
+
+func (s *Status) logBlocked(r *http.Request, reqData *data.Data, f2b *fail2ban.Fail2Ban, reason string, code int) {
+	// The shadow mode always logs the responses it would block.
+	if !s.enableBlockLogs && !s.shadow {
+		return
+	}
+
+	logger.Info(logger.Blocked(s.shadow),
+		logger.WithIP(reqData.RemoteIP),
+		logger.WithCountry(reqData.Country),
+		logger.WithASN(reqData.ASN),
+		logger.WithReason(reason),
+		logger.WithScore(f2b.Score(reqData.RemoteIP)),
+		logger.WithStatusCode(code),
+		logger.WithMethod(r.Method),
+		logger.WithPath(r.URL.Path),
+		logger.WithUA(r.UserAgent()),
+	)
 }
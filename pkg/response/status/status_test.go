@@ -1,9 +1,13 @@
 package status
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -27,6 +31,8 @@ func TestStatus(t *testing.T) {
 		ips              map[string]ipchecking.IPViewed
 		respStatusCode   int
 		expectedStatus   int
+		allowlisted      bool
+		weights          []rules.StatusCodeWeight
 		expectedIPViewed map[string]ipchecking.IPViewed
 		expectedBody     string
 	}{
@@ -46,6 +52,7 @@ func TestStatus(t *testing.T) {
 					Viewed: utime.Now(),
 					Count:  43,
 					Denied: true,
+					Score:  1,
 				},
 			},
 			expectedStatus: http.StatusTooManyRequests,
@@ -66,6 +73,7 @@ func TestStatus(t *testing.T) {
 					Viewed: utime.Now(),
 					Count:  43,
 					Denied: true,
+					Score:  1,
 				},
 			},
 			expectedStatus: http.StatusTooManyRequests,
@@ -80,11 +88,44 @@ func TestStatus(t *testing.T) {
 					Viewed: utime.Now(),
 					Count:  1,
 					Denied: false,
+					Score:  1,
 				},
 			},
 			expectedStatus: http.StatusBadRequest,
 			expectedBody:   body,
 		},
+		{
+			name:           "weighted",
+			codeRanges:     "400-499",
+			weights:        []rules.StatusCodeWeight{{Codes: "404", Weight: 3}, {Codes: "400-403", Weight: 0.5}},
+			respStatusCode: http.StatusBadRequest,
+			ips: map[string]ipchecking.IPViewed{
+				"192.0.2.1": {
+					Viewed: utime.Now(),
+					Count:  1,
+					Score:  0.25,
+				},
+			},
+			expectedIPViewed: map[string]ipchecking.IPViewed{
+				"192.0.2.1": {
+					Viewed: utime.Now(),
+					Count:  2,
+					Score:  0.75,
+				},
+			},
+			expectedStatus: http.StatusBadRequest,
+			expectedBody:   body,
+		},
+		{
+			name:             "allowlisted not counted",
+			codeRanges:       "400-499",
+			respStatusCode:   http.StatusBadRequest,
+			ips:              map[string]ipchecking.IPViewed{},
+			allowlisted:      true,
+			expectedIPViewed: map[string]ipchecking.IPViewed{},
+			expectedStatus:   http.StatusBadRequest,
+			expectedBody:     body,
+		},
 		{
 			name:             "not denied out of limits",
 			codeRanges:       "400-499",
@@ -117,12 +158,15 @@ func TestStatus(t *testing.T) {
 			f2b.IPs = test.ips
 			d, err := New(next, test.codeRanges, f2b, true)
 			require.NoError(t, err)
+			require.NoError(t, d.WithWeights(test.weights))
 
 			recorder := &httptest.ResponseRecorder{}
 			req := httptest.NewRequest(http.MethodGet, "https://example.com/foo", nil)
 			req, err = data.ServeHTTP(recorder, req, "")
 			require.NoError(t, err)
 
+			data.GetData(req).Allowlisted = test.allowlisted
+
 			var b bytes.Buffer
 			recorder = &httptest.ResponseRecorder{Body: &b}
 			d.ServeHTTP(recorder, req)
@@ -263,3 +307,807 @@ func TestHeaderCopying(t *testing.T) {
 		})
 	}
 }
+
+func TestStatusPathDiversity(t *testing.T) {
+	t.Parallel()
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	f2b := fail2ban.New(rules.RulesTransformed{
+		MaxRetry: 100,
+		Findtime: 300 * time.Second,
+		Bantime:  300 * time.Second,
+	}, nil)
+	s, err := New(next, "", f2b, true)
+	require.NoError(t, err)
+	require.NoError(t, s.WithPathDiversity(rules.PathDiversity{StatusCode: "404", Threshold: 3}, time.Minute))
+
+	for i, test := range []struct {
+		path           string
+		expectedStatus int
+	}{
+		{path: "/broken.png", expectedStatus: http.StatusNotFound},
+		{path: "/broken.png", expectedStatus: http.StatusNotFound},
+		{path: "/.env", expectedStatus: http.StatusNotFound},
+		{path: "/.git/config", expectedStatus: http.StatusTooManyRequests},
+	} {
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "https://example.com"+test.path, nil)
+		req, err = data.ServeHTTP(recorder, req, "")
+		require.NoError(t, err)
+
+		s.ServeHTTP(recorder, req)
+		assert.Equal(t, test.expectedStatus, recorder.Code, "request [%d]", i)
+	}
+
+	assert.False(t, f2b.IsNotBanned("192.0.2.1"))
+}
+
+func TestStatusRestore(t *testing.T) {
+	t.Parallel()
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/admin" {
+			w.WriteHeader(http.StatusUnauthorized)
+
+			return
+		}
+
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	newStatus := func() (*Status, *fail2ban.Fail2Ban) {
+		t.Helper()
+
+		f2b := fail2ban.New(rules.RulesTransformed{
+			MaxRetry: 100,
+			Findtime: 300 * time.Second,
+			Bantime:  300 * time.Second,
+		}, nil)
+		s, err := New(next, "", f2b, true)
+		require.NoError(t, err)
+		require.NoError(t, s.WithBuckets([]rules.StatusCodeBucket{{Codes: "401", MaxRetry: 2}}, time.Minute, time.Hour))
+		require.NoError(t, s.WithPathDiversity(rules.PathDiversity{StatusCode: "404", Threshold: 3}, time.Minute))
+
+		return s, f2b
+	}
+
+	serve := func(s *Status, remoteIP, path string) int {
+		t.Helper()
+
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "https://example.com"+path, nil)
+		req.RemoteAddr = remoteIP + ":1234"
+		req, err := data.ServeHTTP(recorder, req, "")
+		require.NoError(t, err)
+
+		s.ServeHTTP(recorder, req)
+
+		return recorder.Code
+	}
+
+	prev, _ := newStatus()
+	assert.Equal(t, http.StatusUnauthorized, serve(prev, "192.0.2.1", "/admin"))
+	assert.Equal(t, http.StatusNotFound, serve(prev, "192.0.2.2", "/.env"))
+	assert.Equal(t, http.StatusNotFound, serve(prev, "192.0.2.2", "/.git/config"))
+
+	// The bucket and the paths counted before the reload are kept.
+	s, f2b := newStatus()
+	s.Restore(prev)
+	assert.Equal(t, http.StatusTooManyRequests, serve(s, "192.0.2.1", "/admin"))
+	assert.Equal(t, http.StatusTooManyRequests, serve(s, "192.0.2.2", "/wp-admin"))
+	assert.False(t, f2b.IsNotBanned("192.0.2.1"))
+	assert.False(t, f2b.IsNotBanned("192.0.2.2"))
+}
+
+func TestStatusWithNext(t *testing.T) {
+	t.Parallel()
+
+	f2b := fail2ban.New(rules.RulesTransformed{
+		MaxRetry: 100,
+		Findtime: 300 * time.Second,
+		Bantime:  300 * time.Second,
+	}, nil)
+	s, err := New(nil, "", f2b, true)
+	require.NoError(t, err)
+	require.NoError(t, s.WithBuckets([]rules.StatusCodeBucket{{Codes: "401", MaxRetry: 2}}, time.Minute, time.Hour))
+
+	serve := func(s *Status, body string) *httptest.ResponseRecorder {
+		t.Helper()
+
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+		req, err := data.ServeHTTP(recorder, req, "")
+		require.NoError(t, err)
+
+		s.WithNext(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(body))
+		})).ServeHTTP(recorder, req)
+
+		return recorder
+	}
+
+	// Each instance answers with its next handler, counting in the same bucket.
+	recorder := serve(s, "a")
+	assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+	assert.Equal(t, "a", recorder.Body.String())
+
+	recorder = serve(s, "b")
+	assert.Equal(t, http.StatusTooManyRequests, recorder.Code)
+}
+
+func TestStatusResponseFailures(t *testing.T) {
+	t.Parallel()
+
+	invalid := `{"error":"invalid_credentials"}`
+
+	tests := []struct {
+		name           string
+		matchers       []rules.ResponseMatcher
+		respStatusCode int
+		respHeaders    map[string]string
+		respBody       []string
+		allowlisted    bool
+		expectedStatus int
+		expectedBody   string
+		expectedBanned bool
+	}{
+		{
+			name:           "header",
+			matchers:       []rules.ResponseMatcher{{Headers: []rules.HeaderRegexp{{Name: "X-Auth-Result", Regexp: "^fail$"}}}},
+			respStatusCode: http.StatusOK,
+			respHeaders:    map[string]string{"X-Auth-Result": "fail"},
+			respBody:       []string{"Hello"},
+			expectedStatus: http.StatusTooManyRequests,
+			expectedBanned: true,
+		},
+		{
+			name:           "header not matching",
+			matchers:       []rules.ResponseMatcher{{Headers: []rules.HeaderRegexp{{Name: "X-Auth-Result", Regexp: "^fail$"}}}},
+			respStatusCode: http.StatusOK,
+			respHeaders:    map[string]string{"X-Auth-Result": "success"},
+			respBody:       []string{"Hello"},
+			expectedStatus: http.StatusOK,
+			expectedBody:   "Hello",
+		},
+		{
+			name:           "body",
+			matchers:       []rules.ResponseMatcher{{StatusCode: "200", Body: `"error":"invalid_credentials"`}},
+			respStatusCode: http.StatusOK,
+			respBody:       []string{invalid},
+			expectedStatus: http.StatusTooManyRequests,
+			expectedBanned: true,
+		},
+		{
+			name:           "body in several writes",
+			matchers:       []rules.ResponseMatcher{{Body: `"error":"invalid_credentials"`}},
+			respStatusCode: http.StatusOK,
+			respBody:       []string{`{"error":`, `"invalid_credentials"}`},
+			expectedStatus: http.StatusTooManyRequests,
+			expectedBanned: true,
+		},
+		{
+			name:           "body not matching",
+			matchers:       []rules.ResponseMatcher{{Body: `"error":"invalid_credentials"`}},
+			respStatusCode: http.StatusOK,
+			respBody:       []string{`{"token":"abc"}`},
+			expectedStatus: http.StatusOK,
+			expectedBody:   `{"token":"abc"}`,
+		},
+		{
+			name:           "other status code",
+			matchers:       []rules.ResponseMatcher{{StatusCode: "401", Body: `"error":"invalid_credentials"`}},
+			respStatusCode: http.StatusOK,
+			respBody:       []string{invalid},
+			expectedStatus: http.StatusOK,
+			expectedBody:   invalid,
+		},
+		{
+			name:           "header and body",
+			matchers:       []rules.ResponseMatcher{{Headers: []rules.HeaderRegexp{{Name: "X-Auth-Result"}}, Body: "invalid"}},
+			respStatusCode: http.StatusOK,
+			respBody:       []string{invalid},
+			expectedStatus: http.StatusOK,
+			expectedBody:   invalid,
+		},
+		{
+			name:           "beyond the buffer cap",
+			matchers:       []rules.ResponseMatcher{{Body: `"error":"invalid_credentials"`}},
+			respStatusCode: http.StatusOK,
+			respBody:       []string{strings.Repeat(" ", 64), invalid},
+			expectedStatus: http.StatusOK,
+			expectedBody:   strings.Repeat(" ", 64) + invalid,
+		},
+		{
+			name:           "compressed",
+			matchers:       []rules.ResponseMatcher{{Body: `"error":"invalid_credentials"`}},
+			respStatusCode: http.StatusOK,
+			respHeaders:    map[string]string{"Content-Encoding": "gzip"},
+			respBody:       []string{invalid},
+			expectedStatus: http.StatusOK,
+			expectedBody:   invalid,
+		},
+		{
+			name:           "event stream",
+			matchers:       []rules.ResponseMatcher{{Body: `"error":"invalid_credentials"`}},
+			respStatusCode: http.StatusOK,
+			respHeaders:    map[string]string{"Content-Type": "text/event-stream"},
+			respBody:       []string{invalid},
+			expectedStatus: http.StatusOK,
+			expectedBody:   invalid,
+		},
+		{
+			name:           "flushed before matching",
+			matchers:       []rules.ResponseMatcher{{Body: `"error":"invalid_credentials"`}},
+			respStatusCode: http.StatusOK,
+			respBody:       []string{"data: ok\n", "flush", invalid},
+			expectedStatus: http.StatusOK,
+			expectedBody:   "data: ok\n" + invalid,
+		},
+		{
+			name:           "allowlisted not counted",
+			matchers:       []rules.ResponseMatcher{{Body: `"error":"invalid_credentials"`}},
+			respStatusCode: http.StatusOK,
+			respBody:       []string{invalid},
+			allowlisted:    true,
+			expectedStatus: http.StatusOK,
+			expectedBody:   invalid,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for k, v := range test.respHeaders {
+					w.Header().Set(k, v)
+				}
+
+				w.WriteHeader(test.respStatusCode)
+
+				for _, chunk := range test.respBody {
+					if chunk == "flush" {
+						w.(http.Flusher).Flush()
+
+						continue
+					}
+
+					_, err := w.Write([]byte(chunk))
+					assert.NoError(t, err)
+				}
+			})
+
+			f2b := fail2ban.New(rules.RulesTransformed{
+				MaxRetry: 1,
+				Findtime: 300 * time.Second,
+				Bantime:  300 * time.Second,
+			}, nil)
+			f2b.IPs = map[string]ipchecking.IPViewed{"192.0.2.1": {Viewed: utime.Now()}}
+
+			rf := rules.ResponseFailuresRule{MaxBodySize: 64}
+			for _, m := range test.matchers {
+				matcher, err := rules.CompileResponseMatcher(m)
+				require.NoError(t, err)
+
+				rf.Matchers = append(rf.Matchers, matcher)
+			}
+
+			s, err := New(next, "", f2b, true)
+			require.NoError(t, err)
+			require.NoError(t, s.WithResponseFailures(rf))
+
+			recorder := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodPost, "https://example.com/login", nil)
+			req, err = data.ServeHTTP(recorder, req, "")
+			require.NoError(t, err)
+
+			data.GetData(req).Allowlisted = test.allowlisted
+
+			s.ServeHTTP(recorder, req)
+
+			assert.Equal(t, test.expectedStatus, recorder.Code)
+			assert.Equal(t, test.expectedBody, recorder.Body.String())
+			assert.Equal(t, test.expectedBanned, !f2b.IsNotBanned("192.0.2.1"))
+		})
+	}
+}
+
+func TestStatusStreaming(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name           string
+		ips            map[string]ipchecking.IPViewed
+		expectedStatus int
+		expectedBody   string
+	}{
+		{
+			name:           "allowed filtered code is streamed",
+			ips:            map[string]ipchecking.IPViewed{},
+			expectedStatus: http.StatusNotFound,
+			expectedBody:   "first chunk\nsecond chunk\n",
+		},
+		{
+			name:           "banned body is never sent",
+			ips:            map[string]ipchecking.IPViewed{"127.0.0.1": {Viewed: utime.Now()}},
+			expectedStatus: http.StatusTooManyRequests,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			firstChunkRead := make(chan struct{})
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNotFound)
+
+				_, _ = w.Write([]byte("first chunk\n"))
+				w.(http.Flusher).Flush()
+
+				// The client reads the first chunk before the backend is done.
+				if test.expectedStatus == http.StatusNotFound {
+					<-firstChunkRead
+				}
+
+				_, _ = w.Write([]byte("second chunk\n"))
+			})
+
+			f2b := fail2ban.New(rules.RulesTransformed{
+				MaxRetry: 1,
+				Findtime: 300 * time.Second,
+				Bantime:  300 * time.Second,
+			}, nil)
+			f2b.IPs = test.ips
+
+			s, err := New(next, "404", f2b, true)
+			require.NoError(t, err)
+
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				r, err := data.ServeHTTP(w, r, "")
+				if !assert.NoError(t, err) {
+					return
+				}
+
+				s.ServeHTTP(w, r)
+			}))
+			defer server.Close()
+
+			req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, server.URL, nil)
+			require.NoError(t, err)
+
+			resp, err := server.Client().Do(req)
+			require.NoError(t, err)
+
+			defer func() { _ = resp.Body.Close() }()
+
+			assert.Equal(t, test.expectedStatus, resp.StatusCode)
+
+			body := bufio.NewReader(resp.Body)
+
+			if test.expectedStatus == http.StatusNotFound {
+				line, err := body.ReadString('\n')
+				require.NoError(t, err)
+				assert.Equal(t, "first chunk\n", line)
+				close(firstChunkRead)
+
+				rest, err := io.ReadAll(body)
+				require.NoError(t, err)
+				assert.Equal(t, test.expectedBody, line+string(rest))
+
+				return
+			}
+
+			rest, err := io.ReadAll(body)
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedBody, string(rest))
+		})
+	}
+}
+
+func TestStatusInspectionTimeout(t *testing.T) {
+	t.Parallel()
+
+	firstChunkRead := make(chan struct{})
+
+	// A long polling backend, neither flushing nor reaching maxbodysize.
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("first chunk\n"))
+
+		<-firstChunkRead
+
+		_, _ = w.Write([]byte("invalid_credentials\n"))
+	})
+
+	f2b := fail2ban.New(rules.RulesTransformed{
+		MaxRetry: 1,
+		Findtime: 300 * time.Second,
+		Bantime:  300 * time.Second,
+	}, nil)
+
+	s, err := New(next, "", f2b, true)
+	require.NoError(t, err)
+
+	matcher, err := rules.CompileResponseMatcher(rules.ResponseMatcher{Body: "invalid_credentials"})
+	require.NoError(t, err)
+	require.NoError(t, s.WithResponseFailures(rules.ResponseFailuresRule{
+		MaxBodySize: 64 * 1024,
+		Matchers:    []*rules.ResponseMatcherRule{matcher},
+	}))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, err := data.ServeHTTP(w, r, "")
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		s.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, server.URL, nil)
+	require.NoError(t, err)
+
+	resp, err := server.Client().Do(req)
+	require.NoError(t, err)
+
+	defer func() { _ = resp.Body.Close() }()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// The body held for inspection is forwarded before the backend is done.
+	body := bufio.NewReader(resp.Body)
+
+	line, err := body.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "first chunk\n", line)
+	close(firstChunkRead)
+
+	rest, err := io.ReadAll(body)
+	require.NoError(t, err)
+	assert.Equal(t, "invalid_credentials\n", string(rest))
+}
+
+func TestStatusHijack(t *testing.T) {
+	t.Parallel()
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		defer func() { _ = conn.Close() }()
+
+		_, _ = rw.WriteString("HTTP/1.1 418 I'm a teapot\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		_ = rw.Flush()
+	})
+
+	f2b := fail2ban.New(rules.RulesTransformed{
+		MaxRetry: 1,
+		Findtime: 300 * time.Second,
+		Bantime:  300 * time.Second,
+	}, nil)
+
+	s, err := New(next, "400-499", f2b, true)
+	require.NoError(t, err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, err := data.ServeHTTP(w, r, "")
+		if !assert.NoError(t, err) {
+			return
+		}
+
+		s.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	req, err := http.NewRequestWithContext(t.Context(), http.MethodGet, server.URL, nil)
+	require.NoError(t, err)
+
+	resp, err := server.Client().Do(req)
+	require.NoError(t, err)
+
+	defer func() { _ = resp.Body.Close() }()
+
+	assert.Equal(t, http.StatusTeapot, resp.StatusCode)
+}
+
+func TestStatusOutcomes(t *testing.T) {
+	t.Parallel()
+
+	outcomes := rules.OutcomesRule{
+		Latency:           10 * time.Millisecond,
+		SlowWeight:        2,
+		CanceledWeight:    3,
+		ServerErrorCodes:  "500",
+		ServerErrorWeight: 0.5,
+		OutageRatio:       0.5,
+		OutageClients:     5,
+	}
+
+	tests := []struct {
+		name          string
+		delay         time.Duration
+		canceled      bool
+		code          int
+		allowlisted   bool
+		expectedScore float64
+	}{
+		{
+			name: "fast",
+			code: http.StatusOK,
+		},
+		{
+			name:          "slow",
+			delay:         50 * time.Millisecond,
+			code:          http.StatusOK,
+			expectedScore: 2,
+		},
+		{
+			name:          "canceled",
+			canceled:      true,
+			code:          http.StatusOK,
+			expectedScore: 3,
+		},
+		{
+			name:          "server error",
+			code:          http.StatusInternalServerError,
+			expectedScore: 0.5,
+		},
+		{
+			name: "backend unavailable",
+			code: http.StatusServiceUnavailable,
+		},
+		{
+			name:        "allowlisted not counted",
+			delay:       50 * time.Millisecond,
+			canceled:    true,
+			code:        http.StatusInternalServerError,
+			allowlisted: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(test.delay)
+				w.WriteHeader(test.code)
+			})
+
+			f2b := fail2ban.New(rules.RulesTransformed{
+				MaxRetry: 100,
+				Findtime: 300 * time.Second,
+				Bantime:  300 * time.Second,
+			}, nil)
+			f2b.IPs = map[string]ipchecking.IPViewed{"192.0.2.1": {Viewed: utime.Now()}}
+
+			s, err := New(next, "", f2b, true)
+			require.NoError(t, err)
+			require.NoError(t, s.WithOutcomes(outcomes))
+
+			ctx, cancel := context.WithCancel(t.Context())
+			if test.canceled {
+				cancel()
+			} else {
+				defer cancel()
+			}
+
+			recorder := httptest.NewRecorder()
+			req := httptest.NewRequestWithContext(ctx, http.MethodGet, "https://example.com/", nil)
+			req, err = data.ServeHTTP(recorder, req, "")
+			require.NoError(t, err)
+
+			data.GetData(req).Allowlisted = test.allowlisted
+
+			s.ServeHTTP(recorder, req)
+
+			assert.Equal(t, test.code, recorder.Code)
+			assert.InDelta(t, test.expectedScore, f2b.Score("192.0.2.1"), 0)
+		})
+	}
+}
+
+func TestStatusOutcomesOutage(t *testing.T) {
+	t.Parallel()
+
+	code := http.StatusInternalServerError
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(code)
+	})
+
+	f2b := fail2ban.New(rules.RulesTransformed{
+		MaxRetry: 100,
+		Findtime: 300 * time.Second,
+		Bantime:  300 * time.Second,
+	}, nil)
+
+	s, err := New(next, "", f2b, true)
+	require.NoError(t, err)
+	require.NoError(t, s.WithOutcomes(rules.OutcomesRule{
+		ServerErrorCodes:  "500",
+		ServerErrorWeight: 1,
+		OutageRatio:       0.5,
+		OutageClients:     3,
+	}))
+
+	serve := func(remoteIP string) {
+		t.Helper()
+
+		req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+		req.RemoteAddr = remoteIP + ":1234"
+		req, err := data.ServeHTTP(nil, req, "")
+		require.NoError(t, err)
+
+		s.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// A single client failing the backend is counted.
+	for range 3 {
+		serve("192.0.2.1")
+	}
+
+	assert.InDelta(t, 3, f2b.Score("192.0.2.1"), 0)
+
+	// The backend failing for 3 clients, nobody is counted.
+	serve("192.0.2.2")
+	serve("192.0.2.3")
+	serve("192.0.2.4")
+	serve("192.0.2.1")
+
+	assert.InDelta(t, 1, f2b.Score("192.0.2.2"), 0)
+	assert.InDelta(t, 1, f2b.Score("192.0.2.3"), 0)
+	assert.Zero(t, f2b.Score("192.0.2.4"))
+	assert.InDelta(t, 3, f2b.Score("192.0.2.1"), 0)
+
+	// Until the successful requests lower the failure rate.
+	code = http.StatusOK
+	for range 10 {
+		serve("198.51.100.1")
+	}
+
+	code = http.StatusInternalServerError
+	serve("192.0.2.4")
+	assert.InDelta(t, 1, f2b.Score("192.0.2.4"), 0)
+}
+
+func TestOutageWindows(t *testing.T) {
+	t.Parallel()
+
+	o := newOutage(0.5, 2)
+	now := utime.Now()
+
+	assert.False(t, o.add("192.0.2.1", true, now))
+	assert.True(t, o.add("192.0.2.2", true, now))
+
+	// The previous window still counts.
+	assert.True(t, o.failing(now.Add(outageWindow)))
+
+	// Then it is forgotten.
+	assert.False(t, o.failing(now.Add(3*outageWindow)))
+	assert.False(t, o.add("192.0.2.1", true, now.Add(3*outageWindow)))
+}
+
+func TestStatusBuckets(t *testing.T) {
+	t.Parallel()
+
+	var code int
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(code)
+	})
+
+	f2b := fail2ban.New(rules.RulesTransformed{
+		MaxRetry: 100,
+		Findtime: 300 * time.Second,
+		Bantime:  300 * time.Second,
+	}, nil)
+	s, err := New(next, "", f2b, true)
+	require.NoError(t, err)
+	require.NoError(t, s.WithBuckets([]rules.StatusCodeBucket{
+		{Codes: "401,403", MaxRetry: 2},
+		{Codes: "404", MaxRetry: 3},
+	}, time.Minute, time.Hour))
+
+	for i, test := range []struct {
+		code           int
+		expectedStatus int
+	}{
+		{code: http.StatusNotFound, expectedStatus: http.StatusNotFound},
+		{code: http.StatusNotFound, expectedStatus: http.StatusNotFound},
+		// The 401 are counted apart from the 404.
+		{code: http.StatusUnauthorized, expectedStatus: http.StatusUnauthorized},
+		{code: http.StatusBadRequest, expectedStatus: http.StatusBadRequest},
+		{code: http.StatusForbidden, expectedStatus: http.StatusTooManyRequests},
+	} {
+		code = test.code
+
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+		req, err = data.ServeHTTP(recorder, req, "")
+		require.NoError(t, err)
+
+		s.ServeHTTP(recorder, req)
+		assert.Equal(t, test.expectedStatus, recorder.Code, "request [%d]", i)
+	}
+
+	assert.False(t, f2b.IsNotBanned("192.0.2.1"))
+}
+
+func TestStatusBucketsSweep(t *testing.T) {
+	t.Parallel()
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	})
+
+	f2b := fail2ban.New(rules.RulesTransformed{
+		MaxRetry: 100,
+		Findtime: 300 * time.Second,
+		Bantime:  300 * time.Second,
+	}, nil)
+	s, err := New(next, "", f2b, true)
+	require.NoError(t, err)
+	require.NoError(t, s.WithBuckets([]rules.StatusCodeBucket{{Codes: "401", MaxRetry: 2}}, time.Minute, time.Hour))
+
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	req, err = data.ServeHTTP(recorder, req, "")
+	require.NoError(t, err)
+
+	s.ServeHTTP(recorder, req)
+
+	bucket := s.Buckets()[0]
+	assert.InDelta(t, 1, bucket.Score("192.0.2.1"), 0)
+
+	// The failures older than findtime are forgotten.
+	s.Sweep(utime.Now())
+	assert.InDelta(t, 1, bucket.Score("192.0.2.1"), 0)
+
+	s.Sweep(utime.Now().Add(time.Minute))
+
+	bucket.MuIP.Lock()
+	defer bucket.MuIP.Unlock()
+
+	assert.Empty(t, bucket.IPs)
+}
+
+func TestStatusShadow(t *testing.T) {
+	t.Parallel()
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte("unauthorized"))
+	})
+
+	f2b := fail2ban.New(rules.RulesTransformed{
+		MaxRetry: 2,
+		Findtime: 300 * time.Second,
+		Bantime:  300 * time.Second,
+	}, nil)
+	s, err := New(next, "401", f2b, true)
+	require.NoError(t, err)
+	s.WithShadow()
+
+	for i := range 4 {
+		recorder := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+		req, err = data.ServeHTTP(recorder, req, "")
+		require.NoError(t, err)
+
+		s.ServeHTTP(recorder, req)
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code, "request [%d]", i)
+		assert.Equal(t, "unauthorized", recorder.Body.String(), "request [%d]", i)
+	}
+
+	// The failures are counted as usual.
+	assert.False(t, f2b.IsNotBanned("192.0.2.1"))
+}
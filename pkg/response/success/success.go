@@ -0,0 +1,71 @@
+// Package success lowers the failures of the IPs getting successful responses,
+// so that a user mistyping a password before logging in is not left on the
+// verge of a ban.
+package success
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/tomMoulard/fail2ban/pkg/data"
+	"github.com/tomMoulard/fail2ban/pkg/fail2ban"
+	"github.com/tomMoulard/fail2ban/pkg/response/status"
+	"github.com/tomMoulard/fail2ban/pkg/rules"
+)
+
+type success struct {
+	rule       rules.SuccessRule
+	codeRanges status.HTTPCodeRanges
+	f2b        *fail2ban.Fail2Ban
+	// buckets are the status code buckets, lowered along with the jail.
+	buckets []*fail2ban.Fail2Ban
+}
+
+// New creates the success observer.
+func New(rule rules.SuccessRule, f2b *fail2ban.Fail2Ban) (*success, error) {
+	codeRanges, err := status.NewHTTPCodeRanges(strings.Split(rule.StatusCode, ","))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP code ranges: %w", err)
+	}
+
+	return &success{
+		rule:       rule,
+		codeRanges: codeRanges,
+		f2b:        f2b,
+	}, nil
+}
+
+// WithBuckets also resets or decrements the failures of the IP in the status
+// code buckets.
+func (s *success) WithBuckets(buckets []*fail2ban.Fail2Ban) {
+	s.buckets = buckets
+}
+
+// Observe resets or decrements the failures of the IP when the response is a
+// success on one of the routes.
+func (s *success) Observe(r *http.Request, code int) {
+	reqData := data.GetData(r)
+	if reqData == nil || !s.codeRanges.Contains(code) || !s.isRoute(r) {
+		return
+	}
+
+	for _, f2b := range append([]*fail2ban.Fail2Ban{s.f2b.For(reqData)}, s.buckets...) {
+		if s.rule.Reset {
+			f2b.Reset(reqData.RemoteIP)
+		} else {
+			f2b.Decrement(reqData.RemoteIP, s.rule.Decrement)
+		}
+	}
+}
+
+// isRoute returns whether the request is on one of the routes.
+func (s *success) isRoute(r *http.Request) bool {
+	for _, route := range s.rule.Routes {
+		if route.Match(r) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,102 @@
+package success
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tomMoulard/fail2ban/pkg/data"
+	"github.com/tomMoulard/fail2ban/pkg/fail2ban"
+	"github.com/tomMoulard/fail2ban/pkg/rules"
+)
+
+func TestObserve(t *testing.T) {
+	t.Parallel()
+
+	login, err := rules.CompileMatcher(rules.Urlregexp{Path: "^/login$"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name          string
+		rule          rules.SuccessRule
+		path          string
+		code          int
+		expectedScore float64
+	}{
+		{
+			name:          "reset",
+			rule:          rules.SuccessRule{Routes: []*rules.Matcher{login}, StatusCode: "200-299", Reset: true},
+			path:          "/login",
+			code:          http.StatusOK,
+			expectedScore: 0,
+		},
+		{
+			name:          "decrement",
+			rule:          rules.SuccessRule{Routes: []*rules.Matcher{login}, StatusCode: "200-299", Decrement: 0.5},
+			path:          "/login",
+			code:          http.StatusNoContent,
+			expectedScore: 1.5,
+		},
+		{
+			name:          "not a success",
+			rule:          rules.SuccessRule{Routes: []*rules.Matcher{login}, StatusCode: "200-299", Reset: true},
+			path:          "/login",
+			code:          http.StatusUnauthorized,
+			expectedScore: 2,
+		},
+		{
+			name:          "no routes",
+			rule:          rules.SuccessRule{StatusCode: "200-299", Reset: true},
+			path:          "/login",
+			code:          http.StatusOK,
+			expectedScore: 2,
+		},
+		{
+			name:          "not on the route",
+			rule:          rules.SuccessRule{Routes: []*rules.Matcher{login}, StatusCode: "200-299", Reset: true},
+			path:          "/home",
+			code:          http.StatusOK,
+			expectedScore: 2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			newF2B := func() *fail2ban.Fail2Ban {
+				return fail2ban.New(rules.RulesTransformed{
+					MaxRetry: 3,
+					Findtime: 300 * time.Second,
+					Bantime:  300 * time.Second,
+				}, nil)
+			}
+
+			f2b, bucket := newF2B(), newF2B()
+
+			s, err := New(test.rule, f2b)
+			require.NoError(t, err)
+			s.WithBuckets([]*fail2ban.Fail2Ban{bucket})
+
+			for _, f := range []*fail2ban.Fail2Ban{f2b, bucket} {
+				assert.True(t, f.ShouldAllow("192.0.2.1"))
+				assert.True(t, f.ShouldAllow("192.0.2.1"))
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "https://example.com"+test.path, nil)
+			req.RemoteAddr = "192.0.2.1:1234"
+
+			req, err = data.ServeHTTP(nil, req, "")
+			require.NoError(t, err)
+
+			s.Observe(req, test.code)
+
+			assert.InDelta(t, test.expectedScore, f2b.Score("192.0.2.1"), 0)
+			// The status code buckets are lowered along with the jail.
+			assert.InDelta(t, test.expectedScore, bucket.Score("192.0.2.1"), 0)
+		})
+	}
+}
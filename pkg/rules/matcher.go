@@ -0,0 +1,268 @@
+package rules
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// HeaderRegexp struct, matches a request header.
+type HeaderRegexp struct {
+	Name   string `yaml:"name"`
+	Regexp string `yaml:"regexp"` // when empty, the header only has to be present
+}
+
+// Matcher is a compiled Urlregexp.
+type Matcher struct {
+	url     *regexp.Regexp
+	method  *regexp.Regexp
+	host    *regexp.Regexp
+	path    *regexp.Regexp
+	query   *regexp.Regexp
+	headers []headerMatcher
+	any     []*Matcher
+	all     []*Matcher
+	not     bool
+	weight  float64
+}
+
+type headerMatcher struct {
+	name   string
+	regexp *regexp.Regexp
+}
+
+// CompileMatcher compiles a Urlregexp into a Matcher.
+func CompileMatcher(u Urlregexp) (*Matcher, error) {
+	if u.Weight < 0 {
+		return nil, fmt.Errorf("invalid weight %v: must be positive", u.Weight)
+	}
+
+	m := &Matcher{not: u.Not, weight: u.Weight}
+	if m.weight == 0 {
+		m.weight = 1
+	}
+
+	var err error
+
+	for _, field := range []struct {
+		name  string
+		value string
+		re    **regexp.Regexp
+	}{
+		{name: "url", value: u.Regexp, re: &m.url},
+		{name: "method", value: u.Method, re: &m.method},
+		{name: "host", value: u.Host, re: &m.host},
+		{name: "path", value: u.Path, re: &m.path},
+		{name: "query", value: u.Query, re: &m.query},
+	} {
+		if field.value == "" {
+			continue
+		}
+
+		*field.re, err = regexp.Compile(field.value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile %s regexp %q: %w", field.name, field.value, err)
+		}
+	}
+
+	m.headers, err = compileHeaders(u.Headers)
+	if err != nil {
+		return nil, err
+	}
+
+	m.any, err = CompileMatchers(u.Any)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile any: %w", err)
+	}
+
+	m.all, err = CompileMatchers(u.All)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile all: %w", err)
+	}
+
+	return m, nil
+}
+
+func compileHeaders(hs []HeaderRegexp) ([]headerMatcher, error) {
+	headers := make([]headerMatcher, 0, len(hs))
+
+	for _, h := range hs {
+		if h.Name == "" {
+			return nil, errors.New("header name is required")
+		}
+
+		hm := headerMatcher{name: h.Name}
+
+		if h.Regexp != "" {
+			var err error
+
+			hm.regexp, err = regexp.Compile(h.Regexp)
+			if err != nil {
+				return nil, fmt.Errorf("failed to compile header %q regexp %q: %w", h.Name, h.Regexp, err)
+			}
+		}
+
+		headers = append(headers, hm)
+	}
+
+	return headers, nil
+}
+
+// CompileMatchers compiles the request matchers, in order.
+func CompileMatchers(us []Urlregexp) ([]*Matcher, error) {
+	matchers := make([]*Matcher, 0, len(us))
+
+	for _, u := range us {
+		m, err := CompileMatcher(u)
+		if err != nil {
+			return nil, err
+		}
+
+		matchers = append(matchers, m)
+	}
+
+	return matchers, nil
+}
+
+// hostname returns the host without its port, nor the brackets of an IPv6.
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
+
+// Weight returns the score of a match.
+func (m *Matcher) Weight() float64 {
+	return m.weight
+}
+
+// Match returns whether the request matches. All the set conditions must
+// match, the result being inverted by Not.
+func (m *Matcher) Match(r *http.Request) bool {
+	return m.match(r) != m.not
+}
+
+func (m *Matcher) match(r *http.Request) bool {
+	if m.url != nil && !m.url.MatchString(r.URL.String()) {
+		return false
+	}
+
+	if m.method != nil && !m.method.MatchString(r.Method) {
+		return false
+	}
+
+	if m.host != nil && !m.host.MatchString(hostname(r.Host)) {
+		return false
+	}
+
+	if m.path != nil && !m.path.MatchString(r.URL.Path) {
+		return false
+	}
+
+	if m.query != nil && !m.query.MatchString(r.URL.RawQuery) {
+		return false
+	}
+
+	for _, h := range m.headers {
+		if !h.match(r.Header) {
+			return false
+		}
+	}
+
+	for _, sub := range m.all {
+		if !sub.Match(r) {
+			return false
+		}
+	}
+
+	if len(m.any) == 0 {
+		return true
+	}
+
+	for _, sub := range m.any {
+		if sub.Match(r) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (h headerMatcher) match(header http.Header) bool {
+	values := header.Values(h.name)
+	if h.regexp == nil {
+		return len(values) > 0
+	}
+
+	for _, value := range values {
+		if h.regexp.MatchString(value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (h headerMatcher) String() string {
+	if h.regexp == nil {
+		return "header=" + h.name
+	}
+
+	return "header=" + h.name + ":" + h.regexp.String()
+}
+
+// String returns a description of the matcher, used in logs.
+func (m *Matcher) String() string {
+	var parts []string
+
+	if m.url != nil {
+		parts = append(parts, m.url.String())
+	}
+
+	for _, field := range []struct {
+		name string
+		re   *regexp.Regexp
+	}{
+		{name: "method", re: m.method},
+		{name: "host", re: m.host},
+		{name: "path", re: m.path},
+		{name: "query", re: m.query},
+	} {
+		if field.re != nil {
+			parts = append(parts, field.name+"="+field.re.String())
+		}
+	}
+
+	for _, h := range m.headers {
+		parts = append(parts, h.String())
+	}
+
+	if len(m.all) > 0 {
+		parts = append(parts, "all("+joinMatchers(m.all)+")")
+	}
+
+	if len(m.any) > 0 {
+		parts = append(parts, "any("+joinMatchers(m.any)+")")
+	}
+
+	s := strings.Join(parts, " ")
+	if m.not {
+		return "not(" + s + ")"
+	}
+
+	return s
+}
+
+func joinMatchers(matchers []*Matcher) string {
+	s := make([]string, 0, len(matchers))
+	for _, m := range matchers {
+		s = append(s, m.String())
+	}
+
+	return strings.Join(s, ", ")
+}
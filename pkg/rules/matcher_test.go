@@ -0,0 +1,143 @@
+package rules
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatcher(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		matcher  Urlregexp
+		expected bool
+		str      string
+	}{
+		{
+			name:     "empty",
+			expected: true,
+		},
+		{
+			name:     "url",
+			matcher:  Urlregexp{Regexp: `/login\?next=`},
+			expected: true,
+			str:      `/login\?next=`,
+		},
+		{
+			name:     "method and path",
+			matcher:  Urlregexp{Method: `^POST$`, Path: `^/login$`},
+			expected: true,
+			str:      `method=^POST$ path=^/login$`,
+		},
+		{
+			name:    "wrong method",
+			matcher: Urlregexp{Method: `^GET$`, Path: `^/login$`},
+		},
+		{
+			name:     "host",
+			matcher:  Urlregexp{Host: `^admin\.example\.com$`},
+			expected: true,
+		},
+		{
+			name:     "query",
+			matcher:  Urlregexp{Query: `(^|&)next=`},
+			expected: true,
+		},
+		{
+			name:     "header value",
+			matcher:  Urlregexp{Headers: []HeaderRegexp{{Name: "User-Agent", Regexp: `(?i)sqlmap`}}},
+			expected: true,
+			str:      `header=User-Agent:(?i)sqlmap`,
+		},
+		{
+			name:    "missing header",
+			matcher: Urlregexp{Headers: []HeaderRegexp{{Name: "X-Api-Key"}}},
+		},
+		{
+			name:    "negation",
+			matcher: Urlregexp{Path: `^/login$`, Not: true},
+			str:     `not(path=^/login$)`,
+		},
+		{
+			name: "any",
+			matcher: Urlregexp{Any: []Urlregexp{
+				{Path: `^/admin`},
+				{Host: `^admin\.`},
+			}},
+			expected: true,
+			str:      `any(path=^/admin, host=^admin\.)`,
+		},
+		{
+			name: "all",
+			matcher: Urlregexp{All: []Urlregexp{
+				{Method: `^POST$`},
+				{Headers: []HeaderRegexp{{Name: "Content-Type", Regexp: `json`}}, Not: true},
+			}},
+			expected: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			m, err := CompileMatcher(test.matcher)
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(http.MethodPost, "https://admin.example.com/login?next=/", nil)
+			req.Header.Set("User-Agent", "sqlmap/1.0")
+
+			assert.Equal(t, test.expected, m.Match(req))
+
+			if test.str != "" {
+				assert.Equal(t, test.str, m.String())
+			}
+		})
+	}
+}
+
+func TestMatcherHost(t *testing.T) {
+	t.Parallel()
+
+	m, err := CompileMatcher(Urlregexp{Any: []Urlregexp{
+		{Host: `^admin\.example\.com$`},
+		{Host: `^2001:db8::1$`},
+	}})
+	require.NoError(t, err)
+
+	// The host is matched without its port.
+	for _, test := range []struct {
+		host     string
+		expected bool
+	}{
+		{host: "admin.example.com", expected: true},
+		{host: "admin.example.com:8443", expected: true},
+		{host: "[2001:db8::1]", expected: true},
+		{host: "[2001:db8::1]:8443", expected: true},
+		{host: "www.example.com:8443"},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = test.host
+
+		assert.Equal(t, test.expected, m.Match(req), test.host)
+	}
+}
+
+func TestCompileMatcherInvalid(t *testing.T) {
+	t.Parallel()
+
+	for _, u := range []Urlregexp{
+		{Path: "/(login"},
+		{Headers: []HeaderRegexp{{Regexp: "foo"}}},
+		{Headers: []HeaderRegexp{{Name: "foo", Regexp: "(foo"}}},
+		{Any: []Urlregexp{{Method: "(GET"}}},
+	} {
+		_, err := CompileMatcher(u)
+		require.Error(t, err)
+	}
+}
@@ -0,0 +1,62 @@
+package rules
+
+import (
+	"fmt"
+	"time"
+)
+
+// problems collects the rules problems with their field path, so a
+// configuration is fixed in one go.
+type problems []error
+
+// errorf records an invalid value.
+func (p *problems) errorf(path, format string, args ...any) {
+	*p = append(*p, fmt.Errorf("%s: %s", path, fmt.Sprintf(format, args...)))
+}
+
+// duration parses an optional duration, 0 when empty.
+func (p *problems) duration(path, value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	return p.requiredDuration(path, value)
+}
+
+// requiredDuration parses a required duration, greater than 0.
+func (p *problems) requiredDuration(path, value string) time.Duration {
+	if value == "" {
+		p.errorf(path, "must be set")
+
+		return 0
+	}
+
+	d, err := time.ParseDuration(value)
+
+	switch {
+	case err != nil:
+		p.errorf(path, "invalid duration %q", value)
+	case d <= 0:
+		p.errorf(path, "must be greater than 0, got %s", value)
+	}
+
+	return d
+}
+
+// matchers compiles the request matchers, recording the invalid ones.
+func (p *problems) matchers(path string, us []Urlregexp) []*Matcher {
+	var matchers []*Matcher
+
+	for i, u := range us {
+		m, err := CompileMatcher(u)
+		if err != nil {
+			p.errorf(fmt.Sprintf("%s[%d]", path, i), "%v", err)
+
+			continue
+		}
+
+		matchers = append(matchers, m)
+	}
+
+	return matchers
+}
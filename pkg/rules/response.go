@@ -0,0 +1,145 @@
+package rules
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// ResponseFailures struct, counts the responses matching their headers or
+// body as failures (e.g. a 200 with {"error":"invalid_credentials"}).
+type ResponseFailures struct {
+	MaxBodySize int64             `yaml:"maxbodysize"` // body bytes matched, defaults to 4KiB
+	Matchers    []ResponseMatcher `yaml:"matchers"`
+}
+
+// ResponseMatcher struct, matches a failed response. All the set conditions
+// must match.
+type ResponseMatcher struct {
+	StatusCode string         `yaml:"statuscode"` // every status code when empty
+	Headers    []HeaderRegexp `yaml:"headers"`
+	Body       string         `yaml:"body"` // matched against the first maxbodysize bytes
+	Weight     float64        `yaml:"weight"`
+}
+
+// ResponseFailuresRule is a compiled ResponseFailures.
+type ResponseFailuresRule struct {
+	MaxBodySize int64
+	Matchers    []*ResponseMatcherRule
+}
+
+// ResponseMatcherRule is a compiled ResponseMatcher.
+type ResponseMatcherRule struct {
+	StatusCode string
+	headers    []headerMatcher
+	body       *regexp.Regexp
+	weight     float64
+}
+
+// defaultMaxResponseBodySize is the default size of the response bodies
+// matched.
+const defaultMaxResponseBodySize = 4 * 1024
+
+// transformResponseFailures applies the response failures defaults.
+func transformResponseFailures(p *problems, path string, rf ResponseFailures) ResponseFailuresRule {
+	if len(rf.Matchers) == 0 {
+		p.errorf(path+".matchers", "must be set")
+	}
+
+	if rf.MaxBodySize < 0 {
+		p.errorf(path+".maxbodysize", "must be positive, got %d", rf.MaxBodySize)
+	}
+
+	rule := ResponseFailuresRule{MaxBodySize: rf.MaxBodySize}
+	if rule.MaxBodySize == 0 {
+		rule.MaxBodySize = defaultMaxResponseBodySize
+	}
+
+	for i, m := range rf.Matchers {
+		matcher, err := CompileResponseMatcher(m)
+		if err != nil {
+			p.errorf(fmt.Sprintf("%s.matchers[%d]", path, i), "%v", err)
+
+			continue
+		}
+
+		rule.Matchers = append(rule.Matchers, matcher)
+	}
+
+	return rule
+}
+
+// CompileResponseMatcher compiles a ResponseMatcher.
+func CompileResponseMatcher(m ResponseMatcher) (*ResponseMatcherRule, error) {
+	if len(m.Headers) == 0 && m.Body == "" {
+		return nil, errors.New("one of headers or body is required")
+	}
+
+	if m.Weight < 0 {
+		return nil, fmt.Errorf("invalid weight %v: must be positive", m.Weight)
+	}
+
+	rule := &ResponseMatcherRule{StatusCode: m.StatusCode, weight: m.Weight}
+	if rule.weight == 0 {
+		rule.weight = 1
+	}
+
+	var err error
+
+	rule.headers, err = compileHeaders(m.Headers)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.Body != "" {
+		rule.body, err = regexp.Compile(m.Body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile body regexp %q: %w", m.Body, err)
+		}
+	}
+
+	return rule, nil
+}
+
+// Weight returns the score of a match.
+func (m *ResponseMatcherRule) Weight() float64 {
+	return m.weight
+}
+
+// MatchBody returns whether the matcher needs the body to match.
+func (m *ResponseMatcherRule) MatchBody() bool {
+	return m.body != nil
+}
+
+// Match returns whether the response headers and body match. The body is
+// ignored when the matcher has no body regexp.
+func (m *ResponseMatcherRule) Match(header http.Header, body []byte) bool {
+	for _, h := range m.headers {
+		if !h.match(header) {
+			return false
+		}
+	}
+
+	return m.body == nil || m.body.Match(body)
+}
+
+// String returns a description of the matcher, used in logs.
+func (m *ResponseMatcherRule) String() string {
+	var parts []string
+
+	if m.StatusCode != "" {
+		parts = append(parts, "status="+m.StatusCode)
+	}
+
+	for _, h := range m.headers {
+		parts = append(parts, h.String())
+	}
+
+	if m.body != nil {
+		parts = append(parts, "body="+m.body.String())
+	}
+
+	return strings.Join(parts, " ")
+}
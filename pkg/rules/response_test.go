@@ -0,0 +1,77 @@
+package rules
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponseMatcher(t *testing.T) {
+	t.Parallel()
+
+	header := http.Header{"X-Auth-Result": []string{"fail"}}
+	body := []byte(`{"error":"invalid_credentials"}`)
+
+	tests := []struct {
+		name      string
+		matcher   ResponseMatcher
+		expected  bool
+		matchBody bool
+		str       string
+	}{
+		{
+			name:     "header",
+			matcher:  ResponseMatcher{Headers: []HeaderRegexp{{Name: "X-Auth-Result", Regexp: "^fail$"}}},
+			expected: true,
+			str:      "header=X-Auth-Result:^fail$",
+		},
+		{
+			name:    "header not matching",
+			matcher: ResponseMatcher{Headers: []HeaderRegexp{{Name: "X-Auth-Result", Regexp: "^success$"}}},
+		},
+		{
+			name:      "body",
+			matcher:   ResponseMatcher{StatusCode: "200", Body: `"error":"invalid_credentials"`},
+			expected:  true,
+			matchBody: true,
+			str:       `status=200 body="error":"invalid_credentials"`,
+		},
+		{
+			name:      "header and body",
+			matcher:   ResponseMatcher{Headers: []HeaderRegexp{{Name: "X-Missing"}}, Body: "invalid"},
+			matchBody: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			m, err := CompileResponseMatcher(test.matcher)
+			require.NoError(t, err)
+
+			assert.Equal(t, test.expected, m.Match(header, body))
+			assert.Equal(t, test.matchBody, m.MatchBody())
+			assert.InDelta(t, 1, m.Weight(), 0)
+
+			if test.str != "" {
+				assert.Equal(t, test.str, m.String())
+			}
+		})
+	}
+}
+
+func TestCompileResponseMatcherErrors(t *testing.T) {
+	t.Parallel()
+
+	_, err := CompileResponseMatcher(ResponseMatcher{StatusCode: "200"})
+	require.EqualError(t, err, "one of headers or body is required")
+
+	_, err = CompileResponseMatcher(ResponseMatcher{Body: "x", Weight: -1})
+	require.EqualError(t, err, "invalid weight -1: must be positive")
+
+	_, err = CompileResponseMatcher(ResponseMatcher{Headers: []HeaderRegexp{{Regexp: "x"}}})
+	require.EqualError(t, err, "header name is required")
+}
@@ -2,16 +2,187 @@
 package rules
 
 import (
+	"errors"
 	"fmt"
-	"log"
-	"regexp"
+	"net/http"
 	"time"
 )
 
-// Urlregexp struct.
+// Modes of the handlers.
+const (
+	// ModeEnforce blocks the requests, the default.
+	ModeEnforce = "enforce"
+	// ModeShadow counts the failures and bans as usual, but only logs the
+	// requests that would be blocked, letting them through.
+	ModeShadow = "shadow"
+)
+
+// Count modes of the rules.
+const (
+	// CountFailures counts the failures, told by the status codes and the
+	// other rules, the default.
+	CountFailures = "failures"
+	// CountRequests counts every request reaching the fail2ban stage, with its
+	// cost.
+	CountRequests = "requests"
+)
+
+// Urlregexp struct, a request matcher. All the set fields are regexps that
+// must match, and can be combined with any (or) and all (and).
 type Urlregexp struct {
-	Regexp string `yaml:"regexp"`
-	Mode   string `yaml:"mode"`
+	Regexp  string         `yaml:"regexp"` // matched against the full URL
+	Mode    string         `yaml:"mode"`   // only used on top level matchers
+	Weight  float64        `yaml:"weight"` // score of a failure counted by the count mode, default 1
+	Method  string         `yaml:"method"`
+	Host    string         `yaml:"host"`
+	Path    string         `yaml:"path"`
+	Query   string         `yaml:"query"`
+	Headers []HeaderRegexp `yaml:"headers"`
+	Not     bool           `yaml:"not"`  // inverts the match
+	Any     []Urlregexp    `yaml:"any"`  // at least one must match
+	All     []Urlregexp    `yaml:"all"`  // all must match
+	Trap    Trap           `yaml:"trap"` // only used by the trap mode
+}
+
+// Trap struct, the ban and the decoy response of a trap rule.
+type Trap struct {
+	Bantime     string `yaml:"bantime"`     // defaults to the rules bantime
+	StatusCode  int    `yaml:"statuscode"`  // defaults to 200
+	ContentType string `yaml:"contenttype"` // defaults to text/html
+	Body        string `yaml:"body"`
+}
+
+// TrapRule is a compiled trap rule.
+type TrapRule struct {
+	Matcher     *Matcher
+	Bantime     time.Duration
+	StatusCode  int
+	ContentType string
+	Body        string
+}
+
+// Tighten struct, stricter rules applied to the requests matching a list entry
+// with the tighten action. Empty fields default to the main rules.
+type Tighten struct {
+	Bantime  string `yaml:"bantime"`
+	Findtime string `yaml:"findtime"`
+	Maxretry int    `yaml:"maxretry"`
+}
+
+// StatusCodeWeight struct, the score of the failures with the given status
+// codes.
+type StatusCodeWeight struct {
+	Codes  string  `yaml:"codes"` // e.g. "404" or "401,403-499"
+	Weight float64 `yaml:"weight"`
+}
+
+// StatusCodeBucket struct, counts the failures with the given status codes
+// apart from the others, with their own maxretry.
+type StatusCodeBucket struct {
+	Codes    string `yaml:"codes"` // e.g. "404" or "401,403"
+	MaxRetry int    `yaml:"maxretry"`
+}
+
+// PathDiversity struct, bans the IPs requesting too many distinct paths
+// answered with the given status codes (e.g. vulnerability scanners).
+type PathDiversity struct {
+	StatusCode string `yaml:"statuscode"` // defaults to 404
+	Threshold  int    `yaml:"threshold"`  // distinct paths within findtime
+}
+
+// CredentialStuffing struct, locks the usernames with too many failed login
+// attempts, whatever the IPs they come from.
+type CredentialStuffing struct {
+	Routes      []Urlregexp `yaml:"routes"`      // the login routes
+	FormField   string      `yaml:"formfield"`   // username field of url encoded forms
+	JSONField   string      `yaml:"jsonfield"`   // username field of JSON bodies, e.g. "user.email"
+	BasicAuth   bool        `yaml:"basicauth"`   // read the username from the Basic auth
+	StatusCode  string      `yaml:"statuscode"`  // failed attempts, defaults to 401
+	Threshold   int         `yaml:"threshold"`   // failed attempts per username within findtime
+	Locktime    string      `yaml:"locktime"`    // defaults to the rules bantime
+	Penalty     float64     `yaml:"penalty"`     // score added to the IPs involved, defaults to 1
+	MaxBodySize int64       `yaml:"maxbodysize"` // defaults to 64KiB
+}
+
+// CredentialStuffingRule is a compiled CredentialStuffing.
+type CredentialStuffingRule struct {
+	Routes      []*Matcher
+	FormField   string
+	JSONField   string
+	BasicAuth   bool
+	StatusCode  string
+	Threshold   int
+	Findtime    time.Duration
+	Locktime    time.Duration
+	Penalty     float64
+	MaxBodySize int64
+}
+
+// Success struct, lowers the failures of the IPs getting successful responses
+// (e.g. a user logging in after mistyping a password).
+type Success struct {
+	Routes     []Urlregexp `yaml:"routes"`     // required, e.g. the login route
+	StatusCode string      `yaml:"statuscode"` // defaults to 200-299
+	Mode       string      `yaml:"mode"`       // reset (default) or decrement
+	Decrement  float64     `yaml:"decrement"`  // score removed in decrement mode, defaults to 1
+}
+
+// SuccessRule is a compiled Success.
+type SuccessRule struct {
+	Routes     []*Matcher
+	StatusCode string
+	// Reset forgets the failures, otherwise Decrement is removed from the
+	// score.
+	Reset     bool
+	Decrement float64
+}
+
+// Outcomes struct, counts the request outcomes a status code does not show as
+// failures. Each outcome is disabled when not set.
+type Outcomes struct {
+	Slow        *Outcome `yaml:"slow"`        // the backend answered after latency
+	Canceled    *Outcome `yaml:"canceled"`    // the client left before the response ended
+	ServerError *Outcome `yaml:"servererror"` // the backend failed on the request
+	// The slow and server error outcomes are not counted while the backend
+	// fails for everyone: at least OutageRatio of the requests (defaults to
+	// 0.5) from at least OutageClients clients (defaults to 5).
+	OutageRatio   float64 `yaml:"outageratio"`
+	OutageClients int     `yaml:"outageclients"`
+}
+
+// Outcome struct, a request outcome counted as a failure.
+type Outcome struct {
+	Latency    string  `yaml:"latency"`    // slow outcome only
+	StatusCode string  `yaml:"statuscode"` // server error outcome only, defaults to 500
+	Weight     float64 `yaml:"weight"`     // defaults to 1
+}
+
+// OutcomesRule is a compiled Outcomes. A weight of 0 disables the outcome.
+type OutcomesRule struct {
+	Latency           time.Duration
+	SlowWeight        float64
+	CanceledWeight    float64
+	ServerErrorCodes  string
+	ServerErrorWeight float64
+	OutageRatio       float64
+	OutageClients     int
+}
+
+// Escalation struct, slows down, then rejects, the IPs approaching the
+// threshold, before they get banned.
+type Escalation struct {
+	DelayAfter   float64 `yaml:"delayafter"`   // score from which the requests are delayed
+	Delay        string  `yaml:"delay"`        // delay of each request
+	RejectAfter  float64 `yaml:"rejectafter"`  // score from which the requests are rejected
+	MaxTarpitted int     `yaml:"maxtarpitted"` // requests delayed at the same time, defaults to 100
+}
+
+// EscalationRule is a compiled Escalation. A score of 0 disables the step.
+type EscalationRule struct {
+	DelayAfter   float64
+	Delay        time.Duration
+	RejectAfter  float64
+	MaxTarpitted int
 }
 
 // Rules struct fail2ban config.
@@ -22,60 +193,439 @@ type Rules struct {
 	Maxretry   int         `yaml:"maxretry"`
 	Urlregexps []Urlregexp `yaml:"urlregexps"`
 	StatusCode string      `yaml:"statuscode"`
+	Tighten    *Tighten    `yaml:"tighten"`
+	// Threshold is the score banning an IP, maxretry when empty.
+	Threshold          float64             `yaml:"threshold"`
+	StatusCodeWeights  []StatusCodeWeight  `yaml:"statuscodeweights"`
+	StatusCodes        []StatusCodeBucket  `yaml:"statuscodes"`
+	PathDiversity      *PathDiversity      `yaml:"pathdiversity"`
+	CredentialStuffing *CredentialStuffing `yaml:"credentialstuffing"`
+	Success            *Success            `yaml:"success"`
+	ResponseFailures   *ResponseFailures   `yaml:"responsefailures"`
+	Outcomes           *Outcomes           `yaml:"outcomes"`
+	Escalation         *Escalation         `yaml:"escalation"`
+	// Mode of the jail, enforce or shadow, defaults to the global mode.
+	Mode string `yaml:"mode"`
+	// CountMode is failures (default) or requests.
+	CountMode string `yaml:"countmode"`
+	// Costs of the requests in the requests count mode: the weight of the
+	// first matching rule (e.g. by method or path), 1 when none matches.
+	Costs []Urlregexp `yaml:"costs"`
 }
 
 // RulesTransformed transformed Rules struct.
 type RulesTransformed struct {
 	Bantime        time.Duration
 	Findtime       time.Duration
-	URLRegexpAllow []*regexp.Regexp
-	URLRegexpBan   []*regexp.Regexp
+	URLRegexpAllow []*Matcher
+	URLRegexpBan   []*Matcher
+	URLRegexpCount []*Matcher
+	URLTraps       []TrapRule
 	MaxRetry       int
 	Enabled        bool
 	StatusCode     string
+	// Threshold is the score banning an IP, MaxRetry when 0.
+	Threshold         float64
+	StatusCodeWeights []StatusCodeWeight
+	StatusCodes       []StatusCodeBucket
+	// PathDiversity is nil when not configured.
+	PathDiversity *PathDiversity
+	// CredentialStuffing is nil when not configured.
+	CredentialStuffing *CredentialStuffingRule
+	// Success is nil when not configured.
+	Success *SuccessRule
+	// ResponseFailures is nil when not configured.
+	ResponseFailures *ResponseFailuresRule
+	// Outcomes is nil when not configured.
+	Outcomes *OutcomesRule
+	// Escalation is nil when not configured.
+	Escalation *EscalationRule
+	// CountRequests counts every request, with the weight of the first
+	// matching Costs as its cost.
+	CountRequests bool
+	Costs         []*Matcher
+	// Tightened holds the stricter rules, nil when not configured.
+	Tightened *RulesTransformed
 }
 
-// TransformRule morph a Rules object into a RulesTransformed.
+// TransformRule morph a Rules object into a RulesTransformed. It returns every
+// problem found, prefixed by its field path.
 func TransformRule(r Rules) (RulesTransformed, error) {
-	bantime, err := time.ParseDuration(r.Bantime)
-	if err != nil {
-		return RulesTransformed{}, fmt.Errorf("failed to parse bantime duration: %w", err)
+	var p problems
+
+	rules := RulesTransformed{
+		Bantime:   p.requiredDuration("bantime", r.Bantime),
+		Findtime:  p.requiredDuration("findtime", r.Findtime),
+		MaxRetry:  r.Maxretry,
+		Enabled:   r.Enabled,
+		Threshold: r.Threshold,
+		// The status codes are parsed by the status handler.
+		StatusCode:        r.StatusCode,
+		StatusCodeWeights: r.StatusCodeWeights,
+		StatusCodes:       r.StatusCodes,
 	}
 
-	findtime, err := time.ParseDuration(r.Findtime)
-	if err != nil {
-		return RulesTransformed{}, fmt.Errorf("failed to parse findtime duration: %w", err)
+	if r.Maxretry < 0 {
+		p.errorf("maxretry", "must be positive, got %d", r.Maxretry)
 	}
 
-	var regexpAllow []*regexp.Regexp
+	if r.Threshold < 0 {
+		p.errorf("threshold", "must be positive, got %v", r.Threshold)
+	}
 
-	var regexpBan []*regexp.Regexp
+	for i, rg := range r.Urlregexps {
+		transformURLRegexp(&p, fmt.Sprintf("urlregexps[%d]", i), rg, &rules)
+	}
+
+	switch r.CountMode {
+	case "", CountFailures:
+	case CountRequests:
+		rules.CountRequests = true
+	default:
+		p.errorf("countmode", "unknown count mode %q, expecting %s or %s", r.CountMode, CountFailures, CountRequests)
+	}
 
-	for _, rg := range r.Urlregexps {
-		re, err := regexp.Compile(rg.Regexp)
-		if err != nil {
-			return RulesTransformed{}, fmt.Errorf("failed to compile regexp %q: %w", rg.Regexp, err)
+	rules.Costs = p.matchers("costs", r.Costs)
+
+	for i, w := range r.StatusCodeWeights {
+		if w.Weight <= 0 {
+			p.errorf(fmt.Sprintf("statuscodeweights[%d].weight", i), "must be positive, got %v", w.Weight)
 		}
+	}
 
-		switch rg.Mode {
-		case "allow":
-			regexpAllow = append(regexpAllow, re)
-		case "block":
-			regexpBan = append(regexpBan, re)
-		default:
-			log.Printf("mode %q is not known, the rule %q cannot not be applied", rg.Mode, rg.Regexp)
+	for i, b := range r.StatusCodes {
+		if b.MaxRetry <= 0 {
+			p.errorf(fmt.Sprintf("statuscodes[%d].maxretry", i), "must be positive, got %d", b.MaxRetry)
 		}
 	}
 
-	rules := RulesTransformed{
-		Bantime:        bantime,
-		Findtime:       findtime,
-		URLRegexpAllow: regexpAllow,
-		URLRegexpBan:   regexpBan,
-		MaxRetry:       r.Maxretry,
-		Enabled:        r.Enabled,
-		StatusCode:     r.StatusCode,
+	if r.PathDiversity != nil {
+		if r.PathDiversity.Threshold <= 0 {
+			p.errorf("pathdiversity.threshold", "must be positive, got %d", r.PathDiversity.Threshold)
+		}
+
+		pd := *r.PathDiversity
+		if pd.StatusCode == "" {
+			pd.StatusCode = "404"
+		}
+
+		rules.PathDiversity = &pd
+	}
+
+	if r.CredentialStuffing != nil {
+		cs := transformCredentialStuffing(&p, "credentialstuffing", *r.CredentialStuffing, rules.Bantime, rules.Findtime)
+		rules.CredentialStuffing = &cs
+	}
+
+	if r.Success != nil {
+		success := transformSuccess(&p, "success", *r.Success)
+		rules.Success = &success
+	}
+
+	if r.ResponseFailures != nil {
+		rf := transformResponseFailures(&p, "responsefailures", *r.ResponseFailures)
+		rules.ResponseFailures = &rf
+	}
+
+	if r.Outcomes != nil {
+		outcomes := transformOutcomes(&p, "outcomes", *r.Outcomes)
+		rules.Outcomes = &outcomes
+	}
+
+	if r.Escalation != nil {
+		escalation := transformEscalation(&p, "escalation", *r.Escalation)
+		rules.Escalation = &escalation
+	}
+
+	if r.Tighten != nil {
+		tightened := transformTighten(&p, "tighten", rules, *r.Tighten)
+		rules.Tightened = &tightened
+	}
+
+	if len(p) > 0 {
+		return RulesTransformed{}, errors.Join(p...)
 	}
 
 	return rules, nil
 }
+
+// urlModes lists the modes of the top level matchers, for the errors.
+const urlModes = "allow, block, count, watch or trap"
+
+// transformURLRegexp compiles a top level matcher into the rules of its mode.
+func transformURLRegexp(p *problems, path string, rg Urlregexp, rules *RulesTransformed) {
+	switch rg.Mode {
+	case "allow", "block", "count", "watch", "trap":
+	case "":
+		p.errorf(path+".mode", "must be set to one of %s", urlModes)
+	default:
+		p.errorf(path+".mode", "unknown mode %q, expecting one of %s", rg.Mode, urlModes)
+	}
+
+	var trap TrapRule
+	if rg.Mode == "trap" {
+		trap = transformTrap(p, path+".trap", rg.Trap, rules.Bantime)
+	}
+
+	re, err := CompileMatcher(rg)
+	if err != nil {
+		p.errorf(path, "%v", err)
+
+		return
+	}
+
+	switch rg.Mode {
+	case "allow":
+		rules.URLRegexpAllow = append(rules.URLRegexpAllow, re)
+	case "block":
+		rules.URLRegexpBan = append(rules.URLRegexpBan, re)
+	case "count", "watch":
+		rules.URLRegexpCount = append(rules.URLRegexpCount, re)
+	case "trap":
+		trap.Matcher = re
+		rules.URLTraps = append(rules.URLTraps, trap)
+	}
+}
+
+// transformTrap applies the trap defaults.
+func transformTrap(p *problems, path string, t Trap, bantime time.Duration) TrapRule {
+	trap := TrapRule{
+		Bantime:     bantime,
+		StatusCode:  t.StatusCode,
+		ContentType: t.ContentType,
+		Body:        t.Body,
+	}
+
+	if t.Bantime != "" {
+		trap.Bantime = p.requiredDuration(path+".bantime", t.Bantime)
+	}
+
+	switch {
+	case trap.StatusCode == 0:
+		trap.StatusCode = http.StatusOK
+	case trap.StatusCode < 100 || trap.StatusCode > 599:
+		p.errorf(path+".statuscode", "status code %d out of the 100-599 range", trap.StatusCode)
+	}
+
+	if trap.ContentType == "" {
+		trap.ContentType = "text/html; charset=utf-8"
+	}
+
+	return trap
+}
+
+// defaultMaxBodySize is the default size of the login request bodies read to
+// find the username.
+const defaultMaxBodySize = 64 * 1024
+
+// transformCredentialStuffing applies the credential stuffing defaults.
+func transformCredentialStuffing(p *problems, path string, c CredentialStuffing, bantime, findtime time.Duration) CredentialStuffingRule {
+	if len(c.Routes) == 0 {
+		p.errorf(path+".routes", "must be set")
+	}
+
+	if c.FormField == "" && c.JSONField == "" && !c.BasicAuth {
+		p.errorf(path, "one of formfield, jsonfield or basicauth must be set")
+	}
+
+	if c.Threshold <= 0 {
+		p.errorf(path+".threshold", "must be positive, got %d", c.Threshold)
+	}
+
+	if c.Penalty < 0 {
+		p.errorf(path+".penalty", "must be positive, got %v", c.Penalty)
+	}
+
+	if c.MaxBodySize < 0 {
+		p.errorf(path+".maxbodysize", "must be positive, got %d", c.MaxBodySize)
+	}
+
+	cs := CredentialStuffingRule{
+		Routes:      p.matchers(path+".routes", c.Routes),
+		FormField:   c.FormField,
+		JSONField:   c.JSONField,
+		BasicAuth:   c.BasicAuth,
+		StatusCode:  c.StatusCode,
+		Threshold:   c.Threshold,
+		Findtime:    findtime,
+		Locktime:    bantime,
+		Penalty:     c.Penalty,
+		MaxBodySize: c.MaxBodySize,
+	}
+
+	if c.Locktime != "" {
+		cs.Locktime = p.requiredDuration(path+".locktime", c.Locktime)
+	}
+
+	if cs.StatusCode == "" {
+		cs.StatusCode = "401"
+	}
+
+	if cs.Penalty == 0 {
+		cs.Penalty = 1
+	}
+
+	if cs.MaxBodySize == 0 {
+		cs.MaxBodySize = defaultMaxBodySize
+	}
+
+	return cs
+}
+
+// transformTighten overrides the rules with the non empty fields of t.
+func transformTighten(p *problems, path string, rules RulesTransformed, t Tighten) RulesTransformed {
+	if t.Bantime != "" {
+		rules.Bantime = p.requiredDuration(path+".bantime", t.Bantime)
+	}
+
+	if t.Findtime != "" {
+		rules.Findtime = p.requiredDuration(path+".findtime", t.Findtime)
+	}
+
+	switch {
+	case t.Maxretry < 0:
+		p.errorf(path+".maxretry", "must be positive, got %d", t.Maxretry)
+	case t.Maxretry > 0:
+		rules.MaxRetry = t.Maxretry
+		rules.Threshold = 0
+	}
+
+	return rules
+}
+
+// transformSuccess applies the success defaults.
+func transformSuccess(p *problems, path string, s Success) SuccessRule {
+	// Every successful request lowering the failures, a client would reset
+	// them with any page between two failures.
+	if len(s.Routes) == 0 {
+		p.errorf(path+".routes", "must be set")
+	}
+
+	success := SuccessRule{
+		Routes:     p.matchers(path+".routes", s.Routes),
+		StatusCode: s.StatusCode,
+		Decrement:  s.Decrement,
+	}
+
+	switch s.Mode {
+	case "", "reset":
+		success.Reset = true
+	case "decrement":
+	default:
+		p.errorf(path+".mode", "unknown mode %q, expecting reset or decrement", s.Mode)
+	}
+
+	if success.Decrement < 0 {
+		p.errorf(path+".decrement", "must be positive, got %v", success.Decrement)
+	}
+
+	if success.StatusCode == "" {
+		success.StatusCode = "200-299"
+	}
+
+	if success.Decrement == 0 {
+		success.Decrement = 1
+	}
+
+	return success
+}
+
+// transformOutcomes applies the outcomes defaults.
+func transformOutcomes(p *problems, path string, o Outcomes) OutcomesRule {
+	outcomes := OutcomesRule{
+		OutageRatio:   o.OutageRatio,
+		OutageClients: o.OutageClients,
+	}
+
+	if o.Slow != nil {
+		outcomes.Latency = p.requiredDuration(path+".slow.latency", o.Slow.Latency)
+		outcomes.SlowWeight = outcomeWeight(p, path+".slow", *o.Slow)
+	}
+
+	if o.Canceled != nil {
+		outcomes.CanceledWeight = outcomeWeight(p, path+".canceled", *o.Canceled)
+	}
+
+	if o.ServerError != nil {
+		outcomes.ServerErrorCodes = o.ServerError.StatusCode
+		if outcomes.ServerErrorCodes == "" {
+			outcomes.ServerErrorCodes = "500"
+		}
+
+		outcomes.ServerErrorWeight = outcomeWeight(p, path+".servererror", *o.ServerError)
+	}
+
+	if outcomes.OutageRatio < 0 || outcomes.OutageRatio > 1 {
+		p.errorf(path+".outageratio", "must be between 0 and 1, got %v", outcomes.OutageRatio)
+	}
+
+	if outcomes.OutageRatio == 0 {
+		outcomes.OutageRatio = 0.5
+	}
+
+	if outcomes.OutageClients < 0 {
+		p.errorf(path+".outageclients", "must be positive, got %d", outcomes.OutageClients)
+	}
+
+	if outcomes.OutageClients == 0 {
+		outcomes.OutageClients = 5
+	}
+
+	return outcomes
+}
+
+func outcomeWeight(p *problems, path string, o Outcome) float64 {
+	switch {
+	case o.Weight < 0:
+		p.errorf(path+".weight", "must be positive, got %v", o.Weight)
+	case o.Weight == 0:
+		return 1
+	}
+
+	return o.Weight
+}
+
+// defaultMaxTarpitted is the default number of requests delayed at the same
+// time.
+const defaultMaxTarpitted = 100
+
+// MaxDelayed returns the cap of the requests delayed at the same time, by the
+// escalation or the denylist delay action.
+func (r RulesTransformed) MaxDelayed() int {
+	if r.Escalation != nil {
+		return r.Escalation.MaxTarpitted
+	}
+
+	return defaultMaxTarpitted
+}
+
+// transformEscalation applies the escalation defaults.
+func transformEscalation(p *problems, path string, e Escalation) EscalationRule {
+	if e.DelayAfter < 0 {
+		p.errorf(path+".delayafter", "must be positive, got %v", e.DelayAfter)
+	}
+
+	if e.RejectAfter < 0 {
+		p.errorf(path+".rejectafter", "must be positive, got %v", e.RejectAfter)
+	}
+
+	if e.MaxTarpitted < 0 {
+		p.errorf(path+".maxtarpitted", "must be positive, got %d", e.MaxTarpitted)
+	}
+
+	escalation := EscalationRule{
+		DelayAfter:   e.DelayAfter,
+		RejectAfter:  e.RejectAfter,
+		MaxTarpitted: e.MaxTarpitted,
+	}
+
+	if e.DelayAfter > 0 {
+		escalation.Delay = p.requiredDuration(path+".delay", e.Delay)
+	}
+
+	if escalation.MaxTarpitted == 0 {
+		escalation.MaxTarpitted = defaultMaxTarpitted
+	}
+
+	return escalation
+}
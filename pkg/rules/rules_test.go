@@ -1,6 +1,12 @@
 package rules
 
-import "testing"
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
 
 func TestTransformRules(t *testing.T) {
 	t.Parallel()
@@ -38,3 +44,94 @@ func TestTransformRules(t *testing.T) {
 		})
 	}
 }
+
+func TestTransformRuleCountMode(t *testing.T) {
+	t.Parallel()
+
+	got, err := TransformRule(Rules{Bantime: "300s", Findtime: "120s"})
+	require.NoError(t, err)
+	assert.False(t, got.CountRequests)
+
+	got, err = TransformRule(Rules{
+		Bantime:   "300s",
+		Findtime:  "120s",
+		CountMode: CountRequests,
+		Costs:     []Urlregexp{{Method: "^POST$", Weight: 2}},
+		Tighten:   &Tighten{Maxretry: 2},
+	})
+	require.NoError(t, err)
+	assert.True(t, got.CountRequests)
+	require.Len(t, got.Costs, 1)
+	assert.InDelta(t, 2, got.Costs[0].Weight(), 0)
+	// The tightened rules count the requests too.
+	assert.True(t, got.Tightened.CountRequests)
+
+	_, err = TransformRule(Rules{Bantime: "300s", Findtime: "120s", CountMode: "everything"})
+	require.EqualError(t, err, `countmode: unknown count mode "everything", expecting failures or requests`)
+
+	_, err = TransformRule(Rules{Bantime: "300s", Findtime: "120s", Costs: []Urlregexp{{Path: "(static"}}})
+	require.Error(t, err)
+}
+
+func TestTransformRuleSuccess(t *testing.T) {
+	t.Parallel()
+
+	got, err := TransformRule(Rules{
+		Bantime:  "300s",
+		Findtime: "120s",
+		Success:  &Success{Routes: []Urlregexp{{Path: "^/login$"}}},
+	})
+	require.NoError(t, err)
+	require.NotNil(t, got.Success)
+	assert.Len(t, got.Success.Routes, 1)
+	assert.Equal(t, "200-299", got.Success.StatusCode)
+	assert.True(t, got.Success.Reset)
+
+	// Every successful request would reset the failures.
+	_, err = TransformRule(Rules{Bantime: "300s", Findtime: "120s", Success: &Success{}})
+	require.EqualError(t, err, "success.routes: must be set")
+}
+
+func TestTransformRuleErrors(t *testing.T) {
+	t.Parallel()
+
+	// Every problem is reported, with its field path.
+	_, err := TransformRule(Rules{
+		Bantime:   "3 hours",
+		Findtime:  "120s",
+		Threshold: -1,
+		Urlregexps: []Urlregexp{
+			{Path: "^/admin$", Mode: "trap", Trap: Trap{StatusCode: 999}},
+			{Path: "(admin", Mode: "block"},
+		},
+		StatusCodes: []StatusCodeBucket{{Codes: "404"}},
+		Escalation:  &Escalation{DelayAfter: 2},
+		Tighten:     &Tighten{Maxretry: -1},
+	})
+	require.EqualError(t, err, strings.Join([]string{
+		`bantime: invalid duration "3 hours"`,
+		`threshold: must be positive, got -1`,
+		`urlregexps[0].trap.statuscode: status code 999 out of the 100-599 range`,
+		`urlregexps[1]: failed to compile path regexp "(admin": error parsing regexp: missing closing ): ` + "`(admin`",
+		`statuscodes[0].maxretry: must be positive, got 0`,
+		`escalation.delay: must be set`,
+		`tighten.maxretry: must be positive, got -1`,
+	}, "\n"))
+}
+
+func TestMaxDelayed(t *testing.T) {
+	t.Parallel()
+
+	// The denylist delays are capped without escalation too.
+	got, err := TransformRule(Rules{Bantime: "300s", Findtime: "120s"})
+	require.NoError(t, err)
+	assert.Equal(t, defaultMaxTarpitted, got.MaxDelayed())
+
+	got, err = TransformRule(Rules{
+		Bantime:    "300s",
+		Findtime:   "120s",
+		Escalation: &Escalation{RejectAfter: 8, MaxTarpitted: 10},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 10, got.MaxDelayed())
+}
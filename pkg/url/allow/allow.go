@@ -3,22 +3,22 @@ package allow
 
 import (
 	"net/http"
-	"regexp"
 
 	"github.com/tomMoulard/fail2ban/pkg/chain"
+	"github.com/tomMoulard/fail2ban/pkg/rules"
 )
 
 type allow struct {
-	regs []*regexp.Regexp
+	regs []*rules.Matcher
 }
 
-func New(regs []*regexp.Regexp) *allow {
+func New(regs []*rules.Matcher) *allow {
 	return &allow{regs: regs}
 }
 
 func (a *allow) ServeHTTP(w http.ResponseWriter, r *http.Request) (*chain.Status, error) {
 	for _, reg := range a.regs {
-		if reg.MatchString(r.URL.String()) {
+		if reg.Match(r) {
 			return &chain.Status{Break: true}, nil
 		}
 	}
@@ -3,13 +3,13 @@ package allow
 import (
 	"net/http"
 	"net/http/httptest"
-	"regexp"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/tomMoulard/fail2ban/pkg/chain"
 	"github.com/tomMoulard/fail2ban/pkg/data"
+	"github.com/tomMoulard/fail2ban/pkg/rules"
 )
 
 func TestAllow(t *testing.T) {
@@ -17,16 +17,27 @@ func TestAllow(t *testing.T) {
 
 	tests := []struct {
 		name           string
-		regs           []*regexp.Regexp
+		matchers       []rules.Urlregexp
 		expectedStatus *chain.Status
 	}{
 		{
-			name: "allowed",
-			regs: []*regexp.Regexp{regexp.MustCompile(`^https://example.com/foo$`)},
+			name:     "allowed",
+			matchers: []rules.Urlregexp{{Regexp: `^https://example.com/foo$`}},
 			expectedStatus: &chain.Status{
 				Break: true,
 			},
 		},
+		{
+			name:     "allowed by method and path",
+			matchers: []rules.Urlregexp{{Method: `^GET$`, Path: `^/foo$`}},
+			expectedStatus: &chain.Status{
+				Break: true,
+			},
+		},
+		{
+			name:     "other method",
+			matchers: []rules.Urlregexp{{Method: `^POST$`, Path: `^/foo$`}},
+		},
 		{
 			name: "denied",
 		},
@@ -36,11 +47,14 @@ func TestAllow(t *testing.T) {
 		t.Run(test.name, func(t *testing.T) {
 			t.Parallel()
 
-			a := New(test.regs)
+			matchers, err := rules.CompileMatchers(test.matchers)
+			require.NoError(t, err)
+
+			a := New(matchers)
 
 			recorder := &httptest.ResponseRecorder{}
 			req := httptest.NewRequest(http.MethodGet, "https://example.com/foo", nil)
-			req, err := data.ServeHTTP(recorder, req, "")
+			req, err = data.ServeHTTP(recorder, req, "")
 			require.NoError(t, err)
 
 			got, err := a.ServeHTTP(recorder, req)
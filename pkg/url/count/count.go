@@ -0,0 +1,65 @@
+// Package count is a middleware that counts failures for the requests matching
+// a list of rules.
+package count
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/tomMoulard/fail2ban/pkg/chain"
+	"github.com/tomMoulard/fail2ban/pkg/data"
+	"github.com/tomMoulard/fail2ban/pkg/fail2ban"
+	"github.com/tomMoulard/fail2ban/pkg/logger"
+	"github.com/tomMoulard/fail2ban/pkg/rules"
+)
+
+type count struct {
+	regs            []*rules.Matcher
+	f2b             *fail2ban.Fail2Ban
+	enableBlockLogs bool
+}
+
+func New(regs []*rules.Matcher, f2b *fail2ban.Fail2Ban, enableBlockLogs bool) *count {
+	return &count{
+		regs:            regs,
+		f2b:             f2b,
+		enableBlockLogs: enableBlockLogs,
+	}
+}
+
+func (c *count) ServeHTTP(w http.ResponseWriter, r *http.Request) (*chain.Status, error) {
+	reqData := data.GetData(r)
+	if reqData == nil {
+		return nil, errors.New("failed to get data from request context")
+	}
+
+	f2b := c.f2b.For(reqData)
+
+	for _, reg := range c.regs {
+		if !reg.Match(r) {
+			continue
+		}
+
+		if f2b.AddFailure(reqData.RemoteIP, reg.Weight()) {
+			continue
+		}
+
+		if c.enableBlockLogs {
+			logger.Info(logger.Blocked(reqData.Shadow),
+				logger.WithIP(reqData.RemoteIP),
+				logger.WithCountry(reqData.Country),
+				logger.WithASN(reqData.ASN),
+				logger.WithReason("url count rule: "+reg.String()),
+				logger.WithScore(f2b.Score(reqData.RemoteIP)),
+				logger.WithStatusCode(http.StatusTooManyRequests),
+				logger.WithMethod(r.Method),
+				logger.WithPath(r.URL.Path),
+				logger.WithUA(r.UserAgent()),
+			)
+		}
+
+		return &chain.Status{Return: true}, nil
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,96 @@
+package count
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tomMoulard/fail2ban/pkg/chain"
+	"github.com/tomMoulard/fail2ban/pkg/data"
+	"github.com/tomMoulard/fail2ban/pkg/fail2ban"
+	"github.com/tomMoulard/fail2ban/pkg/rules"
+)
+
+func TestCount(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name           string
+		matchers       []rules.Urlregexp
+		expectedStatus []*chain.Status
+		expectedCount  int
+		expectedScore  float64
+	}{
+		{
+			name:     "counted",
+			matchers: []rules.Urlregexp{{Path: `^/wp-login\.php$`}},
+			expectedStatus: []*chain.Status{
+				nil,
+				nil,
+				{Return: true},
+			},
+			expectedCount: 3,
+			expectedScore: 3,
+		},
+		{
+			name:     "weighted",
+			matchers: []rules.Urlregexp{{Path: `^/wp-login\.php$`, Weight: 2}},
+			expectedStatus: []*chain.Status{
+				nil,
+				{Return: true},
+				{Return: true},
+			},
+			expectedCount: 3,
+			expectedScore: 6,
+		},
+		{
+			name:     "fractional weight",
+			matchers: []rules.Urlregexp{{Path: `^/wp-login\.php$`, Weight: 0.5}},
+			expectedStatus: []*chain.Status{
+				nil,
+				nil,
+				nil,
+			},
+			expectedCount: 3,
+			expectedScore: 1.5,
+		},
+		{
+			name:           "not matching",
+			matchers:       []rules.Urlregexp{{Path: `^/admin$`}},
+			expectedStatus: []*chain.Status{nil, nil, nil},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			matchers, err := rules.CompileMatchers(test.matchers)
+			require.NoError(t, err)
+
+			f2b := fail2ban.New(rules.RulesTransformed{
+				MaxRetry: 3,
+				Findtime: 300 * time.Second,
+				Bantime:  300 * time.Second,
+			}, nil)
+			c := New(matchers, f2b, true)
+
+			for i, expected := range test.expectedStatus {
+				recorder := &httptest.ResponseRecorder{}
+				req := httptest.NewRequest(http.MethodGet, "https://example.com/wp-login.php", nil)
+				req, err := data.ServeHTTP(recorder, req, "")
+				require.NoError(t, err)
+
+				got, err := c.ServeHTTP(recorder, req)
+				require.NoError(t, err)
+				assert.Equal(t, expected, got, "request [%d]", i)
+			}
+
+			assert.Equal(t, test.expectedCount, f2b.IPs["192.0.2.1"].Count)
+			assert.InDelta(t, test.expectedScore, f2b.Score("192.0.2.1"), 0)
+		})
+	}
+}
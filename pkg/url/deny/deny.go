@@ -4,23 +4,21 @@ package deny
 import (
 	"errors"
 	"net/http"
-	"regexp"
 
 	"github.com/tomMoulard/fail2ban/pkg/chain"
 	"github.com/tomMoulard/fail2ban/pkg/data"
 	"github.com/tomMoulard/fail2ban/pkg/fail2ban"
-	"github.com/tomMoulard/fail2ban/pkg/ipchecking"
 	"github.com/tomMoulard/fail2ban/pkg/logger"
-	"github.com/tomMoulard/fail2ban/pkg/utils/time"
+	"github.com/tomMoulard/fail2ban/pkg/rules"
 )
 
 type deny struct {
-	regs            []*regexp.Regexp
+	regs            []*rules.Matcher
 	f2b             *fail2ban.Fail2Ban
 	enableBlockLogs bool
 }
 
-func New(regs []*regexp.Regexp, f2b *fail2ban.Fail2Ban, enableBlockLogs bool) *deny {
+func New(regs []*rules.Matcher, f2b *fail2ban.Fail2Ban, enableBlockLogs bool) *deny {
 	return &deny{
 		regs:            regs,
 		f2b:             f2b,
@@ -34,22 +32,15 @@ func (d *deny) ServeHTTP(w http.ResponseWriter, r *http.Request) (*chain.Status,
 		return nil, errors.New("failed to get data from request context")
 	}
 
-	d.f2b.MuIP.Lock()
-	defer d.f2b.MuIP.Unlock()
-
-	ip := d.f2b.IPs[reqData.RemoteIP]
-
 	for _, reg := range d.regs {
-		if reg.MatchString(r.URL.String()) {
-			d.f2b.IPs[reqData.RemoteIP] = ipchecking.IPViewed{
-				Viewed: time.Now(),
-				Count:  ip.Count + 1,
-				Denied: true,
-			}
+		if reg.Match(r) {
+			d.f2b.For(reqData).Ban(reqData.RemoteIP, 0)
 
 			if d.enableBlockLogs {
-				logger.Info("Plugin: FailToBan: IP blocked",
+				logger.Info(logger.Blocked(reqData.Shadow),
 					logger.WithIP(reqData.RemoteIP),
+					logger.WithCountry(reqData.Country),
+					logger.WithASN(reqData.ASN),
 					logger.WithReason("url rule: "+reg.String()),
 					logger.WithStatusCode(http.StatusTooManyRequests),
 					logger.WithMethod(r.Method),
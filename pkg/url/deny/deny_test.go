@@ -3,13 +3,14 @@ package deny
 import (
 	"net/http"
 	"net/http/httptest"
-	"regexp"
 	"testing"
+	gotime "time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/tomMoulard/fail2ban/pkg/chain"
 	"github.com/tomMoulard/fail2ban/pkg/data"
+	"github.com/tomMoulard/fail2ban/pkg/events"
 	"github.com/tomMoulard/fail2ban/pkg/fail2ban"
 	"github.com/tomMoulard/fail2ban/pkg/ipchecking"
 	"github.com/tomMoulard/fail2ban/pkg/rules"
@@ -21,13 +22,13 @@ func TestDeny(t *testing.T) {
 
 	tests := []struct {
 		name             string
-		regs             []*regexp.Regexp
+		matchers         []rules.Urlregexp
 		expectedStatus   *chain.Status
 		expectedIPViewed map[string]ipchecking.IPViewed
 	}{
 		{
-			name: "denied",
-			regs: []*regexp.Regexp{regexp.MustCompile(`^https://example.com/foo$`)},
+			name:     "denied",
+			matchers: []rules.Urlregexp{{Regexp: `^https://example.com/foo$`}},
 			expectedStatus: &chain.Status{
 				Return: true,
 			},
@@ -39,6 +40,25 @@ func TestDeny(t *testing.T) {
 				},
 			},
 		},
+		{
+			name:     "denied by host",
+			matchers: []rules.Urlregexp{{Host: `^example\.com$`}},
+			expectedStatus: &chain.Status{
+				Return: true,
+			},
+			expectedIPViewed: map[string]ipchecking.IPViewed{
+				"192.0.2.1": {
+					Viewed: time.Now(),
+					Count:  1,
+					Denied: true,
+				},
+			},
+		},
+		{
+			name:             "not denied by negated matcher",
+			matchers:         []rules.Urlregexp{{Path: `^/foo$`, Not: true}},
+			expectedIPViewed: map[string]ipchecking.IPViewed{},
+		},
 		{
 			name:             "not denied",
 			expectedIPViewed: map[string]ipchecking.IPViewed{},
@@ -49,12 +69,15 @@ func TestDeny(t *testing.T) {
 		t.Run(test.name, func(t *testing.T) {
 			t.Parallel()
 
+			matchers, err := rules.CompileMatchers(test.matchers)
+			require.NoError(t, err)
+
 			f2b := fail2ban.New(rules.RulesTransformed{}, nil)
-			d := New(test.regs, f2b, true)
+			d := New(matchers, f2b, true)
 
 			recorder := &httptest.ResponseRecorder{}
 			req := httptest.NewRequest(http.MethodGet, "https://example.com/foo", nil)
-			req, err := data.ServeHTTP(recorder, req, "")
+			req, err = data.ServeHTTP(recorder, req, "")
 			require.NoError(t, err)
 
 			got, err := d.ServeHTTP(recorder, req)
@@ -73,3 +96,47 @@ func TestDeny(t *testing.T) {
 		})
 	}
 }
+
+func TestDenyBannedIP(t *testing.T) {
+	t.Parallel()
+
+	f2b := fail2ban.New(rules.RulesTransformed{Bantime: 300 * gotime.Second}, nil)
+
+	recorder := &eventRecorder{}
+	bus := events.New("jail")
+	bus.Subscribe(recorder)
+	f2b.WithEvents(bus)
+
+	// Banned by a trap.
+	f2b.Ban("192.0.2.1", 72*gotime.Hour)
+	banned := f2b.IPs["192.0.2.1"]
+
+	matcher, err := rules.CompileMatcher(rules.Urlregexp{Path: `^/foo$`})
+	require.NoError(t, err)
+
+	d := New([]*rules.Matcher{matcher}, f2b, true)
+
+	for range 3 {
+		req := httptest.NewRequest(http.MethodGet, "https://example.com/foo", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req, err := data.ServeHTTP(nil, req, "")
+		require.NoError(t, err)
+
+		got, err := d.ServeHTTP(nil, req)
+		require.NoError(t, err)
+		assert.Equal(t, &chain.Status{Return: true}, got)
+	}
+
+	// The block URL does not cut the ban down to the rules bantime.
+	assert.Equal(t, banned.Viewed, f2b.IPs["192.0.2.1"].Viewed)
+	assert.Equal(t, 72*gotime.Hour, f2b.IPs["192.0.2.1"].Bantime)
+	assert.Len(t, recorder.events, 1)
+}
+
+type eventRecorder struct {
+	events []events.Event
+}
+
+func (r *eventRecorder) Send(e events.Event) {
+	r.events = append(r.events, e)
+}
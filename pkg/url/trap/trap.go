@@ -0,0 +1,74 @@
+// Package trap is a middleware that bans the clients requesting honeypot URLs,
+// and answers them with a decoy.
+package trap
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/tomMoulard/fail2ban/pkg/chain"
+	"github.com/tomMoulard/fail2ban/pkg/data"
+	"github.com/tomMoulard/fail2ban/pkg/fail2ban"
+	"github.com/tomMoulard/fail2ban/pkg/logger"
+	"github.com/tomMoulard/fail2ban/pkg/rules"
+)
+
+type trap struct {
+	traps           []rules.TrapRule
+	f2b             *fail2ban.Fail2Ban
+	enableBlockLogs bool
+}
+
+func New(traps []rules.TrapRule, f2b *fail2ban.Fail2Ban, enableBlockLogs bool) *trap {
+	return &trap{
+		traps:           traps,
+		f2b:             f2b,
+		enableBlockLogs: enableBlockLogs,
+	}
+}
+
+func (t *trap) ServeHTTP(w http.ResponseWriter, r *http.Request) (*chain.Status, error) {
+	reqData := data.GetData(r)
+	if reqData == nil {
+		return nil, errors.New("failed to get data from request context")
+	}
+
+	for _, trap := range t.traps {
+		if !trap.Matcher.Match(r) {
+			continue
+		}
+
+		t.f2b.For(reqData).Ban(reqData.RemoteIP, trap.Bantime)
+
+		if t.enableBlockLogs {
+			logger.Info(logger.Blocked(reqData.Shadow),
+				logger.WithIP(reqData.RemoteIP),
+				logger.WithCountry(reqData.Country),
+				logger.WithASN(reqData.ASN),
+				logger.WithReason("trap: "+trap.Matcher.String()),
+				logger.WithStatusCode(trap.StatusCode),
+				logger.WithMethod(r.Method),
+				logger.WithPath(r.URL.Path),
+				logger.WithUA(r.UserAgent()),
+			)
+		}
+
+		return &chain.Status{Return: true, Response: decoy(trap)}, nil
+	}
+
+	return nil, nil
+}
+
+// decoy returns the handler writing the decoy response of the trap.
+func decoy(trap rules.TrapRule) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", trap.ContentType)
+		w.WriteHeader(trap.StatusCode)
+
+		if _, err := w.Write([]byte(trap.Body)); err != nil {
+			logger.Error("Plugin: FailToBan: failed to write response",
+				logger.WithErr(err.Error()),
+			)
+		}
+	})
+}
@@ -0,0 +1,86 @@
+package trap
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tomMoulard/fail2ban/pkg/data"
+	"github.com/tomMoulard/fail2ban/pkg/fail2ban"
+	"github.com/tomMoulard/fail2ban/pkg/rules"
+)
+
+func TestTrap(t *testing.T) {
+	t.Parallel()
+
+	matcher, err := rules.CompileMatcher(rules.Urlregexp{Path: `^/\.git/config$`})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name            string
+		url             string
+		expectedReturn  bool
+		expectedBanned  bool
+		expectedBantime time.Duration
+	}{
+		{
+			name:            "trapped",
+			url:             "https://example.com/.git/config",
+			expectedReturn:  true,
+			expectedBanned:  true,
+			expectedBantime: 72 * time.Hour,
+		},
+		{
+			name: "not trapped",
+			url:  "https://example.com/foo",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			f2b := fail2ban.New(rules.RulesTransformed{
+				MaxRetry: 3,
+				Findtime: 300 * time.Second,
+				Bantime:  300 * time.Second,
+			}, nil)
+			tr := New([]rules.TrapRule{{
+				Matcher:     matcher,
+				Bantime:     72 * time.Hour,
+				StatusCode:  http.StatusOK,
+				ContentType: "text/plain",
+				Body:        "[core]",
+			}}, f2b, true)
+
+			recorder := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, test.url, nil)
+			req, err := data.ServeHTTP(recorder, req, "")
+			require.NoError(t, err)
+
+			got, err := tr.ServeHTTP(recorder, req)
+			require.NoError(t, err)
+
+			assert.Equal(t, test.expectedBanned, f2b.IPs["192.0.2.1"].Denied)
+			assert.Equal(t, test.expectedBantime, f2b.IPs["192.0.2.1"].Bantime)
+
+			if !test.expectedReturn {
+				assert.Nil(t, got)
+
+				return
+			}
+
+			require.NotNil(t, got)
+			assert.True(t, got.Return)
+			require.NotNil(t, got.Response)
+
+			got.Response.ServeHTTP(recorder, req)
+			assert.Equal(t, http.StatusOK, recorder.Code)
+			assert.Equal(t, "text/plain", recorder.Header().Get("Content-Type"))
+			assert.Equal(t, "[core]", recorder.Body.String())
+		})
+	}
+}
@@ -0,0 +1,309 @@
+// Package webhook is an events sink posting the events to a URL, from a
+// bounded queue, so that the requests are never slowed down by the receiver.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"text/template"
+	"time"
+
+	"github.com/tomMoulard/fail2ban/pkg/events"
+	"github.com/tomMoulard/fail2ban/pkg/logger"
+)
+
+const (
+	defaultRetries   = 3
+	defaultBackoff   = time.Second
+	defaultTimeout   = 5 * time.Second
+	defaultQueueSize = 1000
+
+	// droppedInterval is how often the events dropped, the queue being full,
+	// are reported.
+	droppedInterval = 10 * time.Second
+)
+
+// Headers of the webhook requests.
+const (
+	// HeaderEvent is the type of the event.
+	HeaderEvent = "X-Fail2ban-Event"
+	// HeaderTimestamp is the Unix time of the request, signed with the body.
+	HeaderTimestamp = "X-Fail2ban-Timestamp"
+	// HeaderSignature is "sha256=" followed by the hex encoded HMAC-SHA256 of
+	// the timestamp, a dot, and the body.
+	HeaderSignature = "X-Fail2ban-Signature"
+)
+
+// Config of the webhook.
+type Config struct {
+	URL string
+	// Template is the text/template of the JSON payload, executed with the
+	// event. The "json" function encodes a value (e.g. {{ json .IP }}).
+	// Defaults to the JSON of the event.
+	Template string
+	// Secret signs the requests when set.
+	Secret []byte
+	// Events are the types of events sent, the decisions (all but the
+	// failures) when empty.
+	Events []events.Type
+	// Retries is the number of retries of a failed delivery, defaults to 3
+	// when nil.
+	Retries *int
+	// Backoff is the delay before the first retry, doubled on each retry,
+	// defaults to 1s.
+	Backoff time.Duration
+	// Timeout of a request, defaults to 5s.
+	Timeout time.Duration
+	// QueueSize is the number of events waiting to be sent, the events over
+	// it being dropped, defaults to 1000.
+	QueueSize int
+}
+
+// Webhook posts the events to a URL.
+type Webhook struct {
+	config   Config
+	retries  int
+	template *template.Template
+	events   map[events.Type]bool
+	client   *http.Client
+	queue    chan events.Event
+	// dropped counts the events dropped since the last report, for a full
+	// queue not to log once per event.
+	dropped atomic.Int64
+}
+
+// New creates a Webhook. Run sends the queued events.
+func New(config Config) (*Webhook, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse url: %w", err)
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid url %q: scheme must be http or https", config.URL)
+	}
+
+	if config.Backoff == 0 {
+		config.Backoff = defaultBackoff
+	}
+
+	if config.Timeout == 0 {
+		config.Timeout = defaultTimeout
+	}
+
+	if config.QueueSize == 0 {
+		config.QueueSize = defaultQueueSize
+	}
+
+	w := &Webhook{
+		config:  config,
+		retries: defaultRetries,
+		client:  &http.Client{Timeout: config.Timeout},
+		queue:   make(chan events.Event, config.QueueSize),
+	}
+
+	if config.Retries != nil {
+		w.retries = *config.Retries
+	}
+
+	if config.Template != "" {
+		w.template, err = template.New("webhook").Funcs(template.FuncMap{"json": toJSON}).Parse(config.Template)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse template: %w", err)
+		}
+
+		// The template must give a JSON payload.
+		if _, err := w.payload(events.Event{Type: events.Ban, IP: "192.0.2.1", Time: time.Now()}); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(config.Events) == 0 {
+		config.Events = events.Decisions
+	}
+
+	w.events = make(map[events.Type]bool, len(config.Events))
+	for _, t := range config.Events {
+		w.events[t] = true
+	}
+
+	return w, nil
+}
+
+func toJSON(v any) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal: %w", err)
+	}
+
+	return string(b), nil
+}
+
+// Send queues the event, dropping it when the queue is full.
+func (w *Webhook) Send(e events.Event) {
+	if !w.events[e.Type] {
+		return
+	}
+
+	select {
+	case w.queue <- e:
+	default:
+		w.dropped.Add(1)
+	}
+}
+
+// Run sends the queued events, until the context is done.
+func (w *Webhook) Run(ctx context.Context) {
+	// The drops are reported apart, a delivery blocking for its retries.
+	go w.runDropped(ctx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-w.queue:
+			if err := w.deliver(ctx, e); err != nil {
+				logger.Error("Plugin: FailToBan: failed to send webhook",
+					logger.WithIP(e.IP),
+					logger.WithReason(string(e.Type)),
+					logger.WithErr(err.Error()),
+				)
+			}
+		}
+	}
+}
+
+// runDropped reports the dropped events every droppedInterval, until the
+// context is done.
+func (w *Webhook) runDropped(ctx context.Context) {
+	ticker := time.NewTicker(droppedInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.reportDropped()
+		}
+	}
+}
+
+// reportDropped logs the events dropped since the last report, if any.
+func (w *Webhook) reportDropped() {
+	if n := w.dropped.Swap(0); n > 0 {
+		logger.Warn("Plugin: FailToBan: webhook queue full, events dropped",
+			logger.WithDropped(n),
+		)
+	}
+}
+
+// deliver posts the event, retrying with backoff.
+func (w *Webhook) deliver(ctx context.Context, e events.Event) error {
+	body, err := w.payload(e)
+	if err != nil {
+		return err
+	}
+
+	backoff := w.config.Backoff
+
+	for attempt := 0; ; attempt++ {
+		retry, err := w.post(ctx, e, body)
+		if err == nil {
+			return nil
+		}
+
+		if !retry || attempt >= w.retries {
+			return fmt.Errorf("attempt %d: %w", attempt+1, err)
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+
+			return fmt.Errorf("attempt %d: %w", attempt+1, err)
+		case <-timer.C:
+		}
+
+		backoff *= 2
+	}
+}
+
+// payload returns the body of the event.
+func (w *Webhook) payload(e events.Event) ([]byte, error) {
+	if w.template == nil {
+		body, err := json.Marshal(e)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal event: %w", err)
+		}
+
+		return body, nil
+	}
+
+	var buf bytes.Buffer
+	if err := w.template.Execute(&buf, e); err != nil {
+		return nil, fmt.Errorf("failed to execute template: %w", err)
+	}
+
+	if !json.Valid(buf.Bytes()) {
+		return nil, fmt.Errorf("template gives invalid JSON: %q", buf.String())
+	}
+
+	return buf.Bytes(), nil
+}
+
+// post sends the body, and returns whether a failure is worth retrying.
+func (w *Webhook) post(ctx context.Context, e events.Event, body []byte) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, string(e.Type))
+
+	if len(w.config.Secret) > 0 {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(HeaderTimestamp, timestamp)
+		req.Header.Set(HeaderSignature, "sha256="+Sign(w.config.Secret, timestamp, body))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("failed to send request: %w", err)
+	}
+
+	// The body is drained for the connection to be reused.
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	_ = resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	default:
+		return false, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+}
+
+// Sign returns the hex encoded HMAC-SHA256 of the timestamp and body, as sent
+// in the HeaderSignature.
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	_, _ = mac.Write([]byte(timestamp + "."))
+	_, _ = mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
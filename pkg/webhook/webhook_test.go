@@ -0,0 +1,252 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tomMoulard/fail2ban/pkg/events"
+)
+
+// receiver records the webhook requests, answering with the codes in order,
+// then 200.
+type receiver struct {
+	mu       sync.Mutex
+	codes    []int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (rcv *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+
+	rcv.requests = append(rcv.requests, r)
+	rcv.bodies = append(rcv.bodies, body)
+
+	if len(rcv.codes) > 0 {
+		w.WriteHeader(rcv.codes[0])
+		rcv.codes = rcv.codes[1:]
+	}
+}
+
+func (rcv *receiver) received() int {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+
+	return len(rcv.requests)
+}
+
+func newReceiver(t *testing.T, codes ...int) (*receiver, string) {
+	t.Helper()
+
+	rcv := &receiver{codes: codes}
+	server := httptest.NewServer(rcv)
+	t.Cleanup(server.Close)
+
+	return rcv, server.URL
+}
+
+var event = events.Event{
+	Type:    events.Ban,
+	Jail:    "jail",
+	IP:      "192.0.2.1",
+	Score:   3,
+	Expires: "2026-01-01T01:00:00Z",
+	Time:    time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+}
+
+func TestNew(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		config      Config
+		expectedErr string
+	}{
+		{
+			name:   "defaults",
+			config: Config{URL: "https://example.com/hook"},
+		},
+		{
+			name:        "invalid scheme",
+			config:      Config{URL: "ftp://example.com/hook"},
+			expectedErr: `invalid url "ftp://example.com/hook": scheme must be http or https`,
+		},
+		{
+			name:        "invalid template",
+			config:      Config{URL: "https://example.com/hook", Template: `{"ip": {{ .IP }`},
+			expectedErr: `failed to parse template: template: webhook:1: unexpected "}" in operand`,
+		},
+		{
+			name:        "template not giving JSON",
+			config:      Config{URL: "https://example.com/hook", Template: `{"ip": {{ .IP }}}`},
+			expectedErr: `template gives invalid JSON: "{\"ip\": 192.0.2.1}"`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			w, err := New(test.config)
+			if test.expectedErr != "" {
+				require.EqualError(t, err, test.expectedErr)
+
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, defaultRetries, w.retries)
+			assert.Equal(t, defaultBackoff, w.config.Backoff)
+			assert.Equal(t, defaultTimeout, w.config.Timeout)
+			assert.Equal(t, defaultQueueSize, cap(w.queue))
+		})
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	t.Parallel()
+
+	rcv, url := newReceiver(t)
+
+	w, err := New(Config{URL: url, Secret: []byte("secret")})
+	require.NoError(t, err)
+	require.NoError(t, w.deliver(t.Context(), event))
+
+	require.Equal(t, 1, rcv.received())
+
+	req, body := rcv.requests[0], rcv.bodies[0]
+	assert.Equal(t, http.MethodPost, req.Method)
+	assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+	assert.Equal(t, "ban", req.Header.Get(HeaderEvent))
+	assert.Equal(t, "sha256="+Sign([]byte("secret"), req.Header.Get(HeaderTimestamp), body), req.Header.Get(HeaderSignature))
+
+	var got events.Event
+	require.NoError(t, json.Unmarshal(body, &got))
+	assert.Equal(t, event, got)
+}
+
+func TestDeliverTemplate(t *testing.T) {
+	t.Parallel()
+
+	rcv, url := newReceiver(t)
+
+	w, err := New(Config{
+		URL:      url,
+		Template: `{"text": {{ json (printf "%s: %s %s" .Jail .Type .IP) }}, "until": {{ json .Expires }}}`,
+	})
+	require.NoError(t, err)
+	require.NoError(t, w.deliver(t.Context(), event))
+
+	require.Equal(t, 1, rcv.received())
+	assert.JSONEq(t, `{"text": "jail: ban 192.0.2.1", "until": "2026-01-01T01:00:00Z"}`, string(rcv.bodies[0]))
+	assert.Empty(t, rcv.requests[0].Header.Get(HeaderSignature))
+}
+
+func TestDeliverRetries(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name             string
+		retries          int
+		codes            []int
+		expectedRequests int
+		expectedErr      string
+	}{
+		{
+			name:             "retried until delivered",
+			retries:          2,
+			codes:            []int{http.StatusInternalServerError, http.StatusTooManyRequests},
+			expectedRequests: 3,
+		},
+		{
+			name:             "retries exhausted",
+			retries:          2,
+			codes:            []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway},
+			expectedRequests: 3,
+			expectedErr:      "attempt 3: unexpected status code 502",
+		},
+		{
+			name:             "client error not retried",
+			retries:          2,
+			codes:            []int{http.StatusBadRequest},
+			expectedRequests: 1,
+			expectedErr:      "attempt 1: unexpected status code 400",
+		},
+		{
+			name:             "retries disabled",
+			codes:            []int{http.StatusBadGateway},
+			expectedRequests: 1,
+			expectedErr:      "attempt 1: unexpected status code 502",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			rcv, url := newReceiver(t, test.codes...)
+
+			w, err := New(Config{URL: url, Retries: &test.retries, Backoff: time.Millisecond})
+			require.NoError(t, err)
+
+			err = w.deliver(t.Context(), event)
+			if test.expectedErr != "" {
+				require.EqualError(t, err, test.expectedErr)
+			} else {
+				require.NoError(t, err)
+			}
+
+			assert.Equal(t, test.expectedRequests, rcv.received())
+		})
+	}
+}
+
+func TestSend(t *testing.T) {
+	t.Parallel()
+
+	rcv, url := newReceiver(t)
+
+	w, err := New(Config{URL: url, Events: []events.Type{events.Ban}, QueueSize: 1})
+	require.NoError(t, err)
+
+	// Filtered out.
+	w.Send(events.Event{Type: events.Unban, IP: "192.0.2.1"})
+	assert.Empty(t, w.queue)
+
+	w.Send(event)
+	// Dropped, the queue being full, and counted until the next report.
+	w.Send(event)
+	assert.Len(t, w.queue, 1)
+	assert.Equal(t, int64(1), w.dropped.Load())
+
+	w.reportDropped()
+	assert.Zero(t, w.dropped.Load())
+
+	go w.Run(t.Context())
+
+	assert.Eventually(t, func() bool { return rcv.received() == 1 }, time.Second, time.Millisecond)
+}
+
+func TestSendDecisions(t *testing.T) {
+	t.Parallel()
+
+	w, err := New(Config{URL: "http://192.0.2.1/hook", QueueSize: 10})
+	require.NoError(t, err)
+
+	for _, typ := range events.Types {
+		w.Send(events.Event{Type: typ, IP: "192.0.2.1"})
+	}
+
+	// The failures are only sent when asked for.
+	assert.Len(t, w.queue, len(events.Decisions))
+}
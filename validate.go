@@ -0,0 +1,454 @@
+package fail2ban
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tomMoulard/fail2ban/pkg/events"
+	"github.com/tomMoulard/fail2ban/pkg/export"
+	"github.com/tomMoulard/fail2ban/pkg/geoip"
+	lDeny "github.com/tomMoulard/fail2ban/pkg/list/deny"
+	"github.com/tomMoulard/fail2ban/pkg/logger"
+	"github.com/tomMoulard/fail2ban/pkg/rules"
+)
+
+// validator collects the configuration problems with their field path.
+type validator struct {
+	strict bool
+	errs   []error
+}
+
+// errorf records an invalid value.
+func (v *validator) errorf(path, format string, args ...any) {
+	v.errs = append(v.errs, fmt.Errorf("%s: %s", path, fmt.Sprintf(format, args...)))
+}
+
+// suspiciousf records a legal but suspicious value, rejected in strict mode.
+func (v *validator) suspiciousf(path, format string, args ...any) {
+	if v.strict {
+		v.errorf(path, format+" (strict)", args...)
+
+		return
+	}
+
+	logger.Warn("Plugin: FailToBan: suspicious configuration",
+		logger.WithReason(fmt.Sprintf("%s: %s", path, fmt.Sprintf(format, args...))),
+	)
+}
+
+// nested records the problems of a sub configuration, prefixed by its path.
+func (v *validator) nested(path string, err error) {
+	if err == nil {
+		return
+	}
+
+	errs := []error{err}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		errs = joined.Unwrap()
+	}
+
+	for _, e := range errs {
+		v.errs = append(v.errs, fmt.Errorf("%s.%w", path, e))
+	}
+}
+
+// Validate checks the whole configuration, and returns every problem found,
+// prefixed by its field path. When Strict is set, suspicious values are
+// rejected too.
+func (c *Config) Validate() error {
+	v := &validator{strict: c.Strict}
+
+	v.rules("rules", c.Rules)
+	v.list("denylist", c.Denylist)
+	v.list("allowlist", c.Allowlist)
+	v.unsupported(c)
+	v.duration("geoip.reloadInterval", c.GeoIP.ReloadInterval)
+	v.mode("mode", c.Mode)
+
+	if c.Challenge.Enabled {
+		v.challenge("challenge", c.Challenge)
+	}
+
+	for i, w := range c.Webhooks {
+		v.webhook(fmt.Sprintf("webhooks[%d]", i), w)
+	}
+
+	if c.Export.Path != "" {
+		v.export("export", c.Export)
+
+		if c.SourceCriterion.RequestHeaderName != "" && !c.Export.DangerouslyExportHeaderIPs {
+			v.errorf("export.dangerouslyExportHeaderIPs", "must be set to export the IPs read from the %q header, which the clients may forge",
+				c.SourceCriterion.RequestHeaderName)
+		}
+	}
+
+	if c.Fail2banLog.Path != "" {
+		v.fail2banLog("fail2banLog", c.Fail2banLog)
+	}
+
+	return errors.Join(v.errs...)
+}
+
+// rules records the problems TransformRule finds, then checks the status
+// codes, parsed by the status handlers, and the suspicious values.
+func (v *validator) rules(path string, r rules.Rules) {
+	_, err := rules.TransformRule(r)
+	v.nested(path, err)
+
+	bantime, _ := time.ParseDuration(r.Bantime)
+	findtime, _ := time.ParseDuration(r.Findtime)
+
+	if bantime > 0 && findtime > 0 && bantime < findtime {
+		v.suspiciousf(path+".bantime", "%s is shorter than findtime %s", bantime, findtime)
+	}
+
+	switch {
+	case r.Maxretry == 0 && r.Threshold <= 0:
+		v.errorf(path+".maxretry", "must be set")
+	case r.Maxretry == 1:
+		v.suspiciousf(path+".maxretry", "bans on the first failure")
+	}
+
+	v.mode(path+".mode", r.Mode)
+
+	if (r.CountMode == "" || r.CountMode == rules.CountFailures) && len(r.Costs) > 0 {
+		v.suspiciousf(path+".costs", "only used in the %s count mode", rules.CountRequests)
+	}
+
+	for i, u := range r.Urlregexps {
+		if (u.Mode == "block" || u.Mode == "trap") && u.Regexp == "" && u.Method == "" && u.Host == "" && u.Path == "" &&
+			u.Query == "" && len(u.Headers) == 0 && len(u.Any) == 0 && len(u.All) == 0 {
+			v.suspiciousf(fmt.Sprintf("%s.urlregexps[%d]", path, i), "matches every request")
+		}
+	}
+
+	if r.StatusCode != "" {
+		v.statusCodes(path+".statuscode", r.StatusCode)
+	}
+
+	for i, w := range r.StatusCodeWeights {
+		v.statusCodes(fmt.Sprintf("%s.statuscodeweights[%d].codes", path, i), w.Codes)
+	}
+
+	for i, b := range r.StatusCodes {
+		bPath := fmt.Sprintf("%s.statuscodes[%d]", path, i)
+
+		v.statusCodes(bPath+".codes", b.Codes)
+
+		if b.MaxRetry == 1 {
+			v.suspiciousf(bPath+".maxretry", "bans on the first failure")
+		}
+	}
+
+	if r.PathDiversity != nil && r.PathDiversity.StatusCode != "" {
+		v.statusCodes(path+".pathdiversity.statuscode", r.PathDiversity.StatusCode)
+	}
+
+	if r.CredentialStuffing != nil && r.CredentialStuffing.StatusCode != "" {
+		v.statusCodes(path+".credentialstuffing.statuscode", r.CredentialStuffing.StatusCode)
+	}
+
+	if r.Success != nil && r.Success.StatusCode != "" {
+		v.successCodes(path+".success.statuscode", r.Success.StatusCode)
+	}
+
+	if r.ResponseFailures != nil {
+		for i, m := range r.ResponseFailures.Matchers {
+			if m.StatusCode != "" {
+				v.codeRanges(fmt.Sprintf("%s.responsefailures.matchers[%d].statuscode", path, i), m.StatusCode)
+			}
+		}
+	}
+
+	if r.Outcomes != nil && r.Outcomes.ServerError != nil && r.Outcomes.ServerError.StatusCode != "" {
+		v.codeRanges(path+".outcomes.servererror.statuscode", r.Outcomes.ServerError.StatusCode)
+	}
+
+	if r.Escalation != nil {
+		v.escalation(path+".escalation", *r.Escalation, r)
+	}
+}
+
+func (v *validator) escalation(path string, e rules.Escalation, r rules.Rules) {
+	if e.DelayAfter > 0 && e.RejectAfter > 0 && e.DelayAfter >= e.RejectAfter {
+		v.suspiciousf(path+".delayafter", "%v is not lower than rejectafter %v", e.DelayAfter, e.RejectAfter)
+	}
+
+	threshold := r.Threshold
+	if threshold <= 0 {
+		threshold = float64(r.Maxretry)
+	}
+
+	for _, step := range []struct {
+		name  string
+		score float64
+	}{
+		{name: "delayafter", score: e.DelayAfter},
+		{name: "rejectafter", score: e.RejectAfter},
+	} {
+		if step.score > 0 && threshold > 0 && step.score >= threshold {
+			v.suspiciousf(path+"."+step.name, "%v is never reached before the ban at %v", step.score, threshold)
+		}
+	}
+}
+
+func (v *validator) challenge(path string, c Challenge) {
+	switch {
+	case c.Secret == "":
+		v.errorf(path+".secret", "must be set")
+	case len(c.Secret) < 16:
+		v.suspiciousf(path+".secret", "is shorter than 16 bytes")
+	}
+
+	if c.Difficulty != nil {
+		switch d := *c.Difficulty; {
+		case d < 0 || d > 32:
+			v.errorf(path+".difficulty", "must be between 0 and 32, got %d", d)
+		case d > 24:
+			v.suspiciousf(path+".difficulty", "%d takes browsers minutes to solve", d)
+		}
+	}
+
+	v.duration(path+".ttl", c.TTL)
+
+	if c.Path != "" && !strings.HasPrefix(c.Path, "/") {
+		v.errorf(path+".path", "must start with /, got %q", c.Path)
+	}
+}
+
+func (v *validator) webhook(path string, w Webhook) {
+	if u, err := url.Parse(w.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		v.errorf(path+".url", "must be a http or https URL, got %q", w.URL)
+	}
+
+	for i, t := range w.Events {
+		if !slices.Contains(events.Types, events.Type(t)) {
+			v.errorf(fmt.Sprintf("%s.events[%d]", path, i), "unknown event %q, expecting one of %s, %s, %s, %s or %s",
+				t, events.Ban, events.Unban, events.Expire, events.StaticBlock, events.Failure)
+		}
+	}
+
+	if w.Retries != nil && *w.Retries < 0 {
+		v.errorf(path+".retries", "must be positive, got %d", *w.Retries)
+	}
+
+	if w.QueueSize < 0 {
+		v.errorf(path+".queueSize", "must be positive, got %d", w.QueueSize)
+	}
+
+	v.duration(path+".backoff", w.Backoff)
+	v.duration(path+".timeout", w.Timeout)
+}
+
+// exportName matches the nftables and ipset names the exporter writes.
+var exportName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,27}$`)
+
+func (v *validator) export(path string, e Export) {
+	switch e.Format {
+	case export.FormatNftables, export.FormatIpset, export.FormatCIDR:
+	case "":
+		v.errorf(path+".format", "must be set")
+	default:
+		v.errorf(path+".format", "unknown format %q, expecting %s, %s or %s",
+			e.Format, export.FormatNftables, export.FormatIpset, export.FormatCIDR)
+	}
+
+	v.duration(path+".interval", e.Interval)
+
+	for _, name := range []struct {
+		path  string
+		value string
+	}{
+		{path: path + ".table", value: e.Table},
+		{path: path + ".set", value: e.Set},
+	} {
+		if name.value != "" && !exportName.MatchString(name.value) {
+			v.errorf(name.path, "invalid name %q: up to 28 letters, digits or underscores", name.value)
+		}
+	}
+}
+
+func (v *validator) fail2banLog(path string, l Fail2banLog) {
+	if l.MaxSize < 0 {
+		v.errorf(path+".maxSize", "must be positive, got %d", l.MaxSize)
+	}
+
+	if l.MaxBackups < 0 {
+		v.errorf(path+".maxBackups", "must be positive, got %d", l.MaxBackups)
+	}
+}
+
+func (v *validator) mode(path, mode string) {
+	switch mode {
+	case "", rules.ModeEnforce, rules.ModeShadow:
+	default:
+		v.errorf(path, "unknown mode %q, expecting %s or %s", mode, rules.ModeEnforce, rules.ModeShadow)
+	}
+}
+
+// statusCodes validates a comma separated list of error status codes or
+// ranges.
+func (v *validator) statusCodes(path, value string) {
+	for _, r := range v.codeRanges(path, value) {
+		if r.low < 400 {
+			v.suspiciousf(path, "%q includes non-error status codes", r.block)
+		}
+	}
+}
+
+// successCodes validates a comma separated list of success status codes or
+// ranges.
+func (v *validator) successCodes(path, value string) {
+	for _, r := range v.codeRanges(path, value) {
+		if r.high >= 400 {
+			v.suspiciousf(path, "%q includes error status codes", r.block)
+		}
+	}
+}
+
+type codeRange struct {
+	block     string
+	low, high int
+}
+
+// codeRanges validates a comma separated list of status codes or ranges, and
+// returns the valid ones.
+func (v *validator) codeRanges(path, value string) []codeRange {
+	var ranges []codeRange
+
+	for _, block := range strings.Split(value, ",") {
+		codes := strings.Split(block, "-")
+		if len(codes) > 2 {
+			v.errorf(path, "invalid range %q", block)
+
+			continue
+		}
+
+		low, errLow := strconv.Atoi(codes[0])
+		high, errHigh := strconv.Atoi(codes[len(codes)-1])
+
+		switch {
+		case errLow != nil || errHigh != nil:
+			v.errorf(path, "invalid status code %q", block)
+		case low < 100 || high > 599:
+			v.errorf(path, "status code %q out of the 100-599 range", block)
+		case low > high:
+			v.errorf(path, "invalid range %q: %d is greater than %d", block, low, high)
+		default:
+			ranges = append(ranges, codeRange{block: block, low: low, high: high})
+		}
+	}
+
+	return ranges
+}
+
+func (v *validator) list(path string, l List) {
+	v.action(path+".action", l.Action, path+".delay", l.Delay)
+	v.duration(path+".expiryHorizon", l.ExpiryHorizon)
+	v.duration(path+".hostnames.ttl", l.Hostnames.TTL)
+	v.duration(path+".hostnames.negativeTTL", l.Hostnames.NegativeTTL)
+
+	if l.CrowdSec.URL != "" {
+		v.crowdSec(path+".crowdsec", l.CrowdSec)
+	}
+
+	for i, ip := range l.IP {
+		if _, _, err := geoip.ParseSelector(ip); err != nil {
+			v.errorf(fmt.Sprintf("%s.ip[%d]", path, i), "%v", err)
+		}
+	}
+
+	for i, e := range l.Entries {
+		ePath := fmt.Sprintf("%s.entries[%d]", path, i)
+
+		if e.IP == "" {
+			v.errorf(ePath+".ip", "must be set")
+		}
+
+		if e.Expires != "" {
+			if _, _, err := lDeny.ParseExpires(e.Expires); err != nil {
+				v.errorf(ePath+".expires", "%v", err)
+			}
+		}
+
+		v.action(ePath+".action", e.Action, ePath+".delay", e.Delay)
+	}
+}
+
+// unsupported reports the list fields the jail ignores.
+func (v *validator) unsupported(c *Config) {
+	if len(c.Allowlist.Entries) > 0 {
+		v.suspiciousf("allowlist.entries", "are not supported, they are ignored")
+	}
+
+	if c.Allowlist.Action != "" {
+		v.suspiciousf("allowlist.action", "is not supported, it is ignored")
+	}
+
+	if c.Allowlist.CrowdSec.URL != "" {
+		v.suspiciousf("allowlist.crowdsec", "is not supported, it is ignored")
+	}
+
+	if len(c.Denylist.Hostnames.Suffixes) > 0 {
+		v.suspiciousf("denylist.hostnames", "are not supported, they are ignored")
+	}
+}
+
+func (v *validator) crowdSec(path string, c CrowdSec) {
+	if u, err := url.Parse(c.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		v.errorf(path+".url", "must be a http or https URL, got %q", c.URL)
+	}
+
+	if c.APIKey == "" {
+		v.errorf(path+".apiKey", "must be set")
+	}
+
+	v.duration(path+".interval", c.Interval)
+	v.duration(path+".timeout", c.Timeout)
+}
+
+func (v *validator) action(path, action, delayPath, delay string) {
+	switch action {
+	case "", lDeny.ActionBlock, lDeny.ActionObserve, lDeny.ActionTighten:
+	case lDeny.ActionDelay:
+		v.requiredDuration(delayPath, delay)
+	default:
+		v.errorf(path, "unknown action %q, expecting one of %s, %s, %s or %s",
+			action, lDeny.ActionBlock, lDeny.ActionObserve, lDeny.ActionTighten, lDeny.ActionDelay)
+	}
+}
+
+// duration validates an optional duration.
+func (v *validator) duration(path, value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	return v.requiredDuration(path, value)
+}
+
+// requiredDuration validates a required duration, greater than 0.
+func (v *validator) requiredDuration(path, value string) time.Duration {
+	if value == "" {
+		v.errorf(path, "must be set")
+
+		return 0
+	}
+
+	d, err := time.ParseDuration(value)
+
+	switch {
+	case err != nil:
+		v.errorf(path, "invalid duration %q", value)
+	case d <= 0:
+		v.errorf(path, "must be greater than 0, got %s", value)
+	}
+
+	return d
+}
@@ -0,0 +1,366 @@
+package fail2ban
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/tomMoulard/fail2ban/pkg/rules"
+)
+
+func TestValidate(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name           string
+		cfg            func(cfg *Config)
+		expectedErrors []string
+	}{
+		{
+			name: "valid",
+			cfg:  func(cfg *Config) {},
+		},
+		{
+			name: "every problem is reported",
+			cfg: func(cfg *Config) {
+				cfg.Rules.Bantime = "3 hours"
+				cfg.Rules.Findtime = "-1m"
+				cfg.Rules.Maxretry = -2
+				cfg.Rules.StatusCode = "600,abc,499-400"
+				cfg.Rules.Urlregexps = []rules.Urlregexp{
+					{Regexp: "/admin", Mode: "blok"},
+					{Regexp: "/(admin", Mode: "block"},
+				}
+				cfg.Denylist.Entries = []ListEntry{
+					{IP: "192.0.2.1", Expires: "tomorrow"},
+					{IP: "192.0.2.2", Action: "delay"},
+					{IP: "192.0.2.3", Expires: "-72h"},
+				}
+				cfg.GeoIP.ReloadInterval = "often"
+			},
+			expectedErrors: []string{
+				`rules.bantime: invalid duration "3 hours"`,
+				`rules.findtime: must be greater than 0, got -1m`,
+				`rules.maxretry: must be positive, got -2`,
+				`rules.urlregexps[0].mode: unknown mode "blok", expecting one of allow, block, count, watch or trap`,
+				`rules.urlregexps[1]: failed to compile url regexp "/(admin": error parsing regexp: missing closing ): ` + "`/(admin`",
+				`rules.statuscode: status code "600" out of the 100-599 range`,
+				`rules.statuscode: invalid status code "abc"`,
+				`rules.statuscode: invalid range "499-400": 499 is greater than 400`,
+				`denylist.entries[0].expires: failed to parse expiry "tomorrow": not a RFC3339 timestamp nor a positive duration`,
+				`denylist.entries[1].delay: must be set`,
+				`denylist.entries[2].expires: failed to parse expiry "-72h": not a RFC3339 timestamp nor a positive duration`,
+				`geoip.reloadInterval: invalid duration "often"`,
+			},
+		},
+		{
+			name: "missing maxretry",
+			cfg: func(cfg *Config) {
+				cfg.Rules.Maxretry = 0
+			},
+			expectedErrors: []string{`rules.maxretry: must be set`},
+		},
+		{
+			name: "threshold without maxretry",
+			cfg: func(cfg *Config) {
+				cfg.Rules.Maxretry = 0
+				cfg.Rules.Threshold = 2.5
+			},
+		},
+		{
+			name: "invalid credential stuffing",
+			cfg: func(cfg *Config) {
+				cfg.Rules.CredentialStuffing = &rules.CredentialStuffing{
+					Locktime: "forever",
+				}
+			},
+			expectedErrors: []string{
+				`rules.credentialstuffing.routes: must be set`,
+				`rules.credentialstuffing: one of formfield, jsonfield or basicauth must be set`,
+				`rules.credentialstuffing.threshold: must be positive, got 0`,
+				`rules.credentialstuffing.locktime: invalid duration "forever"`,
+			},
+		},
+		{
+			name: "invalid success",
+			cfg: func(cfg *Config) {
+				cfg.Rules.Success = &rules.Success{
+					StatusCode: "200-299,700",
+					Mode:       "forget",
+					Decrement:  -1,
+				}
+			},
+			expectedErrors: []string{
+				`rules.success.routes: must be set`,
+				`rules.success.mode: unknown mode "forget", expecting reset or decrement`,
+				`rules.success.decrement: must be positive, got -1`,
+				`rules.success.statuscode: status code "700" out of the 100-599 range`,
+			},
+		},
+		{
+			name: "invalid response failures",
+			cfg: func(cfg *Config) {
+				cfg.Rules.ResponseFailures = &rules.ResponseFailures{
+					MaxBodySize: -1,
+					Matchers: []rules.ResponseMatcher{
+						{StatusCode: "200"},
+						{StatusCode: "2xx", Body: "(error"},
+					},
+				}
+			},
+			expectedErrors: []string{
+				`rules.responsefailures.maxbodysize: must be positive, got -1`,
+				`rules.responsefailures.matchers[0]: one of headers or body is required`,
+				`rules.responsefailures.matchers[1]: failed to compile body regexp "(error": error parsing regexp: missing closing ): ` + "`(error`",
+				`rules.responsefailures.matchers[1].statuscode: invalid status code "2xx"`,
+			},
+		},
+		{
+			name: "invalid outcomes",
+			cfg: func(cfg *Config) {
+				cfg.Rules.Outcomes = &rules.Outcomes{
+					Slow:          &rules.Outcome{},
+					Canceled:      &rules.Outcome{Weight: -1},
+					ServerError:   &rules.Outcome{StatusCode: "5xx"},
+					OutageRatio:   1.5,
+					OutageClients: -1,
+				}
+			},
+			expectedErrors: []string{
+				`rules.outcomes.slow.latency: must be set`,
+				`rules.outcomes.canceled.weight: must be positive, got -1`,
+				`rules.outcomes.outageratio: must be between 0 and 1, got 1.5`,
+				`rules.outcomes.outageclients: must be positive, got -1`,
+				`rules.outcomes.servererror.statuscode: invalid status code "5xx"`,
+			},
+		},
+		{
+			name: "invalid status code buckets",
+			cfg: func(cfg *Config) {
+				cfg.Rules.StatusCodes = []rules.StatusCodeBucket{
+					{Codes: "401,403", MaxRetry: 5},
+					{Codes: "4O4"},
+				}
+			},
+			expectedErrors: []string{
+				`rules.statuscodes[1].maxretry: must be positive, got 0`,
+				`rules.statuscodes[1].codes: invalid status code "4O4"`,
+			},
+		},
+		{
+			name: "invalid escalation",
+			cfg: func(cfg *Config) {
+				cfg.Rules.Escalation = &rules.Escalation{
+					DelayAfter:   2,
+					RejectAfter:  -1,
+					MaxTarpitted: -5,
+				}
+			},
+			expectedErrors: []string{
+				`rules.escalation.rejectafter: must be positive, got -1`,
+				`rules.escalation.maxtarpitted: must be positive, got -5`,
+				`rules.escalation.delay: must be set`,
+			},
+		},
+		{
+			name: "invalid count mode",
+			cfg: func(cfg *Config) {
+				cfg.Rules.CountMode = "everything"
+				cfg.Rules.Costs = []rules.Urlregexp{
+					{Method: "^POST$", Weight: 2},
+					{Path: "^/(static", Weight: 0.1},
+					{Path: "^/health$", Weight: -1},
+				}
+			},
+			expectedErrors: []string{
+				`rules.countmode: unknown count mode "everything", expecting failures or requests`,
+				`rules.costs[1]: failed to compile path regexp "^/(static": error parsing regexp: missing closing ): ` + "`^/(static`",
+				`rules.costs[2]: invalid weight -1: must be positive`,
+			},
+		},
+		{
+			name: "requests count mode",
+			cfg: func(cfg *Config) {
+				cfg.Rules.CountMode = rules.CountRequests
+				cfg.Rules.Costs = []rules.Urlregexp{{Method: "^POST$", Weight: 2}}
+			},
+		},
+		{
+			name: "invalid challenge",
+			cfg: func(cfg *Config) {
+				difficulty := 33
+				cfg.Challenge = Challenge{
+					Enabled:    true,
+					Difficulty: &difficulty,
+					TTL:        "1 day",
+					Path:       "challenge",
+				}
+			},
+			expectedErrors: []string{
+				`challenge.secret: must be set`,
+				`challenge.difficulty: must be between 0 and 32, got 33`,
+				`challenge.ttl: invalid duration "1 day"`,
+				`challenge.path: must start with /, got "challenge"`,
+			},
+		},
+		{
+			name: "invalid modes",
+			cfg: func(cfg *Config) {
+				cfg.Mode = "dry-run"
+				cfg.Rules.Mode = "audit"
+			},
+			expectedErrors: []string{
+				`rules.mode: unknown mode "audit", expecting enforce or shadow`,
+				`mode: unknown mode "dry-run", expecting enforce or shadow`,
+			},
+		},
+		{
+			name: "invalid webhooks",
+			cfg: func(cfg *Config) {
+				retries := -1
+				cfg.Webhooks = []Webhook{
+					{URL: "https://example.com/hook", Events: []string{"ban", "unban"}},
+					{URL: "example.com/hook", Events: []string{"banned"}, Retries: &retries, QueueSize: -1, Backoff: "1"},
+				}
+			},
+			expectedErrors: []string{
+				`webhooks[1].url: must be a http or https URL, got "example.com/hook"`,
+				`webhooks[1].events[0]: unknown event "banned", expecting one of ban, unban, expire, static_block or failure`,
+				`webhooks[1].retries: must be positive, got -1`,
+				`webhooks[1].queueSize: must be positive, got -1`,
+				`webhooks[1].backoff: invalid duration "1"`,
+			},
+		},
+		{
+			name: "invalid export",
+			cfg: func(cfg *Config) {
+				cfg.Export = Export{Path: "/var/lib/fail2ban/bans.nft", Format: "iptables", Interval: "often", Set: "fail2ban-bans"}
+			},
+			expectedErrors: []string{
+				`export.format: unknown format "iptables", expecting nftables, ipset or cidr`,
+				`export.interval: invalid duration "often"`,
+				`export.set: invalid name "fail2ban-bans": up to 28 letters, digits or underscores`,
+			},
+		},
+		{
+			name: "export of header IPs",
+			cfg: func(cfg *Config) {
+				cfg.SourceCriterion.RequestHeaderName = "X-Real-Ip"
+				cfg.Export = Export{Path: "/var/lib/fail2ban/bans.nft", Format: "nftables"}
+			},
+			expectedErrors: []string{
+				`export.dangerouslyExportHeaderIPs: must be set to export the IPs read from the "X-Real-Ip" header, which the clients may forge`,
+			},
+		},
+		{
+			name: "dangerous export of header IPs",
+			cfg: func(cfg *Config) {
+				cfg.SourceCriterion.RequestHeaderName = "X-Real-Ip"
+				cfg.Export = Export{Path: "/var/lib/fail2ban/bans.nft", Format: "nftables", DangerouslyExportHeaderIPs: true}
+			},
+		},
+		{
+			name: "invalid crowdsec",
+			cfg: func(cfg *Config) {
+				cfg.Denylist.CrowdSec = CrowdSec{URL: "crowdsec:8080", Interval: "10"}
+			},
+			expectedErrors: []string{
+				`denylist.crowdsec.url: must be a http or https URL, got "crowdsec:8080"`,
+				`denylist.crowdsec.apiKey: must be set`,
+				`denylist.crowdsec.interval: invalid duration "10"`,
+			},
+		},
+		{
+			name: "invalid fail2ban log",
+			cfg: func(cfg *Config) {
+				cfg.Fail2banLog = Fail2banLog{Path: "/var/log/traefik/fail2ban.log", MaxSize: -1, MaxBackups: -3}
+			},
+			expectedErrors: []string{
+				`fail2banLog.maxSize: must be positive, got -1`,
+				`fail2banLog.maxBackups: must be positive, got -3`,
+			},
+		},
+		{
+			name: "disabled challenge is not validated",
+			cfg: func(cfg *Config) {
+				difficulty := 33
+				cfg.Challenge = Challenge{Difficulty: &difficulty}
+			},
+		},
+		{
+			name: "suspicious values are allowed",
+			cfg: func(cfg *Config) {
+				cfg.Rules.Bantime = "1m"
+				cfg.Rules.Findtime = "10m"
+				cfg.Rules.Maxretry = 1
+				cfg.Rules.StatusCode = "200-599"
+				cfg.Rules.Urlregexps = []rules.Urlregexp{{Mode: "block"}}
+			},
+		},
+		{
+			name: "suspicious values are rejected in strict mode",
+			cfg: func(cfg *Config) {
+				cfg.Strict = true
+				cfg.Rules.Bantime = "1m"
+				cfg.Rules.Findtime = "10m"
+				cfg.Rules.Maxretry = 1
+				cfg.Rules.StatusCode = "200-599"
+				cfg.Rules.Urlregexps = []rules.Urlregexp{{Mode: "block"}}
+				cfg.Rules.Costs = []rules.Urlregexp{{Method: "^POST$", Weight: 2}}
+				cfg.Rules.Success = &rules.Success{Routes: []rules.Urlregexp{{Path: "^/login$"}}, StatusCode: "200-401"}
+				cfg.Rules.Escalation = &rules.Escalation{DelayAfter: 1, Delay: "1s", RejectAfter: 1}
+				difficulty := 28
+				cfg.Challenge = Challenge{Enabled: true, Secret: "short", Difficulty: &difficulty}
+				cfg.Allowlist.Entries = []ListEntry{{IP: "192.0.2.1"}}
+				cfg.Allowlist.Action = "observe"
+				cfg.Denylist.Hostnames.Suffixes = []string{".example.com"}
+			},
+			expectedErrors: []string{
+				`rules.bantime: 1m0s is shorter than findtime 10m0s (strict)`,
+				`rules.maxretry: bans on the first failure (strict)`,
+				`rules.costs: only used in the requests count mode (strict)`,
+				`rules.urlregexps[0]: matches every request (strict)`,
+				`rules.statuscode: "200-599" includes non-error status codes (strict)`,
+				`rules.success.statuscode: "200-401" includes error status codes (strict)`,
+				`rules.escalation.delayafter: 1 is not lower than rejectafter 1 (strict)`,
+				`rules.escalation.delayafter: 1 is never reached before the ban at 1 (strict)`,
+				`rules.escalation.rejectafter: 1 is never reached before the ban at 1 (strict)`,
+				`allowlist.entries: are not supported, they are ignored (strict)`,
+				`allowlist.action: is not supported, it is ignored (strict)`,
+				`denylist.hostnames: are not supported, they are ignored (strict)`,
+				`challenge.secret: is shorter than 16 bytes (strict)`,
+				`challenge.difficulty: 28 takes browsers minutes to solve (strict)`,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			cfg := CreateConfig()
+			cfg.Rules.Maxretry = 4
+			test.cfg(cfg)
+
+			err := cfg.Validate()
+			if len(test.expectedErrors) == 0 {
+				require.NoError(t, err)
+
+				return
+			}
+
+			require.Error(t, err)
+			assert.Equal(t, test.expectedErrors, splitErrors(err))
+		})
+	}
+}
+
+func splitErrors(err error) []string {
+	var errs []string
+
+	for _, e := range err.(interface{ Unwrap() []error }).Unwrap() {
+		errs = append(errs, e.Error())
+	}
+
+	return errs
+}